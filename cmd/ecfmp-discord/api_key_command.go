@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"ecfmp/discord/internal/config"
+	db "ecfmp/discord/internal/db"
+	grpc "ecfmp/discord/internal/grpc"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/**
+ * Runs the api-key subcommand, which mints, revokes and lists the API keys stored in mongo, or mints a key
+ * for AUTH_API_KEYS_FILE.
+ *
+ *	ecfmp-discord api-key create -name <name> [-scopes messages:write,admin] [-expires 720h]
+ *	ecfmp-discord api-key revoke -id <id>
+ *	ecfmp-discord api-key list
+ *	ecfmp-discord api-key hash -name <name> [-scopes messages:write,admin] [-expires 720h]
+ */
+func runApiKeyCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ecfmp-discord api-key <create|revoke|list|hash>")
+	}
+
+	// Keys in a file don't need mongo
+	if args[0] == "hash" {
+		return hashApiKey(args[1:])
+	}
+
+	if err := cfg.Mongo.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	mongo, err := db.ConnectMongo(cfg.Mongo)
+	if err != nil {
+		return fmt.Errorf("failed to connect to mongo: %w", err)
+	}
+	defer mongo.Disconnect()
+
+	ctx := context.Background()
+	switch args[0] {
+	case "create":
+		return createApiKey(ctx, mongo, args[1:])
+	case "revoke":
+		return revokeApiKey(ctx, mongo, args[1:])
+	case "list":
+		return listApiKeys(ctx, mongo)
+	default:
+		return fmt.Errorf("unknown api-key command %v", args[0])
+	}
+}
+
+/**
+ * Generates a new key from the flags, returning the key to give to the user and what to store.
+ */
+func newApiKey(command string, args []string) (string, *db.ApiKey, error) {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	name := flags.String("name", "", "name of the tool or person the key is for")
+	scopes := flags.String("scopes", grpc.MessagesWriteScope, "comma separated list of scopes to grant, e.g. messages:write and admin")
+	expires := flags.Duration("expires", 0, "how long until the key expires, never if not set")
+	if err := flags.Parse(args); err != nil {
+		return "", nil, err
+	}
+
+	if *name == "" {
+		return "", nil, fmt.Errorf("-name is required")
+	}
+
+	key, hash, err := grpc.GenerateApiKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	apiKey := &db.ApiKey{
+		Name:      *name,
+		Hash:      hash,
+		Scopes:    []string{},
+		CreatedAt: time.Now(),
+	}
+
+	if *scopes != "" {
+		apiKey.Scopes = strings.Split(*scopes, ",")
+	}
+
+	if *expires > 0 {
+		apiKey.ExpiresAt = apiKey.CreatedAt.Add(*expires)
+	}
+
+	return key, apiKey, nil
+}
+
+func createApiKey(ctx context.Context, mongo *db.Mongo, args []string) error {
+	key, apiKey, err := newApiKey("api-key create", args)
+	if err != nil {
+		return err
+	}
+
+	id, err := mongo.CreateApiKey(ctx, apiKey)
+	if err != nil {
+		return fmt.Errorf("failed to create api key: %w", err)
+	}
+
+	fmt.Printf("Created api key %v (%v)\n", apiKey.Name, id)
+	fmt.Println("This key will not be shown again:")
+	fmt.Println(key)
+	return nil
+}
+
+/**
+ * Mints a key to be added to AUTH_API_KEYS_FILE, printing the key and its entry in the file. Only the hash of
+ * the key goes in the file.
+ */
+func hashApiKey(args []string) error {
+	key, apiKey, err := newApiKey("api-key hash", args)
+	if err != nil {
+		return err
+	}
+
+	entry := struct {
+		Name      string     `json:"name"`
+		Hash      string     `json:"hash"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}{Name: apiKey.Name, Hash: apiKey.Hash, Scopes: apiKey.Scopes}
+
+	if !apiKey.ExpiresAt.IsZero() {
+		entry.ExpiresAt = &apiKey.ExpiresAt
+	}
+
+	entryJson, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Add this entry to the api keys file:")
+	fmt.Println(string(entryJson))
+	fmt.Println("This key will not be shown again:")
+	fmt.Println(key)
+	return nil
+}
+
+func revokeApiKey(ctx context.Context, mongo *db.Mongo, args []string) error {
+	flags := flag.NewFlagSet("api-key revoke", flag.ContinueOnError)
+	id := flags.String("id", "", "id of the key to revoke")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	if err := mongo.RevokeApiKey(ctx, *id); err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+
+	fmt.Printf("Revoked api key %v\n", *id)
+	return nil
+}
+
+func listApiKeys(ctx context.Context, mongo *db.Mongo) error {
+	keys, err := mongo.ListApiKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list api keys: %w", err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tNAME\tSCOPES\tEXPIRES\tLAST USED\tREVOKED")
+	for _, key := range keys {
+		fmt.Fprintf(
+			writer,
+			"%v\t%v\t%v\t%v\t%v\t%v\n",
+			key.Id,
+			key.Name,
+			strings.Join(key.Scopes, ","),
+			formatOptionalTime(key.ExpiresAt),
+			formatOptionalTime(key.LastUsedAt),
+			formatOptionalTime(key.RevokedAt),
+		)
+	}
+
+	return writer.Flush()
+}
+
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Format(time.RFC3339)
+}
@@ -1,11 +1,24 @@
 package main
 
 import (
+	"context"
+	"ecfmp/discord/internal/admin"
+	"ecfmp/discord/internal/config"
 	db "ecfmp/discord/internal/db"
 	discord "ecfmp/discord/internal/discord"
 	grpc "ecfmp/discord/internal/grpc"
+	"ecfmp/discord/internal/health"
+	"ecfmp/discord/internal/tracing"
+	"errors"
+	"flag"
+	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	logConfig "ecfmp/discord/internal/log"
 
@@ -14,8 +27,10 @@ import (
 )
 
 func main() {
-	// Set the logging level
-	log.SetLevel(logConfig.EnvToLogLevel(os.Getenv("LOG_LEVEL")))
+	// Log at the level from the environment until the config has been loaded
+	if level, err := logConfig.ParseLogLevel(os.Getenv("LOG_LEVEL")); err == nil {
+		log.SetLevel(level)
+	}
 
 	// If there's an env file in the environment variables, load it
 	envFile := os.Getenv("ENV_FILE")
@@ -29,54 +44,355 @@ func main() {
 		log.Infof("Successfully loaded environment variables from %v", envFile)
 	}
 
-	listener, err := net.Listen("tcp", ":80")
+	// Run any subcommand instead of the server. Subcommands have their own flags, so only take their
+	// config from the environment and CONFIG_FILE.
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		cfg, err := config.Load(nil)
+		if err == nil {
+			err = logConfig.Configure(cfg.Log)
+		}
+
+		if err != nil {
+			log.Fatalf("invalid configuration:\n%v", err)
+		}
+
+		switch os.Args[1] {
+		case "api-key":
+			if err := runApiKeyCommand(cfg, os.Args[2:]); err != nil {
+				log.Fatalf("api-key: %v", err)
+			}
+		case "migrate":
+			if err := runMigrateCommand(cfg, os.Args[2:]); err != nil {
+				log.Fatalf("migrate: %v", err)
+			}
+		default:
+			log.Fatalf("unknown command %v", os.Args[1])
+		}
+
+		return
+	}
+
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	if err == nil {
+		err = cfg.Validate()
+	}
+
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+
+	if err := logConfig.Configure(cfg.Log); err != nil {
+		log.Fatalf("failed to configure logging: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", cfg.Server.ListenAddress)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 		panic(err)
 	}
 
-	mongo, err := db.NewMongo()
+	shutdownTracing, err := tracing.Setup(context.Background())
 	if err != nil {
-		log.Fatalf("failed to connect to mongo: %v", err)
-		panic(err)
+		log.Fatalf("failed to set up tracing: %v", err)
 	}
 
-	// Defer closing the mongo connection
+	// Flush any spans that haven't been exported yet
 	defer func() {
-		if err := mongo.Disconnect(); err != nil {
-			log.Errorf("failed to disconnect from mongo: %v", err)
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Errorf("failed to shut down tracing: %v", err)
 		}
 	}()
 
+	store, closeStore, err := openStore(cfg)
+	if err != nil {
+		log.Fatalf("failed to open the %v message store: %v", cfg.Store.Backend, err)
+	}
+
+	// Defer closing the store, e.g. the mongo connection
+	defer func() {
+		if err := closeStore(); err != nil {
+			log.Errorf("failed to close the %v message store: %v", cfg.Store.Backend, err)
+		}
+	}()
+
+	// API keys can only be stored in mongo, so this is nil if messages are stored elsewhere
+	mongo, _ := store.(*db.Mongo)
+
 	// Create the discord publisher
-	publisher := discord.NewDiscordPublisher(os.Getenv("DISCORD_BOT_TOKEN"))
+	publisher := discord.NewDiscordPublisher(cfg.Discord.BotToken)
 
-	// Create the discord scheduler
-	scheduler := discord.NewDiscordScheduler(mongo, publisher)
+	// Create the discord scheduler, picking up any messages left waiting when we last shut down
+	scheduler := discord.NewDiscordScheduler(store, publisher, cfg.Scheduler)
+	if err := scheduler.ResumeQueuedMessages(context.Background()); err != nil {
+		log.Errorf("failed to resume messages queued at last shutdown: %v", err)
+	}
 
-	// Try the public key from the environment directly
-	publicKey := os.Getenv("AUTH_JWT_PUBLIC_KEY")
+	keys, err := loadJwtKeys(cfg.Auth)
+	if err != nil {
+		log.Fatalf("failed to load jwt public keys: %v", err)
+	}
+
+	// Stop refreshing or watching the keys, if they are
+	if closer, ok := keys.(interface{ Close() }); ok {
+		defer closer.Close()
+	}
+	jwtInterceptor := grpc.NewJwtAuthInterceptor(keys, cfg.Auth.JwtAudience, cfg.Auth.JwtIssuer)
+
+	// Allow the log level to be changed without restarting
+	go changeLogLevelOnSignal()
 
-	// If the public key is empty, try to get it from a file
-	if publicKey == "" {
-		publicKeyFile := os.Getenv("AUTH_JWT_PUBLIC_KEY_FILE")
-		if publicKeyFile == "" {
-			log.Fatalf("AUTH_JWT_PUBLIC_KEY_FILE is not set")
+	// Allow the keys to be reloaded on demand
+	if refreshableKeys, ok := keys.(grpc.RefreshableKeyProvider); ok {
+		go refreshJwtKeysOnSighup(refreshableKeys)
+	}
+
+	// If API keys are enabled, accept either a JWT or an API key
+	var interceptor grpc.AuthInterceptor = jwtInterceptor
+	apiKeyStore, err := loadApiKeyStore(cfg.Auth, mongo)
+	if err != nil {
+		log.Fatalf("failed to load api keys: %v", err)
+	}
+
+	authenticators := []grpc.Authenticator{jwtInterceptor}
+	if apiKeyStore != nil {
+		log.Info("API key authentication enabled")
+		authenticators = append(authenticators, grpc.NewApiKeyAuthInterceptor(apiKeyStore))
+	}
+
+	// If client certificates are mapped to identities, accept them too
+	certificateAuthenticator, err := loadClientCertificateAuthenticator(cfg.Server.Tls)
+	if err != nil {
+		log.Fatalf("failed to load client certificate identities: %v", err)
+	}
+
+	if certificateAuthenticator != nil {
+		log.Info("Client certificate authentication enabled")
+		authenticators = append(authenticators, certificateAuthenticator)
+	}
+
+	if len(authenticators) > 1 {
+		interceptor = grpc.NewCompositeAuthInterceptor(authenticators...)
+	}
+
+	grpcServer, err := grpc.NewServer(cfg.Server, store, scheduler, interceptor)
+	if err != nil {
+		log.Fatalf("failed to create server: %v", err)
+	}
+
+	// Report the health of each component through the standard gRPC health service. Liveness only
+	// depends on the scheduler still running, whereas readiness ("") depends on every component.
+	healthChecker := health.NewChecker(grpcServer.Health(), 10*time.Second)
+	healthChecker.AddCheck("store", store.Ping)
+	healthChecker.AddCheck("discord", publisher.CheckHealth)
+	healthChecker.AddCheck("scheduler", scheduler.CheckHealth)
+	healthChecker.AddCheck("liveness", func(context.Context) error {
+		if !scheduler.Alive() {
+			return fmt.Errorf("scheduler is not running")
 		}
 
-		// Get the public key by reading the file, throw error if file doesnt exist
-		fromFile, err := os.ReadFile(publicKeyFile)
+		return nil
+	})
+	healthChecker.Start()
+
+	// Serve metrics, health, pprof and the dashboard on a separate port, so that they're not exposed
+	// alongside the gRPC API
+	logConfig.RegisterSecret(cfg.Server.AdminToken)
+	adminServer := &http.Server{
+		Addr:              cfg.Server.AdminListenAddress,
+		Handler:           admin.NewHandler(cfg.Server.AdminToken, store, scheduler, healthChecker),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	adminErr := make(chan error, 1)
+	go func() {
+		adminErr <- serveAdmin(adminServer)
+	}()
+
+	log.Info("Discord server starting...")
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- grpcServer.Serve(listener)
+	}()
+
+	// Run until we're told to stop, or either server fails
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case sig := <-signals:
+		log.Infof("Received %v, shutting down", sig)
+	case err := <-serveErr:
+		log.Errorf("failed to serve: %v", err)
+	case err := <-adminErr:
+		log.Errorf("failed to serve admin server: %v", err)
+	}
+
+	// Stop taking requests, then let the scheduler finish what it's publishing. The scheduler has its own
+	// deadline, so that slow requests can't leave it no time to finish. The store is closed once we return.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	healthChecker.Stop()
+	grpcServer.GracefulStop(ctx)
+	if err := adminServer.Shutdown(ctx); err != nil {
+		log.Errorf("failed to shut down admin server: %v", err)
+	}
+
+	schedulerCtx, cancelScheduler := context.WithTimeout(context.Background(), cfg.Scheduler.ShutdownTimeout)
+	defer cancelScheduler()
+	if err := scheduler.Shutdown(schedulerCtx); err != nil {
+		log.Errorf("failed to save messages waiting to be published: %v", err)
+	}
+
+	log.Info("Discord server stopped")
+}
+
+/**
+ * Serves the admin HTTP endpoints until the server is shut down, returning why it stopped if it wasn't.
+ */
+func serveAdmin(server *http.Server) error {
+	log.Infof("Admin server listening on %v", server.Addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Opens where messages are stored, returning it along with a function that closes it.
+ */
+func openStore(cfg *config.Config) (db.MessageStore, func() error, error) {
+	switch cfg.Store.Backend {
+	case "sqlite":
+		sqlite, err := db.NewSqlite(cfg.Sqlite)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return sqlite, sqlite.Close, nil
+	case "memory":
+		log.Warn("Storing messages in memory, they will be lost when the service stops")
+		return db.NewMemory(), func() error { return nil }, nil
+	default:
+		mongo, err := db.NewMongo(cfg.Mongo)
 		if err != nil {
-			log.Fatalf("failed to read public key file: %v", err)
+			return nil, nil, err
 		}
 
-		publicKey = string(fromFile)
+		return mongo, mongo.Disconnect, nil
 	}
-	interceptor := grpc.NewJwtAuthInterceptor([]byte(publicKey), os.Getenv("AUTH_JWT_AUDIENCE"))
+}
 
-	grpcServer := grpc.NewServer(mongo, scheduler, interceptor)
-	log.Info("Discord server starting...")
-	if err := grpcServer.Serve(listener); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+/**
+ * Loads the JWT public keys, either from a JWKS endpoint, directly from the config or from a
+ * comma-separated list of files and directories.
+ */
+func loadJwtKeys(auth config.Auth) (grpc.KeyProvider, error) {
+	// Prefer a JWKS endpoint if one is configured
+	if auth.JwksUrl != "" {
+		return grpc.NewJwksKeyProvider(auth.JwksUrl, auth.JwksCacheTtl, auth.JwksMinRefreshInterval)
+	}
+
+	// Try the public key from the config directly
+	if auth.JwtPublicKey != "" {
+		key, err := grpc.ParsePublicKey("", []byte(auth.JwtPublicKey))
+		if err != nil {
+			return nil, err
+		}
+
+		return grpc.NewKeySet(key)
+	}
+
+	// If the public key is empty, try to get it from files
+	paths := strings.Split(auth.JwtPublicKeyFile, ",")
+	for i := range paths {
+		paths[i] = strings.TrimSpace(paths[i])
+	}
+
+	provider, err := grpc.NewFileKeyProvider(paths...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider.WatchForChanges(auth.JwtPublicKeyReloadInterval)
+	return provider, nil
+}
+
+/**
+ * Loads where API keys are stored, either a file or mongo. Returns nil if API keys are not enabled.
+ */
+func loadApiKeyStore(auth config.Auth, mongo *db.Mongo) (grpc.ApiKeyStore, error) {
+	if auth.ApiKeysFile != "" {
+		store, err := db.LoadApiKeyFile(auth.ApiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return store, nil
+	}
+
+	if auth.ApiKeysEnabled {
+		return mongo, nil
+	}
+
+	return nil, nil
+}
+
+/**
+ * Loads the mapping of client certificate subjects to identities. Returns nil if client certificates
+ * are not used for authentication.
+ */
+func loadClientCertificateAuthenticator(tls config.Tls) (grpc.Authenticator, error) {
+	if tls.ClientIdentitiesFile == "" {
+		return nil, nil
+	}
+
+	identities, err := grpc.LoadClientCertificateIdentities(tls.ClientIdentitiesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return grpc.NewClientCertificateAuthenticator(identities), nil
+}
+
+/**
+ * Reloads the JWT public keys whenever the process receives SIGHUP.
+ */
+func refreshJwtKeysOnSighup(keys grpc.RefreshableKeyProvider) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		log.Info("Received SIGHUP, reloading jwt public keys")
+		if err := keys.Refresh(); err != nil {
+			log.Errorf("Failed to reload jwt public keys, keeping existing keys: %v", err)
+		}
+	}
+}
+
+/**
+ * Makes the log level one step more verbose on SIGUSR1, or one step less verbose on SIGUSR2. Either
+ * change reverts after LOG_LEVEL_REVERT_AFTER.
+ */
+func changeLogLevelOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for sig := range signals {
+		steps := 1
+		if sig == syscall.SIGUSR2 {
+			steps = -1
+		}
+
+		change, err := logConfig.StepLevel(steps)
+		if err != nil {
+			log.Errorf("Failed to change log level: %v", err)
+			continue
+		}
+
+		log.Warnf("Received %v, log level changed from %v to %v until %v", sig, change.Previous, change.Current, change.RevertAt.Format(time.RFC3339))
 	}
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"ecfmp/discord/internal/config"
+	db "ecfmp/discord/internal/db"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+/**
+ * Runs the migrate subcommand, which applies the mongo migrations that haven't been applied yet, or lists
+ * which have been.
+ *
+ *	ecfmp-discord migrate [up]
+ *	ecfmp-discord migrate status
+ */
+func runMigrateCommand(cfg *config.Config, args []string) error {
+	if err := cfg.Mongo.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	if len(args) == 0 {
+		return migrateUp(cfg.Mongo)
+	}
+
+	switch args[0] {
+	case "up":
+		return migrateUp(cfg.Mongo)
+	case "status":
+		return migrateStatus(cfg.Mongo)
+	default:
+		return fmt.Errorf("usage: ecfmp-discord migrate [up|status]")
+	}
+}
+
+func migrateUp(mongo config.Mongo) error {
+	applied, err := db.MigrateMongo(mongo)
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		fmt.Println("Mongo is already up to date")
+		return nil
+	}
+
+	fmt.Printf("Applied migrations %v\n", applied)
+	return nil
+}
+
+func migrateStatus(mongo config.Mongo) error {
+	applied, pending, err := db.MongoMigrationStatus(mongo)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "VERSION\tAPPLIED\tDESCRIPTION")
+	for _, migration := range applied {
+		fmt.Fprintf(writer, "%v\t%v\t%v\n", migration.Version, migration.AppliedAt.Format(time.RFC3339), migration.Description)
+	}
+
+	for _, version := range pending {
+		fmt.Fprintf(writer, "%v\t%v\t%v\n", version, "pending", db.MongoMigrationDescription(version))
+	}
+
+	return writer.Flush()
+}
@@ -0,0 +1,33 @@
+#!/usr/bin/env sh
+# Probes the gRPC health service, the same way the service is served: over TLS if TLS_CERT_FILE is set, with a
+# client certificate if HEALTH_PROBE_TLS_CLIENT_CERT is set (e.g. when TLS_CLIENT_AUTH is require). The server's
+# certificate is only verified if HEALTH_PROBE_TLS_CA_CERT is set, as it is unlikely to be issued for localhost.
+# Any arguments are passed on to grpc_health_probe.
+set -e
+
+address="${LISTEN_ADDRESS:-:80}"
+case "$address" in
+    :*) address="localhost$address" ;;
+esac
+
+set -- -addr "$address" -connect-timeout 100ms -rpc-timeout 250ms "$@"
+
+if [ -n "$TLS_CERT_FILE" ]; then
+    set -- "$@" -tls
+
+    if [ -n "$HEALTH_PROBE_TLS_CA_CERT" ]; then
+        set -- "$@" -tls-ca-cert "$HEALTH_PROBE_TLS_CA_CERT"
+    else
+        set -- "$@" -tls-no-verify
+    fi
+
+    if [ -n "$HEALTH_PROBE_TLS_SERVER_NAME" ]; then
+        set -- "$@" -tls-server-name "$HEALTH_PROBE_TLS_SERVER_NAME"
+    fi
+
+    if [ -n "$HEALTH_PROBE_TLS_CLIENT_CERT" ]; then
+        set -- "$@" -tls-client-cert "$HEALTH_PROBE_TLS_CLIENT_CERT" -tls-client-key "$HEALTH_PROBE_TLS_CLIENT_KEY"
+    fi
+fi
+
+exec grpc_health_probe "$@"
@@ -0,0 +1,150 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"ecfmp/discord/internal/db"
+	_ "embed"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How many messages the dashboard shows, unless asked for more or fewer
+const (
+	defaultMessageLimit = 50
+	maxMessageLimit     = 500
+)
+
+//go:embed dashboard.html
+var dashboardHtml string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"formatTime": formatTime,
+	"published": func(message db.DiscordMessage, version db.DiscordMessageVersion) bool {
+		return version.ClientRequestId != "" && version.ClientRequestId == message.LastClientRequestPublished
+	},
+}).Parse(dashboardHtml))
+
+/**
+ * The data the dashboard is rendered from.
+ */
+type dashboardData struct {
+	Messages []db.DiscordMessage
+	Limit    int64
+	Csrf     string
+	Notice   string
+}
+
+/**
+ * Lists the most recent messages with their versions, publish state and last error.
+ */
+func (server *Server) dashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := int64(defaultMessageLimit)
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		parsed, err := strconv.ParseInt(rawLimit, 10, 64)
+		if err != nil || parsed <= 0 || parsed > maxMessageLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxMessageLimit), http.StatusBadRequest)
+			return
+		}
+
+		limit = parsed
+	}
+
+	messages, err := server.messages.GetRecentDiscordMessages(r.Context(), limit)
+	if err != nil {
+		log.Errorf("Admin: Failed to get recent messages: %v", err)
+		http.Error(w, "failed to get recent messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err = dashboardTemplate.Execute(w, dashboardData{
+		Messages: messages,
+		Limit:    limit,
+		Csrf:     server.csrfToken(),
+		Notice:   r.URL.Query().Get("notice"),
+	})
+	if err != nil {
+		log.Errorf("Admin: Failed to render dashboard: %v", err)
+	}
+}
+
+/**
+ * Handles the dashboard's buttons, POST /messages/{id}/requeue and POST /messages/{id}/cancel, redirecting
+ * back to the dashboard afterwards.
+ */
+func (server *Server) messageAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/messages/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(server.csrfToken())) != 1 {
+		http.Error(w, "invalid csrf token", http.StatusForbidden)
+		return
+	}
+
+	id, action := parts[0], parts[1]
+	logger := log.WithFields(log.Fields{"message_id": id, "remote_addr": r.RemoteAddr})
+	ctx := r.Context()
+
+	var done string
+	switch action {
+	case "requeue":
+		if err := server.messages.ResetDiscordMessageState(ctx, id); err != nil {
+			logger.Errorf("Admin: Failed to requeue message: %v", err)
+			http.Error(w, "failed to requeue message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		server.scheduler.ScheduleMessage(ctx, id)
+		logger.Info("Admin: Requeued message")
+		done = "requeued"
+	case "cancel":
+		if err := server.messages.CancelDiscordMessage(ctx, id); err != nil {
+			logger.Errorf("Admin: Failed to cancel message: %v", err)
+			http.Error(w, "failed to cancel message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("Admin: Cancelled message")
+		done = "cancelled"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	http.Redirect(w, r, "/?notice="+url.QueryEscape("Message "+id+" "+done), http.StatusSeeOther)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,151 @@
+package admin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"ecfmp/discord/internal/db"
+	"ecfmp/discord/internal/discord"
+	"ecfmp/discord/internal/metrics"
+	"encoding/hex"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/**
+ * MessageStore is the part of the message storage the dashboard needs.
+ */
+type MessageStore interface {
+	GetRecentDiscordMessages(ctx context.Context, limit int64) ([]db.DiscordMessage, error)
+	CancelDiscordMessage(ctx context.Context, id string) error
+	ResetDiscordMessageState(ctx context.Context, id string) error
+}
+
+/**
+ * HealthReporter reports whether a component, or the whole service if the name is empty, is serving.
+ */
+type HealthReporter interface {
+	Serving(ctx context.Context, name string) bool
+}
+
+/**
+ * Server serves the admin HTTP endpoints, which are on a separate port to the gRPC API so that they're not
+ * exposed alongside it.
+ *
+ * The metrics and health endpoints are open, so that they can be scraped and probed. pprof and the dashboard
+ * need the admin token, either as a bearer token or as the password for basic auth so that browsers can
+ * prompt for it. If there is no admin token, they are disabled.
+ */
+type Server struct {
+	token     string
+	messages  MessageStore
+	scheduler discord.Scheduler
+	health    HealthReporter
+}
+
+/**
+ * NewHandler creates the handler for the admin HTTP server.
+ */
+func NewHandler(token string, messages MessageStore, scheduler discord.Scheduler, health HealthReporter) http.Handler {
+	server := &Server{
+		token:     token,
+		messages:  messages,
+		scheduler: scheduler,
+		health:    health,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz/live", server.live)
+	mux.HandleFunc("/healthz/ready", server.ready)
+
+	if token == "" {
+		log.Warn("Admin: ADMIN_TOKEN is not set, pprof and the dashboard are disabled")
+		return mux
+	}
+
+	mux.Handle("/debug/pprof/", server.authenticated(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", server.authenticated(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", server.authenticated(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", server.authenticated(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", server.authenticated(http.HandlerFunc(pprof.Trace)))
+	mux.Handle("/messages/", server.authenticated(http.HandlerFunc(server.messageAction)))
+	mux.Handle("/", server.authenticated(http.HandlerFunc(server.dashboard)))
+
+	return mux
+}
+
+/**
+ * Liveness only depends on the scheduler still running, so that a restart is only triggered if it would help.
+ */
+func (server *Server) live(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, server.health.Serving(r.Context(), "liveness"))
+}
+
+/**
+ * Readiness depends on every component being healthy.
+ */
+func (server *Server) ready(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, server.health.Serving(r.Context(), ""))
+}
+
+func writeHealth(w http.ResponseWriter, serving bool) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !serving {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not serving\n"))
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
+
+/**
+ * Only lets the request through if it has the admin token.
+ */
+func (server *Server) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !server.validToken(requestToken(r)) {
+			log.WithField("remote_addr", r.RemoteAddr).Warnf("Admin: Rejected unauthenticated request for %v", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Basic realm="ecfmp-discord admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+/**
+ * Gets the token from the bearer token, or the password if using basic auth.
+ */
+func requestToken(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return authorization[len("Bearer "):]
+	}
+
+	return ""
+}
+
+func (server *Server) validToken(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(server.token)) == 1
+}
+
+/**
+ * The token that forms must include, so that another site can't use the browser's saved credentials to
+ * post to the dashboard. It is derived from the admin token, so it doesn't need storing anywhere.
+ */
+func (server *Server) csrfToken() string {
+	mac := hmac.New(sha256.New, []byte(server.token))
+	mac.Write([]byte("ecfmp-discord admin csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,293 @@
+package admin_test
+
+import (
+	"context"
+	"ecfmp/discord/internal/admin"
+	"ecfmp/discord/internal/db"
+	"ecfmp/discord/internal/discord"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testToken = "admin-token"
+
+type MockMessageStore struct {
+	messages  []db.DiscordMessage
+	err       error
+	limit     int64
+	cancelled []string
+	reset     []string
+}
+
+func (store *MockMessageStore) GetRecentDiscordMessages(ctx context.Context, limit int64) ([]db.DiscordMessage, error) {
+	store.limit = limit
+	return store.messages, store.err
+}
+
+func (store *MockMessageStore) CancelDiscordMessage(ctx context.Context, id string) error {
+	store.cancelled = append(store.cancelled, id)
+	return store.err
+}
+
+func (store *MockMessageStore) ResetDiscordMessageState(ctx context.Context, id string) error {
+	store.reset = append(store.reset, id)
+	return store.err
+}
+
+type MockScheduler struct {
+	scheduled []string
+}
+
+func (scheduler *MockScheduler) ScheduleMessage(ctx context.Context, id string) {
+	scheduler.scheduled = append(scheduler.scheduled, id)
+}
+
+func (scheduler *MockScheduler) Ready() bool {
+	return true
+}
+
+func (scheduler *MockScheduler) Pause() {}
+
+func (scheduler *MockScheduler) Resume() {}
+
+func (scheduler *MockScheduler) Status() discord.SchedulerStatus {
+	return discord.SchedulerStatus{}
+}
+
+type MockHealth struct {
+	serving map[string]bool
+}
+
+func (health *MockHealth) Serving(ctx context.Context, name string) bool {
+	return health.serving[name]
+}
+
+type testAdmin struct {
+	handler   http.Handler
+	store     *MockMessageStore
+	scheduler *MockScheduler
+	health    *MockHealth
+}
+
+func newTestAdmin(token string) *testAdmin {
+	log.SetLevel(log.FatalLevel)
+
+	test := &testAdmin{
+		store: &MockMessageStore{
+			messages: []db.DiscordMessage{
+				{
+					Id:                         "6553e4f1a3c9c1b2d3e4f5a6",
+					Channel:                    "1234",
+					DiscordId:                  "5678",
+					LastClientRequestPublished: "request-1",
+					CreatedAt:                  time.Now(),
+					Versions: []db.DiscordMessageVersion{
+						{ClientRequestId: "request-1", Content: "<b>Flow measure</b>", CreatedBy: db.Caller{Name: "ECFMP"}},
+					},
+				},
+				{
+					Id:               "6553e4f1a3c9c1b2d3e4f5a7",
+					Channel:          "1234",
+					CreatedAt:        time.Now(),
+					LastPublishError: "HTTP 403 Forbidden",
+					Versions: []db.DiscordMessageVersion{
+						{ClientRequestId: "request-2", Content: "Another flow measure"},
+					},
+				},
+			},
+		},
+		scheduler: &MockScheduler{},
+		health:    &MockHealth{serving: map[string]bool{}},
+	}
+	test.handler = admin.NewHandler(token, test.store, test.scheduler, test.health)
+
+	return test
+}
+
+func (test *testAdmin) do(request *http.Request) *http.Response {
+	recorder := httptest.NewRecorder()
+	test.handler.ServeHTTP(recorder, request)
+	return recorder.Result()
+}
+
+func body(t *testing.T, response *http.Response) string {
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+
+	return string(content)
+}
+
+func authenticatedRequest(method string, target string, body io.Reader) *http.Request {
+	request := httptest.NewRequest(method, target, body)
+	request.Header.Set("Authorization", "Bearer "+testToken)
+	return request
+}
+
+func csrfToken(t *testing.T, test *testAdmin) string {
+	page := body(t, test.do(authenticatedRequest(http.MethodGet, "/", nil)))
+	match := regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`).FindStringSubmatch(page)
+	if match == nil {
+		t.Fatalf("Dashboard has no csrf token")
+	}
+
+	return match[1]
+}
+
+func postAction(test *testAdmin, target string, csrf string) *http.Response {
+	request := authenticatedRequest(http.MethodPost, target, strings.NewReader(url.Values{"csrf": {csrf}}.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return test.do(request)
+}
+
+func Test_ItServesHealthWithoutAToken(t *testing.T) {
+	test := newTestAdmin(testToken)
+
+	assert.Equal(t, http.StatusServiceUnavailable, test.do(httptest.NewRequest(http.MethodGet, "/healthz/live", nil)).StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, test.do(httptest.NewRequest(http.MethodGet, "/healthz/ready", nil)).StatusCode)
+
+	test.health.serving["liveness"] = true
+	assert.Equal(t, http.StatusOK, test.do(httptest.NewRequest(http.MethodGet, "/healthz/live", nil)).StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, test.do(httptest.NewRequest(http.MethodGet, "/healthz/ready", nil)).StatusCode)
+
+	test.health.serving[""] = true
+	assert.Equal(t, http.StatusOK, test.do(httptest.NewRequest(http.MethodGet, "/healthz/ready", nil)).StatusCode)
+}
+
+func Test_ItServesMetricsWithoutAToken(t *testing.T) {
+	test := newTestAdmin(testToken)
+
+	assert.Equal(t, http.StatusOK, test.do(httptest.NewRequest(http.MethodGet, "/metrics", nil)).StatusCode)
+}
+
+func Test_ItRequiresTheTokenForTheDashboardAndPprof(t *testing.T) {
+	test := newTestAdmin(testToken)
+
+	for _, path := range []string{"/", "/debug/pprof/", "/debug/pprof/cmdline"} {
+		response := test.do(httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode, path)
+		assert.Contains(t, response.Header.Get("WWW-Authenticate"), "Basic")
+
+		wrongToken := httptest.NewRequest(http.MethodGet, path, nil)
+		wrongToken.Header.Set("Authorization", "Bearer wrong-token")
+		assert.Equal(t, http.StatusUnauthorized, test.do(wrongToken).StatusCode, path)
+
+		assert.Equal(t, http.StatusOK, test.do(authenticatedRequest(http.MethodGet, path, nil)).StatusCode, path)
+	}
+}
+
+func Test_ItAcceptsTheTokenAsTheBasicAuthPassword(t *testing.T) {
+	test := newTestAdmin(testToken)
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.SetBasicAuth("oncall", testToken)
+	assert.Equal(t, http.StatusOK, test.do(request).StatusCode)
+}
+
+func Test_ItDisablesTheDashboardAndPprofWithoutAToken(t *testing.T) {
+	test := newTestAdmin("")
+
+	assert.Equal(t, http.StatusNotFound, test.do(httptest.NewRequest(http.MethodGet, "/", nil)).StatusCode)
+	assert.Equal(t, http.StatusNotFound, test.do(httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)).StatusCode)
+
+	// An empty bearer token mustn't match the empty admin token
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Authorization", "Bearer ")
+	assert.Equal(t, http.StatusNotFound, test.do(request).StatusCode)
+
+	assert.Equal(t, http.StatusOK, test.do(httptest.NewRequest(http.MethodGet, "/metrics", nil)).StatusCode)
+}
+
+func Test_ItListsRecentMessages(t *testing.T) {
+	test := newTestAdmin(testToken)
+
+	response := test.do(authenticatedRequest(http.MethodGet, "/", nil))
+	page := body(t, response)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, int64(50), test.store.limit)
+	assert.Contains(t, page, "6553e4f1a3c9c1b2d3e4f5a6")
+	assert.Contains(t, page, "request-1</code> (published)")
+	assert.Contains(t, page, `class="state-published"`)
+	assert.Contains(t, page, `class="state-failed"`)
+	assert.Contains(t, page, "HTTP 403 Forbidden")
+	assert.Contains(t, page, "/messages/6553e4f1a3c9c1b2d3e4f5a7/cancel")
+	assert.NotContains(t, page, "/messages/6553e4f1a3c9c1b2d3e4f5a6/cancel")
+
+	// Message content is escaped
+	assert.Contains(t, page, "&lt;b&gt;Flow measure&lt;/b&gt;")
+	assert.NotContains(t, page, "<b>Flow measure</b>")
+}
+
+func Test_ItListsAsManyMessagesAsAskedFor(t *testing.T) {
+	test := newTestAdmin(testToken)
+
+	assert.Equal(t, http.StatusOK, test.do(authenticatedRequest(http.MethodGet, "/?limit=5", nil)).StatusCode)
+	assert.Equal(t, int64(5), test.store.limit)
+
+	assert.Equal(t, http.StatusBadRequest, test.do(authenticatedRequest(http.MethodGet, "/?limit=0", nil)).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, test.do(authenticatedRequest(http.MethodGet, "/?limit=100000", nil)).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, test.do(authenticatedRequest(http.MethodGet, "/?limit=lots", nil)).StatusCode)
+}
+
+func Test_ItReportsFailingToListMessages(t *testing.T) {
+	test := newTestAdmin(testToken)
+	test.store.err = errors.New("connection refused")
+
+	assert.Equal(t, http.StatusInternalServerError, test.do(authenticatedRequest(http.MethodGet, "/", nil)).StatusCode)
+}
+
+func Test_ItRequeuesAMessage(t *testing.T) {
+	test := newTestAdmin(testToken)
+
+	response := postAction(test, "/messages/6553e4f1a3c9c1b2d3e4f5a7/requeue", csrfToken(t, test))
+	assert.Equal(t, http.StatusSeeOther, response.StatusCode)
+	assert.Equal(t, []string{"6553e4f1a3c9c1b2d3e4f5a7"}, test.store.reset)
+	assert.Equal(t, []string{"6553e4f1a3c9c1b2d3e4f5a7"}, test.scheduler.scheduled)
+}
+
+func Test_ItCancelsAMessage(t *testing.T) {
+	test := newTestAdmin(testToken)
+
+	response := postAction(test, "/messages/6553e4f1a3c9c1b2d3e4f5a7/cancel", csrfToken(t, test))
+	assert.Equal(t, http.StatusSeeOther, response.StatusCode)
+	assert.Equal(t, []string{"6553e4f1a3c9c1b2d3e4f5a7"}, test.store.cancelled)
+	assert.Empty(t, test.scheduler.scheduled)
+}
+
+func Test_ItDoesNotScheduleAMessageThatFailedToReset(t *testing.T) {
+	test := newTestAdmin(testToken)
+	csrf := csrfToken(t, test)
+	test.store.err = errors.New("message not found")
+
+	response := postAction(test, "/messages/6553e4f1a3c9c1b2d3e4f5a7/requeue", csrf)
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+	assert.Empty(t, test.scheduler.scheduled)
+}
+
+func Test_ItRejectsActionsWithoutTheCsrfToken(t *testing.T) {
+	test := newTestAdmin(testToken)
+
+	response := postAction(test, "/messages/6553e4f1a3c9c1b2d3e4f5a7/cancel", "")
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	assert.Empty(t, test.store.cancelled)
+}
+
+func Test_ItRejectsUnknownActions(t *testing.T) {
+	test := newTestAdmin(testToken)
+	csrf := csrfToken(t, test)
+
+	assert.Equal(t, http.StatusNotFound, postAction(test, "/messages/6553e4f1a3c9c1b2d3e4f5a7/delete", csrf).StatusCode)
+	assert.Equal(t, http.StatusNotFound, postAction(test, "/messages/6553e4f1a3c9c1b2d3e4f5a7", csrf).StatusCode)
+	assert.Equal(t, http.StatusMethodNotAllowed, test.do(authenticatedRequest(http.MethodGet, "/messages/6553e4f1a3c9c1b2d3e4f5a7/cancel", nil)).StatusCode)
+}
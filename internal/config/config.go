@@ -0,0 +1,190 @@
+package config
+
+import (
+	"time"
+)
+
+/**
+ * Config is the configuration for the whole service.
+ *
+ * Each setting is read, in increasing order of precedence, from its default, the config file, the
+ * environment and the command line. The env tag gives the environment variable for a setting, and the
+ * flag tag its command line flag. Secrets have no flag, so that they don't end up in the process list,
+ * but may instead be read from the file named by the variable with a _FILE suffix.
+ */
+type Config struct {
+	Server    Server    `yaml:"server" toml:"server"`
+	Log       Log       `yaml:"log" toml:"log"`
+	Store     Store     `yaml:"store" toml:"store"`
+	Mongo     Mongo     `yaml:"mongo" toml:"mongo"`
+	Sqlite    Sqlite    `yaml:"sqlite" toml:"sqlite"`
+	Discord   Discord   `yaml:"discord" toml:"discord"`
+	Scheduler Scheduler `yaml:"scheduler" toml:"scheduler"`
+	Auth      Auth      `yaml:"auth" toml:"auth"`
+}
+
+type Server struct {
+	ListenAddress      string        `yaml:"listen_address" toml:"listen_address" env:"LISTEN_ADDRESS" flag:"listen-address" usage:"address the gRPC server listens on"`
+	AdminListenAddress string        `yaml:"admin_listen_address" toml:"admin_listen_address" env:"ADMIN_LISTEN_ADDRESS" flag:"admin-listen-address" usage:"address the admin HTTP server listens on"`
+	AdminToken         string        `yaml:"admin_token" toml:"admin_token" env:"ADMIN_TOKEN" secret:"true"`
+	ShutdownTimeout    time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"how long to wait for requests to finish when shutting down"`
+	Tls                Tls           `yaml:"tls" toml:"tls"`
+}
+
+/**
+ * Tls is enabled when both the certificate and key are set. Client certificates are verified against
+ * the client CA if it is set, and are optional unless ClientAuth is "require".
+ */
+type Tls struct {
+	CertFile             string `yaml:"cert_file" toml:"cert_file" env:"TLS_CERT_FILE" flag:"tls-cert-file" usage:"certificate the gRPC server presents"`
+	KeyFile              string `yaml:"key_file" toml:"key_file" env:"TLS_KEY_FILE" flag:"tls-key-file" usage:"private key for the certificate"`
+	ClientCaFile         string `yaml:"client_ca_file" toml:"client_ca_file" env:"TLS_CLIENT_CA_FILE" flag:"tls-client-ca-file" usage:"CA that client certificates are verified against"`
+	ClientAuth           string `yaml:"client_auth" toml:"client_auth" env:"TLS_CLIENT_AUTH" flag:"tls-client-auth" usage:"whether client certificates are required or optional"`
+	ClientIdentitiesFile string `yaml:"client_identities_file" toml:"client_identities_file" env:"TLS_CLIENT_IDENTITIES_FILE" flag:"tls-client-identities-file" usage:"mapping of client certificate subjects to identities"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" toml:"level" env:"LOG_LEVEL" flag:"log-level" usage:"minimum level to log, unknown levels log at INFO"`
+	Format string `yaml:"format" toml:"format" env:"LOG_FORMAT" flag:"log-format" usage:"json or text"`
+
+	// How long a change to the level made at runtime lasts, unless the change says otherwise
+	LevelRevertAfter time.Duration `yaml:"level_revert_after" toml:"level_revert_after" env:"LOG_LEVEL_REVERT_AFTER" flag:"log-level-revert-after" usage:"how long runtime changes to the log level last"`
+}
+
+/**
+ * Store chooses where messages are stored. Messages stored in memory are lost when the service restarts,
+ * so it is only for development.
+ */
+type Store struct {
+	Backend string `yaml:"backend" toml:"backend" env:"STORE" flag:"store" usage:"where messages are stored: mongo, sqlite or memory"`
+}
+
+type Mongo struct {
+	Host        string        `yaml:"host" toml:"host" env:"MONGO_HOST" flag:"mongo-host" usage:"mongo connection URI"`
+	Username    string        `yaml:"username" toml:"username" env:"MONGO_USERNAME" flag:"mongo-username" usage:"mongo username"`
+	Password    string        `yaml:"password" toml:"password" env:"MONGO_PASSWORD" secret:"true"`
+	Database    string        `yaml:"database" toml:"database" env:"MONGO_DB" flag:"mongo-db" usage:"mongo database to use"`
+	MaxPoolSize uint64        `yaml:"max_pool_size" toml:"max_pool_size" env:"MONGO_MAX_POOL_SIZE" flag:"mongo-max-pool-size" usage:"maximum number of connections to mongo"`
+	MessageTtl  time.Duration `yaml:"message_ttl" toml:"message_ttl" env:"MONGO_MESSAGE_TTL" flag:"mongo-message-ttl" usage:"how long messages are kept after they were last active, unless marked active"`
+
+	// Expired messages are archived to a collection, to gzipped JSON lines files in the archive directory, or not at all
+	CleanupInterval time.Duration `yaml:"cleanup_interval" toml:"cleanup_interval" env:"MONGO_CLEANUP_INTERVAL" flag:"mongo-cleanup-interval" usage:"how often expired messages are archived and deleted"`
+	Archive         string        `yaml:"archive" toml:"archive" env:"MONGO_ARCHIVE" flag:"mongo-archive" usage:"where expired messages are archived: collection, file or none"`
+	ArchiveDir      string        `yaml:"archive_dir" toml:"archive_dir" env:"MONGO_ARCHIVE_DIR" flag:"mongo-archive-dir" usage:"directory expired messages are archived to, if archived to a file"`
+
+	// How long a single operation may take, unless the caller's deadline is sooner
+	OperationTimeout time.Duration `yaml:"operation_timeout" toml:"operation_timeout" env:"MONGO_OPERATION_TIMEOUT" flag:"mongo-operation-timeout" usage:"how long a single mongo operation may take"`
+
+	// If not, migrations are only applied by the migrate command, and the service won't start until they have been
+	MigrateOnStartup bool `yaml:"migrate_on_startup" toml:"migrate_on_startup" env:"MONGO_MIGRATE_ON_STARTUP" flag:"mongo-migrate-on-startup" usage:"apply any mongo migrations that haven't been applied on startup"`
+}
+
+/**
+ * Sqlite stores messages in a single file, for running without mongo. Messages that haven't been active for
+ * the ttl, and aren't marked active, are archived and deleted every cleanup interval.
+ */
+type Sqlite struct {
+	Path            string        `yaml:"path" toml:"path" env:"SQLITE_PATH" flag:"sqlite-path" usage:"sqlite database file, created if it doesn't exist"`
+	MessageTtl      time.Duration `yaml:"message_ttl" toml:"message_ttl" env:"SQLITE_MESSAGE_TTL" flag:"sqlite-message-ttl" usage:"how long messages are kept after they were last active, unless marked active"`
+	CleanupInterval time.Duration `yaml:"cleanup_interval" toml:"cleanup_interval" env:"SQLITE_CLEANUP_INTERVAL" flag:"sqlite-cleanup-interval" usage:"how often expired messages are archived and deleted"`
+	Archive         string        `yaml:"archive" toml:"archive" env:"SQLITE_ARCHIVE" flag:"sqlite-archive" usage:"where expired messages are archived: file or none"`
+	ArchiveDir      string        `yaml:"archive_dir" toml:"archive_dir" env:"SQLITE_ARCHIVE_DIR" flag:"sqlite-archive-dir" usage:"directory expired messages are archived to, if archived to a file"`
+
+	// How long a single operation may take, unless the caller's deadline is sooner
+	OperationTimeout time.Duration `yaml:"operation_timeout" toml:"operation_timeout" env:"SQLITE_OPERATION_TIMEOUT" flag:"sqlite-operation-timeout" usage:"how long a single sqlite operation may take"`
+}
+
+type Discord struct {
+	BotToken string `yaml:"bot_token" toml:"bot_token" env:"DISCORD_BOT_TOKEN" secret:"true"`
+}
+
+type Scheduler struct {
+	QueueSize       int           `yaml:"queue_size" toml:"queue_size" env:"SCHEDULER_QUEUE_SIZE" flag:"scheduler-queue-size" usage:"how many messages may be waiting to be published"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SCHEDULER_SHUTDOWN_TIMEOUT" flag:"scheduler-shutdown-timeout" usage:"how long to wait for the message being published to finish when shutting down, once requests have"`
+}
+
+/**
+ * Auth configures how callers are authenticated. JWTs are verified against keys from the JWKS endpoint if
+ * it is set, otherwise the public key, otherwise the comma separated list of public key files and directories.
+ */
+type Auth struct {
+	JwtAudience                string        `yaml:"jwt_audience" toml:"jwt_audience" env:"AUTH_JWT_AUDIENCE" flag:"auth-jwt-audience" usage:"audience JWTs must be issued for"`
+	JwtIssuer                  string        `yaml:"jwt_issuer" toml:"jwt_issuer" env:"AUTH_JWT_ISSUER" flag:"auth-jwt-issuer" usage:"issuer JWTs must be issued by"`
+	JwtPublicKey               string        `yaml:"jwt_public_key" toml:"jwt_public_key" env:"AUTH_JWT_PUBLIC_KEY" flag:"auth-jwt-public-key" usage:"PEM encoded public key to verify JWTs with"`
+	JwtPublicKeyFile           string        `yaml:"jwt_public_key_file" toml:"jwt_public_key_file" env:"AUTH_JWT_PUBLIC_KEY_FILE" flag:"auth-jwt-public-key-file" usage:"comma separated public key files and directories to verify JWTs with"`
+	JwtPublicKeyReloadInterval time.Duration `yaml:"jwt_public_key_reload_interval" toml:"jwt_public_key_reload_interval" env:"AUTH_JWT_PUBLIC_KEY_RELOAD_INTERVAL" flag:"auth-jwt-public-key-reload-interval" usage:"how often to check the public key files for changes"`
+	JwksUrl                    string        `yaml:"jwks_url" toml:"jwks_url" env:"AUTH_JWKS_URL" flag:"auth-jwks-url" usage:"JWKS endpoint to fetch the public keys from"`
+	JwksCacheTtl               time.Duration `yaml:"jwks_cache_ttl" toml:"jwks_cache_ttl" env:"AUTH_JWKS_CACHE_TTL" flag:"auth-jwks-cache-ttl" usage:"how long to cache the JWKS for"`
+	JwksMinRefreshInterval     time.Duration `yaml:"jwks_min_refresh_interval" toml:"jwks_min_refresh_interval" env:"AUTH_JWKS_MIN_REFRESH_INTERVAL" flag:"auth-jwks-min-refresh-interval" usage:"how soon the JWKS may be fetched again for a token with an unknown kid"`
+	ApiKeysFile                string        `yaml:"api_keys_file" toml:"api_keys_file" env:"AUTH_API_KEYS_FILE" flag:"auth-api-keys-file" usage:"file of API keys to accept"`
+	ApiKeysEnabled             bool          `yaml:"api_keys_enabled" toml:"api_keys_enabled" env:"AUTH_API_KEYS_ENABLED" flag:"auth-api-keys-enabled" usage:"accept the API keys stored in mongo"`
+}
+
+/**
+ * Default returns the configuration used where nothing else is set.
+ */
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			ListenAddress:      ":80",
+			AdminListenAddress: ":9090",
+			ShutdownTimeout:    20 * time.Second,
+		},
+		Log: Log{
+			Level:            "INFO",
+			Format:           "text",
+			LevelRevertAfter: 15 * time.Minute,
+		},
+		Store: Store{
+			Backend: "mongo",
+		},
+		Mongo: Mongo{
+			MaxPoolSize:      10,
+			MessageTtl:       7 * 24 * time.Hour,
+			CleanupInterval:  time.Hour,
+			Archive:          "collection",
+			ArchiveDir:       "archive",
+			OperationTimeout: 5 * time.Second,
+			MigrateOnStartup: true,
+		},
+		Sqlite: Sqlite{
+			Path:             "ecfmp-discord.db",
+			MessageTtl:       7 * 24 * time.Hour,
+			CleanupInterval:  time.Hour,
+			Archive:          "file",
+			ArchiveDir:       "archive",
+			OperationTimeout: 5 * time.Second,
+		},
+		Scheduler: Scheduler{
+			QueueSize:       50,
+			ShutdownTimeout: 10 * time.Second,
+		},
+		Auth: Auth{
+			JwtIssuer:                  "ecfmp-auth",
+			JwtPublicKeyReloadInterval: 30 * time.Second,
+			JwksCacheTtl:               15 * time.Minute,
+			JwksMinRefreshInterval:     30 * time.Second,
+		},
+	}
+}
+
+/**
+ * Enabled returns whether the gRPC server should serve TLS.
+ */
+func (tls Tls) Enabled() bool {
+	return tls.CertFile != "" || tls.KeyFile != ""
+}
+
+/**
+ * UsesMongo returns whether messages are stored in mongo.
+ */
+func (store Store) UsesMongo() bool {
+	return store.Backend == "mongo"
+}
+
+/**
+ * RequireClientCert returns whether clients must present a certificate.
+ */
+func (tls Tls) RequireClientCert() bool {
+	return tls.ClientAuth == "require"
+}
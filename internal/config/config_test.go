@@ -0,0 +1,224 @@
+package config_test
+
+import (
+	"ecfmp/discord/internal/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name string, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Failed to write %v: %v", name, err)
+	}
+
+	return path
+}
+
+func validConfig() *config.Config {
+	validConfig := config.Default()
+	validConfig.Mongo.Host = "mongodb://localhost:27017"
+	validConfig.Mongo.Database = "ecfmp"
+	validConfig.Discord.BotToken = "abc"
+	validConfig.Auth.JwtAudience = "ecfmp-discord"
+	validConfig.Auth.JwtPublicKeyFile = "./docker/dev_public_key.pub"
+
+	return validConfig
+}
+
+func Test_ItLoadsTheDefaults(t *testing.T) {
+	loaded, err := config.Load(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ":80", loaded.Server.ListenAddress)
+	assert.Equal(t, uint64(10), loaded.Mongo.MaxPoolSize)
+	assert.Equal(t, 7*24*time.Hour, loaded.Mongo.MessageTtl)
+	assert.True(t, loaded.Mongo.MigrateOnStartup)
+	assert.Equal(t, 50, loaded.Scheduler.QueueSize)
+	assert.Equal(t, "ecfmp-auth", loaded.Auth.JwtIssuer)
+}
+
+func Test_ItLoadsFromTheEnvironment(t *testing.T) {
+	t.Setenv("LISTEN_ADDRESS", ":8080")
+	t.Setenv("SCHEDULER_QUEUE_SIZE", "100")
+	t.Setenv("MONGO_MESSAGE_TTL", "24h")
+	t.Setenv("AUTH_API_KEYS_ENABLED", "true")
+
+	loaded, err := config.Load(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ":8080", loaded.Server.ListenAddress)
+	assert.Equal(t, 100, loaded.Scheduler.QueueSize)
+	assert.Equal(t, 24*time.Hour, loaded.Mongo.MessageTtl)
+	assert.True(t, loaded.Auth.ApiKeysEnabled)
+}
+
+func Test_ItLoadsAYamlFile(t *testing.T) {
+	path := writeFile(t, "config.yaml", "server:\n  listen_address: \":8080\"\n  tls:\n    client_auth: require\nscheduler:\n  queue_size: 100\nmongo:\n  message_ttl: 24h\n")
+
+	loaded, err := config.Load([]string{"-config", path})
+	assert.Nil(t, err)
+	assert.Equal(t, ":8080", loaded.Server.ListenAddress)
+	assert.Equal(t, "require", loaded.Server.Tls.ClientAuth)
+	assert.Equal(t, 100, loaded.Scheduler.QueueSize)
+	assert.Equal(t, 24*time.Hour, loaded.Mongo.MessageTtl)
+}
+
+func Test_ItLoadsATomlFile(t *testing.T) {
+	path := writeFile(t, "config.toml", "[server]\nlisten_address = \":8080\"\n\n[scheduler]\nqueue_size = 100\n\n[mongo]\nmessage_ttl = \"24h\"\n")
+	t.Setenv("CONFIG_FILE", path)
+
+	loaded, err := config.Load(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ":8080", loaded.Server.ListenAddress)
+	assert.Equal(t, 100, loaded.Scheduler.QueueSize)
+	assert.Equal(t, 24*time.Hour, loaded.Mongo.MessageTtl)
+}
+
+func Test_ItRejectsUnknownKeysInTheFile(t *testing.T) {
+	yamlPath := writeFile(t, "config.yaml", "scheduler:\n  queue_sise: 100\n")
+	_, err := config.Load([]string{"-config", yamlPath})
+	assert.ErrorContains(t, err, "queue_sise")
+
+	tomlPath := writeFile(t, "config.toml", "[scheduler]\nqueue_sise = 100\n")
+	_, err = config.Load([]string{"-config", tomlPath})
+	assert.ErrorContains(t, err, "queue_sise")
+}
+
+func Test_ItRejectsUnknownFileTypes(t *testing.T) {
+	path := writeFile(t, "config.json", "{}")
+
+	_, err := config.Load([]string{"-config", path})
+	assert.ErrorContains(t, err, "must be .yaml, .yml or .toml")
+}
+
+func Test_ItPrefersFlagsToTheEnvironmentToTheFile(t *testing.T) {
+	path := writeFile(t, "config.yaml", "server:\n  listen_address: \":1\"\n  admin_listen_address: \":2\"\nscheduler:\n  queue_size: 1\n")
+	t.Setenv("ADMIN_LISTEN_ADDRESS", ":3")
+	t.Setenv("SCHEDULER_QUEUE_SIZE", "3")
+
+	loaded, err := config.Load([]string{"-config", path, "-scheduler-queue-size", "4", "-auth-api-keys-enabled"})
+	assert.Nil(t, err)
+	assert.Equal(t, ":1", loaded.Server.ListenAddress)
+	assert.Equal(t, ":3", loaded.Server.AdminListenAddress)
+	assert.Equal(t, 4, loaded.Scheduler.QueueSize)
+	assert.True(t, loaded.Auth.ApiKeysEnabled)
+}
+
+func Test_ItReadsSecretsFromFiles(t *testing.T) {
+	path := writeFile(t, "bot_token", "secret-token\n")
+	t.Setenv("DISCORD_BOT_TOKEN", "")
+	os.Unsetenv("DISCORD_BOT_TOKEN")
+	t.Setenv("DISCORD_BOT_TOKEN_FILE", path)
+
+	loaded, err := config.Load(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-token", loaded.Discord.BotToken)
+}
+
+func Test_ItRejectsASecretAndItsFileTogether(t *testing.T) {
+	path := writeFile(t, "bot_token", "secret-token")
+	t.Setenv("DISCORD_BOT_TOKEN", "other-token")
+	t.Setenv("DISCORD_BOT_TOKEN_FILE", path)
+
+	_, err := config.Load(nil)
+	assert.ErrorContains(t, err, "only one of DISCORD_BOT_TOKEN and DISCORD_BOT_TOKEN_FILE may be set")
+}
+
+func Test_ItDoesNotAcceptSecretsAsFlags(t *testing.T) {
+	_, err := config.Load([]string{"-discord-bot-token", "abc"})
+	assert.ErrorContains(t, err, "flag provided but not defined")
+}
+
+func Test_ItReportsEveryInvalidValueTogether(t *testing.T) {
+	t.Setenv("SCHEDULER_QUEUE_SIZE", "lots")
+	t.Setenv("SHUTDOWN_TIMEOUT", "soon")
+
+	_, err := config.Load([]string{"-mongo-max-pool-size", "-1"})
+	assert.ErrorContains(t, err, "invalid SCHEDULER_QUEUE_SIZE")
+	assert.ErrorContains(t, err, "invalid SHUTDOWN_TIMEOUT")
+	assert.ErrorContains(t, err, "invalid -mongo-max-pool-size")
+}
+
+func Test_ItValidatesAValidConfig(t *testing.T) {
+	assert.Nil(t, validConfig().Validate())
+}
+
+func Test_ItDoesNotNeedMongoWhenStoringMessagesInMemory(t *testing.T) {
+	memoryConfig := validConfig()
+	memoryConfig.Store.Backend = "memory"
+	memoryConfig.Mongo = config.Mongo{}
+
+	assert.Nil(t, memoryConfig.Validate())
+}
+
+func Test_ItDoesNotNeedMongoWhenStoringMessagesInSqlite(t *testing.T) {
+	sqliteConfig := validConfig()
+	sqliteConfig.Store.Backend = "sqlite"
+	sqliteConfig.Mongo = config.Mongo{}
+
+	assert.Nil(t, sqliteConfig.Validate())
+}
+
+func Test_ItReportsEveryValidationErrorTogether(t *testing.T) {
+	err := config.Default().Validate()
+	assert.ErrorContains(t, err, "MONGO_HOST is required")
+	assert.ErrorContains(t, err, "MONGO_DB is required")
+	assert.ErrorContains(t, err, "DISCORD_BOT_TOKEN or DISCORD_BOT_TOKEN_FILE is required")
+	assert.ErrorContains(t, err, "AUTH_JWT_AUDIENCE is required")
+	assert.ErrorContains(t, err, "one of AUTH_JWKS_URL, AUTH_JWT_PUBLIC_KEY or AUTH_JWT_PUBLIC_KEY_FILE is required")
+}
+
+var validationTests = []struct {
+	name     string
+	modify   func(*config.Config)
+	expected string
+}{
+	{"no listen address", func(c *config.Config) { c.Server.ListenAddress = "" }, "LISTEN_ADDRESS is required"},
+	{"no shutdown timeout", func(c *config.Config) { c.Server.ShutdownTimeout = 0 }, "SHUTDOWN_TIMEOUT must be positive"},
+	{"cert without key", func(c *config.Config) { c.Server.Tls.CertFile = "cert.pem" }, "TLS_CERT_FILE and TLS_KEY_FILE must be set together"},
+	{"unknown client auth", func(c *config.Config) { c.Server.Tls.ClientAuth = "sometimes" }, "invalid TLS_CLIENT_AUTH sometimes"},
+	{"required client cert without ca", func(c *config.Config) {
+		c.Server.Tls.CertFile, c.Server.Tls.KeyFile, c.Server.Tls.ClientAuth = "cert.pem", "key.pem", "require"
+	}, "TLS_CLIENT_AUTH require needs TLS_CLIENT_CA_FILE to be set"},
+	{"client identities without tls", func(c *config.Config) { c.Server.Tls.ClientIdentitiesFile = "identities.json" }, "client certificates need TLS_CERT_FILE and TLS_KEY_FILE to be set"},
+	{"unknown log format", func(c *config.Config) { c.Log.Format = "xml" }, "invalid LOG_FORMAT xml, must be json or text"},
+	{"no log level revert", func(c *config.Config) { c.Log.LevelRevertAfter = 0 }, "LOG_LEVEL_REVERT_AFTER must be positive"},
+	{"unknown store", func(c *config.Config) { c.Store.Backend = "postgres" }, "invalid STORE postgres, must be mongo, sqlite or memory"},
+	{"no sqlite path", func(c *config.Config) { c.Store.Backend, c.Sqlite.Path = "sqlite", "" }, "SQLITE_PATH is required"},
+	{"no sqlite ttl", func(c *config.Config) { c.Store.Backend, c.Sqlite.MessageTtl = "sqlite", 0 }, "SQLITE_MESSAGE_TTL must be positive"},
+	{"no sqlite cleanup", func(c *config.Config) { c.Store.Backend, c.Sqlite.CleanupInterval = "sqlite", 0 }, "SQLITE_CLEANUP_INTERVAL must be positive"},
+	{"sqlite archive to a collection", func(c *config.Config) { c.Store.Backend, c.Sqlite.Archive = "sqlite", "collection" }, "invalid SQLITE_ARCHIVE collection, must be file or none"},
+	{"no sqlite timeout", func(c *config.Config) { c.Store.Backend, c.Sqlite.OperationTimeout = "sqlite", 0 }, "SQLITE_OPERATION_TIMEOUT must be positive"},
+	{"api keys without mongo", func(c *config.Config) {
+		c.Store.Backend, c.Auth.ApiKeysEnabled = "memory", true
+	}, "AUTH_API_KEYS_ENABLED needs STORE to be mongo"},
+	{"no pool", func(c *config.Config) { c.Mongo.MaxPoolSize = 0 }, "MONGO_MAX_POOL_SIZE must be positive"},
+	{"no mongo ttl", func(c *config.Config) { c.Mongo.MessageTtl = 0 }, "MONGO_MESSAGE_TTL must be positive"},
+	{"no mongo cleanup", func(c *config.Config) { c.Mongo.CleanupInterval = 0 }, "MONGO_CLEANUP_INTERVAL must be positive"},
+	{"unknown mongo archive", func(c *config.Config) { c.Mongo.Archive = "s3" }, "invalid MONGO_ARCHIVE s3, must be collection, file or none"},
+	{"mongo archive file without a dir", func(c *config.Config) { c.Mongo.Archive, c.Mongo.ArchiveDir = "file", "" }, "MONGO_ARCHIVE_DIR is required to archive to a file"},
+	{"no mongo timeout", func(c *config.Config) { c.Mongo.OperationTimeout = 0 }, "MONGO_OPERATION_TIMEOUT must be positive"},
+	{"no queue", func(c *config.Config) { c.Scheduler.QueueSize = 0 }, "SCHEDULER_QUEUE_SIZE must be positive"},
+	{"no scheduler shutdown timeout", func(c *config.Config) { c.Scheduler.ShutdownTimeout = 0 }, "SCHEDULER_SHUTDOWN_TIMEOUT must be positive"},
+	{"no issuer", func(c *config.Config) { c.Auth.JwtIssuer = "" }, "AUTH_JWT_ISSUER is required"},
+	{"no jwks refresh interval", func(c *config.Config) { c.Auth.JwksMinRefreshInterval = 0 }, "AUTH_JWKS_MIN_REFRESH_INTERVAL must be positive"},
+	{"jwks refresh interval longer than the cache", func(c *config.Config) {
+		c.Auth.JwksCacheTtl, c.Auth.JwksMinRefreshInterval = time.Minute, time.Hour
+	}, "AUTH_JWKS_MIN_REFRESH_INTERVAL must be no more than AUTH_JWKS_CACHE_TTL"},
+	{"both api key sources", func(c *config.Config) {
+		c.Auth.ApiKeysFile, c.Auth.ApiKeysEnabled = "keys.json", true
+	}, "only one of AUTH_API_KEYS_FILE and AUTH_API_KEYS_ENABLED may be set"},
+}
+
+func Test_ItValidatesTheConfig(t *testing.T) {
+	for _, tt := range validationTests {
+		t.Run(tt.name, func(t *testing.T) {
+			invalidConfig := validConfig()
+			tt.modify(invalidConfig)
+			assert.ErrorContains(t, invalidConfig.Validate(), tt.expected)
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+/**
+ * A setting in the config, found by walking the struct tags.
+ */
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  reflect.Value
+}
+
+/**
+ * A value given on the command line, applied once the file and environment have been loaded.
+ */
+type flagValue struct {
+	setting setting
+	raw     string
+}
+
+/**
+ * Load loads the configuration from the config file, the environment and the command line arguments.
+ * The config file is given by the -config flag or CONFIG_FILE, and may be YAML or TOML depending on its
+ * extension.
+ *
+ * Every problem found is reported together, rather than just the first. The config is not validated, as
+ * not every command needs every setting; call Validate once it's loaded.
+ */
+func Load(args []string) (*Config, error) {
+	config := Default()
+	settings := settingsOf(config)
+
+	var errs []error
+	var flagValues []flagValue
+	flags := flag.NewFlagSet("ecfmp-discord", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file to load")
+	for _, setting := range settings {
+		if setting.flag == "" {
+			continue
+		}
+
+		setting := setting
+		record := func(raw string) error {
+			flagValues = append(flagValues, flagValue{setting: setting, raw: raw})
+			return nil
+		}
+
+		// Allow -flag on its own for booleans, rather than needing -flag=true
+		if setting.value.Kind() == reflect.Bool {
+			flags.BoolFunc(setting.flag, setting.usage, record)
+		} else {
+			flags.Func(setting.flag, setting.usage, record)
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if flags.NArg() > 0 {
+		errs = append(errs, fmt.Errorf("unexpected arguments %v", flags.Args()))
+	}
+
+	if *configFile != "" {
+		if err := loadFile(config, *configFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, setting := range settings {
+		if err := loadEnv(setting); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, value := range flagValues {
+		if err := setValue(value.setting.value, value.raw); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -%v: %w", value.setting.flag, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return config, nil
+}
+
+/**
+ * Loads the config file over the top of the config. Unknown keys are an error, as they're most likely typos.
+ */
+func loadFile(config *Config, path string) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch extension := strings.ToLower(filepath.Ext(path)); extension {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(contents))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("invalid config file %v: %w", path, err)
+		}
+	case ".toml":
+		metadata, err := toml.Decode(string(contents), config)
+		if err != nil {
+			return fmt.Errorf("invalid config file %v: %w", path, err)
+		}
+
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("invalid config file %v: unknown keys %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("config file %v must be .yaml, .yml or .toml", path)
+	}
+
+	return nil
+}
+
+/**
+ * Loads a setting from its environment variable, or for secrets the file named by its _FILE variable.
+ */
+func loadEnv(setting setting) error {
+	raw, set := os.LookupEnv(setting.env)
+	if setting.secret {
+		if path, fileSet := os.LookupEnv(setting.env + "_FILE"); fileSet {
+			if set {
+				return fmt.Errorf("only one of %v and %v_FILE may be set", setting.env, setting.env)
+			}
+
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read %v_FILE: %w", setting.env, err)
+			}
+
+			// Files written by editors and secret stores often end with a newline that isn't part of the secret
+			raw, set = strings.TrimRight(string(contents), "\r\n"), true
+		}
+	}
+
+	if !set {
+		return nil
+	}
+
+	if err := setValue(setting.value, raw); err != nil {
+		return fmt.Errorf("invalid %v: %w", setting.env, err)
+	}
+
+	return nil
+}
+
+/**
+ * Parses the raw value into the setting, according to its type.
+ */
+func setValue(value reflect.Value, raw string) error {
+	if value.Type() == reflect.TypeOf(time.Duration(0)) {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+
+		value.SetInt(int64(duration))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(parsed)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(parsed)
+	case reflect.Uint64:
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetUint(parsed)
+	default:
+		return fmt.Errorf("unsupported setting type %v", value.Type())
+	}
+
+	return nil
+}
+
+/**
+ * Walks the config, returning every setting that has an environment variable.
+ */
+func settingsOf(config *Config) []setting {
+	var settings []setting
+	var walk func(value reflect.Value)
+	walk = func(value reflect.Value) {
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.Type.Kind() == reflect.Struct {
+				walk(value.Field(i))
+				continue
+			}
+
+			if env := field.Tag.Get("env"); env != "" {
+				settings = append(settings, setting{
+					env:    env,
+					flag:   field.Tag.Get("flag"),
+					usage:  field.Tag.Get("usage"),
+					secret: field.Tag.Get("secret") == "true",
+					value:  value.Field(i),
+				})
+			}
+		}
+	}
+
+	walk(reflect.ValueOf(config).Elem())
+	return settings
+}
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/**
+ * Validate checks the whole config, returning every problem found joined together.
+ */
+func (config *Config) Validate() error {
+	errs := []error{
+		config.Server.Validate(),
+		config.Log.Validate(),
+		config.Store.Validate(),
+		config.Discord.Validate(),
+		config.Scheduler.Validate(),
+		config.Auth.Validate(),
+	}
+
+	// Mongo is only needed if messages are stored there, and likewise sqlite
+	switch config.Store.Backend {
+	case "mongo":
+		errs = append(errs, config.Mongo.Validate())
+	case "sqlite":
+		errs = append(errs, config.Sqlite.Validate())
+	}
+
+	if config.Auth.ApiKeysEnabled && !config.Store.UsesMongo() {
+		errs = append(errs, fmt.Errorf("AUTH_API_KEYS_ENABLED needs STORE to be mongo"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (server Server) Validate() error {
+	var errs []error
+	if server.ListenAddress == "" {
+		errs = append(errs, fmt.Errorf("LISTEN_ADDRESS is required"))
+	}
+
+	if server.AdminListenAddress == "" {
+		errs = append(errs, fmt.Errorf("ADMIN_LISTEN_ADDRESS is required"))
+	}
+
+	if server.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("SHUTDOWN_TIMEOUT must be positive"))
+	}
+
+	return errors.Join(append(errs, server.Tls.Validate())...)
+}
+
+func (tls Tls) Validate() error {
+	var errs []error
+	if tls.Enabled() && (tls.CertFile == "" || tls.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+
+	switch tls.ClientAuth {
+	case "", "optional":
+	case "require":
+		if tls.ClientCaFile == "" {
+			errs = append(errs, fmt.Errorf("TLS_CLIENT_AUTH require needs TLS_CLIENT_CA_FILE to be set"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid TLS_CLIENT_AUTH %v, must be require or optional", tls.ClientAuth))
+	}
+
+	if !tls.Enabled() && (tls.ClientCaFile != "" || tls.ClientIdentitiesFile != "") {
+		errs = append(errs, fmt.Errorf("client certificates need TLS_CERT_FILE and TLS_KEY_FILE to be set"))
+	}
+
+	return errors.Join(errs...)
+}
+
+/**
+ * An unknown level isn't an error, it logs a warning and falls back to INFO instead.
+ */
+func (log Log) Validate() error {
+	var errs []error
+	switch strings.ToLower(log.Format) {
+	case "json", "text":
+	default:
+		errs = append(errs, fmt.Errorf("invalid LOG_FORMAT %v, must be json or text", log.Format))
+	}
+
+	if log.LevelRevertAfter <= 0 {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL_REVERT_AFTER must be positive"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (store Store) Validate() error {
+	switch store.Backend {
+	case "mongo", "sqlite", "memory":
+		return nil
+	default:
+		return fmt.Errorf("invalid STORE %v, must be mongo, sqlite or memory", store.Backend)
+	}
+}
+
+func (mongo Mongo) Validate() error {
+	var errs []error
+	if mongo.Host == "" {
+		errs = append(errs, fmt.Errorf("MONGO_HOST is required"))
+	}
+
+	if mongo.Database == "" {
+		errs = append(errs, fmt.Errorf("MONGO_DB is required"))
+	}
+
+	if mongo.MaxPoolSize == 0 {
+		errs = append(errs, fmt.Errorf("MONGO_MAX_POOL_SIZE must be positive"))
+	}
+
+	if mongo.MessageTtl <= 0 {
+		errs = append(errs, fmt.Errorf("MONGO_MESSAGE_TTL must be positive"))
+	}
+
+	if mongo.CleanupInterval <= 0 {
+		errs = append(errs, fmt.Errorf("MONGO_CLEANUP_INTERVAL must be positive"))
+	}
+
+	switch mongo.Archive {
+	case "collection", "none":
+	case "file":
+		if mongo.ArchiveDir == "" {
+			errs = append(errs, fmt.Errorf("MONGO_ARCHIVE_DIR is required to archive to a file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid MONGO_ARCHIVE %v, must be collection, file or none", mongo.Archive))
+	}
+
+	if mongo.OperationTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("MONGO_OPERATION_TIMEOUT must be positive"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (sqlite Sqlite) Validate() error {
+	var errs []error
+	if sqlite.Path == "" {
+		errs = append(errs, fmt.Errorf("SQLITE_PATH is required"))
+	}
+
+	if sqlite.MessageTtl <= 0 {
+		errs = append(errs, fmt.Errorf("SQLITE_MESSAGE_TTL must be positive"))
+	}
+
+	if sqlite.CleanupInterval <= 0 {
+		errs = append(errs, fmt.Errorf("SQLITE_CLEANUP_INTERVAL must be positive"))
+	}
+
+	switch sqlite.Archive {
+	case "none":
+	case "file":
+		if sqlite.ArchiveDir == "" {
+			errs = append(errs, fmt.Errorf("SQLITE_ARCHIVE_DIR is required to archive to a file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid SQLITE_ARCHIVE %v, must be file or none", sqlite.Archive))
+	}
+
+	if sqlite.OperationTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("SQLITE_OPERATION_TIMEOUT must be positive"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (discord Discord) Validate() error {
+	if discord.BotToken == "" {
+		return fmt.Errorf("DISCORD_BOT_TOKEN or DISCORD_BOT_TOKEN_FILE is required")
+	}
+
+	return nil
+}
+
+func (scheduler Scheduler) Validate() error {
+	var errs []error
+	if scheduler.QueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("SCHEDULER_QUEUE_SIZE must be positive"))
+	}
+
+	if scheduler.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("SCHEDULER_SHUTDOWN_TIMEOUT must be positive"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (auth Auth) Validate() error {
+	var errs []error
+	if auth.JwtAudience == "" {
+		errs = append(errs, fmt.Errorf("AUTH_JWT_AUDIENCE is required"))
+	}
+
+	if auth.JwtIssuer == "" {
+		errs = append(errs, fmt.Errorf("AUTH_JWT_ISSUER is required"))
+	}
+
+	if auth.JwksUrl == "" && auth.JwtPublicKey == "" && auth.JwtPublicKeyFile == "" {
+		errs = append(errs, fmt.Errorf("one of AUTH_JWKS_URL, AUTH_JWT_PUBLIC_KEY or AUTH_JWT_PUBLIC_KEY_FILE is required"))
+	}
+
+	if auth.JwksCacheTtl <= 0 {
+		errs = append(errs, fmt.Errorf("AUTH_JWKS_CACHE_TTL must be positive"))
+	}
+
+	if auth.JwksMinRefreshInterval <= 0 {
+		errs = append(errs, fmt.Errorf("AUTH_JWKS_MIN_REFRESH_INTERVAL must be positive"))
+	} else if auth.JwksMinRefreshInterval > auth.JwksCacheTtl {
+		errs = append(errs, fmt.Errorf("AUTH_JWKS_MIN_REFRESH_INTERVAL must be no more than AUTH_JWKS_CACHE_TTL"))
+	}
+
+	if auth.JwtPublicKeyReloadInterval <= 0 {
+		errs = append(errs, fmt.Errorf("AUTH_JWT_PUBLIC_KEY_RELOAD_INTERVAL must be positive"))
+	}
+
+	if auth.ApiKeysFile != "" && auth.ApiKeysEnabled {
+		errs = append(errs, fmt.Errorf("only one of AUTH_API_KEYS_FILE and AUTH_API_KEYS_ENABLED may be set"))
+	}
+
+	return errors.Join(errs...)
+}
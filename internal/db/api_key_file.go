@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+/**
+ * ApiKeyFile is a read-only store of API keys, loaded from a JSON file containing an array of keys.
+ * As the file isn't written to, when each key was last used is only tracked in memory.
+ */
+type ApiKeyFile struct {
+	keys  []ApiKey
+	mutex sync.Mutex
+}
+
+/**
+ * Loads API keys from a JSON file
+ */
+func LoadApiKeyFile(path string) (*ApiKeyFile, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api key file %v: %w", path, err)
+	}
+
+	var keys []ApiKey
+	if err := json.Unmarshal(contents, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse api key file %v: %w", path, err)
+	}
+
+	for i := range keys {
+		if keys[i].Name == "" || keys[i].Hash == "" {
+			return nil, fmt.Errorf("api key %v in %v must have a name and hash", i, path)
+		}
+
+		// Keys in files don't need an id, so use the name
+		if keys[i].Id == "" {
+			keys[i].Id = keys[i].Name
+		}
+	}
+
+	return &ApiKeyFile{keys: keys}, nil
+}
+
+/**
+ * Gets an API key by the hash of the key
+ */
+func (f *ApiKeyFile) GetApiKeyByHash(ctx context.Context, hash string) (*ApiKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i := range f.keys {
+		if f.keys[i].Hash == hash {
+			key := f.keys[i]
+			return &key, nil
+		}
+	}
+
+	return nil, nil
+}
+
+/**
+ * Records when an API key was last used
+ */
+func (f *ApiKeyFile) UpdateApiKeyLastUsed(ctx context.Context, id string, lastUsedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i := range f.keys {
+		if f.keys[i].Id == id {
+			f.keys[i].LastUsedAt = lastUsedAt
+			return nil
+		}
+	}
+
+	return fmt.Errorf("api key not found")
+}
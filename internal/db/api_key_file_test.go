@@ -0,0 +1,52 @@
+package db_test
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ItLoadsApiKeysFromFile(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "api_keys.json")
+	contents := `[{"name": "cron", "hash": "abc", "scopes": ["admin"], "expires_at": "2030-01-01T00:00:00Z"}]`
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Failed to write api key file: %v", err)
+	}
+
+	// When
+	store, err := db.LoadApiKeyFile(path)
+	assert.Nil(t, err)
+
+	// Then
+	key, err := store.GetApiKeyByHash(context.Background(), "abc")
+	assert.Nil(t, err)
+	assert.Equal(t, "cron", key.Id)
+	assert.Equal(t, []string{"admin"}, key.Scopes)
+	assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), key.ExpiresAt)
+
+	missing, err := store.GetApiKeyByHash(context.Background(), "def")
+	assert.Nil(t, err)
+	assert.Nil(t, missing)
+
+	lastUsed := time.Now()
+	assert.Nil(t, store.UpdateApiKeyLastUsed(context.Background(), "cron", lastUsed))
+	key, _ = store.GetApiKeyByHash(context.Background(), "abc")
+	assert.Equal(t, lastUsed, key.LastUsedAt)
+}
+
+func Test_ItRejectsApiKeyFileWithoutHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api_keys.json")
+	if err := os.WriteFile(path, []byte(`[{"name": "cron"}]`), 0600); err != nil {
+		t.Fatalf("Failed to write api key file: %v", err)
+	}
+
+	store, err := db.LoadApiKeyFile(path)
+	assert.Nil(t, store)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"ecfmp/discord/internal/tracing"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The errors every MessageStore returns, possibly wrapped, so that callers can check for them with errors.Is
+var (
+	// A message to be changed doesn't exist
+	ErrMessageNotFound = errors.New("message not found")
+
+	// A client request id has already been used, for another message
+	ErrDuplicateClientRequest = errors.New("client request id already used")
+
+	// An id isn't a valid ObjectId, so can't be the id of anything stored
+	ErrInvalidId = errors.New("invalid id")
+
+	// A message isn't at the version a new version expected, because another was published first
+	ErrVersionConflict = errors.New("message is not at the expected version")
+)
+
+/**
+ * VersionConflictError is an ErrVersionConflict that says which version the message is actually at, so that
+ * the caller can rebase on it.
+ */
+type VersionConflictError struct {
+	CurrentVersion         int
+	CurrentClientRequestId string
+}
+
+func (err *VersionConflictError) Error() string {
+	return fmt.Sprintf("%v, it is at version %v (client request id %q)", ErrVersionConflict, err.CurrentVersion, err.CurrentClientRequestId)
+}
+
+func (err *VersionConflictError) Unwrap() error {
+	return ErrVersionConflict
+}
+
+/**
+ * Parses the id as an ObjectId, returning ErrInvalidId if it isn't one.
+ */
+func parseId(id string) (primitive.ObjectID, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return objectId, fmt.Errorf("%w %q: %w", ErrInvalidId, id, err)
+	}
+
+	return objectId, nil
+}
+
+func duplicateClientRequestError(clientRequestId string) error {
+	return fmt.Errorf("%w: %q", ErrDuplicateClientRequest, clientRequestId)
+}
+
+/**
+ * Makes sure that an error caused by the context ending wraps context.DeadlineExceeded or context.Canceled,
+ * whatever the driver wrapped it in, so that callers can tell that the operation ran out of time rather than
+ * failed.
+ */
+func contextError(err error) error {
+	if err == nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	if mongo.IsTimeout(err) {
+		return fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+	}
+
+	return err
+}
+
+/**
+ * Ends the span of a store operation, deferred with the operation's named error.
+ */
+func endOperation(span trace.Span, err *error) {
+	*err = contextError(*err)
+	tracing.EndSpan(span, *err)
+}
@@ -0,0 +1,333 @@
+package db
+
+import (
+	"context"
+	pb "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/**
+ * Memory stores messages in memory, with the same semantics as Mongo, for tests and for running without a
+ * database in development. Nothing is kept across restarts, and messages are never expired.
+ */
+type Memory struct {
+	mutex sync.RWMutex
+
+	// Messages by id, and the order they were written in
+	messages map[string]*DiscordMessage
+	order    []string
+
+	// The id of the message each client request id was used for
+	clientRequestIds map[string]string
+
+	// Kept in the order they were saved, which is also oldest first
+	queued []QueuedMessage
+}
+
+/**
+ * Creates an empty in-memory store.
+ */
+func NewMemory() *Memory {
+	return &Memory{
+		messages:         make(map[string]*DiscordMessage),
+		clientRequestIds: make(map[string]string),
+	}
+}
+
+/**
+ * Write a discord message, recording the caller that created it
+ */
+func (m *Memory) WriteDiscordMessage(ctx context.Context, clientRequestId string, caller Caller, message *pb.CreateRequest) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.clientRequestIds[clientRequestId]; ok {
+		return "", duplicateClientRequestError(clientRequestId)
+	}
+
+	id := primitive.NewObjectID().Hex()
+	now := time.Now()
+	m.messages[id] = &DiscordMessage{
+		Id:             id,
+		Channel:        message.Channel,
+		Versions:       []DiscordMessageVersion{newVersion(clientRequestId, caller, message.Content, &message.Embeds)},
+		CreatedAt:      now,
+		LastActivityAt: now,
+	}
+	m.order = append(m.order, id)
+	m.clientRequestIds[clientRequestId] = id
+
+	return id, nil
+}
+
+/**
+ * Add a new version of a discord message, recording the caller that created the version
+ */
+func (m *Memory) PublishMessageVersion(ctx context.Context, clientRequestId string, caller Caller, message *pb.UpdateRequest, expected ExpectedVersion) error {
+	return m.update(ctx, message.Id, func(stored *DiscordMessage) error {
+		if _, ok := m.clientRequestIds[clientRequestId]; ok {
+			return duplicateClientRequestError(clientRequestId)
+		}
+
+		latest := stored.LatestVersion()
+		if !expected.Matches(len(stored.Versions), latest.ClientRequestId) {
+			return &VersionConflictError{CurrentVersion: len(stored.Versions), CurrentClientRequestId: latest.ClientRequestId}
+		}
+
+		stored.Versions = append(stored.Versions, newVersion(clientRequestId, caller, message.Content, &message.Embeds))
+		stored.CancelledAt = time.Time{}
+		stored.LastActivityAt = time.Now()
+		m.clientRequestIds[clientRequestId] = stored.Id
+
+		return nil
+	})
+}
+
+func (m *Memory) UpdateMessageWithDiscordIdAndLastPublishRequest(ctx context.Context, id string, discordId string, requestId string) error {
+	return m.update(ctx, id, func(stored *DiscordMessage) error {
+		stored.DiscordId = discordId
+		stored.LastClientRequestPublished = requestId
+		stored.LastPublishAttemptAt = time.Now()
+		stored.LastPublishError = ""
+		stored.PublishingStartedAt = time.Time{}
+		stored.LastActivityAt = stored.LastPublishAttemptAt
+		return nil
+	})
+}
+
+func (m *Memory) UpdateMessageWithLastPublishRequest(ctx context.Context, id string, requestId string) error {
+	return m.update(ctx, id, func(stored *DiscordMessage) error {
+		stored.LastClientRequestPublished = requestId
+		stored.LastPublishAttemptAt = time.Now()
+		stored.LastPublishError = ""
+		stored.LastActivityAt = stored.LastPublishAttemptAt
+		return nil
+	})
+}
+
+func (m *Memory) SetDiscordMessageActive(ctx context.Context, id string, active bool) error {
+	return m.update(ctx, id, func(stored *DiscordMessage) error {
+		stored.Active = active
+		stored.LastActivityAt = time.Now()
+		return nil
+	})
+}
+
+func (m *Memory) GetDiscordMessageById(ctx context.Context, id string) (*DiscordMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := parseId(id); err != nil {
+		return nil, err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	stored, ok := m.messages[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return copyMessage(stored), nil
+}
+
+func (m *Memory) GetDiscordMessageByClientRequestId(ctx context.Context, clientRequestId string) (*DiscordMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	id, ok := m.clientRequestIds[clientRequestId]
+	if !ok {
+		return nil, nil
+	}
+
+	return copyMessage(m.messages[id]), nil
+}
+
+/**
+ * Gets the most recently created messages, newest first.
+ */
+func (m *Memory) GetRecentDiscordMessages(ctx context.Context, limit int64) ([]DiscordMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	// As with mongo, a limit of zero means no limit
+	messages := make([]DiscordMessage, 0)
+	for i := len(m.order) - 1; i >= 0 && (limit <= 0 || int64(len(messages)) < limit); i-- {
+		messages = append(messages, *copyMessage(m.messages[m.order[i]]))
+	}
+
+	return messages, nil
+}
+
+/**
+ * Gets the ids of the messages whose last publish failed, and that haven't been cancelled, oldest first.
+ */
+func (m *Memory) GetFailedDiscordMessageIds(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	ids := make([]string, 0)
+	for _, id := range m.order {
+		if stored := m.messages[id]; stored.LastPublishError != "" && !stored.Cancelled() {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func (m *Memory) RecordPublishError(ctx context.Context, id string, publishErr string) error {
+	return m.update(ctx, id, func(stored *DiscordMessage) error {
+		stored.LastPublishError = publishErr
+		stored.LastPublishAttemptAt = time.Now()
+		return nil
+	})
+}
+
+func (m *Memory) CancelDiscordMessage(ctx context.Context, id string) error {
+	return m.update(ctx, id, func(stored *DiscordMessage) error {
+		stored.CancelledAt = time.Now()
+		return nil
+	})
+}
+
+func (m *Memory) ResetDiscordMessageState(ctx context.Context, id string) error {
+	return m.update(ctx, id, func(stored *DiscordMessage) error {
+		stored.CancelledAt = time.Time{}
+		stored.LastPublishError = ""
+		stored.PublishingStartedAt = time.Time{}
+		return nil
+	})
+}
+
+func (m *Memory) ResetDiscordMessageForRepublish(ctx context.Context, id string) error {
+	return m.update(ctx, id, func(stored *DiscordMessage) error {
+		stored.DiscordId = ""
+		stored.LastClientRequestPublished = ""
+		stored.CancelledAt = time.Time{}
+		stored.LastPublishError = ""
+		stored.PublishingStartedAt = time.Time{}
+		return nil
+	})
+}
+
+func (m *Memory) SetDiscordMessagePublishing(ctx context.Context, id string, publishing bool) error {
+	return m.update(ctx, id, func(stored *DiscordMessage) error {
+		stored.PublishingStartedAt = time.Time{}
+		if publishing {
+			stored.PublishingStartedAt = time.Now()
+		}
+
+		return nil
+	})
+}
+
+/**
+ * Saves the ids of messages that were waiting to be published. Saving an id that is already saved has no effect.
+ */
+func (m *Memory) SaveQueuedMessageIds(ctx context.Context, ids []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, id := range ids {
+		if !m.isQueued(id) {
+			m.queued = append(m.queued, QueuedMessage{MessageId: id, QueuedAt: time.Now()})
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Takes the ids of the messages that were saved as waiting to be published, oldest first.
+ */
+func (m *Memory) TakeQueuedMessageIds(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ids := make([]string, 0, len(m.queued))
+	for _, message := range m.queued {
+		ids = append(ids, message.MessageId)
+	}
+
+	m.queued = nil
+	return ids, nil
+}
+
+func (m *Memory) isQueued(id string) bool {
+	for _, message := range m.queued {
+		if message.MessageId == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * Changes the message with the given id while holding the lock, failing if it doesn't exist.
+ */
+func (m *Memory) update(ctx context.Context, id string, change func(stored *DiscordMessage) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, err := parseId(id); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.messages[id]
+	if !ok {
+		return ErrMessageNotFound
+	}
+
+	return change(stored)
+}
+
+/**
+ * Messages in memory can always be reached.
+ */
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+/**
+ * Copies the message, so that callers can't change what is stored.
+ */
+func copyMessage(message *DiscordMessage) *DiscordMessage {
+	copied := *message
+	copied.Versions = append([]DiscordMessageVersion(nil), message.Versions...)
+	return &copied
+}
@@ -2,99 +2,201 @@ package db
 
 import (
 	"context"
+	"ecfmp/discord/internal/config"
+	logConfig "ecfmp/discord/internal/log"
+	"ecfmp/discord/internal/tracing"
 	pb "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
+	"errors"
 	"fmt"
-	"os"
+	"sync"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+var dbLog = logConfig.Subsystem(logConfig.SubsystemDb)
+
 type Mongo struct {
 	Client   *mongo.Client
 	database string
+
+	// How long each operation may take, unless the caller's deadline is sooner
+	timeout time.Duration
+
+	// Messages are archived and deleted once they haven't been active for the ttl
+	ttl         time.Duration
+	archiver    messageArchiver
+	stopCleanup chan struct{}
+	cleanupDone sync.WaitGroup
+	stopOnce    sync.Once
+}
+
+/**
+ * Create a new mongo connection, migrating the database first if configured to. Otherwise the database must
+ * already be up to date.
+ */
+func NewMongo(config config.Mongo) (*Mongo, error) {
+	client, err := connectMongo(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	database := client.Database(config.Database)
+	if config.MigrateOnStartup {
+		_, err = migrateMongo(ctx, database)
+	} else {
+		err = checkMongoMigrated(ctx, database)
+	}
+
+	if err != nil {
+		dbLog.Errorf("Failed to migrate mongo: %v", err)
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	m := &Mongo{
+		Client:      client,
+		database:    config.Database,
+		timeout:     config.OperationTimeout,
+		ttl:         config.MessageTtl,
+		stopCleanup: make(chan struct{}),
+	}
+
+	if config.Archive == "collection" {
+		m.archiver = mongoArchiver{collection: database.Collection("discord_messages_archive"), timeout: config.OperationTimeout}
+	} else if m.archiver, err = newArchiver(config.Archive, config.ArchiveDir); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	m.cleanupDone.Add(1)
+	go func() {
+		defer m.cleanupDone.Done()
+		expireMessagesEvery(config.CleanupInterval, m.stopCleanup, m.DeleteExpiredMessages)
+	}()
+
+	return m, nil
+}
+
+/**
+ * Connects to mongo without migrating it or expiring messages, for tools such as the api-key command that only
+ * use the connection briefly.
+ */
+func ConnectMongo(config config.Mongo) (*Mongo, error) {
+	client, err := connectMongo(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mongo{Client: client, database: config.Database, timeout: config.OperationTimeout}, nil
 }
 
 /**
- * Create a new mongo connection
+ * Applies any migrations that haven't been applied to the mongo database yet, returning the versions applied.
  */
-func NewMongo() (*Mongo, error) {
+func MigrateMongo(config config.Mongo) ([]int, error) {
+	client, err := connectMongo(config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	return migrateMongo(ctx, client.Database(config.Database))
+}
+
+/**
+ * Lists the migrations that have been applied to the mongo database, and the versions of those that haven't.
+ */
+func MongoMigrationStatus(config config.Mongo) (applied []AppliedMigration, pending []int, err error) {
+	client, err := connectMongo(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer client.Disconnect(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	database := client.Database(config.Database)
+	cursor, err := database.Collection("schema_migrations").Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := cursor.All(ctx, &applied); err != nil {
+		return nil, nil, err
+	}
+
+	pending, err = pendingMongoMigrations(ctx, database)
+	return applied, pending, err
+}
+
+func connectMongo(config config.Mongo) (*mongo.Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	auth := options.Credential{
-		Username: os.Getenv("MONGO_USERNAME"),
-		Password: os.Getenv("MONGO_PASSWORD"),
+		Username: config.Username,
+		Password: config.Password,
 	}
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(os.Getenv("MONGO_HOST")).SetAuth(auth).SetMaxPoolSize(10).SetMaxConnIdleTime(5*time.Second))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(config.Host).SetAuth(auth).SetMaxPoolSize(config.MaxPoolSize).SetMaxConnIdleTime(5*time.Second).SetMonitor(newMetricsMonitor()))
 	if err != nil {
-		log.Errorf("Failed to connect to mongo: %v", err)
+		dbLog.Errorf("Failed to connect to mongo: %v", err)
 		return nil, err
 	}
 
-	// Create necessary indexes in mongo
-	collection := client.Database(os.Getenv("MONGO_DB")).Collection("discord_messages")
-	_, indexErr := collection.Indexes().CreateOne(
-		context.Background(),
-		mongo.IndexModel{
-			Keys: bson.M{
-				"versions.client_request_id": 1,
-			},
-			Options: options.Index().SetUnique(true).SetName("versions_client_request_id"),
-		},
-	)
-
-	if indexErr != nil {
-		log.Errorf("Failed to create index: %v", indexErr)
-		return nil, indexErr
-	}
-
-	// Create an index on a ttl field that will delete messages after 1 week
-	_, indexErr = collection.Indexes().CreateOne(
-		context.Background(),
-		mongo.IndexModel{
-			Keys: bson.M{
-				"created_at": 1,
-			},
-			Options: options.Index().SetExpireAfterSeconds(604800).SetName("created_at"),
-		},
-	)
-
-	if indexErr != nil {
-		log.Errorf("Failed to create index: %v", indexErr)
-		return nil, indexErr
-	}
-
-	return &Mongo{
-		Client:   client,
-		database: os.Getenv("MONGO_DB"),
-	}, nil
+	return client, nil
+}
+
+/**
+ * Returns an error if any migrations haven't been applied to the database yet.
+ */
+func checkMongoMigrated(ctx context.Context, database *mongo.Database) error {
+	pending, err := pendingMongoMigrations(ctx, database)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		return fmt.Errorf("mongo migrations %v haven't been applied, run ecfmp-discord migrate", pending)
+	}
+
+	return nil
 }
 
 /**
- * Write a discord message to the database
+ * Write a discord message to the database, recording the caller that created it
  */
-func (m *Mongo) WriteDiscordMessage(clientRequestId string, message *pb.CreateRequest) (string, error) {
+func (m *Mongo) WriteDiscordMessage(ctx context.Context, clientRequestId string, caller Caller, message *pb.CreateRequest) (id string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.WriteDiscordMessage")
+	defer endOperation(span, &err)
+
 	collection := m.Client.Database(m.database).Collection("discord_messages")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
 	defer cancel()
 
-	version := DiscordMessageVersion{
-		ClientRequestId: clientRequestId,
-		Content:         message.Content,
-		Embeds:          DiscordEmbedToMongo(&message.Embeds),
-		CreatedAt:       time.Now(),
-	}
+	now := time.Now()
 	record := DiscordMessage{
-		Channel:   message.Channel,
-		Versions:  []DiscordMessageVersion{version},
-		CreatedAt: time.Now(),
+		Channel:        message.Channel,
+		Versions:       []DiscordMessageVersion{newVersion(clientRequestId, caller, message.Content, &message.Embeds)},
+		CreatedAt:      now,
+		LastActivityAt: now,
 	}
 	res, err := collection.InsertOne(ctx, record)
+	if mongo.IsDuplicateKeyError(err) {
+		return "", fmt.Errorf("%w: %w", ErrDuplicateClientRequest, err)
+	}
+
 	if err != nil {
 		return "", err
 	}
@@ -103,56 +205,87 @@ func (m *Mongo) WriteDiscordMessage(clientRequestId string, message *pb.CreateRe
 }
 
 /**
- * Publish a discord message to the database
+ * Publish a discord message to the database, recording the caller that created the version
  */
-func (m *Mongo) PublishMessageVersion(clientRequestId string, message *pb.UpdateRequest) error {
+func (m *Mongo) PublishMessageVersion(ctx context.Context, clientRequestId string, caller Caller, message *pb.UpdateRequest, expected ExpectedVersion) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.PublishMessageVersion")
+	defer endOperation(span, &err)
+
 	collection := m.Client.Database(m.database).Collection("discord_messages")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
 	defer cancel()
 
-	objectId, idErr := primitive.ObjectIDFromHex(message.Id)
+	objectId, idErr := parseId(message.Id)
 	if idErr != nil {
 		return idErr
 	}
 
-	// Update the message
-	version := DiscordMessageVersion{
-		ClientRequestId: clientRequestId,
-		Content:         message.Content,
-		Embeds:          DiscordEmbedToMongo(&message.Embeds),
-		CreatedAt:       time.Now(),
+	// Update the message. The unique index stops another message using the client request id, but not this
+	// one, so that is checked by the filter, as is the expected version. A new version is published even if
+	// publishing the previous one was cancelled.
+	version := newVersion(clientRequestId, caller, message.Content, &message.Embeds)
+	filter := bson.M{"_id": objectId, "versions.client_request_id": bson.M{"$ne": clientRequestId}}
+	switch {
+	case expected.Number > 0:
+		filter["versions"] = bson.M{"$size": expected.Number}
+	case expected.ClientRequestId != "":
+		filter["$expr"] = bson.M{"$eq": bson.A{bson.M{"$arrayElemAt": bson.A{"$versions.client_request_id", -1}}, expected.ClientRequestId}}
 	}
-	updateCount, err := collection.UpdateByID(ctx, objectId, bson.M{"$push": bson.M{"versions": version}})
+
+	updateCount, err := collection.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"versions": version}, "$set": bson.M{"last_activity_at": time.Now()}, "$unset": bson.M{"cancelled_at": ""}})
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %w", ErrDuplicateClientRequest, err)
+	}
+
 	if err != nil {
 		return err
 	}
 
-	if updateCount.ModifiedCount != 1 {
-		return fmt.Errorf("message not found")
+	if updateCount.ModifiedCount == 1 {
+		return nil
 	}
 
-	return nil
+	// Either the message doesn't exist, it already has a version with the client request id, or it isn't at
+	// the expected version
+	var current DiscordMessage
+	err = collection.FindOne(ctx, bson.M{"_id": objectId}).Decode(&current)
+	if err == mongo.ErrNoDocuments {
+		return ErrMessageNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if current.Version(clientRequestId) != nil {
+		return duplicateClientRequestError(clientRequestId)
+	}
+
+	return &VersionConflictError{CurrentVersion: len(current.Versions), CurrentClientRequestId: current.LatestVersion().ClientRequestId}
 }
 
 /**
  * Update the message with the discord id and the last publish request id, so we avoid publishing the same message twice.
  * Called when the message is published to discord for the first time.
  */
-func (m *Mongo) UpdateMessageWithDiscordIdAndLastPublishRequest(id string, discordId string, requestId string) error {
+func (m *Mongo) UpdateMessageWithDiscordIdAndLastPublishRequest(ctx context.Context, id string, discordId string, requestId string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.UpdateMessageWithDiscordIdAndLastPublishRequest")
+	defer endOperation(span, &err)
+
 	collection := m.Client.Database(m.database).Collection("discord_messages")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
 	defer cancel()
 
-	objectId, idErr := primitive.ObjectIDFromHex(id)
+	objectId, idErr := parseId(id)
 	if idErr != nil {
 		return idErr
 	}
 
 	// Update the message
 	var updated DiscordMessage
-	updateErr := collection.FindOneAndUpdate(ctx, bson.M{"_id": objectId}, bson.M{"$set": bson.M{"discord_id": discordId, "last_client_request_published": requestId}}).Decode(&updated)
+	updateErr := collection.FindOneAndUpdate(ctx, bson.M{"_id": objectId}, bson.M{"$set": bson.M{"discord_id": discordId, "last_client_request_published": requestId, "last_publish_attempt_at": time.Now(), "last_activity_at": time.Now()}, "$unset": bson.M{"last_publish_error": "", "publishing_started_at": ""}}).Decode(&updated)
 	if updateErr != nil && updateErr == mongo.ErrNoDocuments {
-		return fmt.Errorf("message not found")
+		return ErrMessageNotFound
 	}
 
 	if updateErr != nil {
@@ -166,21 +299,24 @@ func (m *Mongo) UpdateMessageWithDiscordIdAndLastPublishRequest(id string, disco
  * Update the message with the last publish request id, so we avoid publishing the same message twice.
  * Called when the message is published to discord for subsequent times.
  */
-func (m *Mongo) UpdateMessageWithLastPublishRequest(id string, requestId string) error {
+func (m *Mongo) UpdateMessageWithLastPublishRequest(ctx context.Context, id string, requestId string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.UpdateMessageWithLastPublishRequest")
+	defer endOperation(span, &err)
+
 	collection := m.Client.Database(m.database).Collection("discord_messages")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
 	defer cancel()
 
-	objectId, idErr := primitive.ObjectIDFromHex(id)
+	objectId, idErr := parseId(id)
 	if idErr != nil {
 		return idErr
 	}
 
 	// Update the message
 	var updated DiscordMessage
-	updateErr := collection.FindOneAndUpdate(ctx, bson.M{"_id": objectId}, bson.M{"$set": bson.M{"last_client_request_published": requestId}}).Decode(&updated)
+	updateErr := collection.FindOneAndUpdate(ctx, bson.M{"_id": objectId}, bson.M{"$set": bson.M{"last_client_request_published": requestId, "last_publish_attempt_at": time.Now(), "last_activity_at": time.Now()}, "$unset": bson.M{"last_publish_error": ""}}).Decode(&updated)
 	if updateErr != nil && updateErr == mongo.ErrNoDocuments {
-		return fmt.Errorf("message not found")
+		return ErrMessageNotFound
 	}
 
 	if updateErr != nil {
@@ -194,23 +330,26 @@ func (m *Mongo) UpdateMessageWithLastPublishRequest(id string, requestId string)
  * Gets a discord message is present by id
  * Should handle the case where the message is not present without erroring
  */
-func (m *Mongo) GetDiscordMessageById(id string) (*DiscordMessage, error) {
+func (m *Mongo) GetDiscordMessageById(ctx context.Context, id string) (message *DiscordMessage, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.GetDiscordMessageById")
+	defer endOperation(span, &err)
+
 	collection := m.Client.Database(m.database).Collection("discord_messages")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
 	defer cancel()
 
-	objectId, idErr := primitive.ObjectIDFromHex(id)
+	objectId, idErr := parseId(id)
 	if idErr != nil {
 		return nil, idErr
 	}
 
 	var result DiscordMessage
-	err := collection.FindOne(ctx, bson.M{"_id": objectId}).Decode(&result)
-	if err != nil && err != mongo.ErrNoDocuments {
-		return nil, err
+	findErr := collection.FindOne(ctx, bson.M{"_id": objectId}).Decode(&result)
+	if findErr != nil && findErr != mongo.ErrNoDocuments {
+		return nil, findErr
 	}
 
-	if err == mongo.ErrNoDocuments {
+	if findErr == mongo.ErrNoDocuments {
 		return nil, nil
 	}
 
@@ -221,18 +360,21 @@ func (m *Mongo) GetDiscordMessageById(id string) (*DiscordMessage, error) {
  * Gets a discord message is present by client request id
  * Should handle the case where the message is not present without erroring
  */
-func (m *Mongo) GetDiscordMessageByClientRequestId(clientRequestId string) (*DiscordMessage, error) {
+func (m *Mongo) GetDiscordMessageByClientRequestId(ctx context.Context, clientRequestId string) (message *DiscordMessage, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.GetDiscordMessageByClientRequestId")
+	defer endOperation(span, &err)
+
 	collection := m.Client.Database(m.database).Collection("discord_messages")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
 	defer cancel()
 
 	var result DiscordMessage
-	err := collection.FindOne(ctx, bson.M{"versions.client_request_id": clientRequestId}).Decode(&result)
-	if err != nil && err != mongo.ErrNoDocuments {
-		return nil, err
+	findErr := collection.FindOne(ctx, bson.M{"versions.client_request_id": clientRequestId}).Decode(&result)
+	if findErr != nil && findErr != mongo.ErrNoDocuments {
+		return nil, findErr
 	}
 
-	if err == mongo.ErrNoDocuments {
+	if findErr == mongo.ErrNoDocuments {
 		return nil, nil
 	}
 
@@ -240,10 +382,31 @@ func (m *Mongo) GetDiscordMessageByClientRequestId(clientRequestId string) (*Dis
 }
 
 /**
- * Disconnects from the mongo database.
+ * Checks that the mongo database can be reached.
+ */
+func (m *Mongo) Ping(ctx context.Context) error {
+	return m.Client.Ping(ctx, readpref.Primary())
+}
+
+/**
+ * Stops expiring messages and disconnects from the mongo database. Disconnecting again does nothing.
  */
 func (m *Mongo) Disconnect() error {
+	// Connections made by ConnectMongo don't expire messages
+	m.stopOnce.Do(func() {
+		if m.stopCleanup != nil {
+			close(m.stopCleanup)
+		}
+	})
+	m.cleanupDone.Wait()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	return m.Client.Disconnect(ctx)
+
+	err := m.Client.Disconnect(ctx)
+	if errors.Is(err, mongo.ErrClientDisconnected) {
+		return nil
+	}
+
+	return err
 }
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"ecfmp/discord/internal/tracing"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/**
+ * Creates a new API key
+ */
+func (m *Mongo) CreateApiKey(ctx context.Context, key *ApiKey) (id string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.CreateApiKey")
+	defer endOperation(span, &err)
+
+	collection := m.Client.Database(m.database).Collection("api_keys")
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	res, err := collection.InsertOne(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	return res.InsertedID.(primitive.ObjectID).Hex(), nil
+}
+
+/**
+ * Gets an API key by the hash of the key
+ * Should handle the case where the key is not present without erroring
+ */
+func (m *Mongo) GetApiKeyByHash(ctx context.Context, hash string) (key *ApiKey, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.GetApiKeyByHash")
+	defer endOperation(span, &err)
+
+	collection := m.Client.Database(m.database).Collection("api_keys")
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	var result ApiKey
+	err = collection.FindOne(ctx, bson.M{"hash": hash}).Decode(&result)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+
+	return &result, nil
+}
+
+/**
+ * Lists all API keys, including revoked and expired ones
+ */
+func (m *Mongo) ListApiKeys(ctx context.Context) (keys []ApiKey, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.ListApiKeys")
+	defer endOperation(span, &err)
+
+	collection := m.Client.Database(m.database).Collection("api_keys")
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	keys = make([]ApiKey, 0)
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+/**
+ * Records when an API key was last used
+ */
+func (m *Mongo) UpdateApiKeyLastUsed(ctx context.Context, id string, lastUsedAt time.Time) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.UpdateApiKeyLastUsed")
+	defer endOperation(span, &err)
+
+	return m.updateApiKey(ctx, id, bson.M{"$set": bson.M{"last_used_at": lastUsedAt}})
+}
+
+/**
+ * Revokes an API key, so that it can no longer be used
+ */
+func (m *Mongo) RevokeApiKey(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.RevokeApiKey")
+	defer endOperation(span, &err)
+
+	return m.updateApiKey(ctx, id, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+}
+
+func (m *Mongo) updateApiKey(ctx context.Context, id string, update bson.M) error {
+	collection := m.Client.Database(m.database).Collection("api_keys")
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	objectId, idErr := parseId(id)
+	if idErr != nil {
+		return idErr
+	}
+
+	updateResult, err := collection.UpdateByID(ctx, objectId, update)
+	if err != nil {
+		return err
+	}
+
+	if updateResult.MatchedCount != 1 {
+		return fmt.Errorf("api key not found")
+	}
+
+	return nil
+}
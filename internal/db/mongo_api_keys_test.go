@@ -0,0 +1,56 @@
+package db_test
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ItCreatesAndRevokesApiKeys(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	// When
+	id, err := mongo.CreateApiKey(context.Background(), &db.ApiKey{Name: "cron", Hash: "abc", Scopes: []string{"admin"}, CreatedAt: time.Now()})
+	assert.Nil(t, err)
+
+	lastUsed := time.Now().Truncate(time.Millisecond)
+	assert.Nil(t, mongo.UpdateApiKeyLastUsed(context.Background(), id, lastUsed))
+	assert.Nil(t, mongo.RevokeApiKey(context.Background(), id))
+
+	// Then
+	key, err := mongo.GetApiKeyByHash(context.Background(), "abc")
+	assert.Nil(t, err)
+	assert.Equal(t, id, key.Id)
+	assert.Equal(t, "cron", key.Name)
+	assert.Equal(t, []string{"admin"}, key.Scopes)
+	assert.True(t, lastUsed.Equal(key.LastUsedAt))
+	assert.True(t, key.Revoked())
+
+	keys, err := mongo.ListApiKeys(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(keys))
+}
+
+func Test_ItDoesntFindApiKeyByUnknownHash(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	key, err := mongo.GetApiKeyByHash(context.Background(), "abc")
+	assert.Nil(t, err)
+	assert.Nil(t, key)
+}
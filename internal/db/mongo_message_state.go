@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"ecfmp/discord/internal/tracing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+ * Gets the most recently created messages, newest first, for the admin dashboard.
+ */
+func (m *Mongo) GetRecentDiscordMessages(ctx context.Context, limit int64) (messages []DiscordMessage, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.GetRecentDiscordMessages")
+	defer endOperation(span, &err)
+
+	collection := m.Client.Database(m.database).Collection("discord_messages")
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	messages = make([]DiscordMessage, 0)
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+/**
+ * Records why publishing the message failed, so that it can be seen without reading the logs.
+ */
+func (m *Mongo) RecordPublishError(ctx context.Context, id string, publishErr string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.RecordPublishError")
+	defer endOperation(span, &err)
+
+	return m.updateMessageState(ctx, id, bson.M{"$set": bson.M{"last_publish_error": publishErr, "last_publish_attempt_at": time.Now()}})
+}
+
+/**
+ * Cancels publishing the message, so that the scheduler skips it until it is requeued or a new version is
+ * published.
+ */
+func (m *Mongo) CancelDiscordMessage(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.CancelDiscordMessage")
+	defer endOperation(span, &err)
+
+	return m.updateMessageState(ctx, id, bson.M{"$set": bson.M{"cancelled_at": time.Now()}})
+}
+
+/**
+ * Clears any cancellation and publish error from the message, so that it can be published again.
+ */
+func (m *Mongo) ResetDiscordMessageState(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.ResetDiscordMessageState")
+	defer endOperation(span, &err)
+
+	return m.updateMessageState(ctx, id, bson.M{"$unset": bson.M{"cancelled_at": "", "last_publish_error": "", "publishing_started_at": ""}})
+}
+
+/**
+ * Clears the discord id, and anything published, from the message so that it is published again as a new
+ * discord message. The existing discord message is left as it is.
+ */
+func (m *Mongo) ResetDiscordMessageForRepublish(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.ResetDiscordMessageForRepublish")
+	defer endOperation(span, &err)
+
+	return m.updateMessageState(ctx, id, bson.M{
+		"$set":   bson.M{"discord_id": "", "last_client_request_published": ""},
+		"$unset": bson.M{"cancelled_at": "", "last_publish_error": "", "publishing_started_at": ""},
+	})
+}
+
+/**
+ * Marks whether the message is being sent to discord as a new post, so that if publishing it is interrupted,
+ * it isn't posted again without checking whether the first post reached discord.
+ */
+func (m *Mongo) SetDiscordMessagePublishing(ctx context.Context, id string, publishing bool) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.SetDiscordMessagePublishing")
+	defer endOperation(span, &err)
+
+	if publishing {
+		return m.updateMessageState(ctx, id, bson.M{"$set": bson.M{"publishing_started_at": time.Now()}})
+	}
+
+	return m.updateMessageState(ctx, id, bson.M{"$unset": bson.M{"publishing_started_at": ""}})
+}
+
+/**
+ * Marks whether the message is active, so that it is kept however long ago it was last active.
+ */
+func (m *Mongo) SetDiscordMessageActive(ctx context.Context, id string, active bool) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.SetDiscordMessageActive")
+	defer endOperation(span, &err)
+
+	return m.updateMessageState(ctx, id, bson.M{"$set": bson.M{"active": active, "last_activity_at": time.Now()}})
+}
+
+/**
+ * Gets the ids of the messages whose last publish failed, and that haven't been cancelled, oldest first.
+ */
+func (m *Mongo) GetFailedDiscordMessageIds(ctx context.Context) (ids []string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.GetFailedDiscordMessageIds")
+	defer endOperation(span, &err)
+
+	collection := m.Client.Database(m.database).Collection("discord_messages")
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	filter := bson.M{"last_publish_error": bson.M{"$exists": true}, "cancelled_at": bson.M{"$exists": false}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": 1}).SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []struct {
+		Id primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &failed); err != nil {
+		return nil, err
+	}
+
+	ids = make([]string, 0, len(failed))
+	for _, message := range failed {
+		ids = append(ids, message.Id.Hex())
+	}
+
+	return ids, nil
+}
+
+func (m *Mongo) updateMessageState(ctx context.Context, id string, update bson.M) error {
+	collection := m.Client.Database(m.database).Collection("discord_messages")
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	objectId, idErr := parseId(id)
+	if idErr != nil {
+		return idErr
+	}
+
+	result, err := collection.UpdateByID(ctx, objectId, update)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount != 1 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
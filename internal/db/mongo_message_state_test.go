@@ -0,0 +1,196 @@
+package db_test
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	pb "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestMessage(t *testing.T, mongo *db.Mongo, clientRequestId string) string {
+	id, err := mongo.WriteDiscordMessage(context.Background(), clientRequestId, db.Caller{}, &pb.CreateRequest{Channel: "123", Content: "Hello World!"})
+	if err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	return id
+}
+
+func Test_ItGetsRecentMessagesNewestFirst(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	first := writeTestMessage(t, mongo, "1")
+	second := writeTestMessage(t, mongo, "2")
+	third := writeTestMessage(t, mongo, "3")
+
+	// When
+	messages, err := mongo.GetRecentDiscordMessages(context.Background(), 2)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, third, messages[0].Id)
+	assert.Equal(t, second, messages[1].Id)
+	assert.NotEqual(t, first, messages[1].Id)
+}
+
+func Test_ItRecordsAPublishErrorUntilThePublishSucceeds(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	id := writeTestMessage(t, mongo, "1")
+
+	// When
+	assert.Nil(t, mongo.RecordPublishError(context.Background(), id, "HTTP 403 Forbidden"))
+
+	// Then
+	message, err := mongo.GetDiscordMessageById(context.Background(), id)
+	assert.Nil(t, err)
+	assert.Equal(t, "HTTP 403 Forbidden", message.LastPublishError)
+	assert.False(t, message.LastPublishAttemptAt.IsZero())
+	assert.Equal(t, db.MessageStateFailed, message.State())
+
+	// When it's published
+	assert.Nil(t, mongo.UpdateMessageWithDiscordIdAndLastPublishRequest(context.Background(), id, "456", "1"))
+
+	// Then
+	message, err = mongo.GetDiscordMessageById(context.Background(), id)
+	assert.Nil(t, err)
+	assert.Equal(t, "", message.LastPublishError)
+	assert.Equal(t, db.MessageStatePublished, message.State())
+}
+
+func Test_ItCancelsAndResetsAMessage(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	id := writeTestMessage(t, mongo, "1")
+	assert.Nil(t, mongo.RecordPublishError(context.Background(), id, "HTTP 403 Forbidden"))
+
+	// When
+	assert.Nil(t, mongo.CancelDiscordMessage(context.Background(), id))
+
+	// Then
+	message, err := mongo.GetDiscordMessageById(context.Background(), id)
+	assert.Nil(t, err)
+	assert.True(t, message.Cancelled())
+	assert.Equal(t, db.MessageStateCancelled, message.State())
+
+	// When
+	assert.Nil(t, mongo.ResetDiscordMessageState(context.Background(), id))
+
+	// Then
+	message, err = mongo.GetDiscordMessageById(context.Background(), id)
+	assert.Nil(t, err)
+	assert.False(t, message.Cancelled())
+	assert.Equal(t, "", message.LastPublishError)
+	assert.Equal(t, db.MessageStatePending, message.State())
+}
+
+func Test_ItUncancelsAMessageWhenANewVersionIsPublished(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	id := writeTestMessage(t, mongo, "1")
+	assert.Nil(t, mongo.CancelDiscordMessage(context.Background(), id))
+
+	// When
+	assert.Nil(t, mongo.PublishMessageVersion(context.Background(), "2", db.Caller{}, &pb.UpdateRequest{Id: id, Content: "Hello again!"}, db.ExpectedVersion{}))
+
+	// Then
+	message, err := mongo.GetDiscordMessageById(context.Background(), id)
+	assert.Nil(t, err)
+	assert.False(t, message.Cancelled())
+}
+
+func Test_ItDoesNotChangeTheStateOfAMissingMessage(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	// Then
+	assert.ErrorContains(t, mongo.CancelDiscordMessage(context.Background(), "5f9f1b9b9c9d9b9b9c9d9b9b"), "message not found")
+	assert.ErrorContains(t, mongo.ResetDiscordMessageState(context.Background(), "5f9f1b9b9c9d9b9b9c9d9b9b"), "message not found")
+	assert.NotNil(t, mongo.RecordPublishError(context.Background(), "invalid", "error"))
+}
+
+func Test_ItGetsTheFailedMessageIds(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	failed := writeTestMessage(t, mongo, "1")
+	cancelled := writeTestMessage(t, mongo, "2")
+	writeTestMessage(t, mongo, "3")
+	assert.Nil(t, mongo.RecordPublishError(context.Background(), failed, "HTTP 403 Forbidden"))
+	assert.Nil(t, mongo.RecordPublishError(context.Background(), cancelled, "HTTP 403 Forbidden"))
+	assert.Nil(t, mongo.CancelDiscordMessage(context.Background(), cancelled))
+
+	// When
+	ids, err := mongo.GetFailedDiscordMessageIds(context.Background())
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []string{failed}, ids)
+}
+
+func Test_ItResetsAMessageToBeRepublished(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	id := writeTestMessage(t, mongo, "1")
+	assert.Nil(t, mongo.UpdateMessageWithDiscordIdAndLastPublishRequest(context.Background(), id, "456", "1"))
+
+	// When
+	assert.Nil(t, mongo.ResetDiscordMessageForRepublish(context.Background(), id))
+
+	// Then
+	message, err := mongo.GetDiscordMessageById(context.Background(), id)
+	assert.Nil(t, err)
+	assert.Equal(t, "", message.DiscordId)
+	assert.Equal(t, "", message.LastClientRequestPublished)
+	assert.Equal(t, db.MessageStatePending, message.State())
+}
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"context"
+	"ecfmp/discord/internal/metrics"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+/**
+ * newMetricsMonitor creates a command monitor that records how long each Mongo command takes, and logs
+ * each command at TRACE so that the db subsystem can be debugged at runtime.
+ */
+func newMetricsMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, succeeded *event.CommandSucceededEvent) {
+			metrics.MongoOperationDuration.WithLabelValues(succeeded.CommandName, "success").Observe(succeeded.Duration.Seconds())
+			dbLog.WithFields(log.Fields{"command": succeeded.CommandName, "latency_ms": succeeded.Duration.Milliseconds()}).Trace("Mongo command succeeded")
+		},
+		Failed: func(_ context.Context, failed *event.CommandFailedEvent) {
+			metrics.MongoOperationDuration.WithLabelValues(failed.CommandName, "error").Observe(failed.Duration.Seconds())
+			dbLog.WithFields(log.Fields{"command": failed.CommandName, "latency_ms": failed.Duration.Milliseconds()}).Tracef("Mongo command failed: %v", failed.Failure)
+		},
+	}
+}
@@ -0,0 +1,225 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+ * A mongoMigration is a change to the indexes or documents in mongo. Mongo can't apply a migration and record
+ * it atomically, and several instances may start at once, so every migration must be safe to apply again.
+ */
+type mongoMigration struct {
+	description string
+	apply       func(ctx context.Context, database *mongo.Database) error
+}
+
+/**
+ * The changes to mongo, in the order they are applied. Each is applied once and recorded in schema_migrations.
+ * Never change a migration that has been released, add a new one instead.
+ */
+var mongoMigrations = []mongoMigration{
+	// 1
+	{
+		description: "client request ids are unique across messages",
+		apply: func(ctx context.Context, database *mongo.Database) error {
+			return createIndex(ctx, database.Collection("discord_messages"), "versions_client_request_id", bson.M{"versions.client_request_id": 1}, true)
+		},
+	},
+
+	// 2
+	{
+		description: "api keys are looked up by their hash, which is unique",
+		apply: func(ctx context.Context, database *mongo.Database) error {
+			return createIndex(ctx, database.Collection("api_keys"), "hash", bson.M{"hash": 1}, true)
+		},
+	},
+
+	// 3
+	{
+		description: "messages expire by when they were last active, rather than by a ttl index on when they were created",
+		apply: func(ctx context.Context, database *mongo.Database) error {
+			collection := database.Collection("discord_messages")
+			if err := dropIndexIfExists(ctx, collection, "created_at"); err != nil {
+				return err
+			}
+
+			// Messages were last active when they were last published, or failed to be, if not when they were created
+			_, err := collection.UpdateMany(
+				ctx,
+				bson.M{"last_activity_at": bson.M{"$exists": false}},
+				bson.A{bson.M{"$set": bson.M{"last_activity_at": bson.M{"$ifNull": bson.A{"$last_publish_attempt_at", "$created_at"}}}}},
+			)
+			if err != nil {
+				return err
+			}
+
+			return createIndex(ctx, collection, "last_activity_at", bson.M{"last_activity_at": 1}, false)
+		},
+	},
+
+	// 4
+	{
+		description: "versions written before payloads were hashed have their payload hash",
+		apply:       backfillPayloadHashes,
+	},
+}
+
+/**
+ * AppliedMigration records that a migration has been applied.
+ */
+type AppliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+/**
+ * Returns what the migration with the given version does.
+ */
+func MongoMigrationDescription(version int) string {
+	if version < 1 || version > len(mongoMigrations) {
+		return ""
+	}
+
+	return mongoMigrations[version-1].description
+}
+
+/**
+ * Brings mongo up to date, applying any migrations that haven't been applied yet, and returns the versions it
+ * applied.
+ */
+func migrateMongo(ctx context.Context, database *mongo.Database) ([]int, error) {
+	pending, err := pendingMongoMigrations(ctx, database)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := database.Collection("schema_migrations")
+	for _, version := range pending {
+		migration := mongoMigrations[version-1]
+		if err := migration.apply(ctx, database); err != nil {
+			return nil, fmt.Errorf("failed to apply migration %v: %w", version, err)
+		}
+
+		// Another instance may have applied it at the same time, which is just as good
+		_, err := collection.InsertOne(ctx, AppliedMigration{Version: version, Description: migration.description, AppliedAt: time.Now()})
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("failed to record migration %v: %w", version, err)
+		}
+
+		dbLog.Infof("Applied mongo migration %v: %v", version, migration.description)
+	}
+
+	return pending, nil
+}
+
+/**
+ * Returns the versions of the migrations that haven't been applied yet, in the order they should be applied.
+ */
+func pendingMongoMigrations(ctx context.Context, database *mongo.Database) ([]int, error) {
+	cursor, err := database.Collection("schema_migrations").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []AppliedMigration
+	if err := cursor.All(ctx, &applied); err != nil {
+		return nil, err
+	}
+
+	isApplied := make(map[int]bool, len(applied))
+	for _, migration := range applied {
+		if migration.Version > len(mongoMigrations) {
+			return nil, fmt.Errorf("database schema has migration %v, newer than this service knows about (%v)", migration.Version, len(mongoMigrations))
+		}
+
+		isApplied[migration.Version] = true
+	}
+
+	pending := make([]int, 0)
+	for version := 1; version <= len(mongoMigrations); version++ {
+		if !isApplied[version] {
+			pending = append(pending, version)
+		}
+	}
+
+	return pending, nil
+}
+
+/**
+ * Creates the index with the given name, which does nothing if it already exists.
+ */
+func createIndex(ctx context.Context, collection *mongo.Collection, name string, keys bson.M, unique bool) error {
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: options.Index().SetUnique(unique).SetName(name)})
+	return err
+}
+
+// The error codes mongo returns when dropping an index that, or whose collection, doesn't exist
+const (
+	namespaceNotFound = 26
+	indexNotFound     = 27
+)
+
+/**
+ * Drops the index with the given name, if there is one.
+ */
+func dropIndexIfExists(ctx context.Context, collection *mongo.Collection, name string) error {
+	_, err := collection.Indexes().DropOne(ctx, name)
+
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && (commandErr.Code == namespaceNotFound || commandErr.Code == indexNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+/**
+ * Hashes the payload of every version that doesn't have its hash, so that retried requests are recognised
+ * without hashing old versions each time.
+ */
+func backfillPayloadHashes(ctx context.Context, database *mongo.Database) error {
+	collection := database.Collection("discord_messages")
+	cursor, err := collection.Find(
+		ctx,
+		bson.M{"versions": bson.M{"$elemMatch": bson.M{"payload_hash": bson.M{"$in": bson.A{nil, ""}}}}},
+		options.Find().SetProjection(bson.M{"versions": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var message DiscordMessage
+		if err := cursor.Decode(&message); err != nil {
+			return err
+		}
+
+		hashes := bson.M{}
+		for i := range message.Versions {
+			if message.Versions[i].PayloadHash == "" {
+				hashes[fmt.Sprintf("versions.%v.payload_hash", i)] = message.Versions[i].Hash()
+			}
+		}
+
+		objectId, err := parseId(message.Id)
+		if err != nil {
+			return err
+		}
+
+		// Versions are only ever appended, so the positions still match if another version has been published since
+		if _, err := collection.UpdateByID(ctx, objectId, bson.M{"$set": hashes}); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
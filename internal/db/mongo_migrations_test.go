@@ -0,0 +1,185 @@
+package db_test
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongo_driver "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func Test_ItRecordsEveryMongoMigration(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// When
+	applied, err := db.MigrateMongo(testMongoConfig(t))
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4}, applied)
+
+	recorded, pending, err := db.MongoMigrationStatus(testMongoConfig(t))
+	assert.Nil(t, err)
+	assert.Empty(t, pending)
+	assert.Equal(t, 4, len(recorded))
+	assert.Equal(t, 1, recorded[0].Version)
+	assert.NotEmpty(t, recorded[0].Description)
+	assert.WithinDuration(t, time.Now(), recorded[0].AppliedAt, 5*time.Second)
+}
+
+func Test_ItOnlyAppliesMongoMigrationsOnce(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	_, err := db.MigrateMongo(testMongoConfig(t))
+	assert.Nil(t, err)
+
+	// When
+	applied, err := db.MigrateMongo(testMongoConfig(t))
+
+	// Then
+	assert.Nil(t, err)
+	assert.Empty(t, applied)
+}
+
+func Test_ItReappliesMongoMigrationsThatWerentRecorded(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given the migrations were applied, but not recorded
+	_, err := db.MigrateMongo(testMongoConfig(t))
+	assert.Nil(t, err)
+
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	assert.Nil(t, err)
+	defer mongo.Disconnect()
+	mongo.Client.Database(os.Getenv("MONGO_DB")).Collection("schema_migrations").Drop(context.Background())
+
+	// When
+	applied, err := db.MigrateMongo(testMongoConfig(t))
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4}, applied)
+}
+
+func Test_ItDoesntStartWithoutMigratingIfMigrationsAreMissing(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	testConfig := testMongoConfig(t)
+	testConfig.MigrateOnStartup = false
+
+	// When
+	mongo, err := db.NewMongo(testConfig)
+
+	// Then
+	assert.Nil(t, mongo)
+	assert.ErrorContains(t, err, "run ecfmp-discord migrate")
+
+	// Once migrated
+	_, err = db.MigrateMongo(testConfig)
+	assert.Nil(t, err)
+
+	mongo, err = db.NewMongo(testConfig)
+	assert.Nil(t, err)
+	mongo.Disconnect()
+}
+
+func Test_ItDoesntStartIfMongoHasNewerMigrations(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	_, err := db.MigrateMongo(testMongoConfig(t))
+	assert.Nil(t, err)
+
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	assert.Nil(t, err)
+	defer mongo.Disconnect()
+	_, err = mongo.Client.Database(os.Getenv("MONGO_DB")).Collection("schema_migrations").InsertOne(
+		context.Background(),
+		db.AppliedMigration{Version: 1000, Description: "from the future", AppliedAt: time.Now()},
+	)
+	assert.Nil(t, err)
+
+	// When
+	_, err = db.MigrateMongo(testMongoConfig(t))
+
+	// Then
+	assert.ErrorContains(t, err, "newer than this service knows about")
+}
+
+func Test_ItBackfillsMessagesWrittenBeforeTheirStateWasRecorded(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given messages written before activity and payload hashes were recorded, and the ttl index they were
+	// deleted by
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	assert.Nil(t, err)
+	defer mongo.Disconnect()
+
+	database := mongo.Client.Database(os.Getenv("MONGO_DB"))
+	database.Collection("schema_migrations").Drop(context.Background())
+	database.Collection("discord_messages").Drop(context.Background())
+
+	createdAt := time.Now().Add(-2 * time.Hour)
+	publishedAt := time.Now().Add(-time.Hour)
+	unpublished, published := primitive.NewObjectID(), primitive.NewObjectID()
+	_, err = database.Collection("discord_messages").InsertMany(context.Background(), []interface{}{
+		bson.M{
+			"_id":        unpublished,
+			"channel":    "123",
+			"versions":   bson.A{bson.M{"client_request_id": "1", "content": "Hello World!", "embeds": bson.A{}, "created_at": createdAt}},
+			"created_at": createdAt,
+		},
+		bson.M{
+			"_id":                     published,
+			"channel":                 "123",
+			"versions":                bson.A{bson.M{"client_request_id": "2", "content": "Hello World!", "embeds": bson.A{}, "created_at": createdAt}},
+			"created_at":              createdAt,
+			"last_publish_attempt_at": publishedAt,
+		},
+	})
+	assert.Nil(t, err)
+
+	_, err = database.Collection("discord_messages").Indexes().CreateOne(
+		context.Background(),
+		mongo_driver.IndexModel{Keys: bson.M{"created_at": 1}, Options: options.Index().SetName("created_at").SetExpireAfterSeconds(7 * 24 * 60 * 60)},
+	)
+	assert.Nil(t, err)
+
+	// When
+	_, err = db.MigrateMongo(testMongoConfig(t))
+
+	// Then
+	assert.Nil(t, err)
+
+	message, _ := mongo.GetDiscordMessageById(context.Background(), unpublished.Hex())
+	assert.WithinDuration(t, createdAt, message.LastActivityAt, time.Millisecond)
+	assert.Equal(t, db.PayloadHash("Hello World!", []db.DiscordEmbed{}), message.Versions[0].PayloadHash)
+
+	message, _ = mongo.GetDiscordMessageById(context.Background(), published.Hex())
+	assert.WithinDuration(t, publishedAt, message.LastActivityAt, time.Millisecond)
+
+	indexes, err := database.Collection("discord_messages").Indexes().ListSpecifications(context.Background())
+	assert.Nil(t, err)
+
+	names := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		names = append(names, index.Name)
+	}
+	assert.NotContains(t, names, "created_at")
+	assert.Contains(t, names, "last_activity_at")
+	assert.Contains(t, names, "versions_client_request_id")
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"ecfmp/discord/internal/tracing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+ * Saves the ids of messages that were waiting to be published, so that they can be published later.
+ * Saving an id that is already saved has no effect.
+ */
+func (m *Mongo) SaveQueuedMessageIds(ctx context.Context, ids []string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.SaveQueuedMessageIds")
+	defer endOperation(span, &err)
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	collection := m.Client.Database(m.database).Collection("queued_messages")
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	writes := make([]mongo.WriteModel, 0, len(ids))
+	for _, id := range ids {
+		writes = append(
+			writes,
+			mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": id}).
+				SetUpdate(bson.M{"$setOnInsert": QueuedMessage{MessageId: id, QueuedAt: time.Now()}}).
+				SetUpsert(true),
+		)
+	}
+
+	_, err = collection.BulkWrite(ctx, writes)
+	return err
+}
+
+/**
+ * Takes the ids of the messages that were saved as waiting to be published, oldest first,
+ * removing them so that they are only taken once.
+ */
+func (m *Mongo) TakeQueuedMessageIds(ctx context.Context) (ids []string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.TakeQueuedMessageIds")
+	defer endOperation(span, &err)
+
+	collection := m.Client.Database(m.database).Collection("queued_messages")
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"queued_at": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var queued []QueuedMessage
+	if err := cursor.All(ctx, &queued); err != nil {
+		return nil, err
+	}
+
+	ids = make([]string, 0, len(queued))
+	for _, message := range queued {
+		ids = append(ids, message.MessageId)
+	}
+
+	if len(ids) == 0 {
+		return ids, nil
+	}
+
+	if _, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,53 @@
+package db_test
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ItSavesAndTakesQueuedMessageIds(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	// When
+	assert.Nil(t, mongo.SaveQueuedMessageIds(context.Background(), []string{"1", "2"}))
+	assert.Nil(t, mongo.SaveQueuedMessageIds(context.Background(), []string{"2", "3"}))
+
+	// Then
+	ids, err := mongo.TakeQueuedMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"1", "2", "3"}, ids)
+
+	// They can only be taken once
+	ids, err = mongo.TakeQueuedMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+}
+
+func Test_ItSavesNoQueuedMessageIds(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	// When
+	assert.Nil(t, mongo.SaveQueuedMessageIds(context.Background(), []string{}))
+
+	// Then
+	ids, err := mongo.TakeQueuedMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"context"
+	"ecfmp/discord/internal/tracing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+ * Archives and deletes the messages that haven't been active for the ttl, and aren't marked active, returning
+ * how many were deleted.
+ */
+func (m *Mongo) DeleteExpiredMessages(ctx context.Context) (deleted int64, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Mongo.DeleteExpiredMessages")
+	defer endOperation(span, &err)
+
+	return expireMessages(ctx, m, m.archiver, time.Now().Add(-m.ttl))
+}
+
+func (m *Mongo) findExpiredMessages(ctx context.Context, cutoff time.Time, limit int) ([]DiscordMessage, error) {
+	collection := m.Client.Database(m.database).Collection("discord_messages")
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, expiredFilter(cutoff), options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]DiscordMessage, 0)
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (m *Mongo) deleteExpiredMessages(ctx context.Context, ids []string, cutoff time.Time) (int64, error) {
+	collection := m.Client.Database(m.database).Collection("discord_messages")
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	objectIds := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		objectId, err := parseId(id)
+		if err != nil {
+			return 0, err
+		}
+
+		objectIds = append(objectIds, objectId)
+	}
+
+	filter := expiredFilter(cutoff)
+	filter["_id"] = bson.M{"$in": objectIds}
+	result, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
+
+/**
+ * Matches the messages that haven't been active since the cutoff, and aren't marked active.
+ */
+func expiredFilter(cutoff time.Time) bson.M {
+	return bson.M{
+		"active":           bson.M{"$ne": true},
+		"last_activity_at": bson.M{"$lt": cutoff},
+	}
+}
+
+/**
+ * mongoArchiver copies expired messages to an archive collection, replacing any earlier copy of the same
+ * message.
+ */
+type mongoArchiver struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+}
+
+func (archiver mongoArchiver) archive(ctx context.Context, messages []DiscordMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, archiver.timeout)
+	defer cancel()
+
+	now := time.Now()
+	writes := make([]mongo.WriteModel, 0, len(messages))
+	for _, message := range messages {
+		objectId, err := parseId(message.Id)
+		if err != nil {
+			return err
+		}
+
+		// The id is set by the filter, as an ObjectId rather than the string it is decoded as
+		archived := ArchivedDiscordMessage{DiscordMessage: message, ArchivedAt: now}
+		archived.Id = ""
+		writes = append(writes, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": objectId}).SetReplacement(archived).SetUpsert(true))
+	}
+
+	_, err := archiver.collection.BulkWrite(ctx, writes)
+	return err
+}
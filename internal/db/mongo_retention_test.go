@@ -0,0 +1,62 @@
+package db_test
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func Test_ItArchivesAndDeletesExpiredMongoMessages(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	testConfig := testMongoConfig(t)
+	testConfig.MessageTtl = 100 * time.Millisecond
+	testConfig.Archive = "collection"
+	mongo, err := db.NewMongo(testConfig)
+	if err != nil {
+		t.Errorf("Failed to connect to mongo: %v", err)
+	}
+
+	inactive := writeStoreMessage(t, mongo, "1")
+	active := writeStoreMessage(t, mongo, "2")
+	assert.Nil(t, mongo.SetDiscordMessageActive(context.Background(), active, true))
+
+	time.Sleep(150 * time.Millisecond)
+	recent := writeStoreMessage(t, mongo, "3")
+
+	// When
+	deleted, err := mongo.DeleteExpiredMessages(context.Background())
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	for _, id := range []string{inactive} {
+		message, _ := mongo.GetDiscordMessageById(context.Background(), id)
+		assert.Nil(t, message)
+	}
+
+	for _, id := range []string{active, recent} {
+		message, _ := mongo.GetDiscordMessageById(context.Background(), id)
+		assert.NotNil(t, message)
+	}
+
+	var archived db.ArchivedDiscordMessage
+	objectId, _ := primitive.ObjectIDFromHex(inactive)
+	err = mongo.Client.Database(os.Getenv("MONGO_DB")).Collection("discord_messages_archive").FindOne(context.Background(), bson.M{"_id": objectId}).Decode(&archived)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", archived.LatestVersion().ClientRequestId)
+	assert.WithinDuration(t, time.Now(), archived.ArchivedAt, time.Second)
+
+	count, err := mongo.Client.Database(os.Getenv("MONGO_DB")).Collection("discord_messages_archive").CountDocuments(context.Background(), bson.M{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+}
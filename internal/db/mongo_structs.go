@@ -1,7 +1,10 @@
 package db
 
 import (
+	"crypto/sha256"
 	pb "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
+	"encoding/hex"
+	"encoding/json"
 	"time"
 
 	discordgo "github.com/bwmarrin/discordgo"
@@ -104,6 +107,17 @@ func DiscordEmbedToMongo(embeds *[]*pb.DiscordEmbeds) []DiscordEmbed {
 	return result
 }
 
+/**
+ * Caller is a struct that represents who made the request that created a Discord Message Version.
+ */
+type Caller struct {
+	Subject   string `bson:"subject,omitempty"`
+	Name      string `bson:"name,omitempty"`
+	ClientId  string `bson:"client_id,omitempty"`
+	IpAddress string `bson:"ip_address,omitempty"`
+	UserAgent string `bson:"user_agent,omitempty"`
+}
+
 /**
  * DiscordMessageVersion is a struct that represents a version of a Discord Message.
  */
@@ -111,9 +125,58 @@ type DiscordMessageVersion struct {
 	ClientRequestId string         `bson:"client_request_id"`
 	Content         string         `bson:"content"`
 	Embeds          []DiscordEmbed `bson:"embeds"`
+	PayloadHash     string         `bson:"payload_hash,omitempty"`
+	CreatedBy       Caller         `bson:"created_by"`
 	CreatedAt       time.Time      `bson:"created_at"`
 }
 
+/**
+ * newVersion creates a version of a message from what a request asked to publish.
+ */
+func newVersion(clientRequestId string, caller Caller, content string, embeds *[]*pb.DiscordEmbeds) DiscordMessageVersion {
+	version := DiscordMessageVersion{
+		ClientRequestId: clientRequestId,
+		Content:         content,
+		Embeds:          DiscordEmbedToMongo(embeds),
+		CreatedBy:       caller,
+		CreatedAt:       time.Now(),
+	}
+	version.PayloadHash = PayloadHash(version.Content, version.Embeds)
+
+	return version
+}
+
+/**
+ * PayloadHash hashes what a request asked to publish, so that a retried request can be told apart from a
+ * different request reusing its client request id.
+ */
+func PayloadHash(content string, embeds []DiscordEmbed) string {
+	if embeds == nil {
+		embeds = []DiscordEmbed{}
+	}
+
+	// These types always marshal
+	payload, _ := json.Marshal(struct {
+		Content string
+		Embeds  []DiscordEmbed
+	}{content, embeds})
+
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+/**
+ * Hash returns the hash of the version's payload, hashing it now if the version was stored before payloads
+ * were hashed.
+ */
+func (d *DiscordMessageVersion) Hash() string {
+	if d.PayloadHash != "" {
+		return d.PayloadHash
+	}
+
+	return PayloadHash(d.Content, d.Embeds)
+}
+
 /**
  * MarshallToLibraryMessageSend converts a DiscordMessageVersion to a DiscordGo MessageSend for first
  * time publishing.
@@ -173,4 +236,133 @@ type DiscordMessage struct {
 	LastClientRequestPublished string                  `bson:"last_client_request_published"`
 	Versions                   []DiscordMessageVersion `bson:"versions"`
 	CreatedAt                  time.Time               `bson:"created_at"`
+	LastPublishError           string                  `bson:"last_publish_error,omitempty"`
+	LastPublishAttemptAt       time.Time               `bson:"last_publish_attempt_at,omitempty"`
+	CancelledAt                time.Time               `bson:"cancelled_at,omitempty"`
+
+	// When the message was last sent to discord as a new post, until we know whether discord accepted it. If
+	// publishing is interrupted, e.g. by shutdown, this is left set, as the post may be on discord already.
+	PublishingStartedAt time.Time `bson:"publishing_started_at,omitempty"`
+
+	// When the message was last written or published, which it is kept for the ttl after
+	LastActivityAt time.Time `bson:"last_activity_at,omitempty"`
+
+	// Active messages, such as those for a flow measure that is still in force, are kept however long ago
+	// they were last active
+	Active bool `bson:"active,omitempty"`
+}
+
+// The publish states of a message, as shown on the admin dashboard
+const (
+	MessageStatePending   = "pending"
+	MessageStatePublished = "published"
+	MessageStateFailed    = "failed"
+	MessageStateCancelled = "cancelled"
+)
+
+/**
+ * LatestVersion returns the most recent version of the message, which is the one that should be published.
+ */
+func (d *DiscordMessage) LatestVersion() *DiscordMessageVersion {
+	if len(d.Versions) == 0 {
+		return nil
+	}
+
+	return &d.Versions[len(d.Versions)-1]
+}
+
+/**
+ * Version returns the version of the message created by the client request id, or nil if there isn't one.
+ */
+func (d *DiscordMessage) Version(clientRequestId string) *DiscordMessageVersion {
+	for i := range d.Versions {
+		if d.Versions[i].ClientRequestId == clientRequestId {
+			return &d.Versions[i]
+		}
+	}
+
+	return nil
+}
+
+/**
+ * LastActiveAt returns when the message was last written or published. Messages written before this was
+ * recorded were last active when they were created, as far as is known.
+ */
+func (d *DiscordMessage) LastActiveAt() time.Time {
+	if d.LastActivityAt.IsZero() {
+		return d.CreatedAt
+	}
+
+	return d.LastActivityAt
+}
+
+/**
+ * Cancelled returns whether publishing the message has been cancelled.
+ */
+func (d *DiscordMessage) Cancelled() bool {
+	return !d.CancelledAt.IsZero()
+}
+
+/**
+ * MayBeOnDiscord returns whether publishing the message as a new post was interrupted, so that it may or may
+ * not be on discord, and it can't be posted again without risking posting it twice.
+ */
+func (d *DiscordMessage) MayBeOnDiscord() bool {
+	return d.DiscordId == "" && !d.PublishingStartedAt.IsZero()
+}
+
+/**
+ * State returns whether the latest version of the message has been published, is waiting to be published,
+ * failed the last time it was published or has been cancelled.
+ */
+func (d *DiscordMessage) State() string {
+	latest := d.LatestVersion()
+	switch {
+	case latest != nil && d.LastClientRequestPublished == latest.ClientRequestId:
+		return MessageStatePublished
+	case d.Cancelled():
+		return MessageStateCancelled
+	case d.LastPublishError != "":
+		return MessageStateFailed
+	default:
+		return MessageStatePending
+	}
+}
+
+/**
+ * ApiKey is a struct that represents an API key that may be used instead of a JWT to authenticate.
+ * Only the hash of the key is stored.
+ */
+type ApiKey struct {
+	Id         string    `bson:"_id,omitempty" json:"id"`
+	Name       string    `bson:"name" json:"name"`
+	Hash       string    `bson:"hash" json:"hash"`
+	Scopes     []string  `bson:"scopes" json:"scopes"`
+	ExpiresAt  time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	RevokedAt  time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+}
+
+/**
+ * Expired returns whether the key has passed its expiry time, if it has one.
+ */
+func (k *ApiKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt)
+}
+
+/**
+ * Revoked returns whether the key has been revoked.
+ */
+func (k *ApiKey) Revoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+/**
+ * QueuedMessage is a message that was waiting to be published when the service shut down,
+ * so that it can be published when the service starts again.
+ */
+type QueuedMessage struct {
+	MessageId string    `bson:"_id"`
+	QueuedAt  time.Time `bson:"queued_at"`
 }
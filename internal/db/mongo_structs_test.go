@@ -0,0 +1,40 @@
+package db_test
+
+import (
+	db "ecfmp/discord/internal/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ItHashesTheSamePayloadTheSame(t *testing.T) {
+	embeds := []db.DiscordEmbed{{Title: "Title", Fields: []db.DiscordEmbedField{{Name: "Name", Value: "Value"}}}}
+	sameEmbeds := []db.DiscordEmbed{{Title: "Title", Fields: []db.DiscordEmbedField{{Name: "Name", Value: "Value"}}}}
+
+	assert.Equal(t, db.PayloadHash("Hello", embeds), db.PayloadHash("Hello", sameEmbeds))
+	assert.Equal(t, db.PayloadHash("Hello", nil), db.PayloadHash("Hello", []db.DiscordEmbed{}))
+}
+
+func Test_ItHashesDifferentPayloadsDifferently(t *testing.T) {
+	embeds := []db.DiscordEmbed{{Title: "Title", Fields: []db.DiscordEmbedField{{Name: "Name", Value: "Value"}}}}
+	otherEmbeds := []db.DiscordEmbed{{Title: "Title", Fields: []db.DiscordEmbedField{{Name: "Name", Value: "Other"}}}}
+
+	assert.NotEqual(t, db.PayloadHash("Hello", embeds), db.PayloadHash("Goodbye", embeds))
+	assert.NotEqual(t, db.PayloadHash("Hello", embeds), db.PayloadHash("Hello", otherEmbeds))
+	assert.NotEqual(t, db.PayloadHash("Hello", embeds), db.PayloadHash("Hello", nil))
+}
+
+func Test_ItHashesVersionsStoredWithoutAHash(t *testing.T) {
+	hashed := db.DiscordMessageVersion{Content: "Hello", PayloadHash: "abc"}
+	unhashed := db.DiscordMessageVersion{Content: "Hello"}
+
+	assert.Equal(t, "abc", hashed.Hash())
+	assert.Equal(t, db.PayloadHash("Hello", nil), unhashed.Hash())
+}
+
+func Test_ItGetsTheVersionForAClientRequestId(t *testing.T) {
+	message := db.DiscordMessage{Versions: []db.DiscordMessageVersion{{ClientRequestId: "1"}, {ClientRequestId: "2"}}}
+
+	assert.Equal(t, "2", message.Version("2").ClientRequestId)
+	assert.Nil(t, message.Version("3"))
+}
@@ -2,6 +2,7 @@ package db_test
 
 import (
 	"context"
+	"ecfmp/discord/internal/config"
 	db "ecfmp/discord/internal/db"
 	pb "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
 	"os"
@@ -13,33 +14,68 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+/**
+ * The mongo config for the test database, taken from the environment as in CI.
+ */
+func testMongoConfig(t *testing.T) config.Mongo {
+	testConfig, err := config.Load(nil)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	return testConfig.Mongo
+}
+
 func SetupTest(t *testing.T) func(tb testing.TB) {
 
-	mongo, err := db.NewMongo()
+	mongo, err := db.NewMongo(testMongoConfig(t))
 	if err != nil {
 		t.Errorf("Failed to connect to mongo: %v", err)
 	}
 
 	mongo.Client.Database(os.Getenv("MONGO_DB")).Collection("discord_messages").Drop(context.Background())
+	mongo.Client.Database(os.Getenv("MONGO_DB")).Collection("api_keys").Drop(context.Background())
+	mongo.Client.Database(os.Getenv("MONGO_DB")).Collection("queued_messages").Drop(context.Background())
+	mongo.Client.Database(os.Getenv("MONGO_DB")).Collection("discord_messages_archive").Drop(context.Background())
+	mongo.Client.Database(os.Getenv("MONGO_DB")).Collection("schema_migrations").Drop(context.Background())
 
 	return func(tb testing.TB) {
 		mongo.Client.Disconnect(context.Background())
 	}
 }
 
+func Test_ItDisconnectsFromMongoTwice(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, err := db.NewMongo(testMongoConfig(t))
+	if err != nil {
+		t.Fatalf("Failed to connect to mongo: %v", err)
+	}
+
+	// When
+	assert.Nil(t, mongo.Disconnect())
+
+	// Then
+	assert.Nil(t, mongo.Disconnect())
+}
+
 func Test_ItWritesADiscordMessage(t *testing.T) {
 	teardown := SetupTest(t)
 	defer teardown(t)
 
 	// Given
-	mongo, err := db.NewMongo()
+	mongo, err := db.NewMongo(testMongoConfig(t))
 	if err != nil {
 		t.Errorf("Failed to connect to mongo: %v", err)
 	}
 
 	// When
 	id, err := mongo.WriteDiscordMessage(
+		context.Background(),
 		"1",
+		db.Caller{},
 		&pb.CreateRequest{
 			Channel: "123",
 			Content: "Hello World!",
@@ -104,16 +140,16 @@ func Test_ItGetsDiscordMessageByClientRequestId(t *testing.T) {
 	defer teardown(t)
 
 	// Given
-	mongo, err := db.NewMongo()
+	mongo, err := db.NewMongo(testMongoConfig(t))
 	if err != nil {
 		t.Errorf("Failed to connect to mongo: %v", err)
 	}
 
 	// When
-	messageId, _ := mongo.WriteDiscordMessage("1", &pb.CreateRequest{Content: "Hello World!"})
+	messageId, _ := mongo.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Content: "Hello World!"})
 
 	// Then
-	message, requestErr := mongo.GetDiscordMessageByClientRequestId("1")
+	message, requestErr := mongo.GetDiscordMessageByClientRequestId(context.Background(), "1")
 	assert.Nil(t, requestErr)
 	assert.Equal(t, messageId, message.Id)
 	assert.Equal(t, 1, len(message.Versions))
@@ -126,16 +162,16 @@ func Test_ItDoesntFindMessageByClientRequestId(t *testing.T) {
 	defer teardown(t)
 
 	// Given
-	mongo, err := db.NewMongo()
+	mongo, err := db.NewMongo(testMongoConfig(t))
 	if err != nil {
 		t.Errorf("Failed to connect to mongo: %v", err)
 	}
 
 	// When
-	mongo.WriteDiscordMessage("1", &pb.CreateRequest{Content: "Hello World!"})
+	mongo.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Content: "Hello World!"})
 
 	// Then
-	message, requestErr := mongo.GetDiscordMessageByClientRequestId("2")
+	message, requestErr := mongo.GetDiscordMessageByClientRequestId(context.Background(), "2")
 	assert.Nil(t, requestErr)
 	assert.Nil(t, message)
 }
@@ -145,16 +181,16 @@ func Test_ItGetsDiscordMessageById(t *testing.T) {
 	defer teardown(t)
 
 	// Given
-	mongo, err := db.NewMongo()
+	mongo, err := db.NewMongo(testMongoConfig(t))
 	if err != nil {
 		t.Errorf("Failed to connect to mongo: %v", err)
 	}
 
 	// When
-	messageId, _ := mongo.WriteDiscordMessage("1", &pb.CreateRequest{Content: "Hello World!"})
+	messageId, _ := mongo.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Content: "Hello World!"})
 
 	// Then
-	message, requestErr := mongo.GetDiscordMessageById(messageId)
+	message, requestErr := mongo.GetDiscordMessageById(context.Background(), messageId)
 	assert.Nil(t, requestErr)
 	assert.Equal(t, messageId, message.Id)
 }
@@ -164,16 +200,16 @@ func Test_ItDoesntFindMessageById(t *testing.T) {
 	defer teardown(t)
 
 	// Given
-	mongo, err := db.NewMongo()
+	mongo, err := db.NewMongo(testMongoConfig(t))
 	if err != nil {
 		t.Errorf("Failed to connect to mongo: %v", err)
 	}
 
 	// When
-	mongo.WriteDiscordMessage("1", &pb.CreateRequest{Content: "Hello World!"})
+	mongo.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Content: "Hello World!"})
 
 	// Then
-	message, requestErr := mongo.GetDiscordMessageById("65106dab41199f298668474f")
+	message, requestErr := mongo.GetDiscordMessageById(context.Background(), "65106dab41199f298668474f")
 	assert.Nil(t, requestErr)
 	assert.Nil(t, message)
 }
@@ -183,17 +219,18 @@ func Test_ItReturnsErrorFindingBadId(t *testing.T) {
 	defer teardown(t)
 
 	// Given
-	mongo, err := db.NewMongo()
+	mongo, err := db.NewMongo(testMongoConfig(t))
 	if err != nil {
 		t.Errorf("Failed to connect to mongo: %v", err)
 	}
 
 	// When
-	mongo.WriteDiscordMessage("1", &pb.CreateRequest{Content: "Hello World!"})
+	mongo.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Content: "Hello World!"})
 
 	// Then
-	_, requestErr := mongo.GetDiscordMessageById("abc")
-	assert.Equal(t, "the provided hex string is not a valid ObjectID", requestErr.Error())
+	_, requestErr := mongo.GetDiscordMessageById(context.Background(), "abc")
+	assert.ErrorIs(t, requestErr, db.ErrInvalidId)
+	assert.ErrorContains(t, requestErr, "the provided hex string is not a valid ObjectID")
 }
 
 func Test_ItUpdatesMessageById(t *testing.T) {
@@ -201,15 +238,17 @@ func Test_ItUpdatesMessageById(t *testing.T) {
 	defer teardown(t)
 
 	// Given
-	mongo, err := db.NewMongo()
+	mongo, err := db.NewMongo(testMongoConfig(t))
 	if err != nil {
 		t.Errorf("Failed to connect to mongo: %v", err)
 	}
 
 	// When
-	id, _ := mongo.WriteDiscordMessage("1", &pb.CreateRequest{Content: "Hello World!"})
+	id, _ := mongo.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Content: "Hello World!"})
 	publishErr := mongo.PublishMessageVersion(
+		context.Background(),
 		"another-request-id",
+		db.Caller{},
 		&pb.UpdateRequest{
 			Id:      id,
 			Content: "Hello Go!",
@@ -234,6 +273,7 @@ func Test_ItUpdatesMessageById(t *testing.T) {
 				},
 			},
 		},
+		db.ExpectedVersion{},
 	)
 	assert.Nil(t, publishErr)
 
@@ -268,14 +308,14 @@ func Test_ItReturnsErrorUpdatingNonExistentMessage(t *testing.T) {
 	defer teardown(t)
 
 	// Given
-	mongo, err := db.NewMongo()
+	mongo, err := db.NewMongo(testMongoConfig(t))
 	if err != nil {
 		t.Errorf("Failed to connect to mongo: %v", err)
 	}
 
 	// When
-	mongo.WriteDiscordMessage("1", &pb.CreateRequest{Content: "Hello World!"})
-	publishErr := mongo.PublishMessageVersion("another-request-id", &pb.UpdateRequest{Id: "65106dab41199f298668474f", Content: "Hello Go!"})
+	mongo.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Content: "Hello World!"})
+	publishErr := mongo.PublishMessageVersion(context.Background(), "another-request-id", db.Caller{}, &pb.UpdateRequest{Id: "65106dab41199f298668474f", Content: "Hello Go!"}, db.ExpectedVersion{})
 	assert.Equal(t, "message not found", publishErr.Error())
 }
 
@@ -284,15 +324,16 @@ func Test_ItReturnsErrorUpdatingBadId(t *testing.T) {
 	defer teardown(t)
 
 	// Given
-	mongo, err := db.NewMongo()
+	mongo, err := db.NewMongo(testMongoConfig(t))
 	if err != nil {
 		t.Errorf("Failed to connect to mongo: %v", err)
 	}
 
 	// When
-	mongo.WriteDiscordMessage("1", &pb.CreateRequest{Content: "Hello World!"})
-	publishErr := mongo.PublishMessageVersion("another-request-id", &pb.UpdateRequest{Id: "abc", Content: "Hello Go!"})
-	assert.Equal(t, "the provided hex string is not a valid ObjectID", publishErr.Error())
+	mongo.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Content: "Hello World!"})
+	publishErr := mongo.PublishMessageVersion(context.Background(), "another-request-id", db.Caller{}, &pb.UpdateRequest{Id: "abc", Content: "Hello Go!"}, db.ExpectedVersion{})
+	assert.ErrorIs(t, publishErr, db.ErrInvalidId)
+	assert.ErrorContains(t, publishErr, "the provided hex string is not a valid ObjectID")
 }
 
 func Test_ItUpdatesAMessageWithDiscordIdAndPublishedId(t *testing.T) {
@@ -300,16 +341,16 @@ func Test_ItUpdatesAMessageWithDiscordIdAndPublishedId(t *testing.T) {
 	defer teardown(t)
 
 	// Given
-	mongo, mongoErr := db.NewMongo()
+	mongo, mongoErr := db.NewMongo(testMongoConfig(t))
 	if mongoErr != nil {
 		t.Errorf("Failed to connect to mongo: %v", mongoErr)
 	}
 
 	// When
-	id, _ := mongo.WriteDiscordMessage("1", &pb.CreateRequest{Content: "Hello World!"})
-	publishErr := mongo.PublishMessageVersion("another-request-id", &pb.UpdateRequest{Id: id, Content: "Hello Go!"})
+	id, _ := mongo.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Content: "Hello World!"})
+	publishErr := mongo.PublishMessageVersion(context.Background(), "another-request-id", db.Caller{}, &pb.UpdateRequest{Id: id, Content: "Hello Go!"}, db.ExpectedVersion{})
 	assert.Nil(t, publishErr)
-	updateErr := mongo.UpdateMessageWithDiscordIdAndLastPublishRequest(id, "discord-id", "another-request-id")
+	updateErr := mongo.UpdateMessageWithDiscordIdAndLastPublishRequest(context.Background(), id, "discord-id", "another-request-id")
 	assert.Nil(t, updateErr)
 
 	// Then
@@ -326,16 +367,16 @@ func Test_ItUpdatesAMessageWithPublishedId(t *testing.T) {
 	defer teardown(t)
 
 	// Given
-	mongo, mongoErr := db.NewMongo()
+	mongo, mongoErr := db.NewMongo(testMongoConfig(t))
 	if mongoErr != nil {
 		t.Errorf("Failed to connect to mongo: %v", mongoErr)
 	}
 
 	// When
-	id, _ := mongo.WriteDiscordMessage("1", &pb.CreateRequest{Content: "Hello World!"})
-	publishErr := mongo.PublishMessageVersion("another-request-id", &pb.UpdateRequest{Id: id, Content: "Hello Go!"})
+	id, _ := mongo.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Content: "Hello World!"})
+	publishErr := mongo.PublishMessageVersion(context.Background(), "another-request-id", db.Caller{}, &pb.UpdateRequest{Id: id, Content: "Hello Go!"}, db.ExpectedVersion{})
 	assert.Nil(t, publishErr)
-	updateErr := mongo.UpdateMessageWithLastPublishRequest(id, "another-request-id")
+	updateErr := mongo.UpdateMessageWithLastPublishRequest(context.Background(), id, "another-request-id")
 	assert.Nil(t, updateErr)
 
 	// Then
@@ -346,6 +387,30 @@ func Test_ItUpdatesAMessageWithPublishedId(t *testing.T) {
 	assert.Equal(t, "another-request-id", result.LastClientRequestPublished)
 }
 
+func Test_ItRecordsTheCallerOnEachVersion(t *testing.T) {
+	teardown := SetupTest(t)
+	defer teardown(t)
+
+	// Given
+	mongo, mongoErr := db.NewMongo(testMongoConfig(t))
+	if mongoErr != nil {
+		t.Errorf("Failed to connect to mongo: %v", mongoErr)
+	}
+
+	// When
+	creator := db.Caller{Subject: "ecfmp-api", Name: "ECFMP API", IpAddress: "10.0.0.1", UserAgent: "grpc-go/1.58.3"}
+	updater := db.Caller{Subject: "ecfmp-worker", ClientId: "worker-1", IpAddress: "10.0.0.2"}
+	id, _ := mongo.WriteDiscordMessage(context.Background(), "1", creator, &pb.CreateRequest{Content: "Hello World!"})
+	publishErr := mongo.PublishMessageVersion(context.Background(), "another-request-id", updater, &pb.UpdateRequest{Id: id, Content: "Hello Go!"}, db.ExpectedVersion{})
+	assert.Nil(t, publishErr)
+
+	// Then
+	result, err := mongo.GetDiscordMessageById(context.Background(), id)
+	assert.Nil(t, err)
+	assert.Equal(t, creator, result.Versions[0].CreatedBy)
+	assert.Equal(t, updater, result.Versions[1].CreatedBy)
+}
+
 func Test_ItMarshallsDiscordEmbedFieldToLibrarySend(t *testing.T) {
 	// Given
 	embedField := &db.DiscordEmbedField{
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// How many expired messages are archived and deleted at a time
+const expiryBatchSize = 500
+
+/**
+ * ArchivedDiscordMessage is an expired message, as it was when it was archived.
+ */
+type ArchivedDiscordMessage struct {
+	DiscordMessage `bson:",inline"`
+	ArchivedAt     time.Time `bson:"archived_at"`
+}
+
+/**
+ * A messageArchiver keeps expired messages somewhere before they are deleted. Archiving the same message
+ * twice, e.g. because deleting it failed the first time, must not lose either copy.
+ */
+type messageArchiver interface {
+	archive(ctx context.Context, messages []DiscordMessage) error
+}
+
+/**
+ * An expiringStore is a store that expires messages itself, rather than relying on the database to.
+ */
+type expiringStore interface {
+	// Gets up to limit messages that haven't been active since the cutoff, and aren't marked active
+	findExpiredMessages(ctx context.Context, cutoff time.Time, limit int) ([]DiscordMessage, error)
+
+	// Deletes the messages with the ids that are still expired, returning how many were deleted
+	deleteExpiredMessages(ctx context.Context, ids []string, cutoff time.Time) (int64, error)
+}
+
+/**
+ * Archives and then deletes the messages that haven't been active since the cutoff, a batch at a time, returning
+ * how many were deleted. A message that becomes active again after being archived is archived but not deleted.
+ */
+func expireMessages(ctx context.Context, store expiringStore, archiver messageArchiver, cutoff time.Time) (int64, error) {
+	var deleted int64
+	for {
+		expired, err := store.findExpiredMessages(ctx, cutoff, expiryBatchSize)
+		if err != nil || len(expired) == 0 {
+			return deleted, err
+		}
+
+		if err := archiver.archive(ctx, expired); err != nil {
+			return deleted, fmt.Errorf("failed to archive expired messages: %w", err)
+		}
+
+		ids := make([]string, 0, len(expired))
+		for _, message := range expired {
+			ids = append(ids, message.Id)
+		}
+
+		deletedBatch, err := store.deleteExpiredMessages(ctx, ids, cutoff)
+		deleted += deletedBatch
+		if err != nil || len(expired) < expiryBatchSize || deletedBatch == 0 {
+			return deleted, err
+		}
+	}
+}
+
+/**
+ * Calls expire every interval until stop is closed, logging what it expired.
+ */
+func expireMessagesEvery(interval time.Duration, stop <-chan struct{}, expire func(ctx context.Context) (int64, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			deleted, err := expire(context.Background())
+			if err != nil {
+				dbLog.Errorf("Failed to expire messages: %v", err)
+				continue
+			}
+
+			dbLog.Debugf("Archived and deleted %v expired messages", deleted)
+		}
+	}
+}
+
+/**
+ * Returns the archiver for the kind of archive that isn't specific to a store.
+ */
+func newArchiver(kind string, dir string) (messageArchiver, error) {
+	switch kind {
+	case "none":
+		return noArchiver{}, nil
+	case "file":
+		return fileArchiver{dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown archive %v", kind)
+	}
+}
+
+/**
+ * noArchiver deletes expired messages without keeping them.
+ */
+type noArchiver struct{}
+
+func (noArchiver) archive(ctx context.Context, messages []DiscordMessage) error {
+	return nil
+}
+
+/**
+ * fileArchiver writes each batch of expired messages to a new gzipped file in the directory, one message per
+ * line in mongo's relaxed extended JSON, so that they can be read back with mongoimport if need be. Ids are
+ * written as ObjectIDs, as mongo stores them.
+ */
+type fileArchiver struct {
+	dir string
+}
+
+func (archiver fileArchiver) archive(ctx context.Context, messages []DiscordMessage) (err error) {
+	if err := os.MkdirAll(archiver.dir, 0o750); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	path := filepath.Join(archiver.dir, fmt.Sprintf("discord-messages-%v.jsonl.gz", now.Format("20060102T150405.000000000Z")))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+
+	// Don't leave a partial archive behind, the messages will be archived again on the next run
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	writer := gzip.NewWriter(file)
+	for _, message := range messages {
+		line, err := archiveLine(ArchivedDiscordMessage{DiscordMessage: message, ArchivedAt: now})
+		if err != nil {
+			return err
+		}
+
+		if _, err := writer.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+/**
+ * Marshals the message to extended JSON with its id as an ObjectID rather than the hex string it is held as.
+ */
+func archiveLine(message ArchivedDiscordMessage) ([]byte, error) {
+	objectId, err := parseId(message.Id)
+	if err != nil {
+		return nil, err
+	}
+	message.Id = ""
+
+	fields, err := bson.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	var document bson.D
+	if err := bson.Unmarshal(fields, &document); err != nil {
+		return nil, err
+	}
+
+	return bson.MarshalExtJSON(append(bson.D{{Key: "_id", Value: objectId}}, document...), false, false)
+}
@@ -0,0 +1,626 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"ecfmp/discord/internal/config"
+	"ecfmp/discord/internal/tracing"
+	pb "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+/**
+ * Sqlite stores messages in a single sqlite file, for running without mongo. Messages are archived and
+ * deleted once they haven't been active for the ttl by a job that runs every cleanup interval, as with mongo.
+ */
+type Sqlite struct {
+	db       *sql.DB
+	ttl      time.Duration
+	archiver messageArchiver
+
+	// How long each operation may take, unless the caller's deadline is sooner
+	timeout time.Duration
+
+	stopCleanup chan struct{}
+	cleanupDone sync.WaitGroup
+	stopOnce    sync.Once
+}
+
+const sqliteMessageColumns = `id, channel, discord_id, last_client_request_published, last_publish_error, last_publish_attempt_at, cancelled_at, created_at, last_activity_at, active, publishing_started_at`
+
+/**
+ * Opens the sqlite database, creating it if it doesn't exist, brings its schema up to date and starts
+ * expiring messages.
+ */
+func NewSqlite(config config.Sqlite) (*Sqlite, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	archiver, err := newArchiver(config.Archive, config.ArchiveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	database, err := sql.Open("sqlite", fmt.Sprintf("file:%v?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(wal)", config.Path))
+	if err != nil {
+		dbLog.Errorf("Failed to open sqlite: %v", err)
+		return nil, err
+	}
+
+	// Sqlite only allows one writer at a time, and a single connection also means that checking a client
+	// request id is unused and then using it can't race
+	database.SetMaxOpenConns(1)
+
+	if err := migrateSqlite(ctx, database); err != nil {
+		dbLog.Errorf("Failed to migrate sqlite: %v", err)
+		database.Close()
+		return nil, err
+	}
+
+	s := &Sqlite{
+		db:          database,
+		ttl:         config.MessageTtl,
+		archiver:    archiver,
+		timeout:     config.OperationTimeout,
+		stopCleanup: make(chan struct{}),
+	}
+
+	s.cleanupDone.Add(1)
+	go func() {
+		defer s.cleanupDone.Done()
+		expireMessagesEvery(config.CleanupInterval, s.stopCleanup, s.DeleteExpiredMessages)
+	}()
+
+	return s, nil
+}
+
+/**
+ * Write a discord message to the database, recording the caller that created it
+ */
+func (s *Sqlite) WriteDiscordMessage(ctx context.Context, clientRequestId string, caller Caller, message *pb.CreateRequest) (id string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.WriteDiscordMessage")
+	defer endOperation(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	id = primitive.NewObjectID().Hex()
+	err = s.transaction(ctx, func(tx *sql.Tx) error {
+		if err := checkClientRequestIdUnused(ctx, tx, clientRequestId); err != nil {
+			return err
+		}
+
+		now := time.Now().UnixMilli()
+		_, err := tx.ExecContext(ctx, `INSERT INTO discord_messages (id, channel, created_at, last_activity_at) VALUES (?, ?, ?, ?)`, id, message.Channel, now, now)
+		if err != nil {
+			return err
+		}
+
+		return insertVersion(ctx, tx, id, newVersion(clientRequestId, caller, message.Content, &message.Embeds))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+/**
+ * Publish a discord message to the database, recording the caller that created the version
+ */
+func (s *Sqlite) PublishMessageVersion(ctx context.Context, clientRequestId string, caller Caller, message *pb.UpdateRequest, expected ExpectedVersion) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.PublishMessageVersion")
+	defer endOperation(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if _, idErr := parseId(message.Id); idErr != nil {
+		return idErr
+	}
+
+	return s.transaction(ctx, func(tx *sql.Tx) error {
+		// A new version is published even if publishing the previous one was cancelled
+		result, err := tx.ExecContext(ctx, `UPDATE discord_messages SET cancelled_at = NULL, last_activity_at = ? WHERE id = ?`, time.Now().UnixMilli(), message.Id)
+		if err != nil {
+			return err
+		}
+
+		if updated, err := result.RowsAffected(); err != nil {
+			return err
+		} else if updated != 1 {
+			return ErrMessageNotFound
+		}
+
+		if err := checkClientRequestIdUnused(ctx, tx, clientRequestId); err != nil {
+			return err
+		}
+
+		var number int
+		var latestClientRequestId string
+		err = tx.QueryRowContext(ctx, `SELECT version, client_request_id FROM discord_message_versions WHERE message_id = ? ORDER BY version DESC LIMIT 1`, message.Id).Scan(&number, &latestClientRequestId)
+		if err != nil {
+			return err
+		}
+
+		if !expected.Matches(number, latestClientRequestId) {
+			return &VersionConflictError{CurrentVersion: number, CurrentClientRequestId: latestClientRequestId}
+		}
+
+		return insertVersion(ctx, tx, message.Id, newVersion(clientRequestId, caller, message.Content, &message.Embeds))
+	})
+}
+
+/**
+ * Update the message with the discord id and the last publish request id, so we avoid publishing the same message twice.
+ * Called when the message is published to discord for the first time.
+ */
+func (s *Sqlite) UpdateMessageWithDiscordIdAndLastPublishRequest(ctx context.Context, id string, discordId string, requestId string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.UpdateMessageWithDiscordIdAndLastPublishRequest")
+	defer endOperation(span, &err)
+
+	now := time.Now().UnixMilli()
+	return s.updateMessage(ctx, id, `discord_id = ?, last_client_request_published = ?, last_publish_attempt_at = ?, last_publish_error = '', publishing_started_at = NULL, last_activity_at = ?`, discordId, requestId, now, now)
+}
+
+/**
+ * Update the message with the last publish request id, so we avoid publishing the same message twice.
+ * Called when the message is published to discord for subsequent times.
+ */
+func (s *Sqlite) UpdateMessageWithLastPublishRequest(ctx context.Context, id string, requestId string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.UpdateMessageWithLastPublishRequest")
+	defer endOperation(span, &err)
+
+	now := time.Now().UnixMilli()
+	return s.updateMessage(ctx, id, `last_client_request_published = ?, last_publish_attempt_at = ?, last_publish_error = '', last_activity_at = ?`, requestId, now, now)
+}
+
+/**
+ * Marks whether the message is active, so that it is kept however long ago it was last active.
+ */
+func (s *Sqlite) SetDiscordMessageActive(ctx context.Context, id string, active bool) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.SetDiscordMessageActive")
+	defer endOperation(span, &err)
+
+	return s.updateMessage(ctx, id, `active = ?, last_activity_at = ?`, active, time.Now().UnixMilli())
+}
+
+/**
+ * Gets a discord message by id, or nil if there isn't one.
+ */
+func (s *Sqlite) GetDiscordMessageById(ctx context.Context, id string) (message *DiscordMessage, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.GetDiscordMessageById")
+	defer endOperation(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if _, idErr := parseId(id); idErr != nil {
+		return nil, idErr
+	}
+
+	return s.getMessage(ctx, `SELECT `+sqliteMessageColumns+` FROM discord_messages WHERE id = ?`, id)
+}
+
+/**
+ * Gets the discord message that has a version with the client request id, or nil if there isn't one.
+ */
+func (s *Sqlite) GetDiscordMessageByClientRequestId(ctx context.Context, clientRequestId string) (message *DiscordMessage, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.GetDiscordMessageByClientRequestId")
+	defer endOperation(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return s.getMessage(ctx, `SELECT `+sqliteMessageColumns+` FROM discord_messages WHERE id = (SELECT message_id FROM discord_message_versions WHERE client_request_id = ? LIMIT 1)`, clientRequestId)
+}
+
+/**
+ * Gets the most recently created messages, newest first, for the admin dashboard.
+ */
+func (s *Sqlite) GetRecentDiscordMessages(ctx context.Context, limit int64) (messages []DiscordMessage, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.GetRecentDiscordMessages")
+	defer endOperation(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	// As with mongo, a limit of zero means no limit, as does a negative limit to sqlite
+	if limit == 0 {
+		limit = -1
+	}
+
+	return s.queryMessages(ctx, `SELECT `+sqliteMessageColumns+` FROM discord_messages ORDER BY created_at DESC, rowid DESC LIMIT ?`, limit)
+}
+
+/**
+ * Gets the ids of the messages whose last publish failed, and that haven't been cancelled, oldest first.
+ */
+func (s *Sqlite) GetFailedDiscordMessageIds(ctx context.Context) (ids []string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.GetFailedDiscordMessageIds")
+	defer endOperation(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM discord_messages WHERE last_publish_error != '' AND cancelled_at IS NULL ORDER BY created_at, rowid`)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanIds(rows)
+}
+
+/**
+ * Records why publishing the message failed, so that it can be seen without reading the logs.
+ */
+func (s *Sqlite) RecordPublishError(ctx context.Context, id string, publishErr string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.RecordPublishError")
+	defer endOperation(span, &err)
+
+	return s.updateMessage(ctx, id, `last_publish_error = ?, last_publish_attempt_at = ?`, publishErr, time.Now().UnixMilli())
+}
+
+/**
+ * Cancels publishing the message, so that the scheduler skips it until it is requeued or a new version is
+ * published.
+ */
+func (s *Sqlite) CancelDiscordMessage(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.CancelDiscordMessage")
+	defer endOperation(span, &err)
+
+	return s.updateMessage(ctx, id, `cancelled_at = ?`, time.Now().UnixMilli())
+}
+
+/**
+ * Clears any cancellation and publish error from the message, so that it can be published again.
+ */
+func (s *Sqlite) ResetDiscordMessageState(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.ResetDiscordMessageState")
+	defer endOperation(span, &err)
+
+	return s.updateMessage(ctx, id, `cancelled_at = NULL, last_publish_error = '', publishing_started_at = NULL`)
+}
+
+/**
+ * Clears the discord id, and anything published, from the message so that it is published again as a new
+ * discord message. The existing discord message is left as it is.
+ */
+func (s *Sqlite) ResetDiscordMessageForRepublish(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.ResetDiscordMessageForRepublish")
+	defer endOperation(span, &err)
+
+	return s.updateMessage(ctx, id, `discord_id = '', last_client_request_published = '', cancelled_at = NULL, last_publish_error = '', publishing_started_at = NULL`)
+}
+
+/**
+ * Marks whether the message is being sent to discord as a new post, so that if publishing it is interrupted,
+ * it isn't posted again without checking whether the first post reached discord.
+ */
+func (s *Sqlite) SetDiscordMessagePublishing(ctx context.Context, id string, publishing bool) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.SetDiscordMessagePublishing")
+	defer endOperation(span, &err)
+
+	if publishing {
+		return s.updateMessage(ctx, id, `publishing_started_at = ?`, time.Now().UnixMilli())
+	}
+
+	return s.updateMessage(ctx, id, `publishing_started_at = NULL`)
+}
+
+/**
+ * Saves the ids of messages that were waiting to be published, so that they can be published later.
+ * Saving an id that is already saved has no effect.
+ */
+func (s *Sqlite) SaveQueuedMessageIds(ctx context.Context, ids []string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.SaveQueuedMessageIds")
+	defer endOperation(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return s.transaction(ctx, func(tx *sql.Tx) error {
+		for _, id := range ids {
+			_, err := tx.ExecContext(ctx, `INSERT INTO queued_messages (message_id, queued_at) VALUES (?, ?) ON CONFLICT DO NOTHING`, id, time.Now().UnixMilli())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+/**
+ * Takes the ids of the messages that were saved as waiting to be published, oldest first,
+ * removing them so that they are only taken once.
+ */
+func (s *Sqlite) TakeQueuedMessageIds(ctx context.Context) (ids []string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.TakeQueuedMessageIds")
+	defer endOperation(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	err = s.transaction(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT message_id FROM queued_messages ORDER BY queued_at, rowid`)
+		if err != nil {
+			return err
+		}
+
+		if ids, err = scanIds(rows); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM queued_messages`)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+/**
+ * Archives and deletes the messages that haven't been active for the ttl, and aren't marked active, along with
+ * their versions, returning how many were deleted.
+ */
+func (s *Sqlite) DeleteExpiredMessages(ctx context.Context) (deleted int64, err error) {
+	ctx, span := tracing.StartSpan(ctx, "Sqlite.DeleteExpiredMessages")
+	defer endOperation(span, &err)
+
+	return expireMessages(ctx, s, s.archiver, time.Now().Add(-s.ttl))
+}
+
+func (s *Sqlite) findExpiredMessages(ctx context.Context, cutoff time.Time, limit int) ([]DiscordMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return s.queryMessages(ctx, `SELECT `+sqliteMessageColumns+` FROM discord_messages WHERE active = 0 AND last_activity_at < ? ORDER BY last_activity_at LIMIT ?`, cutoff.UnixMilli(), limit)
+}
+
+func (s *Sqlite) deleteExpiredMessages(ctx context.Context, ids []string, cutoff time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	args := []interface{}{cutoff.UnixMilli()}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	result, err := s.db.ExecContext(ctx, `DELETE FROM discord_messages WHERE active = 0 AND last_activity_at < ? AND id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+/**
+ * Checks that the sqlite database can be used.
+ */
+func (s *Sqlite) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+/**
+ * Stops deleting expired messages and closes the sqlite database.
+ */
+func (s *Sqlite) Close() error {
+	s.stopOnce.Do(func() { close(s.stopCleanup) })
+	s.cleanupDone.Wait()
+	return s.db.Close()
+}
+
+/**
+ * Runs the function in a transaction, committing it if the function succeeds and rolling it back otherwise.
+ */
+func (s *Sqlite) transaction(ctx context.Context, run func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := run(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/**
+ * Sets columns of the message with the given id, failing if it doesn't exist.
+ */
+func (s *Sqlite) updateMessage(ctx context.Context, id string, set string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if _, idErr := parseId(id); idErr != nil {
+		return idErr
+	}
+
+	result, err := s.db.ExecContext(ctx, `UPDATE discord_messages SET `+set+` WHERE id = ?`, append(args, id)...)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if updated != 1 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+func (s *Sqlite) getMessage(ctx context.Context, query string, args ...interface{}) (*DiscordMessage, error) {
+	messages, err := s.queryMessages(ctx, query, args...)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+
+	return &messages[0], nil
+}
+
+/**
+ * Gets the messages selected by the query, along with their versions.
+ */
+func (s *Sqlite) queryMessages(ctx context.Context, query string, args ...interface{}) ([]DiscordMessage, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]DiscordMessage, 0)
+	for rows.Next() {
+		var message DiscordMessage
+		var lastPublishAttemptAt, cancelledAt, publishingStartedAt sql.NullInt64
+		var createdAt, lastActivityAt int64
+		err := rows.Scan(&message.Id, &message.Channel, &message.DiscordId, &message.LastClientRequestPublished, &message.LastPublishError, &lastPublishAttemptAt, &cancelledAt, &createdAt, &lastActivityAt, &message.Active, &publishingStartedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		message.LastPublishAttemptAt = fromSqliteTime(lastPublishAttemptAt)
+		message.CancelledAt = fromSqliteTime(cancelledAt)
+		message.PublishingStartedAt = fromSqliteTime(publishingStartedAt)
+		message.CreatedAt = time.UnixMilli(createdAt).UTC()
+		message.LastActivityAt = time.UnixMilli(lastActivityAt).UTC()
+		messages = append(messages, message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// There's only one connection, so the versions can't be read until the messages have been
+	rows.Close()
+	for i := range messages {
+		if messages[i].Versions, err = s.getVersions(ctx, messages[i].Id); err != nil {
+			return nil, err
+		}
+	}
+
+	return messages, nil
+}
+
+func (s *Sqlite) getVersions(ctx context.Context, messageId string) ([]DiscordMessageVersion, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT client_request_id, content, embeds, payload_hash, created_by, created_at FROM discord_message_versions WHERE message_id = ? ORDER BY version`, messageId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]DiscordMessageVersion, 0)
+	for rows.Next() {
+		var version DiscordMessageVersion
+		var embeds, createdBy string
+		var createdAt int64
+		if err := rows.Scan(&version.ClientRequestId, &version.Content, &embeds, &version.PayloadHash, &createdBy, &createdAt); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(embeds), &version.Embeds); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(createdBy), &version.CreatedBy); err != nil {
+			return nil, err
+		}
+
+		version.CreatedAt = time.UnixMilli(createdAt).UTC()
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+/**
+ * Client request ids are unique, so a request can't be mistaken for another. Checking first gives a clearer
+ * error, but it's the unique index that stops another process using the id between checking and using it.
+ */
+func checkClientRequestIdUnused(ctx context.Context, tx *sql.Tx, clientRequestId string) error {
+	var used bool
+	err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM discord_message_versions WHERE client_request_id = ?)`, clientRequestId).Scan(&used)
+	if err != nil {
+		return err
+	}
+
+	if used {
+		return duplicateClientRequestError(clientRequestId)
+	}
+
+	return nil
+}
+
+/**
+ * Adds a version to the message, after its existing versions.
+ */
+func insertVersion(ctx context.Context, tx *sql.Tx, messageId string, version DiscordMessageVersion) error {
+	embedsJson, err := json.Marshal(version.Embeds)
+	if err != nil {
+		return err
+	}
+
+	callerJson, err := json.Marshal(version.CreatedBy)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO discord_message_versions (message_id, version, client_request_id, content, embeds, payload_hash, created_by, created_at)
+		VALUES (?, (SELECT COALESCE(MAX(version), 0) + 1 FROM discord_message_versions WHERE message_id = ?), ?, ?, ?, ?, ?, ?)`,
+		messageId, messageId, version.ClientRequestId, version.Content, string(embedsJson), version.PayloadHash, string(callerJson), version.CreatedAt.UnixMilli(),
+	)
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return fmt.Errorf("%w: %w", duplicateClientRequestError(version.ClientRequestId), err)
+	}
+
+	return err
+}
+
+func scanIds(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+/**
+ * Times are stored as milliseconds since the epoch, as mongo does, with no time stored as NULL.
+ */
+func fromSqliteTime(millis sql.NullInt64) time.Time {
+	if !millis.Valid {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(millis.Int64).UTC()
+}
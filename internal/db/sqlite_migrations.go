@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+/**
+ * The changes to the sqlite schema, in the order they are applied. Each is applied once, in its own
+ * transaction, and recorded in schema_migrations. Never change a migration that has been released,
+ * add a new one instead.
+ */
+var sqliteMigrations = []string{
+	// 1: messages, their versions and the messages waiting to be published at shutdown
+	`
+	CREATE TABLE discord_messages (
+		id                            TEXT PRIMARY KEY,
+		channel                       TEXT NOT NULL,
+		discord_id                    TEXT NOT NULL DEFAULT '',
+		last_client_request_published TEXT NOT NULL DEFAULT '',
+		last_publish_error            TEXT NOT NULL DEFAULT '',
+		last_publish_attempt_at       INTEGER,
+		cancelled_at                  INTEGER,
+		created_at                    INTEGER NOT NULL
+	);
+
+	CREATE INDEX discord_messages_created_at ON discord_messages (created_at);
+
+	CREATE TABLE discord_message_versions (
+		message_id        TEXT NOT NULL REFERENCES discord_messages (id) ON DELETE CASCADE,
+		version           INTEGER NOT NULL,
+		client_request_id TEXT NOT NULL,
+		content           TEXT NOT NULL,
+		embeds            TEXT NOT NULL,
+		created_by        TEXT NOT NULL,
+		created_at        INTEGER NOT NULL,
+		PRIMARY KEY (message_id, version)
+	);
+
+	CREATE UNIQUE INDEX discord_message_versions_client_request_id ON discord_message_versions (client_request_id);
+
+	CREATE TABLE queued_messages (
+		message_id TEXT PRIMARY KEY,
+		queued_at  INTEGER NOT NULL
+	);
+	`,
+
+	// 2: the hash of each version's payload, so that retried requests can be recognised
+	`
+	ALTER TABLE discord_message_versions ADD COLUMN payload_hash TEXT NOT NULL DEFAULT '';
+	`,
+
+	// 3: messages expire once they haven't been active for the ttl, rather than once they are older than it,
+	// unless they are marked active
+	`
+	ALTER TABLE discord_messages ADD COLUMN last_activity_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE discord_messages ADD COLUMN active INTEGER NOT NULL DEFAULT 0;
+	UPDATE discord_messages SET last_activity_at = COALESCE(last_publish_attempt_at, created_at);
+
+	CREATE INDEX discord_messages_last_activity_at ON discord_messages (last_activity_at);
+	`,
+
+	// 4: when a message started being sent to discord as a new post, so that an interrupted post isn't repeated
+	`
+	ALTER TABLE discord_messages ADD COLUMN publishing_started_at INTEGER;
+	`,
+}
+
+/**
+ * Brings the schema up to date, applying any migrations that haven't been applied yet.
+ */
+func migrateSqlite(ctx context.Context, database *sql.DB) error {
+	_, err := database.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	var applied int
+	if err := database.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+
+	if applied > len(sqliteMigrations) {
+		return fmt.Errorf("database schema is version %v, newer than this service knows about (%v)", applied, len(sqliteMigrations))
+	}
+
+	for version := applied + 1; version <= len(sqliteMigrations); version++ {
+		if err := applySqliteMigration(ctx, database, version); err != nil {
+			return fmt.Errorf("failed to apply migration %v: %w", version, err)
+		}
+
+		dbLog.Infof("Applied sqlite migration %v", version)
+	}
+
+	return nil
+}
+
+func applySqliteMigration(ctx context.Context, database *sql.DB, version int) error {
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, sqliteMigrations[version-1]); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().UnixMilli()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
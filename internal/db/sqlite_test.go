@@ -0,0 +1,343 @@
+package db_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"ecfmp/discord/internal/config"
+	db "ecfmp/discord/internal/db"
+	pb "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/**
+ * A sqlite config for a new database in the test's temporary directory.
+ */
+func testSqliteConfig(t *testing.T) config.Sqlite {
+	return config.Sqlite{
+		Path:             filepath.Join(t.TempDir(), "test.db"),
+		MessageTtl:       time.Hour,
+		CleanupInterval:  time.Hour,
+		Archive:          "none",
+		OperationTimeout: 5 * time.Second,
+	}
+}
+
+func Test_ItKeepsSqliteMessagesWhenReopened(t *testing.T) {
+	// Given
+	testConfig := testSqliteConfig(t)
+	sqlite, err := db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+
+	id := writeStoreMessage(t, sqlite, "1")
+	assert.Nil(t, sqlite.Close())
+
+	// When
+	sqlite, err = db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to reopen sqlite: %v", err)
+	}
+	defer sqlite.Close()
+
+	// Then
+	message, err := sqlite.GetDiscordMessageById(context.Background(), id)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello World!", message.LatestVersion().Content)
+}
+
+func Test_ItClosesSqliteTwice(t *testing.T) {
+	// Given
+	sqlite, err := db.NewSqlite(testSqliteConfig(t))
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+
+	// When
+	assert.Nil(t, sqlite.Close())
+
+	// Then
+	assert.Nil(t, sqlite.Close())
+}
+
+func Test_ItRecordsTheSqliteMigrationsApplied(t *testing.T) {
+	// Given
+	testConfig := testSqliteConfig(t)
+	sqlite, err := db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	assert.Nil(t, sqlite.Close())
+
+	// When
+	database, err := sql.Open("sqlite", testConfig.Path)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	defer database.Close()
+
+	var migrations, version int
+	err = database.QueryRow("SELECT COUNT(*), MAX(version) FROM schema_migrations").Scan(&migrations, &version)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, version, migrations)
+	assert.Greater(t, version, 0)
+}
+
+func Test_ItKeepsClientRequestIdsUniqueAcrossSqliteConnections(t *testing.T) {
+	// Given two stores using the same file, as two processes would
+	testConfig := testSqliteConfig(t)
+	first, err := db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	defer first.Close()
+
+	second, err := db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	defer second.Close()
+
+	writeStoreMessage(t, first, "1")
+
+	// When
+	_, err = second.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Channel: "123", Content: "Hello World!"})
+
+	// Then
+	assert.ErrorIs(t, err, db.ErrDuplicateClientRequest)
+
+	// And the index stops anything that doesn't check first
+	database, err := sql.Open("sqlite", testConfig.Path)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	defer database.Close()
+
+	_, err = database.Exec(
+		`INSERT INTO discord_message_versions (message_id, version, client_request_id, content, embeds, created_by, created_at)
+		SELECT message_id, version + 1, client_request_id, content, embeds, created_by, created_at FROM discord_message_versions`,
+	)
+	assert.ErrorContains(t, err, "UNIQUE constraint failed")
+}
+
+func Test_ItRefusesASqliteSchemaNewerThanItKnows(t *testing.T) {
+	// Given
+	testConfig := testSqliteConfig(t)
+	sqlite, err := db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	assert.Nil(t, sqlite.Close())
+
+	database, err := sql.Open("sqlite", testConfig.Path)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	_, err = database.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (1000, 0)")
+	assert.Nil(t, err)
+	assert.Nil(t, database.Close())
+
+	// When
+	_, err = db.NewSqlite(testConfig)
+
+	// Then
+	assert.ErrorContains(t, err, "newer than this service knows about")
+}
+
+func Test_ItTimesOutSqliteOperations(t *testing.T) {
+	// Given
+	testConfig := testSqliteConfig(t)
+	testConfig.OperationTimeout = time.Nanosecond
+	sqlite, err := db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	defer sqlite.Close()
+
+	// When
+	_, err = sqlite.GetRecentDiscordMessages(context.Background(), 10)
+
+	// Then
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func Test_ItDeletesExpiredSqliteMessages(t *testing.T) {
+	// Given
+	testConfig := testSqliteConfig(t)
+	testConfig.MessageTtl = 50 * time.Millisecond
+	sqlite, err := db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	defer sqlite.Close()
+
+	expired := writeStoreMessage(t, sqlite, "1")
+	time.Sleep(100 * time.Millisecond)
+	current := writeStoreMessage(t, sqlite, "2")
+
+	// When
+	deleted, err := sqlite.DeleteExpiredMessages(context.Background())
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	message, err := sqlite.GetDiscordMessageById(context.Background(), expired)
+	assert.Nil(t, err)
+	assert.Nil(t, message)
+
+	// Its versions are deleted along with it
+	message, err = sqlite.GetDiscordMessageByClientRequestId(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Nil(t, message)
+
+	message, err = sqlite.GetDiscordMessageById(context.Background(), current)
+	assert.Nil(t, err)
+	assert.NotNil(t, message)
+}
+
+func Test_ItExpiresSqliteMessagesByWhenTheyWereLastActive(t *testing.T) {
+	// Given
+	testConfig := testSqliteConfig(t)
+	testConfig.MessageTtl = 200 * time.Millisecond
+	sqlite, err := db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	defer sqlite.Close()
+
+	updated := writeStoreMessage(t, sqlite, "1")
+	published := writeStoreMessage(t, sqlite, "2")
+	inactive := writeStoreMessage(t, sqlite, "3")
+	time.Sleep(250 * time.Millisecond)
+
+	assert.Nil(t, sqlite.PublishMessageVersion(context.Background(), "4", db.Caller{}, &pb.UpdateRequest{Id: updated}, db.ExpectedVersion{}))
+	assert.Nil(t, sqlite.UpdateMessageWithLastPublishRequest(context.Background(), published, "2"))
+
+	// When
+	deleted, err := sqlite.DeleteExpiredMessages(context.Background())
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	message, _ := sqlite.GetDiscordMessageById(context.Background(), inactive)
+	assert.Nil(t, message)
+
+	message, _ = sqlite.GetDiscordMessageById(context.Background(), updated)
+	assert.NotNil(t, message)
+
+	message, _ = sqlite.GetDiscordMessageById(context.Background(), published)
+	assert.NotNil(t, message)
+}
+
+func Test_ItKeepsActiveSqliteMessages(t *testing.T) {
+	// Given
+	testConfig := testSqliteConfig(t)
+	testConfig.MessageTtl = 50 * time.Millisecond
+	sqlite, err := db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	defer sqlite.Close()
+
+	active := writeStoreMessage(t, sqlite, "1")
+	assert.Nil(t, sqlite.SetDiscordMessageActive(context.Background(), active, true))
+	inactive := writeStoreMessage(t, sqlite, "2")
+	time.Sleep(100 * time.Millisecond)
+
+	// When
+	deleted, err := sqlite.DeleteExpiredMessages(context.Background())
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	message, _ := sqlite.GetDiscordMessageById(context.Background(), active)
+	assert.NotNil(t, message)
+
+	message, _ = sqlite.GetDiscordMessageById(context.Background(), inactive)
+	assert.Nil(t, message)
+}
+
+func Test_ItArchivesExpiredSqliteMessagesToAFile(t *testing.T) {
+	// Given
+	testConfig := testSqliteConfig(t)
+	testConfig.MessageTtl = 50 * time.Millisecond
+	testConfig.Archive = "file"
+	testConfig.ArchiveDir = filepath.Join(t.TempDir(), "archive")
+	sqlite, err := db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	defer sqlite.Close()
+
+	id := writeStoreMessage(t, sqlite, "1")
+	time.Sleep(100 * time.Millisecond)
+
+	// When
+	deleted, err := sqlite.DeleteExpiredMessages(context.Background())
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	archives, _ := filepath.Glob(filepath.Join(testConfig.ArchiveDir, "*.jsonl.gz"))
+	assert.Equal(t, 1, len(archives))
+
+	file, err := os.Open(archives[0])
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+
+	lines := bufio.NewScanner(reader)
+	assert.True(t, lines.Scan())
+
+	// The id is an ObjectID, so that it can be looked up if imported into mongo
+	assert.Contains(t, lines.Text(), `{"_id":{"$oid":"`+id+`"}`)
+
+	var archived db.ArchivedDiscordMessage
+	assert.Nil(t, bson.UnmarshalExtJSON(lines.Bytes(), false, &archived))
+	assert.Equal(t, id, archived.Id)
+	assert.Equal(t, "123", archived.Channel)
+	assert.Equal(t, "1", archived.LatestVersion().ClientRequestId)
+	assert.WithinDuration(t, time.Now(), archived.ArchivedAt, time.Second)
+	assert.False(t, lines.Scan())
+}
+
+func Test_ItDeletesExpiredSqliteMessagesPeriodically(t *testing.T) {
+	// Given
+	testConfig := testSqliteConfig(t)
+	testConfig.MessageTtl = 10 * time.Millisecond
+	testConfig.CleanupInterval = 10 * time.Millisecond
+	sqlite, err := db.NewSqlite(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	defer sqlite.Close()
+
+	// When
+	id := writeStoreMessage(t, sqlite, "1")
+
+	// Then
+	assert.Eventually(t, func() bool {
+		message, err := sqlite.GetDiscordMessageById(context.Background(), id)
+		return err == nil && message == nil
+	}, time.Second, 10*time.Millisecond)
+}
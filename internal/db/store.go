@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	pb "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
+)
+
+/**
+ * MessageStore stores discord messages and their versions, what has been published of them, and the messages
+ * waiting to be published at shutdown. Mongo is used in production, Sqlite where running mongo isn't worth it,
+ * and Memory for tests and development.
+ *
+ * Every implementation has the same semantics:
+ *   - client request ids are unique across every version of every message, and using one again is an
+ *     ErrDuplicateClientRequest
+ *   - ids that aren't valid ObjectIds are an ErrInvalidId
+ *   - getting a message that doesn't exist returns nil, rather than an error
+ *   - changing a message that doesn't exist is an ErrMessageNotFound
+ *   - publishing a version of a message that isn't at the expected version is a VersionConflictError, and
+ *     is checked atomically with publishing it
+ *   - a message being sent to discord as a new post stays marked as publishing until it is recorded as
+ *     published, it is no longer marked, or its state is reset
+ *   - writing a message, publishing a version of it, recording that it was published and marking it active
+ *     or not are activity, and messages are kept for a ttl after their last activity unless marked active
+ *   - each operation is bounded by the store's operation timeout and the context's deadline, whichever is
+ *     sooner, and an operation stopped by either returns an error wrapping the context's error
+ *   - Ping checks that the store can be used, for the store health check
+ */
+type MessageStore interface {
+	WriteDiscordMessage(ctx context.Context, clientRequestId string, caller Caller, message *pb.CreateRequest) (string, error)
+	PublishMessageVersion(ctx context.Context, clientRequestId string, caller Caller, message *pb.UpdateRequest, expected ExpectedVersion) error
+	UpdateMessageWithDiscordIdAndLastPublishRequest(ctx context.Context, id string, discordId string, requestId string) error
+	UpdateMessageWithLastPublishRequest(ctx context.Context, id string, requestId string) error
+	GetDiscordMessageById(ctx context.Context, id string) (*DiscordMessage, error)
+	GetDiscordMessageByClientRequestId(ctx context.Context, clientRequestId string) (*DiscordMessage, error)
+	SetDiscordMessageActive(ctx context.Context, id string, active bool) error
+
+	GetRecentDiscordMessages(ctx context.Context, limit int64) ([]DiscordMessage, error)
+	GetFailedDiscordMessageIds(ctx context.Context) ([]string, error)
+	RecordPublishError(ctx context.Context, id string, publishErr string) error
+	CancelDiscordMessage(ctx context.Context, id string) error
+	ResetDiscordMessageState(ctx context.Context, id string) error
+	ResetDiscordMessageForRepublish(ctx context.Context, id string) error
+	SetDiscordMessagePublishing(ctx context.Context, id string, publishing bool) error
+
+	SaveQueuedMessageIds(ctx context.Context, ids []string) error
+	TakeQueuedMessageIds(ctx context.Context) ([]string, error)
+
+	Ping(ctx context.Context) error
+}
+
+var _ MessageStore = (*Mongo)(nil)
+var _ MessageStore = (*Sqlite)(nil)
+var _ MessageStore = (*Memory)(nil)
+
+/**
+ * ExpectedVersion is the version a message must be at for a new version of it to be published, so that
+ * concurrent updates can't overwrite each other unseen. Versions are numbered from 1, or may instead be
+ * identified by the client request id that created them. The zero value expects any version.
+ */
+type ExpectedVersion struct {
+	Number          int
+	ClientRequestId string
+}
+
+/**
+ * Matches returns whether the latest version of a message, given by its number and client request id, is the
+ * one expected.
+ */
+func (expected ExpectedVersion) Matches(number int, clientRequestId string) bool {
+	switch {
+	case expected.Number > 0:
+		return number == expected.Number
+	case expected.ClientRequestId != "":
+		return clientRequestId == expected.ClientRequestId
+	default:
+		return true
+	}
+}
@@ -0,0 +1,453 @@
+package db_test
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	pb "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * The tests every MessageStore must pass, so that each has the same semantics.
+ */
+var messageStoreTests = []struct {
+	name string
+	test func(t *testing.T, store db.MessageStore)
+}{
+	{"it writes and gets a message", testItWritesAndGetsAMessage},
+	{"it stops once the caller's deadline has passed", testItStopsOnceTheCallersDeadlineHasPassed},
+	{"it stops once the caller has cancelled", testItStopsOnceTheCallerHasCancelled},
+	{"it returns nil for a missing message", testItReturnsNilForAMissingMessage},
+	{"it rejects invalid ids", testItRejectsInvalidIds},
+	{"it rejects a duplicate client request id", testItRejectsADuplicateClientRequestId},
+	{"it publishes a new version", testItPublishesANewVersion},
+	{"it does not publish a version of a missing message", testItDoesNotPublishAVersionOfAMissingMessage},
+	{"it publishes a version only at the expected version", testItPublishesAVersionOnlyAtTheExpectedVersion},
+	{"it publishes one of concurrent versions expecting the same version", testItPublishesOneOfConcurrentVersionsExpectingTheSameVersion},
+	{"it records when a message was last active", testItRecordsWhenAMessageWasLastActive},
+	{"it marks a message active", testItMarksAMessageActive},
+	{"it records what was published", testItRecordsWhatWasPublished},
+	{"it gets recent messages", testItGetsRecentMessages},
+	{"it tracks the publish state", testItTracksThePublishState},
+	{"it marks a message being published as a new post", testItMarksAMessageBeingPublishedAsANewPost},
+	{"it saves and takes queued message ids", testItSavesAndTakesQueuedMessageIds},
+	{"it writes concurrently", testItWritesConcurrently},
+}
+
+/**
+ * Runs every store test, each against a new, empty store.
+ */
+func runMessageStoreTests(t *testing.T, newStore func(t *testing.T) db.MessageStore) {
+	for _, tt := range messageStoreTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+func Test_TheMemoryStore(t *testing.T) {
+	runMessageStoreTests(t, func(t *testing.T) db.MessageStore {
+		return db.NewMemory()
+	})
+}
+
+func Test_TheSqliteStore(t *testing.T) {
+	runMessageStoreTests(t, func(t *testing.T) db.MessageStore {
+		sqlite, err := db.NewSqlite(testSqliteConfig(t))
+		if err != nil {
+			t.Fatalf("Failed to open sqlite: %v", err)
+		}
+
+		t.Cleanup(func() { sqlite.Close() })
+		return sqlite
+	})
+}
+
+func Test_TheMongoStore(t *testing.T) {
+	runMessageStoreTests(t, func(t *testing.T) db.MessageStore {
+		teardown := SetupTest(t)
+		t.Cleanup(func() { teardown(t) })
+
+		mongo, err := db.NewMongo(testMongoConfig(t))
+		if err != nil {
+			t.Fatalf("Failed to connect to mongo: %v", err)
+		}
+
+		t.Cleanup(func() { mongo.Disconnect() })
+		return mongo
+	})
+}
+
+func writeStoreMessage(t *testing.T, store db.MessageStore, clientRequestId string) string {
+	id, err := store.WriteDiscordMessage(context.Background(), clientRequestId, db.Caller{Subject: "test"}, &pb.CreateRequest{
+		Channel: "123",
+		Content: "Hello World!",
+		Embeds:  []*pb.DiscordEmbeds{{Title: "Title", Fields: []*pb.DiscordEmbedsFields{{Name: "Name", Value: "Value"}}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	return id
+}
+
+func testItWritesAndGetsAMessage(t *testing.T, store db.MessageStore) {
+	id := writeStoreMessage(t, store, "1")
+
+	message, err := store.GetDiscordMessageById(context.Background(), id)
+	assert.Nil(t, err)
+	assert.Equal(t, id, message.Id)
+	assert.Equal(t, "123", message.Channel)
+	assert.Equal(t, "", message.DiscordId)
+	assert.Equal(t, 1, len(message.Versions))
+	assert.Equal(t, "1", message.Versions[0].ClientRequestId)
+	assert.Equal(t, "Hello World!", message.Versions[0].Content)
+	assert.Equal(t, "Title", message.Versions[0].Embeds[0].Title)
+	assert.Equal(t, "Value", message.Versions[0].Embeds[0].Fields[0].Value)
+	assert.Equal(t, "test", message.Versions[0].CreatedBy.Subject)
+	assert.Equal(t, db.PayloadHash("Hello World!", message.Versions[0].Embeds), message.Versions[0].PayloadHash)
+	assert.False(t, message.CreatedAt.IsZero())
+	assert.Equal(t, db.MessageStatePending, message.State())
+
+	byClientRequestId, err := store.GetDiscordMessageByClientRequestId(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, id, byClientRequestId.Id)
+}
+
+func testItReturnsNilForAMissingMessage(t *testing.T, store db.MessageStore) {
+	message, err := store.GetDiscordMessageById(context.Background(), "5f9f1b9b9c9d9b9b9c9d9b9b")
+	assert.Nil(t, err)
+	assert.Nil(t, message)
+
+	message, err = store.GetDiscordMessageByClientRequestId(context.Background(), "missing")
+	assert.Nil(t, err)
+	assert.Nil(t, message)
+}
+
+func testItRejectsInvalidIds(t *testing.T, store db.MessageStore) {
+	_, err := store.GetDiscordMessageById(context.Background(), "invalid")
+	assert.ErrorIs(t, err, db.ErrInvalidId)
+	assert.ErrorIs(t, store.PublishMessageVersion(context.Background(), "1", db.Caller{}, &pb.UpdateRequest{Id: "invalid"}, db.ExpectedVersion{}), db.ErrInvalidId)
+	assert.ErrorIs(t, store.UpdateMessageWithLastPublishRequest(context.Background(), "invalid", "1"), db.ErrInvalidId)
+	assert.ErrorIs(t, store.CancelDiscordMessage(context.Background(), "invalid"), db.ErrInvalidId)
+}
+
+func testItRejectsADuplicateClientRequestId(t *testing.T, store db.MessageStore) {
+	first := writeStoreMessage(t, store, "1")
+	second := writeStoreMessage(t, store, "2")
+
+	_, err := store.WriteDiscordMessage(context.Background(), "1", db.Caller{}, &pb.CreateRequest{Channel: "123"})
+	assert.ErrorIs(t, err, db.ErrDuplicateClientRequest)
+
+	// Nor can it be used for a version, of another message or the same one
+	err = store.PublishMessageVersion(context.Background(), "1", db.Caller{}, &pb.UpdateRequest{Id: second}, db.ExpectedVersion{})
+	assert.ErrorIs(t, err, db.ErrDuplicateClientRequest)
+
+	err = store.PublishMessageVersion(context.Background(), "1", db.Caller{}, &pb.UpdateRequest{Id: first}, db.ExpectedVersion{})
+	assert.ErrorIs(t, err, db.ErrDuplicateClientRequest)
+
+	message, _ := store.GetDiscordMessageById(context.Background(), first)
+	assert.Equal(t, 1, len(message.Versions))
+	message, _ = store.GetDiscordMessageById(context.Background(), second)
+	assert.Equal(t, 1, len(message.Versions))
+}
+
+func testItPublishesANewVersion(t *testing.T, store db.MessageStore) {
+	id := writeStoreMessage(t, store, "1")
+	assert.Nil(t, store.CancelDiscordMessage(context.Background(), id))
+
+	err := store.PublishMessageVersion(context.Background(), "2", db.Caller{Subject: "updater"}, &pb.UpdateRequest{Id: id, Content: "Hello again!"}, db.ExpectedVersion{})
+	assert.Nil(t, err)
+
+	message, err := store.GetDiscordMessageById(context.Background(), id)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(message.Versions))
+	assert.Equal(t, "2", message.LatestVersion().ClientRequestId)
+	assert.Equal(t, "Hello again!", message.LatestVersion().Content)
+	assert.Equal(t, "updater", message.LatestVersion().CreatedBy.Subject)
+	assert.Equal(t, db.PayloadHash("Hello again!", nil), message.LatestVersion().PayloadHash)
+	assert.False(t, message.Cancelled())
+
+	byClientRequestId, err := store.GetDiscordMessageByClientRequestId(context.Background(), "2")
+	assert.Nil(t, err)
+	assert.Equal(t, id, byClientRequestId.Id)
+}
+
+func testItDoesNotPublishAVersionOfAMissingMessage(t *testing.T, store db.MessageStore) {
+	err := store.PublishMessageVersion(context.Background(), "1", db.Caller{}, &pb.UpdateRequest{Id: "5f9f1b9b9c9d9b9b9c9d9b9b"}, db.ExpectedVersion{})
+	assert.ErrorIs(t, err, db.ErrMessageNotFound)
+}
+
+func testItPublishesAVersionOnlyAtTheExpectedVersion(t *testing.T, store db.MessageStore) {
+	id := writeStoreMessage(t, store, "1")
+
+	assert.Nil(t, store.PublishMessageVersion(context.Background(), "2", db.Caller{}, &pb.UpdateRequest{Id: id}, db.ExpectedVersion{Number: 1}))
+	assert.Nil(t, store.PublishMessageVersion(context.Background(), "3", db.Caller{}, &pb.UpdateRequest{Id: id}, db.ExpectedVersion{ClientRequestId: "2"}))
+
+	// Then versions that expect an earlier version are rejected
+	err := store.PublishMessageVersion(context.Background(), "4", db.Caller{}, &pb.UpdateRequest{Id: id}, db.ExpectedVersion{Number: 2})
+	assert.ErrorIs(t, err, db.ErrVersionConflict)
+
+	var conflict *db.VersionConflictError
+	assert.ErrorAs(t, err, &conflict)
+	assert.Equal(t, 3, conflict.CurrentVersion)
+	assert.Equal(t, "3", conflict.CurrentClientRequestId)
+
+	err = store.PublishMessageVersion(context.Background(), "4", db.Caller{}, &pb.UpdateRequest{Id: id}, db.ExpectedVersion{ClientRequestId: "1"})
+	assert.ErrorIs(t, err, db.ErrVersionConflict)
+
+	message, _ := store.GetDiscordMessageById(context.Background(), id)
+	assert.Equal(t, 3, len(message.Versions))
+
+	// A missing message is still missing, whatever version is expected
+	err = store.PublishMessageVersion(context.Background(), "4", db.Caller{}, &pb.UpdateRequest{Id: "5f9f1b9b9c9d9b9b9c9d9b9b"}, db.ExpectedVersion{Number: 1})
+	assert.ErrorIs(t, err, db.ErrMessageNotFound)
+}
+
+func testItPublishesOneOfConcurrentVersionsExpectingTheSameVersion(t *testing.T, store db.MessageStore) {
+	id := writeStoreMessage(t, store, "1")
+
+	var wait sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			errs[i] = store.PublishMessageVersion(context.Background(), fmt.Sprintf("client-request-id-%v", i), db.Caller{}, &pb.UpdateRequest{Id: id}, db.ExpectedVersion{Number: 1})
+		}(i)
+	}
+	wait.Wait()
+
+	published := 0
+	for _, err := range errs {
+		if err == nil {
+			published++
+		} else {
+			assert.ErrorIs(t, err, db.ErrVersionConflict)
+		}
+	}
+
+	assert.Equal(t, 1, published)
+	message, _ := store.GetDiscordMessageById(context.Background(), id)
+	assert.Equal(t, 2, len(message.Versions))
+}
+
+func testItStopsOnceTheCallersDeadlineHasPassed(t *testing.T, store db.MessageStore) {
+	id := writeStoreMessage(t, store, "1")
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, err := store.WriteDiscordMessage(ctx, "2", db.Caller{}, &pb.CreateRequest{Channel: "1234"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = store.GetDiscordMessageById(ctx, id)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = store.PublishMessageVersion(ctx, "3", db.Caller{}, &pb.UpdateRequest{Id: id}, db.ExpectedVersion{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = store.TakeQueuedMessageIds(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	message, _ := store.GetDiscordMessageById(context.Background(), id)
+	assert.Equal(t, 1, len(message.Versions))
+}
+
+func testItStopsOnceTheCallerHasCancelled(t *testing.T, store db.MessageStore) {
+	id := writeStoreMessage(t, store, "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := store.RecordPublishError(ctx, id, "failed")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = store.GetRecentDiscordMessages(ctx, 10)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	message, _ := store.GetDiscordMessageById(context.Background(), id)
+	assert.Equal(t, "", message.LastPublishError)
+}
+
+func testItRecordsWhenAMessageWasLastActive(t *testing.T, store db.MessageStore) {
+	id := writeStoreMessage(t, store, "1")
+
+	message, _ := store.GetDiscordMessageById(context.Background(), id)
+	assert.WithinDuration(t, time.Now(), message.LastActiveAt(), time.Second)
+	written := message.LastActiveAt()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, store.PublishMessageVersion(context.Background(), "2", db.Caller{}, &pb.UpdateRequest{Id: id}, db.ExpectedVersion{}))
+
+	message, _ = store.GetDiscordMessageById(context.Background(), id)
+	assert.True(t, message.LastActiveAt().After(written))
+	updated := message.LastActiveAt()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, store.UpdateMessageWithDiscordIdAndLastPublishRequest(context.Background(), id, "discord-id", "2"))
+
+	message, _ = store.GetDiscordMessageById(context.Background(), id)
+	assert.True(t, message.LastActiveAt().After(updated))
+}
+
+func testItMarksAMessageActive(t *testing.T, store db.MessageStore) {
+	id := writeStoreMessage(t, store, "1")
+
+	message, _ := store.GetDiscordMessageById(context.Background(), id)
+	assert.False(t, message.Active)
+
+	assert.Nil(t, store.SetDiscordMessageActive(context.Background(), id, true))
+	message, _ = store.GetDiscordMessageById(context.Background(), id)
+	assert.True(t, message.Active)
+
+	assert.Nil(t, store.SetDiscordMessageActive(context.Background(), id, false))
+	message, _ = store.GetDiscordMessageById(context.Background(), id)
+	assert.False(t, message.Active)
+
+	assert.ErrorIs(t, store.SetDiscordMessageActive(context.Background(), "5f9f1b9b9c9d9b9b9c9d9b9b", true), db.ErrMessageNotFound)
+	assert.ErrorIs(t, store.SetDiscordMessageActive(context.Background(), "abc", true), db.ErrInvalidId)
+}
+
+func testItRecordsWhatWasPublished(t *testing.T, store db.MessageStore) {
+	id := writeStoreMessage(t, store, "1")
+
+	assert.Nil(t, store.UpdateMessageWithDiscordIdAndLastPublishRequest(context.Background(), id, "456", "1"))
+	message, _ := store.GetDiscordMessageById(context.Background(), id)
+	assert.Equal(t, "456", message.DiscordId)
+	assert.Equal(t, "1", message.LastClientRequestPublished)
+	assert.Equal(t, db.MessageStatePublished, message.State())
+
+	assert.Nil(t, store.PublishMessageVersion(context.Background(), "2", db.Caller{}, &pb.UpdateRequest{Id: id}, db.ExpectedVersion{}))
+	assert.Nil(t, store.UpdateMessageWithLastPublishRequest(context.Background(), id, "2"))
+	message, _ = store.GetDiscordMessageById(context.Background(), id)
+	assert.Equal(t, "456", message.DiscordId)
+	assert.Equal(t, "2", message.LastClientRequestPublished)
+
+	missing := "5f9f1b9b9c9d9b9b9c9d9b9b"
+	assert.ErrorIs(t, store.UpdateMessageWithDiscordIdAndLastPublishRequest(context.Background(), missing, "456", "1"), db.ErrMessageNotFound)
+	assert.ErrorIs(t, store.UpdateMessageWithLastPublishRequest(context.Background(), missing, "1"), db.ErrMessageNotFound)
+}
+
+func testItGetsRecentMessages(t *testing.T, store db.MessageStore) {
+	writeStoreMessage(t, store, "1")
+	second := writeStoreMessage(t, store, "2")
+	third := writeStoreMessage(t, store, "3")
+
+	messages, err := store.GetRecentDiscordMessages(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, third, messages[0].Id)
+	assert.Equal(t, second, messages[1].Id)
+}
+
+func testItTracksThePublishState(t *testing.T, store db.MessageStore) {
+	failed := writeStoreMessage(t, store, "1")
+	cancelled := writeStoreMessage(t, store, "2")
+	missing := "5f9f1b9b9c9d9b9b9c9d9b9b"
+
+	assert.Nil(t, store.RecordPublishError(context.Background(), failed, "HTTP 403 Forbidden"))
+	assert.Nil(t, store.RecordPublishError(context.Background(), cancelled, "HTTP 403 Forbidden"))
+	assert.Nil(t, store.CancelDiscordMessage(context.Background(), cancelled))
+
+	message, _ := store.GetDiscordMessageById(context.Background(), failed)
+	assert.Equal(t, "HTTP 403 Forbidden", message.LastPublishError)
+	assert.False(t, message.LastPublishAttemptAt.IsZero())
+	assert.Equal(t, db.MessageStateFailed, message.State())
+
+	ids, err := store.GetFailedDiscordMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{failed}, ids)
+
+	assert.Nil(t, store.ResetDiscordMessageState(context.Background(), cancelled))
+	message, _ = store.GetDiscordMessageById(context.Background(), cancelled)
+	assert.False(t, message.Cancelled())
+	assert.Equal(t, "", message.LastPublishError)
+
+	assert.Nil(t, store.UpdateMessageWithDiscordIdAndLastPublishRequest(context.Background(), failed, "456", "1"))
+	assert.Nil(t, store.ResetDiscordMessageForRepublish(context.Background(), failed))
+	message, _ = store.GetDiscordMessageById(context.Background(), failed)
+	assert.Equal(t, "", message.DiscordId)
+	assert.Equal(t, db.MessageStatePending, message.State())
+
+	assert.ErrorIs(t, store.RecordPublishError(context.Background(), missing, "error"), db.ErrMessageNotFound)
+	assert.ErrorIs(t, store.CancelDiscordMessage(context.Background(), missing), db.ErrMessageNotFound)
+	assert.ErrorIs(t, store.ResetDiscordMessageState(context.Background(), missing), db.ErrMessageNotFound)
+	assert.ErrorIs(t, store.ResetDiscordMessageForRepublish(context.Background(), missing), db.ErrMessageNotFound)
+}
+
+func testItMarksAMessageBeingPublishedAsANewPost(t *testing.T, store db.MessageStore) {
+	published := writeStoreMessage(t, store, "1")
+	interrupted := writeStoreMessage(t, store, "2")
+	missing := "5f9f1b9b9c9d9b9b9c9d9b9b"
+
+	assert.Nil(t, store.SetDiscordMessagePublishing(context.Background(), published, true))
+	assert.Nil(t, store.SetDiscordMessagePublishing(context.Background(), interrupted, true))
+
+	message, _ := store.GetDiscordMessageById(context.Background(), interrupted)
+	assert.False(t, message.PublishingStartedAt.IsZero())
+	assert.True(t, message.MayBeOnDiscord())
+
+	// Once it's recorded as published, it's no longer being published
+	assert.Nil(t, store.UpdateMessageWithDiscordIdAndLastPublishRequest(context.Background(), published, "456", "1"))
+	message, _ = store.GetDiscordMessageById(context.Background(), published)
+	assert.True(t, message.PublishingStartedAt.IsZero())
+	assert.False(t, message.MayBeOnDiscord())
+
+	// Recording an error leaves it marked, and resetting the state clears it
+	assert.Nil(t, store.RecordPublishError(context.Background(), interrupted, "interrupted"))
+	message, _ = store.GetDiscordMessageById(context.Background(), interrupted)
+	assert.True(t, message.MayBeOnDiscord())
+
+	assert.Nil(t, store.ResetDiscordMessageState(context.Background(), interrupted))
+	message, _ = store.GetDiscordMessageById(context.Background(), interrupted)
+	assert.False(t, message.MayBeOnDiscord())
+
+	assert.Nil(t, store.SetDiscordMessagePublishing(context.Background(), interrupted, true))
+	assert.Nil(t, store.SetDiscordMessagePublishing(context.Background(), interrupted, false))
+	message, _ = store.GetDiscordMessageById(context.Background(), interrupted)
+	assert.False(t, message.MayBeOnDiscord())
+
+	assert.ErrorIs(t, store.SetDiscordMessagePublishing(context.Background(), missing, true), db.ErrMessageNotFound)
+}
+
+func testItSavesAndTakesQueuedMessageIds(t *testing.T, store db.MessageStore) {
+	assert.Nil(t, store.SaveQueuedMessageIds(context.Background(), []string{}))
+	assert.Nil(t, store.SaveQueuedMessageIds(context.Background(), []string{"1", "2"}))
+	assert.Nil(t, store.SaveQueuedMessageIds(context.Background(), []string{"2", "3"}))
+
+	ids, err := store.TakeQueuedMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"1", "2", "3"}, ids)
+
+	ids, err = store.TakeQueuedMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+}
+
+func testItWritesConcurrently(t *testing.T, store db.MessageStore) {
+	var wait sync.WaitGroup
+	ids := make([]string, 20)
+	for i := range ids {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			id, err := store.WriteDiscordMessage(context.Background(), fmt.Sprintf("client-request-id-%v", i), db.Caller{}, &pb.CreateRequest{Channel: "123"})
+			assert.Nil(t, err)
+			assert.Nil(t, store.PublishMessageVersion(context.Background(), fmt.Sprintf("client-request-id-%v-2", i), db.Caller{}, &pb.UpdateRequest{Id: id}, db.ExpectedVersion{}))
+			ids[i] = id
+		}(i)
+	}
+	wait.Wait()
+
+	for i, id := range ids {
+		message, err := store.GetDiscordMessageById(context.Background(), id)
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("client-request-id-%v-2", i), message.LatestVersion().ClientRequestId)
+	}
+}
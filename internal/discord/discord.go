@@ -1,32 +1,60 @@
 package discord
 
 import (
+	"context"
 	db "ecfmp/discord/internal/db"
+	logConfig "ecfmp/discord/internal/log"
+	"ecfmp/discord/internal/metrics"
+	"ecfmp/discord/internal/tracing"
 	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
 
 	discordgo "github.com/bwmarrin/discordgo"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Discord interface {
-	PublishMessage(channelId string, version *db.DiscordMessageVersion) (string, error)
-	UpdateMessage(channelId string, version *db.DiscordMessageVersion, discordId string) error
+	PublishMessage(ctx context.Context, channelId string, version *db.DiscordMessageVersion) (string, error)
+	UpdateMessage(ctx context.Context, channelId string, version *db.DiscordMessageVersion, discordId string) error
 }
 
+// How recently a call to discord must have succeeded for the publisher to be considered healthy without checking
+const healthyAfterSuccessFor = 5 * time.Minute
+
+// For logging outside of publishing a message
+var discordLog = logConfig.Subsystem(logConfig.SubsystemDiscord)
+
 type DiscordPublisher struct {
 	discord *discordgo.Session
+
+	mutex       sync.Mutex
+	lastSuccess time.Time
 }
 
 /**
  * Creates a new discord publisher.
  */
 func NewDiscordPublisher(token string) *DiscordPublisher {
-	log.Infof("Creating discord publisher")
+	discordLog.Infof("Creating discord publisher")
+
+	// Make sure the token never ends up in the logs, e.g. in the headers of a failed request
+	logConfig.RegisterSecret(token)
+
 	discord, err := discordgo.New("Bot " + token)
 	if err != nil {
-		log.Fatalf("Failed to create discord session: %v", err)
+		discordLog.Fatalf("Failed to create discord session: %v", err)
 	}
 
+	// Discordgo waits out rate limits itself, but we want to know when they happen
+	discord.AddHandler(func(_ *discordgo.Session, rateLimit *discordgo.RateLimit) {
+		metrics.DiscordRateLimits.Inc()
+		discordLog.Warnf("Rate limited by discord on %v, retrying after %v", rateLimit.URL, rateLimit.RetryAfter)
+	})
+
 	return &DiscordPublisher{
 		discord: discord,
 	}
@@ -35,27 +63,66 @@ func NewDiscordPublisher(token string) *DiscordPublisher {
 /**
  * Publishes a message to discord.
  */
-func (d *DiscordPublisher) PublishMessage(channelId string, version *db.DiscordMessageVersion) (string, error) {
-	someJson, _ := json.Marshal(version.MarshallToLibraryMessageSend())
-	log.Infof("Publishing message to discord: %v", string(someJson[:]))
-	message, err := d.discord.ChannelMessageSendComplex(channelId, version.MarshallToLibraryMessageSend())
+func (d *DiscordPublisher) PublishMessage(ctx context.Context, channelId string, version *db.DiscordMessageVersion) (string, error) {
+	_, span := tracing.StartSpan(ctx, "DiscordPublisher.PublishMessage", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("channel", channelId)))
+	logger := logConfig.ForSubsystem(logConfig.LoggerFromContext(ctx), logConfig.SubsystemDiscord).WithField("channel", channelId)
+	payload, _ := json.Marshal(version.MarshallToLibraryMessageSend())
+	logger.WithField("payload", string(payload)).Info("Publishing message to discord")
+	start := time.Now()
+	message, err := d.discord.ChannelMessageSendComplex(channelId, version.MarshallToLibraryMessageSend(), discordgo.WithContext(ctx))
+	metrics.ObserveDiscordRequest("publish", start, err)
+	tracing.EndSpan(span, err)
 	if err != nil {
-		log.Errorf("Failed to publish message: %v", err)
+		logger.WithError(err).Error("Failed to publish message")
 		return "", err
 	}
 
+	d.recordSuccess()
 	return message.ID, nil
 }
 
 /**
  * Updates a message on discord.
  */
-func (d *DiscordPublisher) UpdateMessage(channelId string, version *db.DiscordMessageVersion, discordId string) error {
-	_, err := d.discord.ChannelMessageEditComplex(version.MarshallToLibraryMessageEdit(channelId, discordId))
+func (d *DiscordPublisher) UpdateMessage(ctx context.Context, channelId string, version *db.DiscordMessageVersion, discordId string) error {
+	_, span := tracing.StartSpan(ctx, "DiscordPublisher.UpdateMessage", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("channel", channelId)))
+	logger := logConfig.ForSubsystem(logConfig.LoggerFromContext(ctx), logConfig.SubsystemDiscord).WithFields(log.Fields{"channel": channelId, "discord_id": discordId})
+	start := time.Now()
+	_, err := d.discord.ChannelMessageEditComplex(version.MarshallToLibraryMessageEdit(channelId, discordId), discordgo.WithContext(ctx))
+	metrics.ObserveDiscordRequest("update", start, err)
+	tracing.EndSpan(span, err)
 	if err != nil {
-		log.Errorf("Failed to update message: %v", err)
+		logger.WithError(err).Error("Failed to update message")
 		return err
 	}
 
+	d.recordSuccess()
+	return nil
+}
+
+/**
+ * Checks that we can talk to discord. If a call has succeeded recently that's enough, otherwise the bot
+ * token is checked by fetching the bot's own user.
+ */
+func (d *DiscordPublisher) CheckHealth(ctx context.Context) error {
+	d.mutex.Lock()
+	lastSuccess := d.lastSuccess
+	d.mutex.Unlock()
+
+	if time.Since(lastSuccess) < healthyAfterSuccessFor {
+		return nil
+	}
+
+	if _, err := d.discord.User("@me", discordgo.WithContext(ctx)); err != nil {
+		return fmt.Errorf("failed to validate discord token: %w", err)
+	}
+
+	d.recordSuccess()
 	return nil
 }
+
+func (d *DiscordPublisher) recordSuccess() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.lastSuccess = time.Now()
+}
@@ -1,37 +1,115 @@
 package discord
 
 import (
+	"context"
+	"ecfmp/discord/internal/config"
 	db "ecfmp/discord/internal/db"
+	logConfig "ecfmp/discord/internal/log"
+	"ecfmp/discord/internal/metrics"
+	"ecfmp/discord/internal/tracing"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Scheduler interface {
-	ScheduleMessage(id string)
+	ScheduleMessage(ctx context.Context, id string)
 	Ready() bool
+	Pause()
+	Resume()
+	Status() SchedulerStatus
 }
 
+/**
+ * SchedulerStatus is a snapshot of what the scheduler is doing, for the admin service.
+ */
+type SchedulerStatus struct {
+	Paused bool
+
+	// How many messages are waiting to be published, including any held while paused
+	QueueDepth int
+
+	// The id of the message being published, if any
+	InFlight string
+}
+
+/**
+ * A message waiting to be published, with the logger and span of the request that scheduled it so that
+ * the publish can be correlated with the request.
+ */
+type scheduledMessage struct {
+	id          string
+	logger      *log.Entry
+	requestSpan trace.SpanContext
+}
+
+// For logging outside of publishing a message
+var schedulerLog = logConfig.Subsystem(logConfig.SubsystemScheduler)
+
 type DiscordScheduler struct {
-	channel chan string
-	mongo   *db.Mongo
+	channel chan scheduledMessage
+
+	// How many messages may be waiting to be published before the scheduler is considered unhealthy
+	backlogThreshold int
+
+	store   db.MessageStore
 	discord Discord
-	ready bool
+	ready   bool
+	alive   atomic.Bool
+
+	// Once the intake is closed, messages are kept to be saved rather than scheduled
+	intakeMutex sync.Mutex
+	intakeOpen  bool
+	unscheduled []string
+
+	// Messages that are waiting for room in the channel, which shutdown waits for before draining it
+	sending sync.WaitGroup
+
+	// While paused, messages are held here rather than published. Once resumed, the worker publishes them
+	// before anything else, and they count towards the wait group until then.
+	pauseMutex sync.Mutex
+	paused     bool
+	held       []scheduledMessage
+	resumed    chan struct{}
+
+	// The message currently being published, if any
+	inFlightMutex sync.Mutex
+	inFlight      string
+
+	stopping chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	// Cancelled if shutdown times out while a message is being published
+	publishCtx    context.Context
+	cancelPublish context.CancelFunc
 
 	GoRoutineWaitGroup *sync.WaitGroup
 }
 
 /**
- * Creates a new discord scheduler.
+ * Creates a new discord scheduler. It is considered unhealthy once its queue is 80% full.
  */
-func NewDiscordScheduler(mongo *db.Mongo, discordInterface Discord) *DiscordScheduler {
+func NewDiscordScheduler(store db.MessageStore, discordInterface Discord, config config.Scheduler) *DiscordScheduler {
 	scheduler := &DiscordScheduler{
-		mongo:              mongo,
+		store:              store,
 		discord:            discordInterface,
-		channel:            make(chan string, 50),
-		ready:     false,
+		channel:            make(chan scheduledMessage, config.QueueSize),
+		backlogThreshold:   config.QueueSize * 4 / 5,
+		ready:              false,
+		intakeOpen:         true,
+		resumed:            make(chan struct{}, 1),
+		stopping:           make(chan struct{}),
+		stopped:            make(chan struct{}),
 		GoRoutineWaitGroup: &sync.WaitGroup{},
 	}
+	scheduler.publishCtx, scheduler.cancelPublish = context.WithCancel(context.Background())
 
 	go func(schedulerToProcess *DiscordScheduler) {
 		schedulerToProcess.ready = true
@@ -44,87 +122,452 @@ func NewDiscordScheduler(mongo *db.Mongo, discordInterface Discord) *DiscordSche
 /**
  * Schedules a message to be published to discord.
  */
-func (d *DiscordScheduler) ScheduleMessage(id string) {
-	log.Infof("Scheduler: Scheduling message with id %v", id)
+func (d *DiscordScheduler) ScheduleMessage(ctx context.Context, id string) {
+	logger := logConfig.ForSubsystem(logConfig.LoggerFromContext(ctx), logConfig.SubsystemScheduler).WithField("message_id", id)
+	d.schedule(ctx, scheduledMessage{id: id, logger: logger, requestSpan: trace.SpanContextFromContext(ctx)})
+}
+
+/**
+ * Queues the message to be published. If the queue is full, this waits for room until the context is done or
+ * the scheduler shuts down, in which case the message is published after restart instead.
+ */
+func (d *DiscordScheduler) schedule(ctx context.Context, msg scheduledMessage) {
+	d.intakeMutex.Lock()
+	if !d.intakeOpen {
+		msg.logger.Warn("Scheduler: Shutting down, message will be published after restart")
+		d.unscheduled = append(d.unscheduled, msg.id)
+		d.intakeMutex.Unlock()
+		return
+	}
+
+	if d.holdIfPaused(msg) {
+		msg.logger.Info("Scheduler: Publishing is paused, message will be published when resumed")
+		d.intakeMutex.Unlock()
+		return
+	}
+
+	msg.logger.Info("Scheduler: Scheduling message")
 	d.GoRoutineWaitGroup.Add(1)
-	d.channel <- id
+	metrics.SchedulerQueueDepth.Inc()
+	d.sending.Add(1)
+	d.intakeMutex.Unlock()
+	defer d.sending.Done()
+
+	select {
+	case d.channel <- msg:
+		return
+	case <-ctx.Done():
+		msg.logger.Warn("Scheduler: Gave up waiting for room in the queue, message will be published after restart")
+	case <-d.stopping:
+		msg.logger.Warn("Scheduler: Shutting down, message will be published after restart")
+	}
+
+	metrics.SchedulerQueueDepth.Dec()
+	d.GoRoutineWaitGroup.Done()
+
+	d.intakeMutex.Lock()
+	d.unscheduled = append(d.unscheduled, msg.id)
+	d.intakeMutex.Unlock()
+}
+
+/**
+ * Holds the message until publishing is resumed, if it is paused. Held messages still count towards the
+ * queue depth.
+ */
+func (d *DiscordScheduler) holdIfPaused(msg scheduledMessage) bool {
+	d.pauseMutex.Lock()
+	defer d.pauseMutex.Unlock()
+	if !d.paused {
+		return false
+	}
+
+	metrics.SchedulerQueueDepth.Inc()
+	d.held = append(d.held, msg)
+	return true
+}
+
+/**
+ * Pauses publishing. Messages are still accepted, but are held until publishing is resumed. The message
+ * being published, if any, is allowed to finish.
+ */
+func (d *DiscordScheduler) Pause() {
+	d.pauseMutex.Lock()
+	defer d.pauseMutex.Unlock()
+	if d.paused {
+		return
+	}
+
+	// Any messages still held from the last pause are waiting again
+	d.paused = true
+	d.GoRoutineWaitGroup.Add(-len(d.held))
+}
+
+/**
+ * Resumes publishing. The messages held while paused are handed to the scheduler's goroutine, which
+ * publishes them in the order they were scheduled before anything scheduled since, so this doesn't wait
+ * for room in the queue.
+ */
+func (d *DiscordScheduler) Resume() {
+	d.pauseMutex.Lock()
+	defer d.pauseMutex.Unlock()
+	if !d.paused {
+		return
+	}
+
+	d.paused = false
+	d.GoRoutineWaitGroup.Add(len(d.held))
+	if len(d.held) > 0 {
+		schedulerLog.Infof("Scheduler: Resuming %v messages held while paused", len(d.held))
+	}
+
+	select {
+	case d.resumed <- struct{}{}:
+	default:
+	}
+}
+
+/**
+ * Takes the oldest message held while paused, once publishing has been resumed.
+ */
+func (d *DiscordScheduler) takeHeld() (scheduledMessage, bool) {
+	d.pauseMutex.Lock()
+	defer d.pauseMutex.Unlock()
+	if d.paused || len(d.held) == 0 {
+		return scheduledMessage{}, false
+	}
+
+	msg := d.held[0]
+	d.held = d.held[1:]
+	metrics.SchedulerQueueDepth.Dec()
+	return msg, true
+}
+
+/**
+ * Status returns whether publishing is paused, how many messages are waiting and which is being published.
+ */
+func (d *DiscordScheduler) Status() SchedulerStatus {
+	d.pauseMutex.Lock()
+	defer d.pauseMutex.Unlock()
+
+	return SchedulerStatus{
+		Paused:     d.paused,
+		QueueDepth: len(d.channel) + len(d.held),
+		InFlight:   d.InFlight(),
+	}
 }
 
 func (d *DiscordScheduler) Ready() bool {
 	return d.ready
 }
 
+/**
+ * Whether the scheduler's goroutine is still processing messages.
+ */
+func (d *DiscordScheduler) Alive() bool {
+	return d.alive.Load()
+}
+
+/**
+ * Checks that the scheduler is processing messages and isn't falling behind.
+ */
+func (d *DiscordScheduler) CheckHealth(ctx context.Context) error {
+	if !d.Alive() {
+		return fmt.Errorf("scheduler is not running")
+	}
+
+	if backlog := len(d.channel); backlog >= d.backlogThreshold {
+		return fmt.Errorf("scheduler backlog of %v messages is over the threshold of %v", backlog, d.backlogThreshold)
+	}
+
+	return nil
+}
+
 /**
  * Called by the scheduler's goroutine to process messages from the channel asynchonously to the
  *	request that scheduled them.
  */
 func (d *DiscordScheduler) processChannel() {
-	log.Infof("Started discord scheduler routine")
-	for msg := range d.channel {
-		log.Infof("Scheduler: Processing message %v", msg)
+	schedulerLog.Infof("Started discord scheduler routine")
+	d.alive.Store(true)
+	defer close(d.stopped)
+	defer d.alive.Store(false)
 
-		mongoMessage, mongoErr := d.mongo.GetDiscordMessageById(msg)
-		if mongoErr != nil {
-			log.Errorf("Scheduler: Failed to get message from mongo to publish: %v", mongoErr)
-			continue
+	for {
+		// Once shutting down, stop taking messages so that the rest can be saved
+		select {
+		case <-d.stopping:
+			return
+		default:
 		}
 
-		if mongoMessage == nil {
-			log.Errorf("Scheduler: Message not found in mongo for publishing: %v", msg)
+		// Messages held while paused were scheduled first, so are published first
+		if msg, ok := d.takeHeld(); ok {
+			d.publish(msg)
 			continue
 		}
 
-		// If the message has no discord id, publish it as a new message. Otherwise, update the existing message.
-		if mongoMessage.DiscordId == "" {
-			publishNewMessage(d, mongoMessage)
-		} else {
-			publishMessageUpdate(d, mongoMessage)
+		select {
+		case <-d.stopping:
+			return
+		case <-d.resumed:
+		case msg := <-d.channel:
+			metrics.SchedulerQueueDepth.Dec()
+
+			// Anything already waiting when publishing was paused is held too
+			if d.holdIfPaused(msg) {
+				d.GoRoutineWaitGroup.Done()
+				continue
+			}
+
+			d.publish(msg)
 		}
+	}
+}
+
+func (d *DiscordScheduler) publish(msg scheduledMessage) {
+	// A message whose publishing was interrupted by shutdown is left in flight, so that it's saved
+	d.setInFlight(msg.id)
+	if !d.processMessage(msg) {
+		d.setInFlight("")
+	}
+	d.GoRoutineWaitGroup.Done()
+}
+
+/**
+ * The id of the message currently being published, or an empty string if there isn't one.
+ */
+func (d *DiscordScheduler) InFlight() string {
+	d.inFlightMutex.Lock()
+	defer d.inFlightMutex.Unlock()
+	return d.inFlight
+}
+
+func (d *DiscordScheduler) setInFlight(id string) {
+	d.inFlightMutex.Lock()
+	defer d.inFlightMutex.Unlock()
+	d.inFlight = id
+}
+
+/**
+ * Stops the scheduler. Nothing more is scheduled, the message being published is given until the context
+ * is done to finish, and any messages still waiting are saved so that they're published when the service
+ * next starts. If the message being published doesn't finish in time, publishing it is cancelled, and this
+ * waits for that to stop so that the store isn't closed while it is still being used.
+ */
+func (d *DiscordScheduler) Shutdown(ctx context.Context) error {
+	d.intakeMutex.Lock()
+	d.intakeOpen = false
+	d.intakeMutex.Unlock()
+
+	d.stopOnce.Do(func() { close(d.stopping) })
+	d.sending.Wait()
+
+	remaining := make([]string, 0)
+	select {
+	case <-d.stopped:
+	case <-ctx.Done():
+		d.cancelPublish()
+		<-d.stopped
+
+		// Saved so that it isn't forgotten, but a new post that may have reached discord isn't posted again
+		// after restart until it has been checked and requeued
+		if inFlight := d.InFlight(); inFlight != "" {
+			schedulerLog.WithField("message_id", inFlight).Warn("Scheduler: Timed out waiting for message to publish, it will be checked after restart")
+			remaining = append(remaining, inFlight)
+		}
+	}
+	d.cancelPublish()
+
+	for draining := true; draining; {
+		select {
+		case msg := <-d.channel:
+			metrics.SchedulerQueueDepth.Dec()
+			remaining = append(remaining, msg.id)
+			d.GoRoutineWaitGroup.Done()
+		default:
+			draining = false
+		}
+	}
+
+	d.intakeMutex.Lock()
+	remaining = append(remaining, d.unscheduled...)
+	d.unscheduled = nil
+	d.intakeMutex.Unlock()
+
+	d.pauseMutex.Lock()
+	for _, msg := range d.held {
+		metrics.SchedulerQueueDepth.Dec()
+		remaining = append(remaining, msg.id)
+	}
+	if !d.paused {
+		d.GoRoutineWaitGroup.Add(-len(d.held))
+	}
+	d.held = nil
+	d.pauseMutex.Unlock()
+
+	if len(remaining) == 0 {
+		schedulerLog.Info("Scheduler: Stopped with no messages waiting")
+		return nil
+	}
+
+	// The shutdown deadline may have passed by now, but the messages still need saving
+	schedulerLog.Infof("Scheduler: Saving %v messages waiting to be published", len(remaining))
+	saveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return d.store.SaveQueuedMessageIds(saveCtx, remaining)
+}
+
+/**
+ * Schedules the messages that were saved as waiting to be published when the service last shut down.
+ */
+func (d *DiscordScheduler) ResumeQueuedMessages(ctx context.Context) error {
+	ids, err := d.store.TakeQueuedMessageIds(ctx)
+	if err != nil {
+		return err
+	}
 
-		d.GoRoutineWaitGroup.Done()
+	if len(ids) > 0 {
+		schedulerLog.Infof("Scheduler: Resuming %v messages saved at shutdown", len(ids))
 	}
+
+	for _, id := range ids {
+		d.ScheduleMessage(ctx, id)
+	}
+
+	return nil
 }
 
 /**
- * Publishes a new message to discord and updates the message in mongo to have the discord id.
+ * Publishes a scheduled message. As this happens after the request that scheduled it has completed, it
+ * is traced separately, with a link back to the span of the request. Returns whether publishing was
+ * interrupted by shutdown, in which case it may or may not have been published.
  */
-func publishNewMessage(d *DiscordScheduler, mongoMessage *db.DiscordMessage) {
+func (d *DiscordScheduler) processMessage(msg scheduledMessage) (interrupted bool) {
+	ctx, span := tracing.StartSpan(
+		d.publishCtx,
+		"Scheduler.ProcessMessage",
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.Link{SpanContext: msg.requestSpan}),
+		trace.WithAttributes(attribute.String("message_id", msg.id)),
+	)
+	defer span.End()
+
+	msg.logger.Info("Scheduler: Processing message")
+
+	mongoMessage, mongoErr := d.store.GetDiscordMessageById(ctx, msg.id)
+	if mongoErr != nil {
+		msg.logger.Errorf("Scheduler: Failed to get message from mongo to publish: %v", mongoErr)
+		return ctx.Err() != nil
+	}
+
+	if mongoMessage == nil {
+		msg.logger.Error("Scheduler: Message not found in mongo for publishing")
+		return false
+	}
+
+	// If the message has no discord id, publish it as a new message. Otherwise, update the existing message.
+	logger := msg.logger.WithField("channel", mongoMessage.Channel)
+	ctx = logConfig.ContextWithLogger(ctx, logger)
+	if mongoMessage.Cancelled() {
+		logger.Info("Scheduler: Publishing message was cancelled, skipping")
+		return false
+	}
+
+	// Posting it again could post it twice, so it's left for someone to check discord and requeue it
+	if mongoMessage.MayBeOnDiscord() {
+		logger.Warn("Scheduler: Publishing message was interrupted and it may already be on discord, skipping")
+		recordPublishError(ctx, d, logger, mongoMessage, errMayBeOnDiscord)
+		return false
+	}
+
+	if mongoMessage.DiscordId == "" {
+		return publishNewMessage(ctx, d, logger, mongoMessage)
+	}
+
+	return publishMessageUpdate(ctx, d, logger, mongoMessage)
+}
+
+var errMayBeOnDiscord = errors.New("publishing was interrupted and the message may already be on discord, check discord and then requeue or cancel it")
+
+/**
+ * Publishes a new message to discord and updates the message in mongo to have the discord id. Returns
+ * whether publishing was interrupted by shutdown.
+ *
+ * The message is marked as publishing until the discord id is recorded, so that if we're interrupted after
+ * discord has posted it, but before we know, it isn't posted again.
+ */
+func publishNewMessage(ctx context.Context, d *DiscordScheduler, logger *log.Entry, mongoMessage *db.DiscordMessage) bool {
+	if err := d.store.SetDiscordMessagePublishing(ctx, mongoMessage.Id, true); err != nil {
+		logger.Errorf("Scheduler: Failed to mark message as publishing in mongo: %v", err)
+		return ctx.Err() != nil
+	}
+
 	versionToPublish := &mongoMessage.Versions[len(mongoMessage.Versions)-1]
-	discordId, publishErr := d.discord.PublishMessage(mongoMessage.Channel, versionToPublish)
+	discordId, publishErr := d.discord.PublishMessage(ctx, mongoMessage.Channel, versionToPublish)
+
+	if publishErr != nil && ctx.Err() != nil {
+		logger.Warnf("Scheduler: Publishing message to discord was interrupted: %v", publishErr)
+		return true
+	}
 
 	if publishErr != nil {
-		log.Errorf("Scheduler: Failed to publish message to discord: %v", publishErr)
-		return
+		logger.Errorf("Scheduler: Failed to publish message to discord: %v", publishErr)
+		recordPublishError(ctx, d, logger, mongoMessage, publishErr)
+
+		// Discord turned it down, so it can safely be posted again
+		if err := d.store.SetDiscordMessagePublishing(ctx, mongoMessage.Id, false); err != nil {
+			logger.Errorf("Scheduler: Failed to mark message as no longer publishing in mongo: %v", err)
+		}
+
+		return false
 	}
 
+	// Once it's on discord, record that even if shutdown has interrupted us, so that it isn't published twice
 	mongoMessage.DiscordId = discordId
 	mongoMessage.LastClientRequestPublished = versionToPublish.ClientRequestId
-	mongoErr := d.mongo.UpdateMessageWithDiscordIdAndLastPublishRequest(mongoMessage.Id, discordId, versionToPublish.ClientRequestId)
+	mongoErr := d.store.UpdateMessageWithDiscordIdAndLastPublishRequest(context.WithoutCancel(ctx), mongoMessage.Id, discordId, versionToPublish.ClientRequestId)
 	if mongoErr != nil {
-		log.Errorf("Scheduler: Failed to update message in mongo for publish: %v", mongoErr)
-		return
+		logger.Errorf("Scheduler: Failed to update message in mongo for publish: %v", mongoErr)
+		return false
 	}
 
-	log.Infof("Published new message with client request id %v as %v", versionToPublish.ClientRequestId, discordId)
+	logger.WithFields(log.Fields{"client_request_id": versionToPublish.ClientRequestId, "discord_id": discordId}).Info("Scheduler: Published new message")
+	return false
 }
 
 /**
- * Updates an existing message in discord and mongo.
+ * Updates an existing message in discord and mongo. Returns whether updating it was interrupted by shutdown.
  */
-func publishMessageUpdate(d *DiscordScheduler, mongoMessage *db.DiscordMessage) {
+func publishMessageUpdate(ctx context.Context, d *DiscordScheduler, logger *log.Entry, mongoMessage *db.DiscordMessage) bool {
 	versionToPublish := &mongoMessage.Versions[len(mongoMessage.Versions)-1]
-	updateErr := d.discord.UpdateMessage(mongoMessage.Channel, versionToPublish, mongoMessage.DiscordId)
+	updateErr := d.discord.UpdateMessage(ctx, mongoMessage.Channel, versionToPublish, mongoMessage.DiscordId)
+	if updateErr != nil && ctx.Err() != nil {
+		logger.Warnf("Scheduler: Updating message was interrupted: %v", updateErr)
+		return true
+	}
+
 	if updateErr != nil {
-		log.Errorf("Scheduler: Failed to update message: %v", updateErr)
-		return
+		logger.Errorf("Scheduler: Failed to update message: %v", updateErr)
+		recordPublishError(ctx, d, logger, mongoMessage, updateErr)
+		return false
 	}
 
 	mongoMessage.LastClientRequestPublished = versionToPublish.ClientRequestId
-	mongoErr := d.mongo.UpdateMessageWithLastPublishRequest(mongoMessage.Id, versionToPublish.ClientRequestId)
+	mongoErr := d.store.UpdateMessageWithLastPublishRequest(context.WithoutCancel(ctx), mongoMessage.Id, versionToPublish.ClientRequestId)
 	if mongoErr != nil {
-		log.Errorf("Scheduler: Failed to update message in mongo: %v", mongoErr)
-		return
+		logger.Errorf("Scheduler: Failed to update message in mongo: %v", mongoErr)
+		return false
 	}
 
-	log.Infof("Scheduler: Updated message %v with client request id %v", mongoMessage.DiscordId, versionToPublish.ClientRequestId)
+	logger.WithFields(log.Fields{"client_request_id": versionToPublish.ClientRequestId, "discord_id": mongoMessage.DiscordId}).Info("Scheduler: Updated message")
+	return false
+}
+
+/**
+ * Records why publishing failed against the message, so that it shows on the admin dashboard.
+ */
+func recordPublishError(ctx context.Context, d *DiscordScheduler, logger *log.Entry, mongoMessage *db.DiscordMessage, publishErr error) {
+	if mongoErr := d.store.RecordPublishError(ctx, mongoMessage.Id, publishErr.Error()); mongoErr != nil {
+		logger.Errorf("Scheduler: Failed to record publish error in mongo: %v", mongoErr)
+	}
 }
@@ -2,15 +2,21 @@ package discord_test
 
 import (
 	"context"
+	"ecfmp/discord/internal/config"
 	db "ecfmp/discord/internal/db"
 	discord "ecfmp/discord/internal/discord"
+	"ecfmp/discord/internal/tracing"
 	pb "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
-	"os"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 type MockDiscord struct {
@@ -21,7 +27,7 @@ type MockDiscord struct {
 }
 
 // publishMessage implements discord.Discord.
-func (d *MockDiscord) PublishMessage(channelId string, version *db.DiscordMessageVersion) (string, error) {
+func (d *MockDiscord) PublishMessage(ctx context.Context, channelId string, version *db.DiscordMessageVersion) (string, error) {
 	d.callCount++
 	d.callChannel = channelId
 	d.callVersion = *version
@@ -29,7 +35,7 @@ func (d *MockDiscord) PublishMessage(channelId string, version *db.DiscordMessag
 }
 
 // updateMessage implements discord.Discord.
-func (d *MockDiscord) UpdateMessage(channelId string, version *db.DiscordMessageVersion, discordId string) error {
+func (d *MockDiscord) UpdateMessage(ctx context.Context, channelId string, version *db.DiscordMessageVersion, discordId string) error {
 	d.callCount++
 	d.callChannel = channelId
 	d.callVersion = *version
@@ -37,45 +43,37 @@ func (d *MockDiscord) UpdateMessage(channelId string, version *db.DiscordMessage
 	return nil
 }
 
-type TestMongo struct {
-	client   *db.Mongo
+type TestStore struct {
+	client   db.MessageStore
 	tearDown func()
 }
 
-func SetupTest(t *testing.T) (*TestMongo, *MockDiscord, *discord.DiscordScheduler) {
+func SetupTest(t *testing.T) (*TestStore, *MockDiscord, *discord.DiscordScheduler) {
 	// Turn off logging except for fatals
 	log.SetLevel(log.FatalLevel)
 
-	mongo, err := db.NewMongo()
-	if err != nil {
-		t.Errorf("Failed to connect to mongo: %v", err)
-	}
-
-	mongo.Client.Database(os.Getenv("MONGO_DB")).Collection("discord_messages").Drop(context.Background())
-
+	store := db.NewMemory()
 	mockDiscord := &MockDiscord{}
-	scheduler := discord.NewDiscordScheduler(mongo, mockDiscord)
+	scheduler := discord.NewDiscordScheduler(store, mockDiscord, config.Default().Scheduler)
 
-	return &TestMongo{
-		client: mongo,
-		tearDown: func() {
-			mongo.Client.Disconnect(context.Background())
-		},
+	return &TestStore{
+		client:   store,
+		tearDown: func() {},
 	}, mockDiscord, scheduler
 }
 
 func Test_ItPublishesNewMessages(t *testing.T) {
-	testMongo, mockDiscord, scheduler := SetupTest(t)
-	defer testMongo.tearDown()
+	testStore, mockDiscord, scheduler := SetupTest(t)
+	defer testStore.tearDown()
 
-	// Write to mongo (as this is done before now)
-	mongoId, err := testMongo.client.WriteDiscordMessage("some-client-request-id", &pb.CreateRequest{Channel: "channel", Content: "Hello World"})
+	// Write to the store (as this is done before now)
+	mongoId, err := testStore.client.WriteDiscordMessage(context.Background(), "some-client-request-id", db.Caller{}, &pb.CreateRequest{Channel: "channel", Content: "Hello World"})
 	if err != nil {
-		t.Errorf("Failed to write to mongo: %v", err)
+		t.Errorf("Failed to write message: %v", err)
 	}
 
 	// Run the scheduler
-	scheduler.ScheduleMessage(mongoId)
+	scheduler.ScheduleMessage(context.Background(), mongoId)
 
 	// Wait for the scheduler to finish
 	scheduler.GoRoutineWaitGroup.Wait()
@@ -85,10 +83,10 @@ func Test_ItPublishesNewMessages(t *testing.T) {
 	assert.Equal(t, "Hello World", mockDiscord.callVersion.Content)
 	assert.Equal(t, "channel", mockDiscord.callChannel)
 
-	// Check that the message was written to mongo
-	mongoMessage, mongoErr := testMongo.client.GetDiscordMessageById(mongoId)
+	// Check that the message was updated in the store
+	mongoMessage, mongoErr := testStore.client.GetDiscordMessageById(context.Background(), mongoId)
 	if mongoErr != nil {
-		t.Errorf("Failed to get message from mongo: %v", mongoErr)
+		t.Errorf("Failed to get message: %v", mongoErr)
 	}
 
 	assert.Equal(t, "123", mongoMessage.DiscordId)
@@ -96,20 +94,20 @@ func Test_ItPublishesNewMessages(t *testing.T) {
 }
 
 func Test_ItUpdatesMessagesFromVersions(t *testing.T) {
-	testMongo, mockDiscord, scheduler := SetupTest(t)
-	defer testMongo.tearDown()
+	testStore, mockDiscord, scheduler := SetupTest(t)
+	defer testStore.tearDown()
 
-	// Write to mongo (as this is done before now)
-	mongoId, err := testMongo.client.WriteDiscordMessage("some-client-request-id", &pb.CreateRequest{Channel: "channel", Content: "Hello World"})
+	// Write to the store (as this is done before now)
+	mongoId, err := testStore.client.WriteDiscordMessage(context.Background(), "some-client-request-id", db.Caller{}, &pb.CreateRequest{Channel: "channel", Content: "Hello World"})
 	if err != nil {
-		t.Errorf("Failed to write to mongo: %v", err)
+		t.Errorf("Failed to write message: %v", err)
 	}
 
 	// Update the message to have a discord id
-	testMongo.client.UpdateMessageWithDiscordIdAndLastPublishRequest(mongoId, "123", "some-other-client-request-id")
+	testStore.client.UpdateMessageWithDiscordIdAndLastPublishRequest(context.Background(), mongoId, "123", "some-other-client-request-id")
 
 	// Run the scheduler
-	scheduler.ScheduleMessage(mongoId)
+	scheduler.ScheduleMessage(context.Background(), mongoId)
 
 	// Wait for the scheduler to finish
 	scheduler.GoRoutineWaitGroup.Wait()
@@ -120,18 +118,18 @@ func Test_ItUpdatesMessagesFromVersions(t *testing.T) {
 	assert.Equal(t, "123", mockDiscord.callDiscordId)
 	assert.Equal(t, "channel", mockDiscord.callChannel)
 
-	// Check that the message was written to mongo
-	mongoMessage, mongoErr := testMongo.client.GetDiscordMessageById(mongoId)
+	// Check that the message was updated in the store
+	mongoMessage, mongoErr := testStore.client.GetDiscordMessageById(context.Background(), mongoId)
 	if mongoErr != nil {
-		t.Errorf("Failed to get message from mongo: %v", mongoErr)
+		t.Errorf("Failed to get message: %v", mongoErr)
 	}
 
 	assert.Equal(t, "some-client-request-id", mongoMessage.LastClientRequestPublished)
 }
 
 func Test_ItReturnsReadyStatus(t *testing.T) {
-	testMongo, _, scheduler := SetupTest(t)
-	defer testMongo.tearDown()
+	testStore, _, scheduler := SetupTest(t)
+	defer testStore.tearDown()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -146,3 +144,457 @@ func Test_ItReturnsReadyStatus(t *testing.T) {
 		}
 	}
 }
+
+func Test_ItLinksThePublishTraceToTheRequest(t *testing.T) {
+	testStore, mockDiscord, scheduler := SetupTest(t)
+	defer testStore.tearDown()
+
+	exporter := tracetest.NewInMemoryExporter()
+	previousProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(tracing.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(previousProvider)
+
+	// Schedule the message as part of a request
+	requestCtx, requestSpan := tracing.StartSpan(context.Background(), "request")
+	mongoId, err := testStore.client.WriteDiscordMessage(requestCtx, "some-client-request-id", db.Caller{}, &pb.CreateRequest{Channel: "channel", Content: "Hello World"})
+	if err != nil {
+		t.Errorf("Failed to write message: %v", err)
+	}
+
+	scheduler.ScheduleMessage(requestCtx, mongoId)
+	requestSpan.End()
+
+	// Wait for the scheduler to finish
+	scheduler.GoRoutineWaitGroup.Wait()
+	assert.Equal(t, 1, mockDiscord.callCount)
+
+	spansByName := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spansByName[span.Name] = span
+	}
+
+	// The publish is its own trace, linked back to the request
+	requestTraceId := requestSpan.SpanContext().TraceID()
+	publishSpan := spansByName["Scheduler.ProcessMessage"]
+	assert.NotEqual(t, requestTraceId, publishSpan.SpanContext.TraceID())
+	assert.Equal(t, 1, len(publishSpan.Links))
+	assert.Equal(t, requestTraceId, publishSpan.Links[0].SpanContext.TraceID())
+}
+
+func Test_ItIsHealthyWhileRunning(t *testing.T) {
+	log.SetLevel(log.FatalLevel)
+	scheduler := discord.NewDiscordScheduler(nil, &MockDiscord{}, config.Default().Scheduler)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for !scheduler.Alive() {
+		if ctx.Err() != nil {
+			t.Fatalf("Timed out waiting for scheduler to be alive")
+		}
+	}
+
+	assert.Nil(t, scheduler.CheckHealth(context.Background()))
+}
+
+/**
+ * A discord that blocks publishing until released, so that messages are left waiting.
+ */
+type BlockingDiscord struct {
+	MockDiscord
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *BlockingDiscord) PublishMessage(ctx context.Context, channelId string, version *db.DiscordMessageVersion) (string, error) {
+	d.started <- struct{}{}
+	select {
+	case <-d.release:
+		return d.MockDiscord.PublishMessage(ctx, channelId, version)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+/**
+ * A discord that takes a while to publish, and finishes publishing even if cancelled, as a request that
+ * has already reached discord would.
+ */
+type SlowDiscord struct {
+	MockDiscord
+	started chan struct{}
+	delay   time.Duration
+}
+
+func (d *SlowDiscord) PublishMessage(ctx context.Context, channelId string, version *db.DiscordMessageVersion) (string, error) {
+	d.started <- struct{}{}
+	time.Sleep(d.delay)
+	return d.MockDiscord.PublishMessage(ctx, channelId, version)
+}
+
+/**
+ * A discord that posts the message, but whose response doesn't arrive until the request is cancelled, as
+ * if shutdown interrupted publishing after discord had accepted it.
+ */
+type LostResponseDiscord struct {
+	MockDiscord
+	started chan struct{}
+}
+
+func (d *LostResponseDiscord) PublishMessage(ctx context.Context, channelId string, version *db.DiscordMessageVersion) (string, error) {
+	d.MockDiscord.PublishMessage(ctx, channelId, version)
+	d.started <- struct{}{}
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+/**
+ * A discord that turns messages down while it has an error.
+ */
+type FailingDiscord struct {
+	MockDiscord
+	err error
+}
+
+func (d *FailingDiscord) PublishMessage(ctx context.Context, channelId string, version *db.DiscordMessageVersion) (string, error) {
+	discordId, _ := d.MockDiscord.PublishMessage(ctx, channelId, version)
+	if d.err != nil {
+		return "", d.err
+	}
+
+	return discordId, nil
+}
+
+func writeAndScheduleMessages(t *testing.T, testStore *TestStore, scheduler *discord.DiscordScheduler, count int) []string {
+	ids := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		mongoId, err := testStore.client.WriteDiscordMessage(context.Background(), fmt.Sprintf("client-request-id-%v", i), db.Caller{}, &pb.CreateRequest{Channel: "channel", Content: "Hello World"})
+		if err != nil {
+			t.Errorf("Failed to write message: %v", err)
+		}
+
+		scheduler.ScheduleMessage(context.Background(), mongoId)
+		ids = append(ids, mongoId)
+	}
+
+	return ids
+}
+
+func Test_ItFinishesPublishingAndSavesWaitingMessagesOnShutdown(t *testing.T) {
+	testStore, _, _ := SetupTest(t)
+	defer testStore.tearDown()
+
+	blockingDiscord := &BlockingDiscord{started: make(chan struct{}, 3), release: make(chan struct{})}
+	scheduler := discord.NewDiscordScheduler(testStore.client, blockingDiscord, config.Default().Scheduler)
+	ids := writeAndScheduleMessages(t, testStore, scheduler, 3)
+
+	// Wait for the first message to be in flight, then let it finish once shutdown has started
+	<-blockingDiscord.started
+	assert.Equal(t, ids[0], scheduler.InFlight())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(blockingDiscord.release)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, scheduler.Shutdown(ctx))
+
+	// The message in flight was published
+	assert.Equal(t, 1, blockingDiscord.callCount)
+	mongoMessage, _ := testStore.client.GetDiscordMessageById(context.Background(), ids[0])
+	assert.Equal(t, "123", mongoMessage.DiscordId)
+
+	// The rest were saved for later
+	queued, err := testStore.client.TakeQueuedMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, ids[1:], queued)
+}
+
+func Test_ItSavesTheMessageInFlightIfShutdownTimesOut(t *testing.T) {
+	testStore, _, _ := SetupTest(t)
+	defer testStore.tearDown()
+
+	blockingDiscord := &BlockingDiscord{started: make(chan struct{}, 2), release: make(chan struct{})}
+	defer close(blockingDiscord.release)
+	scheduler := discord.NewDiscordScheduler(testStore.client, blockingDiscord, config.Default().Scheduler)
+	ids := writeAndScheduleMessages(t, testStore, scheduler, 2)
+
+	<-blockingDiscord.started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, scheduler.Shutdown(ctx))
+
+	queued, err := testStore.client.TakeQueuedMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, ids, queued)
+}
+
+func Test_ItWaitsForTheMessageInFlightToStopIfShutdownTimesOut(t *testing.T) {
+	testStore, _, _ := SetupTest(t)
+	defer testStore.tearDown()
+
+	// Given publishing is slower than the shutdown deadline
+	slowDiscord := &SlowDiscord{started: make(chan struct{}, 2), delay: 200 * time.Millisecond}
+	scheduler := discord.NewDiscordScheduler(testStore.client, slowDiscord, config.Default().Scheduler)
+	ids := writeAndScheduleMessages(t, testStore, scheduler, 2)
+	<-slowDiscord.started
+
+	// When
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, scheduler.Shutdown(ctx))
+
+	// Then the message in flight was published and recorded before shutdown returned
+	assert.Equal(t, 1, slowDiscord.callCount)
+	mongoMessage, _ := testStore.client.GetDiscordMessageById(context.Background(), ids[0])
+	assert.Equal(t, "123", mongoMessage.DiscordId)
+	assert.Equal(t, db.MessageStatePublished, mongoMessage.State())
+
+	// So only the message that was waiting is published again after restart
+	queued, err := testStore.client.TakeQueuedMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, ids[1:], queued)
+}
+
+func Test_ItDoesntPostAMessageAgainIfShutdownInterruptedPostingIt(t *testing.T) {
+	testStore, _, _ := SetupTest(t)
+	defer testStore.tearDown()
+
+	// Given discord has posted the message, but shutdown times out before the discord id is saved
+	lostResponseDiscord := &LostResponseDiscord{started: make(chan struct{}, 1)}
+	scheduler := discord.NewDiscordScheduler(testStore.client, lostResponseDiscord, config.Default().Scheduler)
+	ids := writeAndScheduleMessages(t, testStore, scheduler, 1)
+	<-lostResponseDiscord.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, scheduler.Shutdown(ctx))
+
+	mongoMessage, _ := testStore.client.GetDiscordMessageById(context.Background(), ids[0])
+	assert.Equal(t, "", mongoMessage.DiscordId)
+	assert.True(t, mongoMessage.MayBeOnDiscord())
+
+	// When the service restarts
+	restartedDiscord := &MockDiscord{}
+	restarted := discord.NewDiscordScheduler(testStore.client, restartedDiscord, config.Default().Scheduler)
+	assert.Nil(t, restarted.ResumeQueuedMessages(context.Background()))
+	restarted.GoRoutineWaitGroup.Wait()
+
+	// Then it isn't posted again, but is marked as failed for someone to check
+	assert.Equal(t, 1, lostResponseDiscord.callCount)
+	assert.Equal(t, 0, restartedDiscord.callCount)
+	mongoMessage, _ = testStore.client.GetDiscordMessageById(context.Background(), ids[0])
+	assert.Equal(t, db.MessageStateFailed, mongoMessage.State())
+	assert.Contains(t, mongoMessage.LastPublishError, "may already be on discord")
+
+	// And once it has been checked and requeued, it's posted
+	assert.Nil(t, testStore.client.ResetDiscordMessageState(context.Background(), ids[0]))
+	restarted.ScheduleMessage(context.Background(), ids[0])
+	restarted.GoRoutineWaitGroup.Wait()
+	assert.Equal(t, 1, restartedDiscord.callCount)
+	mongoMessage, _ = testStore.client.GetDiscordMessageById(context.Background(), ids[0])
+	assert.Equal(t, db.MessageStatePublished, mongoMessage.State())
+}
+
+func Test_ItPostsAMessageAgainIfDiscordTurnedItDown(t *testing.T) {
+	testStore, _, _ := SetupTest(t)
+	defer testStore.tearDown()
+
+	// Given discord turned the message down
+	failingDiscord := &FailingDiscord{err: errors.New("HTTP 403 Forbidden")}
+	scheduler := discord.NewDiscordScheduler(testStore.client, failingDiscord, config.Default().Scheduler)
+	ids := writeAndScheduleMessages(t, testStore, scheduler, 1)
+	scheduler.GoRoutineWaitGroup.Wait()
+
+	mongoMessage, _ := testStore.client.GetDiscordMessageById(context.Background(), ids[0])
+	assert.Equal(t, db.MessageStateFailed, mongoMessage.State())
+	assert.False(t, mongoMessage.MayBeOnDiscord())
+
+	// When it's scheduled again
+	failingDiscord.err = nil
+	scheduler.ScheduleMessage(context.Background(), ids[0])
+	scheduler.GoRoutineWaitGroup.Wait()
+
+	// Then it's posted
+	assert.Equal(t, 2, failingDiscord.callCount)
+	mongoMessage, _ = testStore.client.GetDiscordMessageById(context.Background(), ids[0])
+	assert.Equal(t, db.MessageStatePublished, mongoMessage.State())
+}
+
+func Test_ItDoesntHoldUpShutdownOrPausingWhileTheQueueIsFull(t *testing.T) {
+	testStore, _, _ := SetupTest(t)
+	defer testStore.tearDown()
+
+	// Given one message in flight, one in the queue, and one waiting for room
+	blockingDiscord := &BlockingDiscord{started: make(chan struct{}, 1), release: make(chan struct{})}
+	scheduler := discord.NewDiscordScheduler(testStore.client, blockingDiscord, config.Scheduler{QueueSize: 1})
+	ids := writeAndScheduleMessages(t, testStore, scheduler, 2)
+	<-blockingDiscord.started
+
+	waitingId, err := testStore.client.WriteDiscordMessage(context.Background(), "waiting-client-request-id", db.Caller{}, &pb.CreateRequest{Channel: "channel", Content: "Hello World"})
+	assert.Nil(t, err)
+
+	scheduled := make(chan struct{})
+	go func() {
+		scheduler.ScheduleMessage(context.Background(), waitingId)
+		close(scheduled)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// When
+	scheduler.Pause()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, scheduler.Shutdown(ctx))
+	<-scheduled
+
+	// Then every message is saved to be published after restart
+	queued, err := testStore.client.TakeQueuedMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, append(ids, waitingId), queued)
+}
+
+func Test_ItStopsWaitingForRoomInTheQueueWhenTheRequestIsDone(t *testing.T) {
+	testStore, _, _ := SetupTest(t)
+	defer testStore.tearDown()
+
+	// Given a full queue
+	blockingDiscord := &BlockingDiscord{started: make(chan struct{}, 1), release: make(chan struct{})}
+	scheduler := discord.NewDiscordScheduler(testStore.client, blockingDiscord, config.Scheduler{QueueSize: 1})
+	ids := writeAndScheduleMessages(t, testStore, scheduler, 2)
+	<-blockingDiscord.started
+
+	waitingId, err := testStore.client.WriteDiscordMessage(context.Background(), "waiting-client-request-id", db.Caller{}, &pb.CreateRequest{Channel: "channel", Content: "Hello World"})
+	assert.Nil(t, err)
+
+	// When
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	scheduler.ScheduleMessage(ctx, waitingId)
+
+	// Then it's kept to be saved at shutdown
+	assert.Equal(t, 1, scheduler.Status().QueueDepth)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer shutdownCancel()
+	assert.Nil(t, scheduler.Shutdown(shutdownCtx))
+
+	queued, err := testStore.client.TakeQueuedMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, append(ids, waitingId), queued)
+}
+
+func Test_ItResumesMessagesSavedAtShutdown(t *testing.T) {
+	testStore, mockDiscord, scheduler := SetupTest(t)
+	defer testStore.tearDown()
+
+	// Given a message saved at the last shutdown
+	mongoId, err := testStore.client.WriteDiscordMessage(context.Background(), "some-client-request-id", db.Caller{}, &pb.CreateRequest{Channel: "channel", Content: "Hello World"})
+	if err != nil {
+		t.Errorf("Failed to write message: %v", err)
+	}
+	testStore.client.SaveQueuedMessageIds(context.Background(), []string{mongoId})
+
+	// When
+	assert.Nil(t, scheduler.ResumeQueuedMessages(context.Background()))
+	scheduler.GoRoutineWaitGroup.Wait()
+
+	// Then
+	assert.Equal(t, 1, mockDiscord.callCount)
+	queued, _ := testStore.client.TakeQueuedMessageIds(context.Background())
+	assert.Empty(t, queued)
+}
+
+func Test_ItHoldsMessagesWhilePausedAndPublishesThemOnResume(t *testing.T) {
+	testStore, mockDiscord, scheduler := SetupTest(t)
+	defer testStore.tearDown()
+
+	// Given publishing is paused
+	scheduler.Pause()
+	ids := writeAndScheduleMessages(t, testStore, scheduler, 2)
+	scheduler.GoRoutineWaitGroup.Wait()
+
+	// Then nothing is published, but the messages are still queued
+	assert.Equal(t, 0, mockDiscord.callCount)
+	assert.Equal(t, discord.SchedulerStatus{Paused: true, QueueDepth: 2}, scheduler.Status())
+
+	// When publishing is resumed
+	scheduler.Resume()
+	scheduler.GoRoutineWaitGroup.Wait()
+
+	// Then they're published
+	assert.Equal(t, 2, mockDiscord.callCount)
+	assert.Equal(t, discord.SchedulerStatus{}, scheduler.Status())
+	for _, id := range ids {
+		mongoMessage, _ := testStore.client.GetDiscordMessageById(context.Background(), id)
+		assert.Equal(t, db.MessageStatePublished, mongoMessage.State())
+	}
+}
+
+func Test_ItDoesntWaitForRoomInTheQueueWhenResuming(t *testing.T) {
+	testStore, _, _ := SetupTest(t)
+	defer testStore.tearDown()
+
+	// Given more messages held while paused than there is room for in the queue
+	blockingDiscord := &BlockingDiscord{started: make(chan struct{}, 3), release: make(chan struct{})}
+	scheduler := discord.NewDiscordScheduler(testStore.client, blockingDiscord, config.Scheduler{QueueSize: 1})
+	scheduler.Pause()
+	ids := writeAndScheduleMessages(t, testStore, scheduler, 3)
+
+	// When
+	resumed := make(chan struct{})
+	go func() {
+		scheduler.Resume()
+		close(resumed)
+	}()
+
+	// Then resuming returns while the first message is still being published
+	<-blockingDiscord.started
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for publishing to resume")
+	}
+	assert.Equal(t, ids[0], scheduler.InFlight())
+
+	// And every held message is published
+	close(blockingDiscord.release)
+	scheduler.GoRoutineWaitGroup.Wait()
+	assert.Equal(t, 3, blockingDiscord.callCount)
+	for _, id := range ids {
+		mongoMessage, _ := testStore.client.GetDiscordMessageById(context.Background(), id)
+		assert.Equal(t, db.MessageStatePublished, mongoMessage.State())
+	}
+}
+
+func Test_ItSavesMessagesHeldWhilePausedOnShutdown(t *testing.T) {
+	testStore, _, scheduler := SetupTest(t)
+	defer testStore.tearDown()
+
+	scheduler.Pause()
+	ids := writeAndScheduleMessages(t, testStore, scheduler, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, scheduler.Shutdown(ctx))
+
+	queued, err := testStore.client.TakeQueuedMessageIds(context.Background())
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, ids, queued)
+}
+
+func Test_ItSkipsCancelledMessages(t *testing.T) {
+	testStore, mockDiscord, scheduler := SetupTest(t)
+	defer testStore.tearDown()
+
+	mongoId, err := testStore.client.WriteDiscordMessage(context.Background(), "some-client-request-id", db.Caller{}, &pb.CreateRequest{Channel: "channel", Content: "Hello World"})
+	if err != nil {
+		t.Errorf("Failed to write message: %v", err)
+	}
+	assert.Nil(t, testStore.client.CancelDiscordMessage(context.Background(), mongoId))
+
+	scheduler.ScheduleMessage(context.Background(), mongoId)
+	scheduler.GoRoutineWaitGroup.Wait()
+
+	assert.Equal(t, 0, mockDiscord.callCount)
+}
@@ -0,0 +1,213 @@
+package grpc
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	"ecfmp/discord/internal/discord"
+	logConfig "ecfmp/discord/internal/log"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+/**
+ * The admin service is not part of the public protocol, so it is described here rather than in the protobuf
+ * repo. Requests and responses are google.protobuf.Struct, with the fields documented on each method.
+ */
+const AdminServiceName = "ecfmp.discord.Admin"
+
+/**
+ * AdminScope is the scope a caller must have been granted to use the admin service.
+ */
+const AdminScope = "admin"
+
+/**
+ * adminService is the interface gRPC checks the admin server against when it is registered.
+ */
+type adminService interface {
+	SetLogLevel(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	GetLogLevels(ctx context.Context, in *emptypb.Empty) (*structpb.Struct, error)
+	PausePublishing(ctx context.Context, in *emptypb.Empty) (*structpb.Struct, error)
+	ResumePublishing(ctx context.Context, in *emptypb.Empty) (*structpb.Struct, error)
+	GetQueueStatus(ctx context.Context, in *emptypb.Empty) (*structpb.Struct, error)
+	RequeueMessage(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	RequeueFailedMessages(ctx context.Context, in *emptypb.Empty) (*structpb.Struct, error)
+	CancelMessage(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	RepublishMessage(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+	GetMessage(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error)
+}
+
+/**
+ * AdminMessageStore is the part of the message storage the admin service needs.
+ */
+type AdminMessageStore interface {
+	GetDiscordMessageById(ctx context.Context, id string) (*db.DiscordMessage, error)
+	CancelDiscordMessage(ctx context.Context, id string) error
+	ResetDiscordMessageState(ctx context.Context, id string) error
+	ResetDiscordMessageForRepublish(ctx context.Context, id string) error
+	GetFailedDiscordMessageIds(ctx context.Context) ([]string, error)
+}
+
+/**
+ * AdminServer implements the admin service, for operating the service at runtime.
+ */
+type AdminServer struct {
+	messages  AdminMessageStore
+	scheduler discord.Scheduler
+}
+
+/**
+ * NewAdminServer creates the admin service.
+ */
+func NewAdminServer(messages AdminMessageStore, scheduler discord.Scheduler) *AdminServer {
+	return &AdminServer{messages: messages, scheduler: scheduler}
+}
+
+/**
+ * RegisterAdminServer registers the admin service with the gRPC server.
+ */
+func RegisterAdminServer(server *grpc.Server, admin *AdminServer) {
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: AdminServiceName,
+		HandlerType: (*adminService)(nil),
+		Methods: []grpc.MethodDesc{
+			adminMethod("SetLogLevel", (*AdminServer).SetLogLevel),
+			adminMethod("GetLogLevels", (*AdminServer).GetLogLevels),
+			adminMethod("PausePublishing", (*AdminServer).PausePublishing),
+			adminMethod("ResumePublishing", (*AdminServer).ResumePublishing),
+			adminMethod("GetQueueStatus", (*AdminServer).GetQueueStatus),
+			adminMethod("RequeueMessage", (*AdminServer).RequeueMessage),
+			adminMethod("RequeueFailedMessages", (*AdminServer).RequeueFailedMessages),
+			adminMethod("CancelMessage", (*AdminServer).CancelMessage),
+			adminMethod("RepublishMessage", (*AdminServer).RepublishMessage),
+			adminMethod("GetMessage", (*AdminServer).GetMessage),
+		},
+		Streams: []grpc.StreamDesc{},
+	}, admin)
+}
+
+/**
+ * adminMethod describes a unary admin method, in the same way generated code does.
+ */
+func adminMethod[Request any, RequestPointer interface {
+	*Request
+}, Response any](name string, method func(*AdminServer, context.Context, RequestPointer) (Response, error)) grpc.MethodDesc {
+	fullMethod := "/" + AdminServiceName + "/" + name
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := RequestPointer(new(Request))
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				if err := requireAdminScope(ctx); err != nil {
+					return nil, err
+				}
+
+				return method(srv.(*AdminServer), ctx, req.(RequestPointer))
+			}
+
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}, handler)
+		},
+	}
+}
+
+/**
+ * requireAdminScope checks that the caller has been granted the admin scope.
+ */
+func requireAdminScope(ctx context.Context) error {
+	identity, ok := IdentityFromContext(ctx)
+	if !ok || !identity.HasScope(AdminScope) {
+		logConfig.LoggerFromContext(ctx).Warning("Admin request denied: caller does not have the admin scope")
+		return status.Errorf(codes.PermissionDenied, "the %v scope is required", AdminScope)
+	}
+
+	return nil
+}
+
+/**
+ * SetLogLevel changes the log level at runtime, reverting after a while.
+ *
+ * Request fields:
+ *   - level: the level to log at, e.g. "debug". Required unless resetting.
+ *   - subsystem: one of grpc, scheduler, discord or db. Changes the overall level if not set.
+ *   - revert_after: how long until the change is reverted, e.g. "30m". Defaults to LOG_LEVEL_REVERT_AFTER.
+ *   - reset: if true, reverts any change straight away instead.
+ *
+ * Response fields: subsystem, previous_level, level and revert_at (RFC 3339).
+ */
+func (admin *AdminServer) SetLogLevel(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error) {
+	logger := logConfig.LoggerFromContext(ctx)
+	fields := in.GetFields()
+	subsystem := fields["subsystem"].GetStringValue()
+
+	if fields["reset"].GetBoolValue() {
+		previous := logConfig.Levels()[subsystem]
+		if err := logConfig.ResetLevel(subsystem); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		current := logConfig.Levels()[subsystem]
+		logger.WithField("log_subsystem", subsystem).Infof("Log level reset from %v to %v", previous, current)
+		return structpb.NewStruct(map[string]interface{}{
+			"subsystem":      subsystem,
+			"previous_level": previous.String(),
+			"level":          current.String(),
+		})
+	}
+
+	if fields["level"].GetStringValue() == "" {
+		return nil, status.Error(codes.InvalidArgument, "level is required")
+	}
+
+	level, err := logConfig.ParseLogLevel(fields["level"].GetStringValue())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var revertAfter time.Duration
+	if rawRevertAfter := fields["revert_after"].GetStringValue(); rawRevertAfter != "" {
+		revertAfter, err = time.ParseDuration(rawRevertAfter)
+		if err != nil || revertAfter <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid revert_after %q, must be a positive duration", rawRevertAfter)
+		}
+	}
+
+	change, err := logConfig.SetLevel(subsystem, level, revertAfter)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	logger.WithFields(log.Fields{"log_subsystem": subsystem, "revert_at": change.RevertAt.UTC().Format(time.RFC3339)}).
+		Infof("Log level changed from %v to %v", change.Previous, change.Current)
+
+	return structpb.NewStruct(map[string]interface{}{
+		"subsystem":      change.Subsystem,
+		"previous_level": change.Previous.String(),
+		"level":          change.Current.String(),
+		"revert_at":      change.RevertAt.UTC().Format(time.RFC3339),
+	})
+}
+
+/**
+ * GetLogLevels returns the level in effect overall ("") and for each subsystem, keyed by subsystem.
+ */
+func (admin *AdminServer) GetLogLevels(ctx context.Context, in *emptypb.Empty) (*structpb.Struct, error) {
+	levels := make(map[string]interface{})
+	for subsystem, level := range logConfig.Levels() {
+		levels[subsystem] = level.String()
+	}
+
+	return structpb.NewStruct(levels)
+}
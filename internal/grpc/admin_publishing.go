@@ -0,0 +1,230 @@
+package grpc
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	logConfig "ecfmp/discord/internal/log"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+/**
+ * PausePublishing stops the scheduler publishing. Messages are still accepted, and are held until publishing
+ * is resumed. Responds with the queue status, as GetQueueStatus.
+ */
+func (admin *AdminServer) PausePublishing(ctx context.Context, in *emptypb.Empty) (*structpb.Struct, error) {
+	admin.scheduler.Pause()
+	logConfig.LoggerFromContext(ctx).Warn("Admin: Publishing paused")
+
+	return admin.queueStatus()
+}
+
+/**
+ * ResumePublishing publishes the messages held while paused, and carries on publishing. Responds with the
+ * queue status, as GetQueueStatus.
+ */
+func (admin *AdminServer) ResumePublishing(ctx context.Context, in *emptypb.Empty) (*structpb.Struct, error) {
+	admin.scheduler.Resume()
+	logConfig.LoggerFromContext(ctx).Info("Admin: Publishing resumed")
+
+	return admin.queueStatus()
+}
+
+/**
+ * GetQueueStatus returns what the scheduler is doing.
+ *
+ * Response fields:
+ *   - paused: whether publishing is paused.
+ *   - queue_depth: how many messages are waiting to be published, including any held while paused.
+ *   - in_flight: the ids of the messages being published.
+ */
+func (admin *AdminServer) GetQueueStatus(ctx context.Context, in *emptypb.Empty) (*structpb.Struct, error) {
+	return admin.queueStatus()
+}
+
+func (admin *AdminServer) queueStatus() (*structpb.Struct, error) {
+	schedulerStatus := admin.scheduler.Status()
+
+	inFlight := make([]interface{}, 0, 1)
+	if schedulerStatus.InFlight != "" {
+		inFlight = append(inFlight, schedulerStatus.InFlight)
+	}
+
+	return structpb.NewStruct(map[string]interface{}{
+		"paused":      schedulerStatus.Paused,
+		"queue_depth": schedulerStatus.QueueDepth,
+		"in_flight":   inFlight,
+	})
+}
+
+/**
+ * RequeueMessage clears any cancellation or publish error from the message, and schedules it to be published
+ * again.
+ *
+ * Request fields: id, the id of the message. Response fields: id.
+ */
+func (admin *AdminServer) RequeueMessage(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error) {
+	id, err := messageIdField(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := admin.messages.ResetDiscordMessageState(ctx, id); err != nil {
+		return nil, messageError(ctx, "requeue", err)
+	}
+
+	admin.scheduler.ScheduleMessage(ctx, id)
+	logConfig.LoggerFromContext(ctx).WithField("message_id", id).Info("Admin: Requeued message")
+
+	return structpb.NewStruct(map[string]interface{}{"id": id})
+}
+
+/**
+ * RequeueFailedMessages requeues every message whose last publish failed and that hasn't been cancelled.
+ *
+ * Response fields: ids, the ids of the messages requeued, oldest first.
+ */
+func (admin *AdminServer) RequeueFailedMessages(ctx context.Context, in *emptypb.Empty) (*structpb.Struct, error) {
+	logger := logConfig.LoggerFromContext(ctx)
+	ids, err := admin.messages.GetFailedDiscordMessageIds(ctx)
+	if err != nil {
+		return nil, storeError(logger, "Failed to get failed messages", err)
+	}
+
+	requeued := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if err := admin.messages.ResetDiscordMessageState(ctx, id); err != nil {
+			logger.WithField("message_id", id).Errorf("Admin: Failed to requeue message: %v", err)
+			continue
+		}
+
+		admin.scheduler.ScheduleMessage(ctx, id)
+		requeued = append(requeued, id)
+	}
+
+	logger.Infof("Admin: Requeued %v of %v failed messages", len(requeued), len(ids))
+	return structpb.NewStruct(map[string]interface{}{"ids": requeued})
+}
+
+/**
+ * CancelMessage stops the message being published, until it is requeued or a new version is published. A
+ * message already published to discord is left as it is.
+ *
+ * Request fields: id, the id of the message. Response fields: id.
+ */
+func (admin *AdminServer) CancelMessage(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error) {
+	id, err := messageIdField(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := admin.messages.CancelDiscordMessage(ctx, id); err != nil {
+		return nil, messageError(ctx, "cancel", err)
+	}
+
+	logConfig.LoggerFromContext(ctx).WithField("message_id", id).Info("Admin: Cancelled message")
+	return structpb.NewStruct(map[string]interface{}{"id": id})
+}
+
+/**
+ * RepublishMessage publishes the latest version of the message to discord again as a new post, e.g. if
+ * the original was deleted. The original post is left as it is.
+ *
+ * Request fields: id, the id of the message. Response fields: id.
+ */
+func (admin *AdminServer) RepublishMessage(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error) {
+	id, err := messageIdField(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := admin.messages.ResetDiscordMessageForRepublish(ctx, id); err != nil {
+		return nil, messageError(ctx, "republish", err)
+	}
+
+	admin.scheduler.ScheduleMessage(ctx, id)
+	logConfig.LoggerFromContext(ctx).WithField("message_id", id).Info("Admin: Republishing message as a new post")
+
+	return structpb.NewStruct(map[string]interface{}{"id": id})
+}
+
+/**
+ * GetMessage returns a message, its versions and who created each of them, e.g. to trace who posted an
+ * erroneous measure.
+ *
+ * Request fields: id, the id of the message.
+ *
+ * Response fields:
+ *   - id, channel, discord_id and created_at (RFC 3339).
+ *   - state: published, pending, failed or cancelled, as on the dashboard.
+ *   - last_publish_error: the error from the last failed publish, if any.
+ *   - versions: oldest first, each with its client_request_id, content, created_at and created_by, which has
+ *     the caller's subject, name, client_id, ip_address and user_agent.
+ */
+func (admin *AdminServer) GetMessage(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error) {
+	id, err := messageIdField(in)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := admin.messages.GetDiscordMessageById(ctx, id)
+	if err != nil {
+		return nil, messageError(ctx, "get", err)
+	}
+
+	if message == nil {
+		return nil, messageError(ctx, "get", db.ErrMessageNotFound)
+	}
+
+	versions := make([]interface{}, len(message.Versions))
+	for i, version := range message.Versions {
+		versions[i] = map[string]interface{}{
+			"client_request_id": version.ClientRequestId,
+			"content":           version.Content,
+			"created_at":        version.CreatedAt.Format(time.RFC3339),
+			"created_by": map[string]interface{}{
+				"subject":    version.CreatedBy.Subject,
+				"name":       version.CreatedBy.Name,
+				"client_id":  version.CreatedBy.ClientId,
+				"ip_address": version.CreatedBy.IpAddress,
+				"user_agent": version.CreatedBy.UserAgent,
+			},
+		}
+	}
+
+	return structpb.NewStruct(map[string]interface{}{
+		"id":                 message.Id,
+		"channel":            message.Channel,
+		"discord_id":         message.DiscordId,
+		"created_at":         message.CreatedAt.Format(time.RFC3339),
+		"state":              message.State(),
+		"last_publish_error": message.LastPublishError,
+		"versions":           versions,
+	})
+}
+
+/**
+ * Gets the message id from the request, checking that it is a valid id.
+ */
+func messageIdField(in *structpb.Struct) (string, error) {
+	id := in.GetFields()["id"].GetStringValue()
+	if id == "" {
+		return "", status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid id %q", id)
+	}
+
+	return id, nil
+}
+
+func messageError(ctx context.Context, action string, err error) error {
+	return storeError(logConfig.LoggerFromContext(ctx), fmt.Sprintf("Failed to %v message", action), err)
+}
@@ -0,0 +1,243 @@
+package grpc_test
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	"ecfmp/discord/internal/discord"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type MockAdminMessageStore struct {
+	messages    map[string]*db.DiscordMessage
+	failed      []string
+	cancelled   []string
+	reset       []string
+	republished []string
+	err         error
+}
+
+func (store *MockAdminMessageStore) GetDiscordMessageById(ctx context.Context, id string) (*db.DiscordMessage, error) {
+	return store.messages[id], store.err
+}
+
+func (store *MockAdminMessageStore) CancelDiscordMessage(ctx context.Context, id string) error {
+	store.cancelled = append(store.cancelled, id)
+	return store.err
+}
+
+func (store *MockAdminMessageStore) ResetDiscordMessageState(ctx context.Context, id string) error {
+	store.reset = append(store.reset, id)
+	return store.err
+}
+
+func (store *MockAdminMessageStore) ResetDiscordMessageForRepublish(ctx context.Context, id string) error {
+	store.republished = append(store.republished, id)
+	return store.err
+}
+
+func (store *MockAdminMessageStore) GetFailedDiscordMessageIds(ctx context.Context) ([]string, error) {
+	return store.failed, store.err
+}
+
+const testMessageId = "6553e4f1a3c9c1b2d3e4f5a6"
+
+func messageRequest(id string) *structpb.Struct {
+	request, _ := structpb.NewStruct(map[string]interface{}{"id": id})
+	return request
+}
+
+func Test_ItPausesAndResumesPublishing(t *testing.T) {
+	scheduler := &MockScheduler{status: discord.SchedulerStatus{QueueDepth: 3, InFlight: testMessageId}}
+	conn := setupAdminClientWith(t, &MockAdminMessageStore{}, scheduler)
+
+	response := &structpb.Struct{}
+	err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/PausePublishing", &emptypb.Empty{}, response)
+	assert.Nil(t, err)
+	assert.True(t, scheduler.paused)
+	assert.True(t, response.Fields["paused"].GetBoolValue())
+
+	err = conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/ResumePublishing", &emptypb.Empty{}, response)
+	assert.Nil(t, err)
+	assert.False(t, scheduler.paused)
+	assert.False(t, response.Fields["paused"].GetBoolValue())
+}
+
+func Test_ItGetsTheQueueStatus(t *testing.T) {
+	scheduler := &MockScheduler{status: discord.SchedulerStatus{QueueDepth: 3, InFlight: testMessageId}}
+	conn := setupAdminClientWith(t, &MockAdminMessageStore{}, scheduler)
+
+	response := &structpb.Struct{}
+	err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/GetQueueStatus", &emptypb.Empty{}, response)
+	assert.Nil(t, err)
+	assert.False(t, response.Fields["paused"].GetBoolValue())
+	assert.Equal(t, float64(3), response.Fields["queue_depth"].GetNumberValue())
+	assert.Equal(t, []interface{}{testMessageId}, response.Fields["in_flight"].GetListValue().AsSlice())
+}
+
+func Test_ItRequeuesAMessage(t *testing.T) {
+	store := &MockAdminMessageStore{}
+	scheduler := &MockScheduler{}
+	conn := setupAdminClientWith(t, store, scheduler)
+
+	response := &structpb.Struct{}
+	err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/RequeueMessage", messageRequest(testMessageId), response)
+	assert.Nil(t, err)
+	assert.Equal(t, testMessageId, response.Fields["id"].GetStringValue())
+	assert.Equal(t, []string{testMessageId}, store.reset)
+	assert.Equal(t, 1, scheduler.callCount)
+	assert.Equal(t, testMessageId, scheduler.callId)
+}
+
+func Test_ItRequeuesFailedMessages(t *testing.T) {
+	store := &MockAdminMessageStore{failed: []string{"6553e4f1a3c9c1b2d3e4f5a6", "6553e4f1a3c9c1b2d3e4f5a7"}}
+	scheduler := &MockScheduler{}
+	conn := setupAdminClientWith(t, store, scheduler)
+
+	response := &structpb.Struct{}
+	err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/RequeueFailedMessages", &emptypb.Empty{}, response)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"6553e4f1a3c9c1b2d3e4f5a6", "6553e4f1a3c9c1b2d3e4f5a7"}, response.Fields["ids"].GetListValue().AsSlice())
+	assert.Equal(t, store.failed, store.reset)
+	assert.Equal(t, 2, scheduler.callCount)
+}
+
+func Test_ItCancelsAMessage(t *testing.T) {
+	store := &MockAdminMessageStore{}
+	scheduler := &MockScheduler{}
+	conn := setupAdminClientWith(t, store, scheduler)
+
+	response := &structpb.Struct{}
+	err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/CancelMessage", messageRequest(testMessageId), response)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{testMessageId}, store.cancelled)
+	assert.Equal(t, 0, scheduler.callCount)
+}
+
+func Test_ItRepublishesAMessage(t *testing.T) {
+	store := &MockAdminMessageStore{}
+	scheduler := &MockScheduler{}
+	conn := setupAdminClientWith(t, store, scheduler)
+
+	response := &structpb.Struct{}
+	err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/RepublishMessage", messageRequest(testMessageId), response)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{testMessageId}, store.republished)
+	assert.Equal(t, testMessageId, scheduler.callId)
+}
+
+func Test_ItGetsAMessageWithWhoCreatedEachVersion(t *testing.T) {
+	createdAt := time.Date(2023, 11, 14, 12, 0, 0, 0, time.UTC)
+	store := &MockAdminMessageStore{messages: map[string]*db.DiscordMessage{
+		testMessageId: {
+			Id:        testMessageId,
+			Channel:   "channel",
+			CreatedAt: createdAt,
+			Versions: []db.DiscordMessageVersion{
+				{
+					ClientRequestId: "1",
+					Content:         "content",
+					CreatedAt:       createdAt,
+					CreatedBy:       db.Caller{Subject: "ecfmp-api", Name: "ECFMP API", ClientId: "ecfmp", IpAddress: "10.0.0.1", UserAgent: "grpc-go"},
+				},
+			},
+		},
+	}}
+	conn := setupAdminClientWith(t, store, &MockScheduler{})
+
+	response := &structpb.Struct{}
+	err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/GetMessage", messageRequest(testMessageId), response)
+	assert.Nil(t, err)
+	assert.Equal(t, testMessageId, response.Fields["id"].GetStringValue())
+	assert.Equal(t, db.MessageStatePending, response.Fields["state"].GetStringValue())
+
+	versions := response.Fields["versions"].GetListValue().AsSlice()
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"client_request_id": "1",
+			"content":           "content",
+			"created_at":        "2023-11-14T12:00:00Z",
+			"created_by": map[string]interface{}{
+				"subject":    "ecfmp-api",
+				"name":       "ECFMP API",
+				"client_id":  "ecfmp",
+				"ip_address": "10.0.0.1",
+				"user_agent": "grpc-go",
+			},
+		},
+	}, versions)
+}
+
+func Test_ItRejectsInvalidMessageIds(t *testing.T) {
+	for _, method := range []string{"RequeueMessage", "CancelMessage", "RepublishMessage", "GetMessage"} {
+		for _, id := range []string{"", "not-an-id"} {
+			t.Run(fmt.Sprintf("%v %q", method, id), func(t *testing.T) {
+				store := &MockAdminMessageStore{}
+				conn := setupAdminClientWith(t, store, &MockScheduler{})
+
+				err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/"+method, messageRequest(id), &structpb.Struct{})
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+			})
+		}
+	}
+}
+
+func Test_ItReportsMissingMessages(t *testing.T) {
+	for _, method := range []string{"RequeueMessage", "CancelMessage", "RepublishMessage", "GetMessage"} {
+		t.Run(method, func(t *testing.T) {
+			store := &MockAdminMessageStore{err: db.ErrMessageNotFound}
+			scheduler := &MockScheduler{}
+			conn := setupAdminClientWith(t, store, scheduler)
+
+			err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/"+method, messageRequest(testMessageId), &structpb.Struct{})
+			assert.Equal(t, codes.NotFound, status.Code(err))
+			assert.Equal(t, 0, scheduler.callCount)
+		})
+	}
+}
+
+func Test_ItTranslatesStoreErrors(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected codes.Code
+	}{
+		{fmt.Errorf("wrapped: %w", db.ErrMessageNotFound), codes.NotFound},
+		{fmt.Errorf("wrapped: %w", db.ErrInvalidId), codes.InvalidArgument},
+		{fmt.Errorf("wrapped: %w", db.ErrDuplicateClientRequest), codes.AlreadyExists},
+		{&db.VersionConflictError{CurrentVersion: 2, CurrentClientRequestId: "2"}, codes.Aborted},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{fmt.Errorf("wrapped: %w", context.Canceled), codes.Canceled},
+		{errors.New("connection refused"), codes.Internal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			conn := setupAdminClientWith(t, &MockAdminMessageStore{err: tt.err}, &MockScheduler{})
+
+			err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/CancelMessage", messageRequest(testMessageId), &structpb.Struct{})
+			assert.Equal(t, tt.expected, status.Code(err))
+			assert.NotContains(t, status.Convert(err).Message(), "connection refused")
+		})
+	}
+}
+
+func Test_ItRequiresTheAdminScopeToControlPublishing(t *testing.T) {
+	scheduler := &MockScheduler{}
+	conn := setupAdminClientWith(t, &MockAdminMessageStore{}, scheduler)
+
+	err := conn.Invoke(adminContext(t, "discord.write"), "/ecfmp.discord.Admin/PausePublishing", &emptypb.Empty{}, &structpb.Struct{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.False(t, scheduler.paused)
+
+	err = conn.Invoke(adminContext(t, "discord.write"), "/ecfmp.discord.Admin/RequeueMessage", messageRequest(testMessageId), &structpb.Struct{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, 0, scheduler.callCount)
+}
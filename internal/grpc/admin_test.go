@@ -0,0 +1,133 @@
+package grpc_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"ecfmp/discord/internal/discord"
+	ecfmp_grpc "ecfmp/discord/internal/grpc"
+	logConfig "ecfmp/discord/internal/log"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+/**
+ * Serves just the admin service over a buffer, authenticating with the test key.
+ */
+func setupAdminClient(t *testing.T) *grpc.ClientConn {
+	return setupAdminClientWith(t, &MockAdminMessageStore{}, &MockScheduler{})
+}
+
+func setupAdminClientWith(t *testing.T, messages ecfmp_grpc.AdminMessageStore, scheduler discord.Scheduler) *grpc.ClientConn {
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
+	if err != nil {
+		t.Fatalf("Failed to get authenticator: %v", err)
+	}
+
+	listener := bufconn.Listen(bufSize)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(ecfmp_grpc.LoggingInterceptor, authenticator.AuthInterceptor))
+	ecfmp_grpc.RegisterAdminServer(server, ecfmp_grpc.NewAdminServer(messages, scheduler))
+	go server.Serve(listener)
+
+	conn, err := grpc.DialContext(
+		context.Background(),
+		"bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+		logConfig.ResetLevel("")
+		for _, subsystem := range logConfig.Subsystems {
+			logConfig.ResetLevel(subsystem)
+		}
+	})
+
+	return conn
+}
+
+func adminContext(t *testing.T, scope string) context.Context {
+	token, err := SignJwtWithClaims(jwt.MapClaims{"aud": "test-aud", "iss": "ecfmp-auth", "sub": "operator", "scope": scope})
+	if err != nil {
+		t.Fatalf("Failed to sign jwt: %v", err)
+	}
+
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func Test_ItSetsTheLogLevelForASubsystem(t *testing.T) {
+	conn := setupAdminClient(t)
+	request, _ := structpb.NewStruct(map[string]interface{}{"level": "debug", "subsystem": "scheduler", "revert_after": "5m"})
+
+	response := &structpb.Struct{}
+	err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/SetLogLevel", request, response)
+	assert.Nil(t, err)
+	assert.Equal(t, "scheduler", response.Fields["subsystem"].GetStringValue())
+	assert.Equal(t, "info", response.Fields["previous_level"].GetStringValue())
+	assert.Equal(t, "debug", response.Fields["level"].GetStringValue())
+	assert.NotEmpty(t, response.Fields["revert_at"].GetStringValue())
+	assert.Equal(t, log.DebugLevel, logConfig.Levels()["scheduler"])
+	assert.Equal(t, log.InfoLevel, logConfig.Levels()["db"])
+
+	levels := &structpb.Struct{}
+	err = conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/GetLogLevels", &emptypb.Empty{}, levels)
+	assert.Nil(t, err)
+	assert.Equal(t, "debug", levels.Fields["scheduler"].GetStringValue())
+	assert.Equal(t, "info", levels.Fields[""].GetStringValue())
+}
+
+func Test_ItResetsTheLogLevel(t *testing.T) {
+	conn := setupAdminClient(t)
+	logConfig.SetLevel("", log.TraceLevel, 0)
+	request, _ := structpb.NewStruct(map[string]interface{}{"reset": true})
+
+	response := &structpb.Struct{}
+	err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/SetLogLevel", request, response)
+	assert.Nil(t, err)
+	assert.Equal(t, "trace", response.Fields["previous_level"].GetStringValue())
+	assert.Equal(t, "info", response.Fields["level"].GetStringValue())
+	assert.Equal(t, log.InfoLevel, logConfig.Levels()[""])
+}
+
+func Test_ItRejectsInvalidLogLevelChanges(t *testing.T) {
+	conn := setupAdminClient(t)
+
+	for _, fields := range []map[string]interface{}{
+		{},
+		{"level": "loud"},
+		{"level": "debug", "subsystem": "everything"},
+		{"level": "debug", "revert_after": "-5m"},
+	} {
+		request, _ := structpb.NewStruct(fields)
+		err := conn.Invoke(adminContext(t, "admin"), "/ecfmp.discord.Admin/SetLogLevel", request, &structpb.Struct{})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "for %v", fields)
+	}
+}
+
+func Test_ItRequiresTheAdminScopeToChangeTheLogLevel(t *testing.T) {
+	conn := setupAdminClient(t)
+	request, _ := structpb.NewStruct(map[string]interface{}{"level": "trace"})
+
+	err := conn.Invoke(adminContext(t, "messages:write"), "/ecfmp.discord.Admin/SetLogLevel", request, &structpb.Struct{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, log.InfoLevel, logConfig.Levels()[""])
+
+	err = conn.Invoke(context.Background(), "/ecfmp.discord.Admin/SetLogLevel", request, &structpb.Struct{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
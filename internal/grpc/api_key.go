@@ -0,0 +1,114 @@
+package grpc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	db "ecfmp/discord/internal/db"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	grpc "google.golang.org/grpc"
+)
+
+const apiKeyPrefix = "ApiKey "
+
+// How stale the last used time of a key may get before we write it again, to avoid a write per request
+const apiKeyLastUsedResolution = time.Minute
+
+/**
+ * ApiKeyStore is where API keys are looked up.
+ */
+type ApiKeyStore interface {
+	GetApiKeyByHash(ctx context.Context, hash string) (*db.ApiKey, error)
+	UpdateApiKeyLastUsed(ctx context.Context, id string, lastUsedAt time.Time) error
+}
+
+/**
+ * ApiKeyAuthInterceptor authenticates requests using API keys passed as "authorization: ApiKey <key>".
+ * This is intended for internal tooling that can't easily get a JWT.
+ */
+type ApiKeyAuthInterceptor struct {
+	store ApiKeyStore
+}
+
+/**
+ * NewApiKeyAuthInterceptor creates a new AuthInterceptor that accepts API keys from the given store.
+ */
+func NewApiKeyAuthInterceptor(store ApiKeyStore) *ApiKeyAuthInterceptor {
+	return &ApiKeyAuthInterceptor{store: store}
+}
+
+/**
+ * GenerateApiKey generates a new random API key, returning the key to give to the user and the hash to store.
+ */
+func GenerateApiKey() (string, string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", "", fmt.Errorf("failed to generate api key: %w", err)
+	}
+
+	key := "ecfmp_" + base64.RawURLEncoding.EncodeToString(randomBytes)
+	return key, HashApiKey(key), nil
+}
+
+/**
+ * HashApiKey hashes an API key for storage. Keys are long and random, so a fast hash is sufficient and
+ * allows the key to be looked up by its hash.
+ */
+func HashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+/**
+ * Authenticate validates an API key credential.
+ */
+func (interceptor *ApiKeyAuthInterceptor) Authenticate(ctx context.Context, credential string) (Identity, error) {
+	if !strings.HasPrefix(credential, apiKeyPrefix) {
+		return Identity{}, ErrCredentialNotSupported
+	}
+
+	apiKey, err := interceptor.store.GetApiKeyByHash(ctx, HashApiKey(strings.TrimPrefix(credential, apiKeyPrefix)))
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+
+	if apiKey == nil {
+		return Identity{}, fmt.Errorf("unknown api key")
+	}
+
+	now := time.Now()
+	if apiKey.Revoked() {
+		return Identity{}, fmt.Errorf("api key %v has been revoked", apiKey.Name)
+	}
+
+	if apiKey.Expired(now) {
+		return Identity{}, fmt.Errorf("api key %v has expired", apiKey.Name)
+	}
+
+	if now.Sub(apiKey.LastUsedAt) >= apiKeyLastUsedResolution {
+		if err := interceptor.store.UpdateApiKeyLastUsed(ctx, apiKey.Id, now); err != nil {
+			log.Errorf("Failed to update last used time of api key %v: %v", apiKey.Name, err)
+		}
+	}
+
+	return Identity{
+		Subject:    "api-key:" + apiKey.Name,
+		Name:       apiKey.Name,
+		ClientId:   apiKey.Id,
+		Scopes:     apiKey.Scopes,
+		Restricted: true,
+	}, nil
+}
+
+/**
+ * AuthInterceptor is a gRPC interceptor that checks for a valid API key in the request metadata.
+ */
+func (interceptor *ApiKeyAuthInterceptor) AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return authenticateRequest(ctx, req, handler, interceptor)
+}
@@ -0,0 +1,246 @@
+package grpc_test
+
+import (
+	"context"
+	"ecfmp/discord/internal/config"
+	db "ecfmp/discord/internal/db"
+	"ecfmp/discord/internal/grpc"
+	pb_discord "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	metadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type MockApiKeyStore struct {
+	keys         []db.ApiKey
+	lastUsedId   string
+	lastUsedTime time.Time
+}
+
+func (store *MockApiKeyStore) GetApiKeyByHash(ctx context.Context, hash string) (*db.ApiKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range store.keys {
+		if store.keys[i].Hash == hash {
+			return &store.keys[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (store *MockApiKeyStore) UpdateApiKeyLastUsed(ctx context.Context, id string, lastUsedAt time.Time) error {
+	store.lastUsedId = id
+	store.lastUsedTime = lastUsedAt
+	return nil
+}
+
+func callInterceptorWithCredential(authenticator grpc.AuthInterceptor, credential string) (bool, grpc.Identity, error) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", credential))
+
+	nextCalled := false
+	var identity grpc.Identity
+	_, err := authenticator.AuthInterceptor(ctx, nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		nextCalled = true
+		identity, _ = grpc.IdentityFromContext(ctx)
+		return nil, nil
+	})
+
+	return nextCalled, identity, err
+}
+
+func newApiKeyStore(t *testing.T, apiKey db.ApiKey) (*MockApiKeyStore, string) {
+	key, hash, err := grpc.GenerateApiKey()
+	if err != nil {
+		t.Fatalf("failed to generate api key: %v", err)
+	}
+
+	apiKey.Hash = hash
+	return &MockApiKeyStore{keys: []db.ApiKey{apiKey}}, key
+}
+
+func Test_ItPassesAuthenticationWithApiKey(t *testing.T) {
+	SetUpTest()
+
+	store, key := newApiKeyStore(t, db.ApiKey{Id: "key-id", Name: "cron", Scopes: []string{"admin"}})
+
+	nextCalled, identity, err := callInterceptorWithCredential(grpc.NewApiKeyAuthInterceptor(store), "ApiKey "+key)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+	assert.Equal(t, "api-key:cron", identity.Subject)
+	assert.Equal(t, "key-id", identity.ClientId)
+	assert.True(t, identity.HasScope("admin"))
+	assert.True(t, identity.Restricted)
+
+	// Last used should be recorded
+	assert.Equal(t, "key-id", store.lastUsedId)
+	assert.WithinDuration(t, time.Now(), store.lastUsedTime, time.Second)
+}
+
+func Test_ItDoesntPassAuthenticationWithUnknownApiKey(t *testing.T) {
+	SetUpTest()
+
+	store, _ := newApiKeyStore(t, db.ApiKey{Id: "key-id", Name: "cron"})
+
+	nextCalled, _, err := callInterceptorWithCredential(grpc.NewApiKeyAuthInterceptor(store), "ApiKey not-the-key")
+	assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
+	assert.False(t, nextCalled)
+}
+
+func Test_ItDoesntPassAuthenticationWithRevokedApiKey(t *testing.T) {
+	SetUpTest()
+
+	store, key := newApiKeyStore(t, db.ApiKey{Id: "key-id", Name: "cron", RevokedAt: time.Now().Add(-time.Hour)})
+
+	nextCalled, _, err := callInterceptorWithCredential(grpc.NewApiKeyAuthInterceptor(store), "ApiKey "+key)
+	assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
+	assert.False(t, nextCalled)
+}
+
+func Test_ItDoesntPassAuthenticationWithExpiredApiKey(t *testing.T) {
+	SetUpTest()
+
+	store, key := newApiKeyStore(t, db.ApiKey{Id: "key-id", Name: "cron", ExpiresAt: time.Now().Add(-time.Minute)})
+
+	nextCalled, _, err := callInterceptorWithCredential(grpc.NewApiKeyAuthInterceptor(store), "ApiKey "+key)
+	assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
+	assert.False(t, nextCalled)
+}
+
+func Test_ItReportsACancelledCallRatherThanAFailedApiKey(t *testing.T) {
+	SetUpTest()
+
+	store, key := newApiKeyStore(t, db.ApiKey{Id: "key-id", Name: "cron"})
+
+	// Given the call has been cancelled
+	ctx, cancel := context.WithCancel(metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "ApiKey "+key)))
+	cancel()
+
+	// When
+	nextCalled := false
+	_, err := grpc.NewApiKeyAuthInterceptor(store).AuthInterceptor(ctx, nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		nextCalled = true
+		return nil, nil
+	})
+
+	// Then
+	assert.Equal(t, codes.Canceled, status.Code(err))
+	assert.False(t, nextCalled)
+}
+
+func Test_ItDoesntUpdateLastUsedIfRecentlyUsed(t *testing.T) {
+	SetUpTest()
+
+	store, key := newApiKeyStore(t, db.ApiKey{Id: "key-id", Name: "cron", LastUsedAt: time.Now()})
+
+	nextCalled, _, err := callInterceptorWithCredential(grpc.NewApiKeyAuthInterceptor(store), "ApiKey "+key)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+	assert.Equal(t, "", store.lastUsedId)
+}
+
+func Test_ItAcceptsEitherCredentialWithCompositeInterceptor(t *testing.T) {
+	SetUpTest()
+
+	store, key := newApiKeyStore(t, db.ApiKey{Id: "key-id", Name: "cron"})
+	jwtAuthenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
+	if err != nil {
+		t.Fatalf("failed to get authenticator: %v", err)
+	}
+
+	authenticator := grpc.NewCompositeAuthInterceptor(jwtAuthenticator, grpc.NewApiKeyAuthInterceptor(store))
+
+	// API key
+	nextCalled, identity, err := callInterceptorWithCredential(authenticator, "ApiKey "+key)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+	assert.Equal(t, "cron", identity.Name)
+
+	// JWT
+	signedJwt, err := SignJwt("test-aud", "ecfmp-auth")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	nextCalled, _, err = callInterceptorWithCredential(authenticator, signedJwt)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+
+	// Neither
+	nextCalled, _, err = callInterceptorWithCredential(authenticator, "ApiKey not-the-key")
+	assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
+	assert.False(t, nextCalled)
+}
+
+func Test_ItDoesntAcceptApiKeysWithJwtInterceptor(t *testing.T) {
+	SetUpTest()
+
+	_, key := newApiKeyStore(t, db.ApiKey{Id: "key-id", Name: "cron"})
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
+	if err != nil {
+		t.Fatalf("failed to get authenticator: %v", err)
+	}
+
+	nextCalled, _, err := callInterceptorWithCredential(authenticator, "ApiKey "+key)
+	assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
+	assert.False(t, nextCalled)
+}
+
+func Test_ItAcceptsBearerPrefixedJwt(t *testing.T) {
+	SetUpTest()
+
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
+	if err != nil {
+		t.Fatalf("failed to get authenticator: %v", err)
+	}
+
+	signedJwt, err := SignJwt("test-aud", "ecfmp-auth")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	nextCalled, _, err := callInterceptorWithCredential(authenticator, "Bearer "+signedJwt)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+}
+
+func Test_ItOnlyLetsApiKeysWithTheScopeWriteMessages(t *testing.T) {
+	SetUpTest()
+
+	scheduler := &MockScheduler{isReady: true}
+	server, err := grpc.NewServer(config.Default().Server, db.NewMemory(), scheduler, grpc.NewNullInterceptor())
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	requestMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id")
+	for _, test := range []struct {
+		name     string
+		identity grpc.Identity
+		allowed  bool
+	}{
+		{"api key without the scope", grpc.Identity{Subject: "api-key:cron", Scopes: []string{"admin"}, Restricted: true}, false},
+		{"api key with the scope", grpc.Identity{Subject: "api-key:cron", Scopes: []string{grpc.MessagesWriteScope}, Restricted: true}, true},
+		{"jwt without scopes", grpc.Identity{Subject: "ecfmp-api"}, true},
+	} {
+		ctx := grpc.ContextWithIdentity(metadata.NewIncomingContext(context.Background(), requestMetadata), test.identity)
+		_, createErr := server.Create(ctx, &pb_discord.CreateRequest{Channel: "1234", Content: "Hello World!"})
+		_, updateErr := server.Update(ctx, &pb_discord.UpdateRequest{Id: "", Content: "Hello World!"})
+
+		if test.allowed {
+			assert.Nil(t, createErr, test.name)
+			assert.Equal(t, codes.InvalidArgument, status.Code(updateErr), test.name)
+		} else {
+			assert.Equal(t, status.Error(codes.PermissionDenied, "the messages:write scope is required"), createErr, test.name)
+			assert.Equal(t, status.Error(codes.PermissionDenied, "the messages:write scope is required"), updateErr, test.name)
+		}
+	}
+
+	assert.Equal(t, 1, scheduler.callCount)
+}
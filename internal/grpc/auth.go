@@ -2,14 +2,15 @@ package grpc
 
 import (
 	"context"
-	"crypto/rsa"
-	grpc_health "ecfmp/discord/proto/health/gen/pb-go/ecfmp.vatsim.net/grpc/health"
-
-	log "github.com/sirupsen/logrus"
+	logConfig "ecfmp/discord/internal/log"
+	"errors"
+	"fmt"
+	"strings"
 
 	jwt "github.com/golang-jwt/jwt/v5"
 	grpc "google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	metadata "google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
@@ -18,28 +19,62 @@ type AuthInterceptor interface {
 	AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error)
 }
 
+/**
+ * ErrCredentialNotSupported is returned by an Authenticator when the credential is not of a type it handles,
+ * so that another Authenticator may try it instead.
+ */
+var ErrCredentialNotSupported = errors.New("credential type not supported")
+
+/**
+ * Authenticator checks the credential passed in the authorization metadata, or other properties of
+ * the request such as its client certificate, returning the identity of the caller if it is valid.
+ * The credential is empty if the request has no authorization metadata.
+ */
+type Authenticator interface {
+	Authenticate(ctx context.Context, credential string) (Identity, error)
+}
+
+/**
+ * CompositeAuthInterceptor accepts a request if any of its authenticators accepts the credential,
+ * e.g. so that either a JWT or an API key may be used.
+ */
+type CompositeAuthInterceptor struct {
+	authenticators []Authenticator
+}
+
 type JwtAuthInterceptor struct {
-	publicKey   *rsa.PublicKey
+	keys        KeyProvider
 	keyAudience string
+	keyIssuer   string
 }
 
 type NullInterceptor struct{}
 
 /**
- * NewJwtAuthInterceptor creates a new AuthInterceptor.
+ * NewJwtAuthInterceptor creates a new AuthInterceptor that accepts tokens signed by any key the provider
+ * supplies, for the given audience and from the given issuer. A *KeySet may be passed directly for a fixed
+ * set of keys.
  */
-func NewJwtAuthInterceptor(publicKey []byte, keyAudience string) *JwtAuthInterceptor {
-	publicKeyFromPem, err := jwt.ParseRSAPublicKeyFromPEM(publicKey)
-	if err != nil {
-		panic(err)
-	}
-
+func NewJwtAuthInterceptor(keys KeyProvider, keyAudience string, keyIssuer string) *JwtAuthInterceptor {
 	return &JwtAuthInterceptor{
-		publicKey:   publicKeyFromPem,
+		keys:        keys,
 		keyAudience: keyAudience,
+		keyIssuer:   keyIssuer,
 	}
 }
 
+/**
+ * NewCompositeAuthInterceptor creates a new AuthInterceptor that accepts any credential that one of
+ * the authenticators accepts.
+ */
+func NewCompositeAuthInterceptor(authenticators ...Authenticator) *CompositeAuthInterceptor {
+	return &CompositeAuthInterceptor{authenticators: authenticators}
+}
+
+func (interceptor *CompositeAuthInterceptor) AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return authenticateRequest(ctx, req, handler, interceptor.authenticators...)
+}
+
 /**
  * NewNullInterceptor creates a new NullInterceptor.
  * This interceptor does not perform any authentication.
@@ -54,64 +89,142 @@ func (interceptor *NullInterceptor) AuthInterceptor(ctx context.Context, req int
 
 /**
  * validateJwt validates the JWT passed in the request metadata.
+ *
+ * The key used to verify the token is selected by the kid header. If the kid is not known, the key provider
+ * is given the chance to refresh its keys. If the token has no kid, or the kid is still not known, each
+ * candidate key is tried in turn until one verifies the signature.
+ */
+func (interceptor *JwtAuthInterceptor) validateJwt(passedJwt string) (*jwt.Token, error) {
+	unverified, _, err := jwt.NewParser().ParseUnverified(passedJwt, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+
+	keyId, _ := unverified.Header["kid"].(string)
+	keySet := interceptor.keys.CurrentKeySet()
+	if _, found := keySet.KeyById(keyId); keyId != "" && !found {
+		keySet = interceptor.keys.RefreshKeySet(keyId)
+	}
+
+	candidates := keySet.candidatesForKeyId(keyId)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no public key found for kid %v", keyId)
+	}
+
+	for _, candidate := range candidates {
+		token, err := interceptor.validateJwtWithKey(passedJwt, candidate)
+
+		// If the signature matched but the claims did not, no other key will do any better
+		if err == nil || !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			return token, err
+		}
+	}
+
+	return nil, jwt.ErrTokenSignatureInvalid
+}
+
+/**
+ * validateJwtWithKey validates the JWT against a single public key. Only the signing algorithms suited to the
+ * key are accepted, so a token can't pick an algorithm (e.g. HS256 or none) that the key wasn't meant for.
  */
-func (interceptor *JwtAuthInterceptor) validateJwt(passedJwt string) (bool, error) {
+func (interceptor *JwtAuthInterceptor) validateJwtWithKey(passedJwt string, key PublicKey) (*jwt.Token, error) {
 	token, err := jwt.Parse(passedJwt, func(token *jwt.Token) (interface{}, error) {
-		return interceptor.publicKey, nil
-	}, jwt.WithAudience(interceptor.keyAudience), jwt.WithIssuer("ecfmp-auth"))
+		return key.Key, nil
+	}, jwt.WithValidMethods(key.Algorithms), jwt.WithAudience(interceptor.keyAudience), jwt.WithIssuer(interceptor.keyIssuer))
 
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	if !token.Valid {
-		return false, status.Errorf(codes.Unauthenticated, "invalid token")
+		return nil, status.Errorf(codes.Unauthenticated, "invalid token")
 	}
 
-	return true, nil
+	return token, nil
+}
+
+/**
+ * Authenticate validates a JWT credential, which may optionally be prefixed with "Bearer ".
+ */
+func (interceptor *JwtAuthInterceptor) Authenticate(ctx context.Context, credential string) (Identity, error) {
+	if credential == "" || strings.HasPrefix(credential, apiKeyPrefix) {
+		return Identity{}, ErrCredentialNotSupported
+	}
+
+	token, err := interceptor.validateJwt(strings.TrimPrefix(credential, "Bearer "))
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to validate jwt: %w", err)
+	}
+
+	if token == nil {
+		return Identity{}, fmt.Errorf("invalid token")
+	}
+
+	return identityFromToken(token), nil
 }
 
 /**
  * AuthInterceptor is a gRPC interceptor that checks for a valid JWT in the
  * request metadata. If the JWT is valid, the request is passed to the handler
- * function. If the JWT is invalid, the request is rejected with an
- * Unauthenticated error.
+ * function, with the identity of the caller in the context. If the JWT is invalid,
+ * the request is rejected with an Unauthenticated error.
  */
 func (interceptor *JwtAuthInterceptor) AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return authenticateRequest(ctx, req, handler, interceptor)
+}
+
+/**
+ * authenticateRequest checks the authorization metadata of the request against each authenticator in turn.
+ * The first authenticator that supports the credential decides whether the request is allowed.
+ */
+func authenticateRequest(ctx context.Context, req interface{}, handler grpc.UnaryHandler, authenticators ...Authenticator) (interface{}, error) {
 	// Check the request type, if its healthcheck, no auth required
 	switch req.(type) {
-	case *grpc_health.HealthCheckRequest:
+	case *healthpb.HealthCheckRequest:
 		return handler(ctx, req)
 	}
 
-	// Get the JWT from the request metadata
-	metadata, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		return nil, status.Error(codes.Unauthenticated, codes.Unauthenticated.String())
-	}
+	logger := logConfig.LoggerFromContext(ctx)
 
-	if len(metadata.Get("authorization")) != 1 {
-		log.Warn("authorization metadata is required")
-		return nil, status.Error(codes.Unauthenticated, codes.Unauthenticated.String())
-	}
+	// Get the credential from the request metadata, if there is one
+	credential := ""
+	if metadata, ok := metadata.FromIncomingContext(ctx); ok {
+		if len(metadata.Get("authorization")) > 1 {
+			logger.Warn("only one authorization metadata value is allowed")
+			return nil, status.Error(codes.Unauthenticated, codes.Unauthenticated.String())
+		}
 
-	if metadata.Get("authorization")[0] == "" {
-		log.Warn("authorization metadata is required")
-		return nil, status.Error(codes.Unauthenticated, codes.Unauthenticated.String())
+		if len(metadata.Get("authorization")) == 1 {
+			credential = metadata.Get("authorization")[0]
+		}
 	}
 
-	// Validate the JWT
-	valid, err := interceptor.validateJwt(metadata.Get("authorization")[0])
-	if err != nil {
-		log.Warn("failed to validate jwt: ", err)
-		return nil, status.Error(codes.Unauthenticated, codes.Unauthenticated.String())
+	for _, authenticator := range authenticators {
+		identity, err := authenticator.Authenticate(ctx, credential)
+		if errors.Is(err, ErrCredentialNotSupported) {
+			continue
+		}
+
+		if err != nil {
+			logger.Warn("failed to authenticate: ", err)
+
+			// If the credential couldn't be checked in time, the caller isn't told that it is wrong
+			if contextErr := contextStatus(err); contextErr != nil {
+				return nil, contextErr
+			}
+
+			return nil, status.Error(codes.Unauthenticated, codes.Unauthenticated.String())
+		}
+
+		// Call the handler with a new context, identifying the caller
+		return handler(contextWithAuthenticatedIdentity(ctx, identity), req)
 	}
 
-	if !valid {
-		log.Warn("invalid token")
-		return nil, status.Error(codes.Unauthenticated, codes.Unauthenticated.String())
+	if credential == "" {
+		logger.Warn("authorization metadata is required")
+	} else {
+		logger.Warn("unsupported authorization credential")
 	}
 
-	// Call the handler with a new context
-	return handler(ctx, req)
+	return nil, status.Error(codes.Unauthenticated, codes.Unauthenticated.String())
 }
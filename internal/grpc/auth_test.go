@@ -1,12 +1,17 @@
-//go:build testing
-
 package grpc_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"ecfmp/discord/internal/grpc"
+	"os"
+	"path/filepath"
 	"testing"
 
+	jwt "github.com/golang-jwt/jwt/v5"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
@@ -22,12 +27,12 @@ func SetUpTest() {
 func Test_ItPassesAuthenticationForSignedString(t *testing.T) {
 	SetUpTest()
 
-	signedJwt, err := grpc.SignJwt("test-aud", "ecfmp-auth")
+	signedJwt, err := SignJwt("test-aud", "ecfmp-auth")
 	if err != nil {
 		t.Fatalf("failed to sign jwt: %v", err)
 	}
 
-	authenticator, err := grpc.GetAuthenticatorWithCorrectKey("test-aud")
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
 	if err != nil {
 		t.Fatalf("failed to get authenticator: %v", err)
 	}
@@ -54,12 +59,12 @@ func Test_ItPassesAuthenticationForSignedString(t *testing.T) {
 func Test_ItDoesntPassAuthenticationWrongAudience(t *testing.T) {
 	SetUpTest()
 
-	signedJwt, err := grpc.SignJwt("test-aud-2", "ecfmp-auth")
+	signedJwt, err := SignJwt("test-aud-2", "ecfmp-auth")
 	if err != nil {
 		t.Fatalf("failed to sign jwt: %v", err)
 	}
 
-	authenticator, err := grpc.GetAuthenticatorWithCorrectKey("test-aud")
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
 	if err != nil {
 		t.Fatalf("failed to get authenticator: %v", err)
 	}
@@ -81,12 +86,12 @@ func Test_ItDoesntPassAuthenticationWrongAudience(t *testing.T) {
 func Test_ItDoesntPassAuthenticationWrongIssuer(t *testing.T) {
 	SetUpTest()
 
-	signedJwt, err := grpc.SignJwt("test-aud", "ecfmp-auth-2")
+	signedJwt, err := SignJwt("test-aud", "ecfmp-auth-2")
 	if err != nil {
 		t.Fatalf("failed to sign jwt: %v", err)
 	}
 
-	authenticator, err := grpc.GetAuthenticatorWithCorrectKey("test-aud")
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
 	if err != nil {
 		t.Fatalf("failed to get authenticator: %v", err)
 	}
@@ -108,7 +113,7 @@ func Test_ItDoesntPassAuthenticationWrongIssuer(t *testing.T) {
 func Test_ItDoesntPassAuthenticationEmptyAuthorization(t *testing.T) {
 	SetUpTest()
 
-	authenticator, err := grpc.GetAuthenticatorWithCorrectKey("test-aud")
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
 	if err != nil {
 		t.Fatalf("failed to get authenticator: %v", err)
 	}
@@ -130,7 +135,7 @@ func Test_ItDoesntPassAuthenticationEmptyAuthorization(t *testing.T) {
 func Test_ItDoesntPassAuthenticationNoAuthorization(t *testing.T) {
 	SetUpTest()
 
-	authenticator, err := grpc.GetAuthenticatorWithCorrectKey("test-aud")
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
 	if err != nil {
 		t.Fatalf("failed to get authenticator: %v", err)
 	}
@@ -149,25 +154,149 @@ func Test_ItDoesntPassAuthenticationNoAuthorization(t *testing.T) {
 func Test_ItDoesntPassAuthenticationSignedBySomeoneElse(t *testing.T) {
 	SetUpTest()
 
-	authenticator, err := grpc.GetAuthenticatorWithCorrectKey("test-aud")
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
 	if err != nil {
 		t.Fatalf("failed to get authenticator: %v", err)
 	}
 
-	signedJwt, err := grpc.SignJwtWithFile("test-aud", "ecfmp-auth", "../../docker/dev_private_key_2.pem")
+	signedJwt, err := SignJwtWithFile("test-aud", "ecfmp-auth", "../../docker/dev_private_key_2.pem")
 	if err != nil {
 		t.Fatalf("failed to sign jwt: %v", err)
 	}
 
-	authenticator, err := grpc.GetAuthenticatorWithCorrectKey("test-aud")
+	// Set our signed jwt in the context
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", signedJwt))
+
+	// Call the auth interceptor and with our signed jwt and verify it doesnt pass
+	nextCalled := false
+	_, err = authenticator.AuthInterceptor(ctx, nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		nextCalled = true
+		return nil, nil
+	})
+
+	assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
+	assert.False(t, nextCalled)
+}
+
+func Test_ItPassesAuthenticationWithFallbackToSecondKey(t *testing.T) {
+	SetUpTest()
+
+	authenticator, err := GetAuthenticatorWithKeyFiles("test-aud", "../../docker/dev_public_key.pub", "../../docker/dev_public_key_2.pub")
 	if err != nil {
 		t.Fatalf("failed to get authenticator: %v", err)
 	}
 
-	// Set our signed jwt in the context
+	signedJwt, err := SignJwtWithFile("test-aud", "ecfmp-auth", "../../docker/dev_private_key_2.pem")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", signedJwt))
+
+	// Token has no kid, so every key should be tried
+	nextCalled := false
+	_, err = authenticator.AuthInterceptor(ctx, nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		nextCalled = true
+		return nil, nil
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+}
+
+func Test_ItPassesAuthenticationWithKeySelectedByKid(t *testing.T) {
+	SetUpTest()
+
+	authenticator, err := GetAuthenticatorWithKeyFiles("test-aud", "../../docker/dev_public_key.pub", "../../docker/dev_public_key_2.pub")
+	if err != nil {
+		t.Fatalf("failed to get authenticator: %v", err)
+	}
+
+	signedJwt, err := SignJwtWithFileAndKeyId("test-aud", "ecfmp-auth", "../../docker/dev_private_key_2.pem", "dev_public_key_2")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", signedJwt))
+
+	nextCalled := false
+	_, err = authenticator.AuthInterceptor(ctx, nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		nextCalled = true
+		return nil, nil
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+}
+
+func Test_ItDoesntPassAuthenticationKidForWrongKey(t *testing.T) {
+	SetUpTest()
+
+	authenticator, err := GetAuthenticatorWithKeyFiles("test-aud", "../../docker/dev_public_key.pub", "../../docker/dev_public_key_2.pub")
+	if err != nil {
+		t.Fatalf("failed to get authenticator: %v", err)
+	}
+
+	// Signed by the second key, but claims to be signed by the first
+	signedJwt, err := SignJwtWithFileAndKeyId("test-aud", "ecfmp-auth", "../../docker/dev_private_key_2.pem", "dev_public_key")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", signedJwt))
+
+	nextCalled := false
+	_, err = authenticator.AuthInterceptor(ctx, nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		nextCalled = true
+		return nil, nil
+	})
+
+	assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
+	assert.False(t, nextCalled)
+}
+
+func Test_ItPassesAuthenticationWithKidNotMatchingTheKeyFileName(t *testing.T) {
+	SetUpTest()
+
+	authenticator, err := GetAuthenticatorWithKeyFiles("test-aud", "../../docker/dev_public_key.pub")
+	if err != nil {
+		t.Fatalf("failed to get authenticator: %v", err)
+	}
+
+	// The issuer names the key ecfmp, but it's configured as dev_public_key.pub
+	signedJwt, err := SignJwtWithFileAndKeyId("test-aud", "ecfmp-auth", "../../docker/dev_private_key.pem", "ecfmp")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", signedJwt))
+
+	nextCalled := false
+	_, err = authenticator.AuthInterceptor(ctx, nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		nextCalled = true
+		return nil, nil
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+}
+
+func Test_ItDoesntPassAuthenticationUnknownKid(t *testing.T) {
+	SetUpTest()
+
+	authenticator, err := GetAuthenticatorWithKeyFiles("test-aud", "../../docker/dev_public_key.pub")
+	if err != nil {
+		t.Fatalf("failed to get authenticator: %v", err)
+	}
+
+	// Signed by a key that isn't configured
+	signedJwt, err := SignJwtWithFileAndKeyId("test-aud", "ecfmp-auth", "../../docker/dev_private_key_2.pem", "some-other-key")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
 	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", signedJwt))
 
-	// Call the auth interceptor and with our signed jwt and verify it doesnt pass
 	nextCalled := false
 	_, err = authenticator.AuthInterceptor(ctx, nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
 		nextCalled = true
@@ -177,3 +306,193 @@ func Test_ItDoesntPassAuthenticationSignedBySomeoneElse(t *testing.T) {
 	assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
 	assert.False(t, nextCalled)
 }
+
+func Test_ItLoadsKeySetFromDirectory(t *testing.T) {
+	directory := t.TempDir()
+	for _, name := range []string{"dev_public_key.pub", "dev_public_key_2.pub"} {
+		contents, err := os.ReadFile(filepath.Join("../../docker", name))
+		if err != nil {
+			t.Fatalf("failed to read public key file: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(directory, name), contents, 0600); err != nil {
+			t.Fatalf("failed to write public key file: %v", err)
+		}
+	}
+
+	// Files that aren't keys are ignored
+	if err := os.WriteFile(filepath.Join(directory, "README.md"), []byte("not a key"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	keySet, err := grpc.LoadKeySet(directory)
+	if err != nil {
+		t.Fatalf("failed to load key set: %v", err)
+	}
+
+	assert.Len(t, keySet.Keys(), 2)
+	_, found := keySet.KeyById("dev_public_key_2")
+	assert.True(t, found)
+}
+
+func Test_ItReturnsAnErrorForInvalidKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.pem")
+	if err := os.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	keySet, err := grpc.LoadKeySet(path)
+	assert.Nil(t, keySet)
+	assert.NotNil(t, err)
+}
+
+func Test_ItReturnsAnErrorForMissingKeyFile(t *testing.T) {
+	keySet, err := grpc.LoadKeySet("../../docker/does_not_exist.pub")
+	assert.Nil(t, keySet)
+	assert.NotNil(t, err)
+}
+
+func Test_ItReturnsAnErrorForEmptyKeySet(t *testing.T) {
+	keySet, err := grpc.NewKeySet()
+	assert.Nil(t, keySet)
+	assert.NotNil(t, err)
+}
+
+func Test_ItPassesAuthenticationForSupportedKeyTypes(t *testing.T) {
+	SetUpTest()
+
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	edPublicKey, edPrivateKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name       string
+		method     jwt.SigningMethod
+		privateKey interface{}
+		publicKey  interface{}
+	}{
+		{"ES256", jwt.SigningMethodES256, p256Key, &p256Key.PublicKey},
+		{"ES384", jwt.SigningMethodES384, p384Key, &p384Key.PublicKey},
+		{"EdDSA", jwt.SigningMethodEdDSA, edPrivateKey, edPublicKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := WritePublicKeyFile(t.TempDir(), "key.pem", tt.publicKey)
+			authenticator, err := GetAuthenticatorWithKeyFiles("test-aud", path)
+			if err != nil {
+				t.Fatalf("failed to get authenticator: %v", err)
+			}
+
+			signedJwt, err := SignJwtWithKey("test-aud", "ecfmp-auth", tt.method, tt.privateKey)
+			if err != nil {
+				t.Fatalf("failed to sign jwt: %v", err)
+			}
+
+			nextCalled, err := callInterceptor(authenticator, signedJwt)
+			assert.Nil(t, err)
+			assert.True(t, nextCalled)
+		})
+	}
+}
+
+func Test_ItDoesntPassAuthenticationWithMixedKeyTypesAndWrongSigner(t *testing.T) {
+	SetUpTest()
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherEcKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	path := WritePublicKeyFile(t.TempDir(), "key.pem", &ecKey.PublicKey)
+
+	authenticator, err := GetAuthenticatorWithKeyFiles("test-aud", "../../docker/dev_public_key.pub", path)
+	if err != nil {
+		t.Fatalf("failed to get authenticator: %v", err)
+	}
+
+	signedJwt, err := SignJwtWithKey("test-aud", "ecfmp-auth", jwt.SigningMethodES256, otherEcKey)
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	nextCalled, err := callInterceptor(authenticator, signedJwt)
+	assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
+	assert.False(t, nextCalled)
+}
+
+func Test_ItDoesntPassAuthenticationWithAlgorithmNotSuitedToKey(t *testing.T) {
+	SetUpTest()
+
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
+	if err != nil {
+		t.Fatalf("failed to get authenticator: %v", err)
+	}
+
+	publicKey, err := GetPublicKeyBytes()
+	if err != nil {
+		t.Fatalf("failed to get public key: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		key    interface{}
+	}{
+		// The classic algorithm confusion attack, using the public key as an HMAC secret
+		{"HS256", jwt.SigningMethodHS256, publicKey},
+		{"none", jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signedJwt, err := SignJwtWithKey("test-aud", "ecfmp-auth", tt.method, tt.key)
+			if err != nil {
+				t.Fatalf("failed to sign jwt: %v", err)
+			}
+
+			nextCalled, err := callInterceptor(authenticator, signedJwt)
+			assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
+			assert.False(t, nextCalled)
+		})
+	}
+}
+
+func Test_ItReturnsAnErrorForUnsupportedCurve(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	path := WritePublicKeyFile(t.TempDir(), "key.pem", &key.PublicKey)
+
+	keySet, err := grpc.LoadKeySet(path)
+	assert.Nil(t, keySet)
+	assert.NotNil(t, err)
+}
+
+func Test_ItPutsTheCallerIdentityInTheContext(t *testing.T) {
+	SetUpTest()
+
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
+	if err != nil {
+		t.Fatalf("failed to get authenticator: %v", err)
+	}
+
+	signedJwt, err := SignJwtWithClaims(jwt.MapClaims{
+		"aud":       "test-aud",
+		"iss":       "ecfmp-auth",
+		"sub":       "ecfmp-api",
+		"name":      "ECFMP API",
+		"client_id": "client-1",
+	})
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", signedJwt))
+
+	var identity grpc.Identity
+	var found bool
+	_, err = authenticator.AuthInterceptor(ctx, nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		identity, found = grpc.IdentityFromContext(ctx)
+		return nil, nil
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, grpc.Identity{Subject: "ecfmp-api", Name: "ECFMP API", ClientId: "client-1"}, identity)
+}
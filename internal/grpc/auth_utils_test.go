@@ -1,8 +1,12 @@
 package grpc_test
 
 import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
 	"log"
 	"os"
+	"path/filepath"
 
 	grpc "ecfmp/discord/internal/grpc"
 	"github.com/golang-jwt/jwt/v5"
@@ -13,11 +17,19 @@ func SignJwt(audience string, issuer string) (string, error) {
 }
 
 func SignJwtWithFile(audience string, issuer string, filePath string) (string, error) {
+	return SignJwtWithFileAndKeyId(audience, issuer, filePath, "")
+}
+
+func SignJwtWithFileAndKeyId(audience string, issuer string, filePath string, keyId string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
 		"aud": audience,
 		"iss": issuer,
 	})
 
+	if keyId != "" {
+		token.Header["kid"] = keyId
+	}
+
 	privateKey, err := os.ReadFile(filePath)
 	if err != nil {
 		log.Fatalf("failed to read private key file: %v", err)
@@ -31,6 +43,44 @@ func SignJwtWithFile(audience string, issuer string, filePath string) (string, e
 	return token.SignedString(privateKeyPem)
 }
 
+func SignJwtWithClaims(claims jwt.MapClaims) (string, error) {
+	privateKey, err := os.ReadFile("../../docker/dev_private_key.pem")
+	if err != nil {
+		log.Fatalf("failed to read private key file: %v", err)
+	}
+
+	privateKeyPem, err := jwt.ParseRSAPrivateKeyFromPEM(privateKey)
+	if err != nil {
+		log.Fatalf("failed to parse private key: %v", err)
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(privateKeyPem)
+}
+
+func SignJwtWithKey(audience string, issuer string, method jwt.SigningMethod, key interface{}) (string, error) {
+	token := jwt.NewWithClaims(method, jwt.MapClaims{
+		"aud": audience,
+		"iss": issuer,
+	})
+
+	return token.SignedString(key)
+}
+
+func WritePublicKeyFile(directory string, name string, publicKey crypto.PublicKey) string {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		log.Fatalf("failed to marshal public key: %v", err)
+	}
+
+	path := filepath.Join(directory, name)
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes}), 0600)
+	if err != nil {
+		log.Fatalf("failed to write public key file: %v", err)
+	}
+
+	return path
+}
+
 func GetPublicKeyBytes() ([]byte, error) {
 	publicKey, err := os.ReadFile("../../docker/dev_public_key.pub")
 	if err != nil {
@@ -49,11 +99,34 @@ func GetPublicKeyString() (string, error) {
 	return string(publicKeyBytes), nil
 }
 
-func GetAuthenticatorWithCorrectKey(audience string) (*grpc.JwtAuthInterceptor, error) {
+func GetKeySetWithCorrectKey() (*grpc.KeySet, error) {
 	publicKey, err := GetPublicKeyBytes()
 	if err != nil {
 		log.Fatalf("failed to read public key file: %v", err)
 	}
 
-	return grpc.NewJwtAuthInterceptor(publicKey, audience), nil
+	key, err := grpc.ParsePublicKey("", publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return grpc.NewKeySet(key)
+}
+
+func GetAuthenticatorWithCorrectKey(audience string) (*grpc.JwtAuthInterceptor, error) {
+	keySet, err := GetKeySetWithCorrectKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return grpc.NewJwtAuthInterceptor(keySet, audience, "ecfmp-auth"), nil
+}
+
+func GetAuthenticatorWithKeyFiles(audience string, paths ...string) (*grpc.JwtAuthInterceptor, error) {
+	keySet, err := grpc.LoadKeySet(paths...)
+	if err != nil {
+		return nil, err
+	}
+
+	return grpc.NewJwtAuthInterceptor(keySet, audience, "ecfmp-auth"), nil
 }
@@ -0,0 +1,78 @@
+package grpc
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	"errors"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/**
+ * Translates an error from the message store into the gRPC status returned to the caller, so that every
+ * method reports the same problem with the same code. Problems with the request are logged as warnings, and
+ * anything else as an error, which is reported as Internal with the given message rather than its detail.
+ */
+func storeError(logger *log.Entry, message string, err error) error {
+	var conflict *db.VersionConflictError
+	switch {
+	case errors.Is(err, db.ErrMessageNotFound):
+		logger.Warningf("%v: message not found", message)
+		return status.Error(codes.NotFound, codes.NotFound.String())
+	case errors.Is(err, db.ErrDuplicateClientRequest):
+		logger.Warningf("%v: %v", message, err)
+		return status.Error(codes.AlreadyExists, "client request id has already been used for another message")
+	case errors.As(err, &conflict):
+		logger.Warningf("%v: %v", message, err)
+		return versionConflictStatus(conflict)
+	case errors.Is(err, db.ErrInvalidId):
+		logger.Warningf("%v: %v", message, err)
+		return status.Error(codes.InvalidArgument, "invalid id")
+	case contextStatus(err) != nil:
+		logger.Warningf("%v: %v", message, err)
+		return contextStatus(err)
+	default:
+		logger.Errorf("%v: %v", message, err)
+		return status.Error(codes.Internal, message)
+	}
+}
+
+/**
+ * A version conflict is Aborted, with the version the message is at in the message and in the details, so that
+ * the caller can rebase on it and retry.
+ */
+func versionConflictStatus(conflict *db.VersionConflictError) error {
+	conflictStatus := status.New(codes.Aborted, conflict.Error())
+	withDetails, err := conflictStatus.WithDetails(&errdetails.ErrorInfo{
+		Reason: "VERSION_CONFLICT",
+		Domain: "discord.ecfmp.vatsim.net",
+		Metadata: map[string]string{
+			"current_version":           strconv.Itoa(conflict.CurrentVersion),
+			"current_client_request_id": conflict.CurrentClientRequestId,
+		},
+	})
+	if err != nil {
+		return conflictStatus.Err()
+	}
+
+	return withDetails.Err()
+}
+
+/**
+ * The status for an error caused by the call's deadline passing, or by the call being cancelled, so that the
+ * caller is told that it ran out of time rather than that the service failed. Returns nil for any other error.
+ */
+func contextStatus(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, codes.DeadlineExceeded.String())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, codes.Canceled.String())
+	default:
+		return nil
+	}
+}
@@ -2,29 +2,41 @@ package grpc
 
 import (
 	"context"
+	"ecfmp/discord/internal/config"
 	db "ecfmp/discord/internal/db"
 	"ecfmp/discord/internal/discord"
+	logConfig "ecfmp/discord/internal/log"
 	pb_discord "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
-	pb_health "ecfmp/discord/proto/health/gen/pb-go/ecfmp.vatsim.net/grpc/health"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	metadata "google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 // server is used to implement helloworld.GreeterServer.
 type server struct {
-	pb_health.UnimplementedHealthServer
 	pb_discord.UnimplementedDiscordServer
 	server    *grpc.Server
-	mongo     *db.Mongo
+	health    *health.Server
+	store     db.MessageStore
 	scheduler discord.Scheduler
 }
 
+/**
+ * Health returns the standard gRPC health service, so that the status of each component can be reported.
+ */
+func (server *server) Health() *health.Server {
+	return server.health
+}
+
 /**
  * Serve the gRPC server
  */
@@ -32,38 +44,140 @@ func (server *server) Serve(listener net.Listener) error {
 	return server.server.Serve(listener)
 }
 
+/**
+ * Stops the gRPC server from accepting new requests and waits for the requests in progress to finish,
+ * cancelling them if they haven't by the time the context is done.
+ */
+func (server *server) GracefulStop(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		server.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logConfig.Subsystem(logConfig.SubsystemGrpc).Warn("Timed out waiting for requests to finish, stopping the gRPC server")
+		server.server.Stop()
+	}
+}
+
+/**
+ * MessagesWriteScope is the scope a restricted caller, such as an API key, must have been granted to create
+ * and update messages.
+ */
+const MessagesWriteScope = "messages:write"
+
+/**
+ * requireMessagesWriteScope checks that the caller may create and update messages.
+ */
+func requireMessagesWriteScope(ctx context.Context) error {
+	identity, ok := IdentityFromContext(ctx)
+	if ok && !identity.Allows(MessagesWriteScope) {
+		logConfig.LoggerFromContext(ctx).Warningf("Request denied: caller does not have the %v scope", MessagesWriteScope)
+		return status.Errorf(codes.PermissionDenied, "the %v scope is required", MessagesWriteScope)
+	}
+
+	return nil
+}
+
 func getClientRequestId(ctx context.Context) (string, error) {
+	logger := logConfig.LoggerFromContext(ctx)
 	metadata, ok := metadata.FromIncomingContext(ctx)
 
 	if !ok {
-		log.Error("Failed to get metadata")
+		logger.Error("Failed to get metadata")
 		return "", fmt.Errorf("failed to get metadata from context")
 	}
 
 	if len(metadata.Get("x-client-request-id")) != 1 {
-		log.Warning("Invalid request: x-client-request-id is required")
+		logger.Warning("Invalid request: x-client-request-id is required")
 		return "", fmt.Errorf("x-client-request-id metadata is required")
 	}
 
 	if metadata.Get("x-client-request-id")[0] == "" {
-		log.Warning("Invalid request: x-client-request-id is empty")
+		logger.Warning("Invalid request: x-client-request-id is empty")
 		return "", fmt.Errorf("x-client-request-id metadata is required")
 	}
 
 	return metadata.Get("x-client-request-id")[0], nil
 }
 
-func validateEmbedFields(embeds []*pb_discord.DiscordEmbeds) error {
+/**
+ * Gets the version the message must be at for an update to be published, from the optional x-expected-version
+ * metadata. It is either a version number, counting from 1, or the client request id that created the version.
+ */
+func getExpectedVersion(ctx context.Context) (db.ExpectedVersion, error) {
+	values := metadata.ValueFromIncomingContext(ctx, "x-expected-version")
+	if len(values) == 0 {
+		return db.ExpectedVersion{}, nil
+	}
+
+	if len(values) != 1 || values[0] == "" {
+		return db.ExpectedVersion{}, fmt.Errorf("x-expected-version metadata must have a single value")
+	}
+
+	if number, err := strconv.Atoi(values[0]); err == nil {
+		if number < 1 {
+			return db.ExpectedVersion{}, fmt.Errorf("x-expected-version must be at least 1")
+		}
+
+		return db.ExpectedVersion{Number: number}, nil
+	}
+
+	return db.ExpectedVersion{ClientRequestId: values[0]}, nil
+}
+
+/**
+ * Gets whether the message should be marked active, from the optional x-message-active metadata. Active messages,
+ * such as those for a flow measure that is still in force, are kept however long ago they last changed. Returns
+ * nil if the request doesn't say.
+ */
+func getMessageActive(ctx context.Context) (*bool, error) {
+	values := metadata.ValueFromIncomingContext(ctx, "x-message-active")
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	if len(values) != 1 {
+		return nil, fmt.Errorf("x-message-active metadata must have a single value")
+	}
+
+	active, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return nil, fmt.Errorf("x-message-active must be true or false")
+	}
+
+	return &active, nil
+}
+
+/**
+ * Marks the message active or not, if the request said to.
+ */
+func (server *server) setMessageActive(ctx context.Context, logger *log.Entry, id string, active *bool) error {
+	if active == nil {
+		return nil
+	}
+
+	if err := server.store.SetDiscordMessageActive(ctx, id, *active); err != nil {
+		return storeError(logger, "Failed to set whether message is active", err)
+	}
+
+	return nil
+}
+
+func validateEmbedFields(logger *log.Entry, embeds []*pb_discord.DiscordEmbeds) error {
 	for _, embed := range embeds {
 		for _, field := range embed.Fields {
 			// Must have name, value and inline
 			if field.Name == "" {
-				log.Warning("Invalid request: embed name is required")
+				logger.Warning("Invalid request: embed name is required")
 				return fmt.Errorf("embed name is required")
 			}
 
 			if field.Value == "" {
-				log.Warning("Invalid request: embed value is required")
+				logger.Warning("Invalid request: embed value is required")
 				return fmt.Errorf("embed value is required")
 			}
 		}
@@ -76,7 +190,12 @@ func validateEmbedFields(embeds []*pb_discord.DiscordEmbeds) error {
  * Implements the Create method of the DiscordServer interface
  */
 func (server *server) Create(ctx context.Context, in *pb_discord.CreateRequest) (*pb_discord.CreateResponse, error) {
-	log.Debug("Create request received")
+	logger := logConfig.LoggerFromContext(ctx)
+	logger.Debug("Create request received")
+
+	if err := requireMessagesWriteScope(ctx); err != nil {
+		return nil, err
+	}
 
 	// Check if the message has already been written, and return the existing id if so
 	clientRequestId, requestIdErr := getClientRequestId(ctx)
@@ -84,42 +203,57 @@ func (server *server) Create(ctx context.Context, in *pb_discord.CreateRequest)
 		return nil, status.Error(codes.InvalidArgument, requestIdErr.Error())
 	}
 
-	log.Debugf("Client request id: %v", clientRequestId)
+	active, activeErr := getMessageActive(ctx)
+	if activeErr != nil {
+		logger.Warningf("Invalid request: %v", activeErr)
+		return nil, status.Error(codes.InvalidArgument, activeErr.Error())
+	}
 
-	existingId, err := server.mongo.GetDiscordMessageByClientRequestId(clientRequestId)
+	existingId, err := server.store.GetDiscordMessageByClientRequestId(ctx, clientRequestId)
 	if err != nil {
-		log.Errorf("Failed to get discord message by client request id: %v", err)
-		return nil, status.Error(codes.Internal, "Failed to get discord message")
+		return nil, storeError(logger, "Failed to get discord message", err)
 	}
 
 	if existingId != nil {
-		log.Infof("Discord message already exists: %v", clientRequestId)
-		return &pb_discord.CreateResponse{Id: existingId.Id}, nil
+		logger.WithField("message_id", existingId.Id).Info("Discord message already exists")
+		return server.repeatedCreate(ctx, logger, existingId, active)
 	}
 
 	// Validate that the channel is set
 	if in.GetChannel() == "" {
-		log.Warning("Invalid request: channel is required")
+		logger.Warning("Invalid request: channel is required")
 		return nil, status.Error(codes.InvalidArgument, "Channel is required")
 	}
 
 	// Validate the embed fields
-	embedFieldsErr := validateEmbedFields(in.Embeds)
+	embedFieldsErr := validateEmbedFields(logger, in.Embeds)
 	if embedFieldsErr != nil {
 		return nil, status.Error(codes.InvalidArgument, embedFieldsErr.Error())
 	}
 
 	// Write the message to the database
-	mongoId, err := server.mongo.WriteDiscordMessage(clientRequestId, in)
+	mongoId, err := server.store.WriteDiscordMessage(ctx, clientRequestId, callerFromContext(ctx), in)
+	if errors.Is(err, db.ErrDuplicateClientRequest) {
+		// A retry of this request was written first, so return the message it wrote
+		existing, getErr := server.store.GetDiscordMessageByClientRequestId(ctx, clientRequestId)
+		if getErr == nil && existing != nil {
+			logger.WithField("message_id", existing.Id).Info("Discord message already exists")
+			return server.repeatedCreate(ctx, logger, existing, active)
+		}
+	}
+
 	if err != nil {
-		log.Errorf("Failed to write discord message: %v", err)
-		return nil, status.Error(codes.Internal, "Failed to create discord message")
+		return nil, storeError(logger, "Failed to create discord message", err)
+	}
+
+	if err := server.setMessageActive(ctx, logger, mongoId, active); err != nil {
+		return nil, err
 	}
 
 	// Schedule the message to be published
-	server.scheduler.ScheduleMessage(mongoId)
+	server.scheduler.ScheduleMessage(ctx, mongoId)
 
-	log.Infof("Written discord message %v", mongoId)
+	logger.WithField("message_id", mongoId).Info("Written discord message")
 	return &pb_discord.CreateResponse{Id: mongoId}, nil
 }
 
@@ -127,59 +261,136 @@ func (server *server) Create(ctx context.Context, in *pb_discord.CreateRequest)
  * Implements the UpdateMessage of the DiscordServer proto
  */
 func (server *server) Update(ctx context.Context, in *pb_discord.UpdateRequest) (*pb_discord.UpdateResponse, error) {
+	logger := logConfig.LoggerFromContext(ctx)
+	if err := requireMessagesWriteScope(ctx); err != nil {
+		return nil, err
+	}
+
 	if in.GetId() == "" {
-		log.Warning("Invalid update request: Id is required")
+		logger.Warning("Invalid update request: Id is required")
 		return nil, status.Error(codes.InvalidArgument, "Id is required")
 	}
 
+	logger = logger.WithField("message_id", in.GetId())
+
 	// Validate the embed fields
-	embedFieldsErr := validateEmbedFields(in.Embeds)
+	embedFieldsErr := validateEmbedFields(logger, in.Embeds)
 	if embedFieldsErr != nil {
 		return nil, status.Error(codes.InvalidArgument, embedFieldsErr.Error())
 	}
 
-	// Check if the message has already been written, and return the existing id if so
+	// Check if the version has already been written, in which case this is either a retry or a mistake
 	clientRequestId, requestIdErr := getClientRequestId(ctx)
 	if requestIdErr != nil {
 		return nil, status.Error(codes.InvalidArgument, requestIdErr.Error())
 	}
 
-	mongoErr := server.mongo.PublishMessageVersion(clientRequestId, in)
-	if mongoErr != nil && mongoErr.Error() == "message not found" {
-		log.Warning("Invalid update request: message not found")
-		return nil, status.Error(codes.NotFound, codes.NotFound.String())
+	// Only publish the version if the message is at the version the caller expects, if it expects one
+	expectedVersion, expectedVersionErr := getExpectedVersion(ctx)
+	if expectedVersionErr != nil {
+		logger.Warningf("Invalid update request: %v", expectedVersionErr)
+		return nil, status.Error(codes.InvalidArgument, expectedVersionErr.Error())
+	}
+
+	active, activeErr := getMessageActive(ctx)
+	if activeErr != nil {
+		logger.Warningf("Invalid update request: %v", activeErr)
+		return nil, status.Error(codes.InvalidArgument, activeErr.Error())
+	}
+
+	existing, err := server.store.GetDiscordMessageByClientRequestId(ctx, clientRequestId)
+	if err != nil {
+		return nil, storeError(logger, "Failed to get discord message", err)
+	}
+
+	if existing != nil {
+		return server.repeatedUpdate(ctx, logger, existing, clientRequestId, in, active)
 	}
 
-	if mongoErr != nil {
-		log.Errorf("Failed to update message: %v", mongoErr)
-		return nil, status.Error(codes.Internal, "Failed to update message")
+	err = server.store.PublishMessageVersion(ctx, clientRequestId, callerFromContext(ctx), in, expectedVersion)
+	if errors.Is(err, db.ErrDuplicateClientRequest) {
+		// A retry of this request was written first, so compare with what it wrote
+		existing, getErr := server.store.GetDiscordMessageByClientRequestId(ctx, clientRequestId)
+		if getErr == nil && existing != nil {
+			return server.repeatedUpdate(ctx, logger, existing, clientRequestId, in, active)
+		}
+	}
+
+	if err != nil {
+		return nil, storeError(logger, "Failed to update message", err)
+	}
+
+	if err := server.setMessageActive(ctx, logger, in.Id, active); err != nil {
+		return nil, err
 	}
 
 	// Schedule the message update to be published
-	server.scheduler.ScheduleMessage(in.Id)
+	server.scheduler.ScheduleMessage(ctx, in.Id)
 
 	return &pb_discord.UpdateResponse{}, nil
 }
 
 /**
- * Implements the Check method of the HealthServer interface
+ * Responds to a create whose client request id has already been used, with the message it created. The message
+ * is still marked active or not, in case that is what failed the first time.
+ */
+func (server *server) repeatedCreate(ctx context.Context, logger *log.Entry, existing *db.DiscordMessage, active *bool) (*pb_discord.CreateResponse, error) {
+	if err := server.setMessageActive(ctx, logger, existing.Id, active); err != nil {
+		return nil, err
+	}
+
+	return &pb_discord.CreateResponse{Id: existing.Id}, nil
+}
+
+/**
+ * Responds to an update whose client request id has already been used. A retry of the update that used it,
+ * for the same message with the same payload, succeeds without publishing anything more, as its version has
+ * already been written. Anything else is rejected, rather than publishing a different payload than was asked for.
  */
-func (server *server) Check(ctx context.Context, in *pb_health.HealthCheckRequest) (*pb_health.HealthCheckResponse, error) {
-	if !server.scheduler.Ready() {
-		return &pb_health.HealthCheckResponse{Status: pb_health.HealthCheckResponse_NOT_SERVING}, nil
+func (server *server) repeatedUpdate(ctx context.Context, logger *log.Entry, existing *db.DiscordMessage, clientRequestId string, in *pb_discord.UpdateRequest, active *bool) (*pb_discord.UpdateResponse, error) {
+	version := existing.Version(clientRequestId)
+	if existing.Id == in.GetId() && version != nil && version.Hash() == db.PayloadHash(in.GetContent(), db.DiscordEmbedToMongo(&in.Embeds)) {
+		logger.Info("Discord message version already exists")
+		if err := server.setMessageActive(ctx, logger, existing.Id, active); err != nil {
+			return nil, err
+		}
+
+		return &pb_discord.UpdateResponse{}, nil
 	}
 
-	return &pb_health.HealthCheckResponse{Status: pb_health.HealthCheckResponse_SERVING}, nil
+	logger.WithField("existing_message_id", existing.Id).Warning("Invalid update request: client request id has already been used for another message or payload")
+	return nil, status.Error(codes.AlreadyExists, "client request id has already been used for another message or payload")
 }
 
 /**
- * Start the gRPC server
+ * Start the gRPC server, serving TLS if it is configured
  */
-func NewServer(mongo *db.Mongo, scheduler discord.Scheduler, interceptor AuthInterceptor) *server {
-	s := grpc.NewServer(grpc.UnaryInterceptor(interceptor.AuthInterceptor))
-	server := &server{mongo: mongo, server: s, scheduler: scheduler}
+func NewServer(config config.Server, store db.MessageStore, scheduler discord.Scheduler, interceptor AuthInterceptor, options ...grpc.ServerOption) (*server, error) {
+	if config.Tls.Enabled() {
+		credentials, err := NewTransportCredentials(TlsConfig{
+			CertFile:          config.Tls.CertFile,
+			KeyFile:           config.Tls.KeyFile,
+			ClientCaFile:      config.Tls.ClientCaFile,
+			RequireClientCert: config.Tls.RequireClientCert(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure tls: %w", err)
+		}
+
+		log.Info("TLS enabled")
+		options = append(options, grpc.Creds(credentials))
+	} else {
+		log.Warn("TLS is not enabled, the gRPC server will accept plaintext connections")
+	}
+
+	s := grpc.NewServer(append(options, grpc.ChainUnaryInterceptor(TracingInterceptor, LoggingInterceptor, MetricsInterceptor, RecoveryInterceptor, interceptor.AuthInterceptor))...)
+	server := &server{store: store, server: s, health: health.NewServer(), scheduler: scheduler}
 	pb_discord.RegisterDiscordServer(s, server)
-	pb_health.RegisterHealthServer(s, server)
+	RegisterAdminServer(s, NewAdminServer(store, scheduler))
+
+	// Not serving until the health checks have run
+	server.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(s, server.health)
 
-	return server
+	return server, nil
 }
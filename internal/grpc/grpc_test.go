@@ -2,19 +2,25 @@ package grpc_test
 
 import (
 	"context"
+	"ecfmp/discord/internal/config"
 	db "ecfmp/discord/internal/db"
+	"ecfmp/discord/internal/discord"
 	ecfmp_grpc "ecfmp/discord/internal/grpc"
+	"ecfmp/discord/internal/health"
 	pb_discord "ecfmp/discord/proto/discord/gen/pb-go/ecfmp.vatsim.net/grpc/discord"
-	pb_health "ecfmp/discord/proto/health/gen/pb-go/ecfmp.vatsim.net/grpc/health"
+	"fmt"
 	"net"
-	"os"
 	"testing"
+	"time"
 
+	jwt "github.com/golang-jwt/jwt/v5"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
@@ -25,8 +31,8 @@ const bufSize = 1024 * 1024
 
 var lis *bufconn.Listener
 
-type TestMongo struct {
-	client   *db.Mongo
+type TestStore struct {
+	client   db.MessageStore
 	tearDown func()
 }
 
@@ -34,9 +40,11 @@ type MockScheduler struct {
 	isReady   bool
 	callCount int
 	callId    string
+	paused    bool
+	status    discord.SchedulerStatus
 }
 
-func (scheduler *MockScheduler) ScheduleMessage(id string) {
+func (scheduler *MockScheduler) ScheduleMessage(ctx context.Context, id string) {
 	scheduler.callCount++
 	scheduler.callId = id
 }
@@ -45,17 +53,25 @@ func (scheduler *MockScheduler) Ready() bool {
 	return scheduler.isReady
 }
 
-func SetupTest(t *testing.T, realInterceptor bool, schedulerReady bool) (TestMongo, *MockScheduler) {
+func (scheduler *MockScheduler) Pause() {
+	scheduler.paused = true
+}
+
+func (scheduler *MockScheduler) Resume() {
+	scheduler.paused = false
+}
+
+func (scheduler *MockScheduler) Status() discord.SchedulerStatus {
+	status := scheduler.status
+	status.Paused = scheduler.paused
+	return status
+}
+
+func SetupTest(t *testing.T, realInterceptor bool, schedulerReady bool) (TestStore, *MockScheduler) {
 	// Turn off logging except for fatals
 	log.SetLevel(log.FatalLevel)
 
-	// Mongo setup
-	mongo, err := db.NewMongo()
-	if err != nil {
-		t.Errorf("Failed to connect to mongo: %v", err)
-	}
-
-	mongo.Client.Database(os.Getenv("MONGO_DB")).Collection("discord_messages").Drop(context.Background())
+	store := db.NewMemory()
 
 	// Mock scheduler
 	scheduler := &MockScheduler{
@@ -64,30 +80,43 @@ func SetupTest(t *testing.T, realInterceptor bool, schedulerReady bool) (TestMon
 
 	var interceptor ecfmp_grpc.AuthInterceptor
 	if realInterceptor {
-		publicKeyBytes, err := GetPublicKeyBytes()
+		keySet, err := GetKeySetWithCorrectKey()
 		if err != nil {
-			t.Errorf("Failed to get public key bytes: %v", err)
+			t.Errorf("Failed to get key set: %v", err)
 		}
 
-		interceptor = ecfmp_grpc.NewJwtAuthInterceptor(publicKeyBytes, "test-aud")
+		interceptor = ecfmp_grpc.NewJwtAuthInterceptor(keySet, "test-aud", "ecfmp-auth")
 	} else {
 		interceptor = ecfmp_grpc.NewNullInterceptor()
 	}
 
 	// gRPC setup
 	lis = bufconn.Listen(bufSize)
-	s := ecfmp_grpc.NewServer(mongo, scheduler, interceptor)
+	s, err := ecfmp_grpc.NewServer(config.Default().Server, store, scheduler, interceptor)
+	if err != nil {
+		t.Errorf("Failed to create server: %v", err)
+	}
+
+	// Report the scheduler's health as it would be in the real server
+	checker := health.NewChecker(s.Health(), time.Minute)
+	checker.AddCheck("scheduler", func(context.Context) error {
+		if !scheduler.Ready() {
+			return fmt.Errorf("scheduler not ready")
+		}
+
+		return nil
+	})
+	checker.RunChecks(context.Background())
+
 	go func() {
 		if err := s.Serve(lis); err != nil {
 			log.Fatalf("Server exited with error: %v", err)
 		}
 	}()
 
-	return TestMongo{
-		client: mongo,
-		tearDown: func() {
-			mongo.Client.Disconnect(context.Background())
-		},
+	return TestStore{
+		client:   store,
+		tearDown: func() {},
 	}, scheduler
 }
 
@@ -160,7 +189,7 @@ func Test_ItCreatesADiscordMessage(t *testing.T) {
 
 	assert.Nil(t, err)
 	responseId := resp.GetId()
-	mongoMessage, err := mongo.client.GetDiscordMessageById(responseId)
+	mongoMessage, err := mongo.client.GetDiscordMessageById(context.Background(), responseId)
 
 	assert.Nil(t, err)
 	assert.Equal(t, responseId, mongoMessage.Id)
@@ -183,6 +212,47 @@ func Test_ItCreatesADiscordMessage(t *testing.T) {
 	assert.Equal(t, responseId, scheduler.callId)
 }
 
+func Test_ItCreatesAnActiveDiscordMessage(t *testing.T) {
+	mongo, scheduler := SetupTest(t, false, true)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := pb_discord.NewDiscordClient(grpcClient.conn)
+
+	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id", "x-message-active", "true")
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	resp, err := client.Create(ctx, &pb_discord.CreateRequest{Channel: "1234567890", Content: "Hello World!"})
+
+	// Then
+	assert.Nil(t, err)
+	mongoMessage, _ := mongo.client.GetDiscordMessageById(context.Background(), resp.GetId())
+	assert.True(t, mongoMessage.Active)
+	assert.Equal(t, 1, scheduler.callCount)
+}
+
+func Test_ItDoesntCreateADiscordMessageWithAnInvalidActiveFlag(t *testing.T) {
+	mongo, scheduler := SetupTest(t, false, true)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := pb_discord.NewDiscordClient(grpcClient.conn)
+
+	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id", "x-message-active", "maybe")
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	_, err := client.Create(ctx, &pb_discord.CreateRequest{Channel: "1234567890", Content: "Hello World!"})
+
+	// Then
+	assert.Equal(t, status.Error(codes.InvalidArgument, "x-message-active must be true or false"), err)
+	assert.Equal(t, 0, scheduler.callCount)
+
+	mongoMessage, _ := mongo.client.GetDiscordMessageByClientRequestId(context.Background(), "my-client-request-id")
+	assert.Nil(t, mongoMessage)
+}
+
 func Test_ItCreatesADiscordMessageWithNoContent(t *testing.T) {
 	mongo, scheduler := SetupTest(t, false, true)
 	defer mongo.tearDown()
@@ -223,7 +293,7 @@ func Test_ItCreatesADiscordMessageWithNoContent(t *testing.T) {
 
 	assert.Nil(t, err)
 	responseId := resp.GetId()
-	mongoMessage, err := mongo.client.GetDiscordMessageById(responseId)
+	mongoMessage, err := mongo.client.GetDiscordMessageById(context.Background(), responseId)
 
 	assert.Nil(t, err)
 	assert.Equal(t, responseId, mongoMessage.Id)
@@ -289,7 +359,7 @@ func Test_ItAllowsCreateIfAuthenticated(t *testing.T) {
 
 	assert.Nil(t, err)
 	responseId := resp.GetId()
-	mongoMessage, err := mongo.client.GetDiscordMessageById(responseId)
+	mongoMessage, err := mongo.client.GetDiscordMessageById(context.Background(), responseId)
 
 	assert.Nil(t, err)
 	assert.Equal(t, responseId, mongoMessage.Id)
@@ -351,7 +421,7 @@ func Test_ItReturnsPrexistingIdIfRequestAlreadyExists(t *testing.T) {
 
 	client := pb_discord.NewDiscordClient(grpcClient.conn)
 
-	mongoId, _ := mongo.client.WriteDiscordMessage("my-client-request-id", &pb_discord.CreateRequest{Content: "Hello, world!"})
+	mongoId, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Content: "Hello, world!"})
 
 	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id")
 	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
@@ -580,11 +650,11 @@ func Test_ItDoesAHealthCheck(t *testing.T) {
 	grpcClient := setupGrpcClient()
 	defer grpcClient.close()
 
-	client := pb_health.NewHealthClient(grpcClient.conn)
+	client := healthpb.NewHealthClient(grpcClient.conn)
 
-	resp, err := client.Check(context.Background(), &pb_health.HealthCheckRequest{})
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
 	assert.Nil(t, err)
-	assert.Equal(t, resp.Status, pb_health.HealthCheckResponse_SERVING)
+	assert.Equal(t, resp.Status, healthpb.HealthCheckResponse_SERVING)
 }
 
 func Test_ItDoesAFailedHealthCheck(t *testing.T) {
@@ -594,11 +664,11 @@ func Test_ItDoesAFailedHealthCheck(t *testing.T) {
 	grpcClient := setupGrpcClient()
 	defer grpcClient.close()
 
-	client := pb_health.NewHealthClient(grpcClient.conn)
+	client := healthpb.NewHealthClient(grpcClient.conn)
 
-	resp, err := client.Check(context.Background(), &pb_health.HealthCheckRequest{})
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
 	assert.Nil(t, err)
-	assert.Equal(t, resp.Status, pb_health.HealthCheckResponse_NOT_SERVING)
+	assert.Equal(t, resp.Status, healthpb.HealthCheckResponse_NOT_SERVING)
 }
 
 func Test_ItDoesAHealthCheckIfUnauthenticated(t *testing.T) {
@@ -608,11 +678,11 @@ func Test_ItDoesAHealthCheckIfUnauthenticated(t *testing.T) {
 	grpcClient := setupGrpcClient()
 	defer grpcClient.close()
 
-	client := pb_health.NewHealthClient(grpcClient.conn)
+	client := healthpb.NewHealthClient(grpcClient.conn)
 
-	resp, err := client.Check(context.Background(), &pb_health.HealthCheckRequest{})
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
 	assert.Nil(t, err)
-	assert.Equal(t, resp.Status, pb_health.HealthCheckResponse_SERVING)
+	assert.Equal(t, resp.Status, healthpb.HealthCheckResponse_SERVING)
 }
 
 func Test_ItUpdatesAMessage(t *testing.T) {
@@ -624,7 +694,7 @@ func Test_ItUpdatesAMessage(t *testing.T) {
 
 	client := pb_discord.NewDiscordClient(grpcClient.conn)
 
-	mongoId, _ := mongo.client.WriteDiscordMessage("my-client-request-id", &pb_discord.CreateRequest{Content: "Hello, world!"})
+	mongoId, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Content: "Hello, world!"})
 
 	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id-2")
 	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
@@ -660,7 +730,7 @@ func Test_ItUpdatesAMessage(t *testing.T) {
 	assert.Nil(t, err)
 
 	// Then
-	mongoMessage, err := mongo.client.GetDiscordMessageById(mongoId)
+	mongoMessage, err := mongo.client.GetDiscordMessageById(context.Background(), mongoId)
 	assert.Nil(t, err)
 	assert.Equal(t, mongoId, mongoMessage.Id)
 	assert.Equal(t, 2, len(mongoMessage.Versions))
@@ -692,7 +762,7 @@ func Test_ItUpdatesAMessageWithNoContent(t *testing.T) {
 
 	client := pb_discord.NewDiscordClient(grpcClient.conn)
 
-	mongoId, _ := mongo.client.WriteDiscordMessage("my-client-request-id", &pb_discord.CreateRequest{Content: "Hello, world!"})
+	mongoId, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Content: "Hello, world!"})
 
 	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id-2")
 	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
@@ -728,7 +798,7 @@ func Test_ItUpdatesAMessageWithNoContent(t *testing.T) {
 	assert.Nil(t, err)
 
 	// Then
-	mongoMessage, err := mongo.client.GetDiscordMessageById(mongoId)
+	mongoMessage, err := mongo.client.GetDiscordMessageById(context.Background(), mongoId)
 	assert.Nil(t, err)
 	assert.Equal(t, mongoId, mongoMessage.Id)
 	assert.Equal(t, 2, len(mongoMessage.Versions))
@@ -760,7 +830,7 @@ func Test_ItUpdatesAMessageIfAuthenticated(t *testing.T) {
 
 	client := pb_discord.NewDiscordClient(grpcClient.conn)
 
-	mongoId, _ := mongo.client.WriteDiscordMessage("my-client-request-id", &pb_discord.CreateRequest{Content: "Hello, world!"})
+	mongoId, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Content: "Hello, world!"})
 
 	token, tokenErr := SignJwt("test-aud", "ecfmp-auth")
 	assert.Nil(t, tokenErr)
@@ -799,7 +869,7 @@ func Test_ItUpdatesAMessageIfAuthenticated(t *testing.T) {
 	assert.Nil(t, err)
 
 	// Then
-	mongoMessage, err := mongo.client.GetDiscordMessageById(mongoId)
+	mongoMessage, err := mongo.client.GetDiscordMessageById(context.Background(), mongoId)
 	assert.Nil(t, err)
 	assert.Equal(t, mongoId, mongoMessage.Id)
 	assert.Equal(t, 2, len(mongoMessage.Versions))
@@ -814,7 +884,7 @@ func Test_ItRejectsAMessageIfNotAuthenticated(t *testing.T) {
 
 	client := pb_discord.NewDiscordClient(grpcClient.conn)
 
-	mongoId, _ := mongo.client.WriteDiscordMessage("my-client-request-id", &pb_discord.CreateRequest{Content: "Hello, world!"})
+	mongoId, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Content: "Hello, world!"})
 
 	// Token is signed with a different key
 	token, tokenErr := SignJwtWithFile("test-aud", "ecfmp-auth", "../../docker/dev_private_key_2.pem")
@@ -864,7 +934,7 @@ func Test_ItDoesntUpdateAMessageNotFound(t *testing.T) {
 
 	client := pb_discord.NewDiscordClient(grpcClient.conn)
 
-	mongo.client.WriteDiscordMessage("my-client-request-id", &pb_discord.CreateRequest{Content: "Hello, world!"})
+	mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Content: "Hello, world!"})
 
 	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id-2")
 	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
@@ -876,6 +946,209 @@ func Test_ItDoesntUpdateAMessageNotFound(t *testing.T) {
 	assert.Equal(t, 0, scheduler.callCount)
 }
 
+func Test_ItDoesntUpdateAMessageWithAnInvalidId(t *testing.T) {
+	mongo, _ := SetupTest(t, false, true)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := pb_discord.NewDiscordClient(grpcClient.conn)
+
+	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id")
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	_, err := client.Update(ctx, &pb_discord.UpdateRequest{Id: "not-an-id", Content: "Hello, world, again!"})
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func Test_ItDoesntUpdateAMessageWithAClientRequestIdUsedByAnotherMessage(t *testing.T) {
+	mongo, scheduler := SetupTest(t, false, true)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := pb_discord.NewDiscordClient(grpcClient.conn)
+
+	mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Channel: "1234", Content: "Hello, world!"})
+	otherId, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id-2", db.Caller{}, &pb_discord.CreateRequest{Channel: "1234", Content: "Hello, world!"})
+
+	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id")
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	_, err := client.Update(ctx, &pb_discord.UpdateRequest{Id: otherId, Content: "Hello, world, again!"})
+
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	assert.Equal(t, 0, scheduler.callCount)
+
+	mongoMessage, _ := mongo.client.GetDiscordMessageById(context.Background(), otherId)
+	assert.Equal(t, 1, len(mongoMessage.Versions))
+}
+
+func Test_ItUpdatesAMessageIdempotently(t *testing.T) {
+	mongo, scheduler := SetupTest(t, false, true)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := pb_discord.NewDiscordClient(grpcClient.conn)
+
+	id, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Channel: "1234", Content: "Hello, world!"})
+
+	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id-2")
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	update := &pb_discord.UpdateRequest{
+		Id:      id,
+		Content: "Hello, world, again!",
+		Embeds:  []*pb_discord.DiscordEmbeds{{Title: "Hello World!", Fields: []*pb_discord.DiscordEmbedsFields{{Name: "Field 1", Value: "Value 1"}}}},
+	}
+
+	_, err := client.Update(ctx, update)
+	assert.Nil(t, err)
+
+	// When it's retried
+	_, err = client.Update(ctx, update)
+	assert.Nil(t, err)
+
+	// Then
+	mongoMessage, _ := mongo.client.GetDiscordMessageById(context.Background(), id)
+	assert.Equal(t, 2, len(mongoMessage.Versions))
+	assert.Equal(t, 1, scheduler.callCount)
+}
+
+func Test_ItDoesntUpdateAMessageWithAClientRequestIdUsedForAnotherPayload(t *testing.T) {
+	mongo, scheduler := SetupTest(t, false, true)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := pb_discord.NewDiscordClient(grpcClient.conn)
+
+	id, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Channel: "1234", Content: "Hello, world!"})
+
+	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id-2")
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	_, err := client.Update(ctx, &pb_discord.UpdateRequest{Id: id, Content: "Hello, world, again!"})
+	assert.Nil(t, err)
+
+	// When it's reused for something else
+	_, err = client.Update(ctx, &pb_discord.UpdateRequest{Id: id, Content: "Goodbye, world!"})
+
+	// Then
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	assert.Equal(t, 1, scheduler.callCount)
+
+	mongoMessage, _ := mongo.client.GetDiscordMessageById(context.Background(), id)
+	assert.Equal(t, 2, len(mongoMessage.Versions))
+	assert.Equal(t, "Hello, world, again!", mongoMessage.LatestVersion().Content)
+}
+
+func Test_ItUpdatesAMessageAtTheExpectedVersion(t *testing.T) {
+	mongo, scheduler := SetupTest(t, false, true)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := pb_discord.NewDiscordClient(grpcClient.conn)
+
+	id, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Channel: "1234", Content: "Hello, world!"})
+
+	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id-2", "x-expected-version", "1")
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	_, err := client.Update(ctx, &pb_discord.UpdateRequest{Id: id, Content: "Hello, world, again!"})
+	assert.Nil(t, err)
+
+	grpcMetadata = metadata.Pairs("x-client-request-id", "my-client-request-id-3", "x-expected-version", "my-client-request-id-2")
+	ctx = metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	_, err = client.Update(ctx, &pb_discord.UpdateRequest{Id: id, Content: "Hello, world, once more!"})
+	assert.Nil(t, err)
+
+	// Then
+	mongoMessage, _ := mongo.client.GetDiscordMessageById(context.Background(), id)
+	assert.Equal(t, 3, len(mongoMessage.Versions))
+	assert.Equal(t, 2, scheduler.callCount)
+}
+
+func Test_ItDoesntUpdateAMessageNotAtTheExpectedVersion(t *testing.T) {
+	mongo, scheduler := SetupTest(t, false, true)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := pb_discord.NewDiscordClient(grpcClient.conn)
+
+	id, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Channel: "1234", Content: "Hello, world!"})
+	mongo.client.PublishMessageVersion(context.Background(), "my-client-request-id-2", db.Caller{}, &pb_discord.UpdateRequest{Id: id, Content: "Hello, world, again!"}, db.ExpectedVersion{})
+
+	// When
+	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id-3", "x-expected-version", "1")
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	_, err := client.Update(ctx, &pb_discord.UpdateRequest{Id: id, Content: "Goodbye, world!"})
+
+	// Then
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Equal(t, 0, scheduler.callCount)
+
+	details := status.Convert(err).Details()
+	assert.Equal(t, 1, len(details))
+	info, ok := details[0].(*errdetails.ErrorInfo)
+	assert.True(t, ok)
+	assert.Equal(t, "VERSION_CONFLICT", info.Reason)
+	assert.Equal(t, "2", info.Metadata["current_version"])
+	assert.Equal(t, "my-client-request-id-2", info.Metadata["current_client_request_id"])
+
+	mongoMessage, _ := mongo.client.GetDiscordMessageById(context.Background(), id)
+	assert.Equal(t, 2, len(mongoMessage.Versions))
+}
+
+func Test_ItDoesntUpdateAMessageWithAnInvalidExpectedVersion(t *testing.T) {
+	mongo, scheduler := SetupTest(t, false, true)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := pb_discord.NewDiscordClient(grpcClient.conn)
+
+	id, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Channel: "1234", Content: "Hello, world!"})
+
+	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id-2", "x-expected-version", "0")
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	_, err := client.Update(ctx, &pb_discord.UpdateRequest{Id: id, Content: "Hello, world, again!"})
+
+	// Then
+	assert.Equal(t, status.Error(codes.InvalidArgument, "x-expected-version must be at least 1"), err)
+	assert.Equal(t, 0, scheduler.callCount)
+}
+
+func Test_ItMarksAMessageNoLongerActiveOnUpdate(t *testing.T) {
+	mongo, scheduler := SetupTest(t, false, true)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := pb_discord.NewDiscordClient(grpcClient.conn)
+
+	id, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Channel: "1234", Content: "Hello, world!"})
+	mongo.client.SetDiscordMessageActive(context.Background(), id, true)
+
+	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id-2", "x-message-active", "false")
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	_, err := client.Update(ctx, &pb_discord.UpdateRequest{Id: id, Content: "The measure has ended"})
+
+	// Then
+	assert.Nil(t, err)
+	mongoMessage, _ := mongo.client.GetDiscordMessageById(context.Background(), id)
+	assert.False(t, mongoMessage.Active)
+	assert.Equal(t, 2, len(mongoMessage.Versions))
+	assert.Equal(t, 1, scheduler.callCount)
+}
+
 func Test_ItDoesntUpdateAMessageNoIdSpecified(t *testing.T) {
 	mongo, scheduler := SetupTest(t, false, true)
 	defer mongo.tearDown()
@@ -885,7 +1158,7 @@ func Test_ItDoesntUpdateAMessageNoIdSpecified(t *testing.T) {
 
 	client := pb_discord.NewDiscordClient(grpcClient.conn)
 
-	mongo.client.WriteDiscordMessage("my-client-request-id", &pb_discord.CreateRequest{Content: "Hello, world!"})
+	mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Content: "Hello, world!"})
 
 	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id-2")
 	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
@@ -904,7 +1177,7 @@ func Test_ItRejectsAnUpdateThatHasMissingFieldName(t *testing.T) {
 	grpcClient := setupGrpcClient()
 	defer grpcClient.close()
 
-	mongoId, _ := mongo.client.WriteDiscordMessage("my-client-request-id", &pb_discord.CreateRequest{Content: "Hello, world!"})
+	mongoId, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Content: "Hello, world!"})
 
 	client := pb_discord.NewDiscordClient(grpcClient.conn)
 
@@ -951,7 +1224,7 @@ func Test_ItRejectsAnUpdateThatHasMissingFieldValue(t *testing.T) {
 	grpcClient := setupGrpcClient()
 	defer grpcClient.close()
 
-	mongoId, _ := mongo.client.WriteDiscordMessage("my-client-request-id", &pb_discord.CreateRequest{Content: "Hello, world!"})
+	mongoId, _ := mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Content: "Hello, world!"})
 
 	client := pb_discord.NewDiscordClient(grpcClient.conn)
 
@@ -1000,7 +1273,7 @@ func Test_ItDoesntUpdateAMessageClientRequestIdEmpty(t *testing.T) {
 
 	client := pb_discord.NewDiscordClient(grpcClient.conn)
 
-	mongo.client.WriteDiscordMessage("my-client-request-id", &pb_discord.CreateRequest{Content: "Hello, world!"})
+	mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Content: "Hello, world!"})
 
 	grpcMetadata := metadata.Pairs("x-client-request-id", "")
 	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
@@ -1021,7 +1294,7 @@ func Test_ItDoesntUpdateAMessageClientRequestIdMissing(t *testing.T) {
 
 	client := pb_discord.NewDiscordClient(grpcClient.conn)
 
-	mongo.client.WriteDiscordMessage("my-client-request-id", &pb_discord.CreateRequest{Content: "Hello, world!"})
+	mongo.client.WriteDiscordMessage(context.Background(), "my-client-request-id", db.Caller{}, &pb_discord.CreateRequest{Content: "Hello, world!"})
 
 	_, err := client.Update(context.Background(), &pb_discord.UpdateRequest{Id: "65106dab41199f298668474f", Content: "Hello, world, again!"})
 
@@ -1046,7 +1319,7 @@ func Test_ItCanCreateThenUpdateAMessage(t *testing.T) {
 
 	assert.Nil(t, err)
 	responseId := resp.GetId()
-	mongoMessage, err := mongo.client.GetDiscordMessageById(responseId)
+	mongoMessage, err := mongo.client.GetDiscordMessageById(context.Background(), responseId)
 
 	assert.Nil(t, err)
 	assert.Equal(t, responseId, mongoMessage.Id)
@@ -1064,7 +1337,7 @@ func Test_ItCanCreateThenUpdateAMessage(t *testing.T) {
 
 	assert.Nil(t, err)
 
-	mongoMessage, err = mongo.client.GetDiscordMessageById(responseId)
+	mongoMessage, err = mongo.client.GetDiscordMessageById(context.Background(), responseId)
 	assert.Nil(t, err)
 	assert.Equal(t, responseId, mongoMessage.Id)
 	assert.Equal(t, 2, len(mongoMessage.Versions))
@@ -1076,3 +1349,55 @@ func Test_ItCanCreateThenUpdateAMessage(t *testing.T) {
 	assert.Equal(t, 2, scheduler.callCount)
 	assert.Equal(t, responseId, scheduler.callId)
 }
+
+func Test_ItRecordsTheCallerOnEachVersion(t *testing.T) {
+	mongo, _ := SetupTest(t, true, true)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := pb_discord.NewDiscordClient(grpcClient.conn)
+
+	token, err := SignJwtWithClaims(jwt.MapClaims{"aud": "test-aud", "iss": "ecfmp-auth", "sub": "ecfmp-api", "name": "ECFMP API"})
+	assert.Nil(t, err)
+
+	grpcMetadata := metadata.Pairs("x-client-request-id", "my-client-request-id", "authorization", token)
+	ctx := metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	resp, err := client.Create(ctx, &pb_discord.CreateRequest{Channel: "123", Content: "Hello, world!"})
+	assert.Nil(t, err)
+
+	token, err = SignJwtWithClaims(jwt.MapClaims{"aud": "test-aud", "iss": "ecfmp-auth", "sub": "ecfmp-worker", "client_id": "worker-1"})
+	assert.Nil(t, err)
+
+	grpcMetadata = metadata.Pairs("x-client-request-id", "my-client-request-id-2", "authorization", token)
+	ctx = metadata.NewOutgoingContext(context.Background(), grpcMetadata)
+	_, err = client.Update(ctx, &pb_discord.UpdateRequest{Id: resp.GetId(), Content: "Hello, world, again!"})
+	assert.Nil(t, err)
+
+	mongoMessage, err := mongo.client.GetDiscordMessageById(context.Background(), resp.GetId())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(mongoMessage.Versions))
+	assert.Equal(t, "ecfmp-api", mongoMessage.Versions[0].CreatedBy.Subject)
+	assert.Equal(t, "ECFMP API", mongoMessage.Versions[0].CreatedBy.Name)
+	assert.Contains(t, mongoMessage.Versions[0].CreatedBy.UserAgent, "grpc-go")
+	assert.Equal(t, "ecfmp-worker", mongoMessage.Versions[1].CreatedBy.Subject)
+	assert.Equal(t, "worker-1", mongoMessage.Versions[1].CreatedBy.ClientId)
+}
+
+func Test_ItDoesAHealthCheckForAComponent(t *testing.T) {
+	mongo, _ := SetupTest(t, true, false)
+	defer mongo.tearDown()
+
+	grpcClient := setupGrpcClient()
+	defer grpcClient.close()
+
+	client := healthpb.NewHealthClient(grpcClient.conn)
+
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "scheduler"})
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Status, healthpb.HealthCheckResponse_NOT_SERVING)
+
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,132 @@
+package grpc
+
+import (
+	"context"
+	db "ecfmp/discord/internal/db"
+	"net"
+	"strings"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	metadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+/**
+ * Identity is who an authenticated request was made by. Restricted callers, such as API keys, may only do what
+ * their scopes allow, whereas others only need a scope to use the admin service.
+ */
+type Identity struct {
+	Subject    string
+	Name       string
+	ClientId   string
+	Scopes     []string
+	Restricted bool
+}
+
+type identityContextKey struct{}
+
+/**
+ * ContextWithIdentity returns a copy of the context carrying the identity of the caller.
+ */
+func ContextWithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+/**
+ * IdentityFromContext returns the identity of the caller, if the request was authenticated.
+ */
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(Identity)
+	return identity, ok
+}
+
+/**
+ * HasScope returns whether the caller has been granted the given scope.
+ */
+func (identity Identity) HasScope(scope string) bool {
+	for _, granted := range identity.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * Allows returns whether the caller may do what the scope grants, either because it has been granted the scope
+ * or because it isn't restricted to its scopes.
+ */
+func (identity Identity) Allows(scope string) bool {
+	return !identity.Restricted || identity.HasScope(scope)
+}
+
+/**
+ * identityFromToken gets the identity from the sub, name, client_id and scope claims of a validated token.
+ */
+func identityFromToken(token *jwt.Token) Identity {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return Identity{}
+	}
+
+	subject, _ := claims.GetSubject()
+	name, _ := claims["name"].(string)
+	clientId, _ := claims["client_id"].(string)
+
+	return Identity{
+		Subject:  subject,
+		Name:     name,
+		ClientId: clientId,
+		Scopes:   scopesFromClaims(claims),
+	}
+}
+
+/**
+ * scopesFromClaims reads the scopes from either a space separated "scope" claim (RFC 8693) or a "scopes" array.
+ */
+func scopesFromClaims(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+
+	scopeList, ok := claims["scopes"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	scopes := make([]string, 0, len(scopeList))
+	for _, scope := range scopeList {
+		if scopeString, ok := scope.(string); ok {
+			scopes = append(scopes, scopeString)
+		}
+	}
+
+	return scopes
+}
+
+/**
+ * callerFromContext builds the caller record that is stored against each message version, combining
+ * the authenticated identity with where the request came from.
+ */
+func callerFromContext(ctx context.Context) db.Caller {
+	identity, _ := IdentityFromContext(ctx)
+	caller := db.Caller{
+		Subject:  identity.Subject,
+		Name:     identity.Name,
+		ClientId: identity.ClientId,
+	}
+
+	if peer, ok := peer.FromContext(ctx); ok && peer.Addr != nil {
+		caller.IpAddress = peer.Addr.String()
+		if host, _, err := net.SplitHostPort(caller.IpAddress); err == nil {
+			caller.IpAddress = host
+		}
+	}
+
+	if metadata, ok := metadata.FromIncomingContext(ctx); ok && len(metadata.Get("user-agent")) > 0 {
+		caller.UserAgent = metadata.Get("user-agent")[0]
+	}
+
+	return caller
+}
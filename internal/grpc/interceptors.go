@@ -0,0 +1,161 @@
+package grpc
+
+import (
+	"context"
+	logConfig "ecfmp/discord/internal/log"
+	"ecfmp/discord/internal/metrics"
+	"ecfmp/discord/internal/tracing"
+	"runtime/debug"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	metadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/**
+ * accessLogContextKey is where the access log of a request is kept, so that authentication, which
+ * happens further down the chain, can record who made the request.
+ */
+type accessLogContextKey struct{}
+
+type accessLog struct {
+	subject string
+}
+
+/**
+ * LoggingInterceptor gives each request a logger carrying the method and x-client-request-id, which
+ * handlers get using log.LoggerFromContext, and writes an access log line once the request completes.
+ */
+func LoggingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+
+	fields := log.Fields{"method": info.FullMethod}
+	if metadata, ok := metadata.FromIncomingContext(ctx); ok && len(metadata.Get("x-client-request-id")) == 1 {
+		fields["client_request_id"] = metadata.Get("x-client-request-id")[0]
+	}
+
+	if traceId := tracing.TraceId(ctx); traceId != "" {
+		fields["trace_id"] = traceId
+	}
+
+	requestLog := &accessLog{}
+	logger := logConfig.ForSubsystem(logConfig.LoggerFromContext(ctx), logConfig.SubsystemGrpc).WithFields(fields)
+	ctx = context.WithValue(logConfig.ContextWithLogger(ctx, logger), accessLogContextKey{}, requestLog)
+
+	resp, err := handler(ctx, req)
+
+	accessFields := log.Fields{
+		"code":       status.Code(err).String(),
+		"latency_ms": time.Since(start).Milliseconds(),
+	}
+	if requestLog.subject != "" {
+		accessFields["subject"] = requestLog.subject
+	}
+
+	// Health checks are frequent and uninteresting
+	if info.FullMethod == healthpb.Health_Check_FullMethodName {
+		logger.WithFields(accessFields).Debug("gRPC request handled")
+	} else {
+		logger.WithFields(accessFields).Info("gRPC request handled")
+	}
+
+	return resp, err
+}
+
+/**
+ * RecoveryInterceptor recovers from panics in handlers, so that a bug in handling one request
+ * fails that request with Internal rather than taking the whole server down.
+ */
+func RecoveryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logConfig.LoggerFromContext(ctx).
+				WithField("stack", string(debug.Stack())).
+				Errorf("Recovered from panic handling request: %v", recovered)
+			resp = nil
+			err = status.Error(codes.Internal, codes.Internal.String())
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+/**
+ * contextWithAuthenticatedIdentity records the identity of the caller in the context, its logger and
+ * the access log of the request.
+ */
+func contextWithAuthenticatedIdentity(ctx context.Context, identity Identity) context.Context {
+	if requestLog, ok := ctx.Value(accessLogContextKey{}).(*accessLog); ok {
+		requestLog.subject = identity.Subject
+	}
+
+	logger := logConfig.LoggerFromContext(ctx).WithField("subject", identity.Subject)
+	return ContextWithIdentity(logConfig.ContextWithLogger(ctx, logger), identity)
+}
+
+/**
+ * MetricsInterceptor counts requests by method and status code, and records how long they took.
+ */
+func MetricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	metrics.GrpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	metrics.GrpcRequestDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+/**
+ * TracingInterceptor starts a span for each request, continuing any W3C trace context passed by the
+ * caller in the request metadata.
+ */
+func TracingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	incoming, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(incoming))
+
+	ctx, span := tracing.StartSpan(
+		ctx,
+		info.FullMethod,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("rpc.method", info.FullMethod)),
+	)
+
+	resp, err := handler(ctx, req)
+	span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+	tracing.EndSpan(span, err)
+	return resp, err
+}
+
+/**
+ * metadataCarrier lets trace context be read from gRPC metadata.
+ */
+type metadataCarrier metadata.MD
+
+func (carrier metadataCarrier) Get(key string) string {
+	values := metadata.MD(carrier).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+func (carrier metadataCarrier) Set(key string, value string) {
+	metadata.MD(carrier).Set(key, value)
+}
+
+func (carrier metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(carrier))
+	for key := range carrier {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
@@ -0,0 +1,160 @@
+package grpc_test
+
+import (
+	"context"
+	"ecfmp/discord/internal/grpc"
+	logConfig "ecfmp/discord/internal/log"
+	"ecfmp/discord/internal/metrics"
+	"ecfmp/discord/internal/tracing"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	googleGrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var testServerInfo = &googleGrpc.UnaryServerInfo{FullMethod: "/ecfmp.discord.Discord/Create"}
+
+func setupLogHook() *test.Hook {
+	log.SetLevel(log.InfoLevel)
+	return test.NewGlobal()
+}
+
+func Test_ItRecoversFromPanicsInHandlers(t *testing.T) {
+	SetUpTest()
+
+	resp, err := grpc.RecoveryInterceptor(context.Background(), nil, testServerInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("something went wrong")
+	})
+
+	assert.Nil(t, resp)
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func Test_ItPassesThroughResponsesWhenThereIsNoPanic(t *testing.T) {
+	SetUpTest()
+
+	resp, err := grpc.RecoveryInterceptor(context.Background(), nil, testServerInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "response", nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "response", resp)
+}
+
+func Test_ItGivesEachRequestALoggerWithTheRequestFields(t *testing.T) {
+	hook := setupLogHook()
+	defer SetUpTest()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-client-request-id", "abc"))
+	_, err := grpc.LoggingInterceptor(ctx, nil, testServerInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		logConfig.LoggerFromContext(ctx).Info("handling")
+		return nil, nil
+	})
+	assert.Nil(t, err)
+
+	entries := hook.AllEntries()
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "handling", entries[0].Message)
+	assert.Equal(t, "abc", entries[0].Data["client_request_id"])
+	assert.Equal(t, "/ecfmp.discord.Discord/Create", entries[0].Data["method"])
+}
+
+func Test_ItWritesAnAccessLog(t *testing.T) {
+	hook := setupLogHook()
+	defer SetUpTest()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-client-request-id", "abc"))
+	_, err := grpc.LoggingInterceptor(ctx, nil, testServerInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "not found")
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	entry := hook.LastEntry()
+	assert.Equal(t, "gRPC request handled", entry.Message)
+	assert.Equal(t, "NotFound", entry.Data["code"])
+	assert.Equal(t, "abc", entry.Data["client_request_id"])
+	assert.Contains(t, entry.Data, "latency_ms")
+}
+
+func Test_ItRecordsTheAuthenticatedSubjectInTheLogs(t *testing.T) {
+	hook := setupLogHook()
+	defer SetUpTest()
+
+	signedJwt, err := SignJwtWithClaims(map[string]interface{}{"aud": "test-aud", "iss": "ecfmp-auth", "sub": "user-1"})
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	authenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", signedJwt))
+	_, err = grpc.LoggingInterceptor(ctx, nil, testServerInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return authenticator.AuthInterceptor(ctx, req, testServerInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+			logConfig.LoggerFromContext(ctx).Info("handling")
+			return nil, nil
+		})
+	})
+	assert.Nil(t, err)
+
+	entries := hook.AllEntries()
+	assert.Equal(t, "user-1", entries[0].Data["subject"])
+	assert.Equal(t, "user-1", hook.LastEntry().Data["subject"])
+	assert.Equal(t, "OK", hook.LastEntry().Data["code"])
+}
+
+func Test_ItCountsRequestsByMethodAndCode(t *testing.T) {
+	SetUpTest()
+
+	counter := metrics.GrpcRequests.WithLabelValues(testServerInfo.FullMethod, "PermissionDenied")
+	before := testutil.ToFloat64(counter)
+
+	_, err := grpc.MetricsInterceptor(context.Background(), nil, testServerInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.PermissionDenied, "denied")
+	})
+
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+}
+
+func Test_ItContinuesTheTraceFromTheRequestMetadata(t *testing.T) {
+	SetUpTest()
+
+	exporter := tracetest.NewInMemoryExporter()
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tracing.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	}()
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", traceparent))
+
+	var handlerTraceId string
+	_, err := grpc.TracingInterceptor(ctx, nil, testServerInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		handlerTraceId = tracing.TraceId(ctx)
+		return nil, status.Error(codes.NotFound, "not found")
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, testServerInfo.FullMethod, spans[0].Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent.SpanID().String())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", handlerTraceId)
+}
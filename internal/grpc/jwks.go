@@ -0,0 +1,310 @@
+package grpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+/**
+ * jsonWebKey is a single key in a JWKS document, as per RFC 7517.
+ */
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyId   string `json:"kid"`
+	Use     string `json:"use"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+/**
+ * JwksKeyProvider is a KeyProvider that fetches keys from a JWKS endpoint.
+ *
+ * Keys are cached and refreshed in the background every cacheTtl. When a token names an unknown kid,
+ * the keys are refetched early, but no more than once every minRefreshInterval. If the endpoint cannot
+ * be reached, the last successfully fetched keys continue to be used.
+ */
+type JwksKeyProvider struct {
+	url                string
+	client             *http.Client
+	cacheTtl           time.Duration
+	minRefreshInterval time.Duration
+
+	keySetMutex sync.RWMutex
+	keySet      *KeySet
+
+	// Only one refresh of each kind is made at a time, and callers that want one while it's in progress share it
+	refreshes singleflight.Group
+
+	refreshMutex       sync.Mutex
+	lastRefreshAttempt time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+/**
+ * NewJwksKeyProvider creates a new JwksKeyProvider. The keys are fetched before returning, so that the
+ * service does not start without any keys, and are then refreshed in the background until Close is called.
+ */
+func NewJwksKeyProvider(url string, cacheTtl time.Duration, minRefreshInterval time.Duration) (*JwksKeyProvider, error) {
+	provider := &JwksKeyProvider{
+		url:                url,
+		client:             &http.Client{Timeout: 10 * time.Second},
+		cacheTtl:           cacheTtl,
+		minRefreshInterval: minRefreshInterval,
+		stop:               make(chan struct{}),
+	}
+
+	if err := provider.Refresh(); err != nil {
+		return nil, err
+	}
+
+	go provider.refreshPeriodically()
+
+	return provider, nil
+}
+
+/**
+ * CurrentKeySet returns the most recently fetched keys.
+ */
+func (provider *JwksKeyProvider) CurrentKeySet() *KeySet {
+	provider.keySetMutex.RLock()
+	defer provider.keySetMutex.RUnlock()
+	return provider.keySet
+}
+
+/**
+ * RefreshKeySet refetches the keys because a token named a kid we don't know about, perhaps because
+ * the signing key has been rotated. Refetches are rate limited, so a flood of tokens with bogus kids
+ * can't be used to hammer the JWKS endpoint. Tokens that arrive during a refetch wait for it, rather
+ * than starting another, and tokens that arrive after it within the rate limit don't wait at all.
+ */
+func (provider *JwksKeyProvider) RefreshKeySet(keyId string) *KeySet {
+	provider.refreshes.Do("unknown-kid", func() (interface{}, error) {
+		if !provider.refreshDue() {
+			return nil, nil
+		}
+
+		log.Infof("JWKS: unknown kid %v, refreshing keys", keyId)
+		if err := provider.refresh(); err != nil {
+			log.Warnf("JWKS: failed to refresh keys, using last known keys: %v", err)
+		}
+
+		return nil, nil
+	})
+
+	return provider.CurrentKeySet()
+}
+
+/**
+ * Refresh fetches the keys from the JWKS endpoint. On failure, the previous keys are kept.
+ */
+func (provider *JwksKeyProvider) Refresh() error {
+	_, err, _ := provider.refreshes.Do("refresh", func() (interface{}, error) {
+		return nil, provider.refresh()
+	})
+
+	return err
+}
+
+/**
+ * refreshDue returns whether it has been long enough since the keys were last fetched to fetch them again
+ * for an unknown kid.
+ */
+func (provider *JwksKeyProvider) refreshDue() bool {
+	provider.refreshMutex.Lock()
+	defer provider.refreshMutex.Unlock()
+	return time.Since(provider.lastRefreshAttempt) >= provider.minRefreshInterval
+}
+
+/**
+ * refresh fetches the keys. No lock is held while fetching, so verifying tokens with known kids isn't held up.
+ */
+func (provider *JwksKeyProvider) refresh() error {
+	provider.refreshMutex.Lock()
+	provider.lastRefreshAttempt = time.Now()
+	provider.refreshMutex.Unlock()
+
+	keySet, err := provider.fetch()
+	if err != nil {
+		return err
+	}
+
+	provider.keySetMutex.Lock()
+	provider.keySet = keySet
+	provider.keySetMutex.Unlock()
+
+	log.Debugf("JWKS: fetched %v keys from %v", len(keySet.Keys()), provider.url)
+	return nil
+}
+
+/**
+ * Close stops the background refresh of keys.
+ */
+func (provider *JwksKeyProvider) Close() {
+	provider.stopOnce.Do(func() {
+		close(provider.stop)
+	})
+}
+
+func (provider *JwksKeyProvider) refreshPeriodically() {
+	ticker := time.NewTicker(provider.cacheTtl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-provider.stop:
+			return
+		case <-ticker.C:
+			if err := provider.Refresh(); err != nil {
+				log.Warnf("JWKS: failed to refresh keys, using last known keys: %v", err)
+			}
+		}
+	}
+}
+
+func (provider *JwksKeyProvider) fetch() (*KeySet, error) {
+	response, err := provider.client.Get(provider.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks from %v: %w", provider.url, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch jwks from %v: unexpected status %v", provider.url, response.StatusCode)
+	}
+
+	var document jsonWebKeySet
+	if err := json.NewDecoder(response.Body).Decode(&document); err != nil {
+		return nil, fmt.Errorf("failed to decode jwks from %v: %w", provider.url, err)
+	}
+
+	return parseJsonWebKeySet(&document)
+}
+
+/**
+ * parseJsonWebKeySet converts a JWKS document into a key set. Keys that aren't for signing, or that
+ * we don't support, are skipped.
+ */
+func parseJsonWebKeySet(document *jsonWebKeySet) (*KeySet, error) {
+	keys := make([]PublicKey, 0, len(document.Keys))
+	for _, webKey := range document.Keys {
+		if webKey.Use != "" && webKey.Use != "sig" {
+			continue
+		}
+
+		key, err := parseJsonWebKey(webKey)
+		if err != nil {
+			log.Warnf("JWKS: skipping key %v: %v", webKey.KeyId, err)
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return NewKeySet(keys...)
+}
+
+func parseJsonWebKey(webKey jsonWebKey) (PublicKey, error) {
+	switch webKey.KeyType {
+	case "RSA":
+		return parseRsaJsonWebKey(webKey)
+	case "EC":
+		return parseEcJsonWebKey(webKey)
+	case "OKP":
+		return parseOkpJsonWebKey(webKey)
+	default:
+		return PublicKey{}, fmt.Errorf("unsupported key type %v", webKey.KeyType)
+	}
+}
+
+func parseRsaJsonWebKey(webKey jsonWebKey) (PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(webKey.N)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("invalid modulus: %w", err)
+	}
+
+	exponent, err := base64.RawURLEncoding.DecodeString(webKey.E)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("invalid exponent: %w", err)
+	}
+
+	if len(modulus) == 0 || len(exponent) == 0 || len(exponent) > 4 {
+		return PublicKey{}, fmt.Errorf("invalid rsa key")
+	}
+
+	return NewPublicKey(webKey.KeyId, &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	})
+}
+
+func parseEcJsonWebKey(webKey jsonWebKey) (PublicKey, error) {
+	var curve elliptic.Curve
+	switch webKey.Curve {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	default:
+		return PublicKey{}, fmt.Errorf("unsupported ec curve %v", webKey.Curve)
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(webKey.X)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("invalid x coordinate: %w", err)
+	}
+
+	y, err := base64.RawURLEncoding.DecodeString(webKey.Y)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("invalid y coordinate: %w", err)
+	}
+
+	key := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return PublicKey{}, fmt.Errorf("invalid ec key, point is not on curve")
+	}
+
+	return NewPublicKey(webKey.KeyId, key)
+}
+
+func parseOkpJsonWebKey(webKey jsonWebKey) (PublicKey, error) {
+	if webKey.Curve != "Ed25519" {
+		return PublicKey{}, fmt.Errorf("unsupported okp curve %v", webKey.Curve)
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(webKey.X)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	if len(x) != ed25519.PublicKeySize {
+		return PublicKey{}, fmt.Errorf("invalid ed25519 key length %v", len(x))
+	}
+
+	return NewPublicKey(webKey.KeyId, ed25519.PublicKey(x))
+}
@@ -0,0 +1,364 @@
+package grpc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"ecfmp/discord/internal/grpc"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	metadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type TestJwksServer struct {
+	server       *httptest.Server
+	mutex        sync.Mutex
+	keys         []map[string]string
+	failing      bool
+	delay        time.Duration
+	requestCount int
+}
+
+func jwkFromFile(t *testing.T, keyId string, filePath string) map[string]string {
+	publicKey, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("failed to read public key file: %v", err)
+	}
+
+	rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(publicKey)
+	if err != nil {
+		t.Fatalf("failed to parse public key: %v", err)
+	}
+
+	return jwkFromRsaKey(keyId, rsaKey)
+}
+
+func jwkFromRsaKey(keyId string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": keyId,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func NewTestJwksServer(keys ...map[string]string) *TestJwksServer {
+	jwksServer := &TestJwksServer{keys: keys}
+	jwksServer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwksServer.mutex.Lock()
+		jwksServer.requestCount++
+		delay := jwksServer.delay
+		jwksServer.mutex.Unlock()
+
+		time.Sleep(delay)
+
+		jwksServer.mutex.Lock()
+		defer jwksServer.mutex.Unlock()
+		if jwksServer.failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": jwksServer.keys})
+	}))
+
+	return jwksServer
+}
+
+func (s *TestJwksServer) SetKeys(keys ...map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keys
+}
+
+func (s *TestJwksServer) SetFailing(failing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing = failing
+}
+
+func (s *TestJwksServer) SetDelay(delay time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.delay = delay
+}
+
+func (s *TestJwksServer) RequestCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requestCount
+}
+
+func callInterceptor(authenticator *grpc.JwtAuthInterceptor, signedJwt string) (bool, error) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", signedJwt))
+
+	nextCalled := false
+	_, err := authenticator.AuthInterceptor(ctx, nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		nextCalled = true
+		return nil, nil
+	})
+
+	return nextCalled, err
+}
+
+func Test_ItPassesAuthenticationWithKeyFromJwks(t *testing.T) {
+	SetUpTest()
+
+	jwksServer := NewTestJwksServer(jwkFromFile(t, "key-1", "../../docker/dev_public_key.pub"))
+	defer jwksServer.server.Close()
+
+	provider, err := grpc.NewJwksKeyProvider(jwksServer.server.URL, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("failed to create jwks provider: %v", err)
+	}
+	defer provider.Close()
+
+	signedJwt, err := SignJwtWithFileAndKeyId("test-aud", "ecfmp-auth", "../../docker/dev_private_key.pem", "key-1")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	nextCalled, err := callInterceptor(grpc.NewJwtAuthInterceptor(provider, "test-aud", "ecfmp-auth"), signedJwt)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+}
+
+func Test_ItRefetchesJwksOnUnknownKid(t *testing.T) {
+	SetUpTest()
+
+	jwksServer := NewTestJwksServer(jwkFromFile(t, "key-1", "../../docker/dev_public_key.pub"))
+	defer jwksServer.server.Close()
+
+	provider, err := grpc.NewJwksKeyProvider(jwksServer.server.URL, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("failed to create jwks provider: %v", err)
+	}
+	defer provider.Close()
+
+	// Rotate the key
+	jwksServer.SetKeys(jwkFromFile(t, "key-2", "../../docker/dev_public_key_2.pub"))
+
+	signedJwt, err := SignJwtWithFileAndKeyId("test-aud", "ecfmp-auth", "../../docker/dev_private_key_2.pem", "key-2")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	nextCalled, err := callInterceptor(grpc.NewJwtAuthInterceptor(provider, "test-aud", "ecfmp-auth"), signedJwt)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+	assert.Equal(t, 2, jwksServer.RequestCount())
+}
+
+func Test_ItRateLimitsJwksRefetches(t *testing.T) {
+	SetUpTest()
+
+	jwksServer := NewTestJwksServer(jwkFromFile(t, "key-1", "../../docker/dev_public_key.pub"))
+	defer jwksServer.server.Close()
+
+	provider, err := grpc.NewJwksKeyProvider(jwksServer.server.URL, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwks provider: %v", err)
+	}
+	defer provider.Close()
+
+	signedJwt, err := SignJwtWithFileAndKeyId("test-aud", "ecfmp-auth", "../../docker/dev_private_key.pem", "some-unknown-key")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	authenticator := grpc.NewJwtAuthInterceptor(provider, "test-aud", "ecfmp-auth")
+	for i := 0; i < 5; i++ {
+		nextCalled, err := callInterceptor(authenticator, signedJwt)
+		assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
+		assert.False(t, nextCalled)
+	}
+
+	// Only the initial fetch should have happened
+	assert.Equal(t, 1, jwksServer.RequestCount())
+}
+
+func Test_ItFetchesJwksOnceForConcurrentUnknownKids(t *testing.T) {
+	SetUpTest()
+
+	jwksServer := NewTestJwksServer(jwkFromFile(t, "key-1", "../../docker/dev_public_key.pub"))
+	defer jwksServer.server.Close()
+
+	provider, err := grpc.NewJwksKeyProvider(jwksServer.server.URL, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("failed to create jwks provider: %v", err)
+	}
+	defer provider.Close()
+
+	// Given a slow endpoint, so that every caller arrives while the fetch is in progress
+	jwksServer.SetDelay(500 * time.Millisecond)
+
+	// When
+	start := make(chan struct{})
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			<-start
+			provider.RefreshKeySet("some-unknown-key")
+		}()
+	}
+	close(start)
+	waitGroup.Wait()
+
+	// Then only the initial fetch and one refetch should have happened
+	assert.Equal(t, 2, jwksServer.RequestCount())
+}
+
+func Test_ItDoesntWaitForAJwksFetchWhenRefetchesAreRateLimited(t *testing.T) {
+	SetUpTest()
+
+	jwksServer := NewTestJwksServer(jwkFromFile(t, "key-1", "../../docker/dev_public_key.pub"))
+	defer jwksServer.server.Close()
+
+	provider, err := grpc.NewJwksKeyProvider(jwksServer.server.URL, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwks provider: %v", err)
+	}
+	defer provider.Close()
+
+	// Given a slow fetch in progress
+	jwksServer.SetDelay(2 * time.Second)
+	refreshed := make(chan error, 1)
+	go func() {
+		refreshed <- provider.Refresh()
+	}()
+	assert.Eventually(t, func() bool { return jwksServer.RequestCount() == 2 }, time.Second, 5*time.Millisecond)
+
+	// When
+	start := time.Now()
+	keySet := provider.RefreshKeySet("some-unknown-key")
+
+	// Then the last known keys are returned without waiting for the fetch
+	assert.Less(t, time.Since(start), time.Second)
+	_, found := keySet.KeyById("key-1")
+	assert.True(t, found)
+	assert.Nil(t, <-refreshed)
+	assert.Equal(t, 2, jwksServer.RequestCount())
+}
+
+func Test_ItKeepsLastGoodJwksWhenEndpointFails(t *testing.T) {
+	SetUpTest()
+
+	jwksServer := NewTestJwksServer(jwkFromFile(t, "key-1", "../../docker/dev_public_key.pub"))
+	defer jwksServer.server.Close()
+
+	provider, err := grpc.NewJwksKeyProvider(jwksServer.server.URL, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("failed to create jwks provider: %v", err)
+	}
+	defer provider.Close()
+
+	jwksServer.SetFailing(true)
+	assert.NotNil(t, provider.Refresh())
+
+	signedJwt, err := SignJwtWithFileAndKeyId("test-aud", "ecfmp-auth", "../../docker/dev_private_key.pem", "key-1")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	nextCalled, err := callInterceptor(grpc.NewJwtAuthInterceptor(provider, "test-aud", "ecfmp-auth"), signedJwt)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+}
+
+func Test_ItRefreshesJwksInTheBackground(t *testing.T) {
+	SetUpTest()
+
+	jwksServer := NewTestJwksServer(jwkFromFile(t, "key-1", "../../docker/dev_public_key.pub"))
+	defer jwksServer.server.Close()
+
+	provider, err := grpc.NewJwksKeyProvider(jwksServer.server.URL, 10*time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwks provider: %v", err)
+	}
+	defer provider.Close()
+
+	jwksServer.SetKeys(jwkFromFile(t, "key-2", "../../docker/dev_public_key_2.pub"))
+
+	assert.Eventually(t, func() bool {
+		_, found := provider.CurrentKeySet().KeyById("key-2")
+		return found
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_ItFailsToCreateJwksProviderIfEndpointUnavailable(t *testing.T) {
+	jwksServer := NewTestJwksServer()
+	jwksServer.SetFailing(true)
+	defer jwksServer.server.Close()
+
+	provider, err := grpc.NewJwksKeyProvider(jwksServer.server.URL, time.Hour, 0)
+	assert.Nil(t, provider)
+	assert.NotNil(t, err)
+}
+
+func Test_ItPassesAuthenticationWithEcAndOkpKeysFromJwks(t *testing.T) {
+	SetUpTest()
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublicKey, edPrivateKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	jwksServer := NewTestJwksServer(
+		map[string]string{
+			"kty": "EC",
+			"kid": "ec-key",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+		map[string]string{
+			"kty": "OKP",
+			"kid": "ed-key",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(edPublicKey),
+		},
+	)
+	defer jwksServer.server.Close()
+
+	provider, err := grpc.NewJwksKeyProvider(jwksServer.server.URL, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create jwks provider: %v", err)
+	}
+	defer provider.Close()
+	authenticator := grpc.NewJwtAuthInterceptor(provider, "test-aud", "ecfmp-auth")
+
+	ecJwt, err := SignJwtWithKey("test-aud", "ecfmp-auth", jwt.SigningMethodES256, ecKey)
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	nextCalled, err := callInterceptor(authenticator, ecJwt)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+
+	edJwt, err := SignJwtWithKey("test-aud", "ecfmp-auth", jwt.SigningMethodEdDSA, edPrivateKey)
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	nextCalled, err = callInterceptor(authenticator, edJwt)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+}
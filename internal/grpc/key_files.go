@@ -0,0 +1,140 @@
+package grpc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/**
+ * FileKeyProvider is a KeyProvider that loads keys from PEM files and directories, and can reload them
+ * without a restart. This allows keys to be rotated by updating a mounted Kubernetes secret.
+ *
+ * New keys are validated before they replace the current ones, so a bad update leaves the old keys in place.
+ */
+type FileKeyProvider struct {
+	paths  []string
+	keySet atomic.Pointer[KeySet]
+
+	reloadMutex     sync.Mutex
+	lastFingerprint []byte
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+/**
+ * NewFileKeyProvider creates a new FileKeyProvider, loading the keys at the given paths.
+ */
+func NewFileKeyProvider(paths ...string) (*FileKeyProvider, error) {
+	provider := &FileKeyProvider{
+		paths: paths,
+		stop:  make(chan struct{}),
+	}
+
+	if err := provider.Refresh(); err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+/**
+ * CurrentKeySet returns the most recently loaded keys.
+ */
+func (provider *FileKeyProvider) CurrentKeySet() *KeySet {
+	return provider.keySet.Load()
+}
+
+/**
+ * RefreshKeySet returns the current keys. Changes on disk are picked up by WatchForChanges or Refresh.
+ */
+func (provider *FileKeyProvider) RefreshKeySet(keyId string) *KeySet {
+	return provider.CurrentKeySet()
+}
+
+/**
+ * Refresh reloads the keys from disk, even if they have not changed.
+ */
+func (provider *FileKeyProvider) Refresh() error {
+	return provider.reload(true)
+}
+
+/**
+ * WatchForChanges polls the key files for changes, reloading them when their contents change.
+ * Polling is used rather than file system events, as Kubernetes updates mounted secrets by swapping
+ * symlinks, which file watchers don't reliably notice.
+ */
+func (provider *FileKeyProvider) WatchForChanges(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-provider.stop:
+				return
+			case <-ticker.C:
+				if err := provider.reload(false); err != nil {
+					log.Errorf("Failed to reload jwt public keys, keeping existing keys: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+/**
+ * Close stops watching for changes.
+ */
+func (provider *FileKeyProvider) Close() {
+	provider.stopOnce.Do(func() {
+		close(provider.stop)
+	})
+}
+
+/**
+ * reload reads the key files and swaps in the new keys if they parse. Unless forced, the keys are only
+ * parsed if the files have changed since they were last read.
+ */
+func (provider *FileKeyProvider) reload(force bool) error {
+	provider.reloadMutex.Lock()
+	defer provider.reloadMutex.Unlock()
+
+	files, err := readKeyFiles(provider.paths...)
+	if err != nil {
+		return err
+	}
+
+	fingerprint := fingerprintKeyFiles(files)
+	if !force && bytes.Equal(fingerprint, provider.lastFingerprint) {
+		return nil
+	}
+
+	// Remember what we've seen, even if it fails to parse, so that we only complain once per change
+	provider.lastFingerprint = fingerprint
+
+	keySet, err := parseKeyFiles(files)
+	if err != nil {
+		return err
+	}
+
+	provider.keySet.Store(keySet)
+	log.Infof("Loaded %v jwt public keys", len(keySet.Keys()))
+	return nil
+}
+
+func fingerprintKeyFiles(files []keyFile) []byte {
+	hash := sha256.New()
+	for _, file := range files {
+		hash.Write([]byte(file.path))
+		hash.Write([]byte{0})
+		hash.Write(file.contents)
+		hash.Write([]byte{0})
+	}
+
+	return hash.Sum(nil)
+}
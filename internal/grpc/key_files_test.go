@@ -0,0 +1,125 @@
+package grpc_test
+
+import (
+	"ecfmp/discord/internal/grpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func copyKeyFile(t *testing.T, from string, to string) {
+	contents, err := os.ReadFile(from)
+	if err != nil {
+		t.Fatalf("failed to read key file: %v", err)
+	}
+
+	// Write then rename, so that a watcher never sees a half written file
+	temporary := to + ".tmp"
+	if err := os.WriteFile(temporary, contents, 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+
+	if err := os.Rename(temporary, to); err != nil {
+		t.Fatalf("failed to rename key file: %v", err)
+	}
+}
+
+func Test_ItReloadsKeysFromFileOnRefresh(t *testing.T) {
+	SetUpTest()
+
+	path := filepath.Join(t.TempDir(), "key.pub")
+	copyKeyFile(t, "../../docker/dev_public_key.pub", path)
+
+	provider, err := grpc.NewFileKeyProvider(path)
+	if err != nil {
+		t.Fatalf("failed to create file key provider: %v", err)
+	}
+	defer provider.Close()
+
+	authenticator := grpc.NewJwtAuthInterceptor(provider, "test-aud", "ecfmp-auth")
+	signedJwt, err := SignJwtWithFile("test-aud", "ecfmp-auth", "../../docker/dev_private_key_2.pem")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	// Not yet rotated
+	nextCalled, err := callInterceptor(authenticator, signedJwt)
+	assert.Equal(t, err, status.Errorf(codes.Unauthenticated, codes.Unauthenticated.String()), nil)
+	assert.False(t, nextCalled)
+
+	// Rotate the key
+	copyKeyFile(t, "../../docker/dev_public_key_2.pub", path)
+	assert.Nil(t, provider.Refresh())
+
+	nextCalled, err = callInterceptor(authenticator, signedJwt)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+}
+
+func Test_ItKeepsExistingKeysIfReloadFails(t *testing.T) {
+	SetUpTest()
+
+	path := filepath.Join(t.TempDir(), "key.pub")
+	copyKeyFile(t, "../../docker/dev_public_key.pub", path)
+
+	provider, err := grpc.NewFileKeyProvider(path)
+	if err != nil {
+		t.Fatalf("failed to create file key provider: %v", err)
+	}
+	defer provider.Close()
+
+	if err := os.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	assert.NotNil(t, provider.Refresh())
+
+	signedJwt, err := SignJwt("test-aud", "ecfmp-auth")
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+
+	nextCalled, err := callInterceptor(grpc.NewJwtAuthInterceptor(provider, "test-aud", "ecfmp-auth"), signedJwt)
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+}
+
+func Test_ItWatchesKeyFilesForChanges(t *testing.T) {
+	SetUpTest()
+
+	directory := t.TempDir()
+	copyKeyFile(t, "../../docker/dev_public_key.pub", filepath.Join(directory, "key-1.pub"))
+
+	provider, err := grpc.NewFileKeyProvider(directory)
+	if err != nil {
+		t.Fatalf("failed to create file key provider: %v", err)
+	}
+	defer provider.Close()
+	provider.WatchForChanges(10 * time.Millisecond)
+
+	// Add a second key alongside the first
+	copyKeyFile(t, "../../docker/dev_public_key_2.pub", filepath.Join(directory, "key-2.pub"))
+
+	assert.Eventually(t, func() bool {
+		_, found := provider.CurrentKeySet().KeyById("key-2")
+		return found
+	}, time.Second, 10*time.Millisecond)
+
+	_, found := provider.CurrentKeySet().KeyById("key-1")
+	assert.True(t, found)
+}
+
+func Test_ItFailsToCreateFileKeyProviderWithInvalidKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pub")
+	if err := os.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+
+	provider, err := grpc.NewFileKeyProvider(path)
+	assert.Nil(t, provider)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,319 @@
+package grpc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+/**
+ * PublicKey is a key that can be used to verify the signature of a JWT.
+ * The Id is matched against the kid header of incoming tokens, and may be empty. Keys loaded from files
+ * take their Id from the file name, which the issuer may not know, so IdFromFileName marks that a token
+ * with another kid may still have been signed with the key.
+ *
+ * The key may be an RSA, ECDSA (P-256 or P-384) or Ed25519 public key. Tokens are only accepted
+ * if they are signed with one of the Algorithms that suit the key.
+ */
+type PublicKey struct {
+	Id             string
+	IdFromFileName bool
+	Key            crypto.PublicKey
+	Algorithms     []string
+}
+
+/**
+ * NewPublicKey creates a PublicKey, working out which signing algorithms may be used with it.
+ */
+func NewPublicKey(id string, key crypto.PublicKey) (PublicKey, error) {
+	algorithms, err := signingAlgorithmsForKey(key)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("public key %q: %w", id, err)
+	}
+
+	return PublicKey{Id: id, Key: key, Algorithms: algorithms}, nil
+}
+
+/**
+ * signingAlgorithmsForKey returns the JWT algorithms that we allow for a given type of key. Anything not
+ * in this list, such as HMAC or "none", is rejected.
+ */
+func signingAlgorithmsForKey(key crypto.PublicKey) ([]string, error) {
+	switch typedKey := key.(type) {
+	case *rsa.PublicKey:
+		return []string{
+			jwt.SigningMethodRS256.Alg(),
+			jwt.SigningMethodRS384.Alg(),
+			jwt.SigningMethodRS512.Alg(),
+		}, nil
+	case *ecdsa.PublicKey:
+		switch typedKey.Curve {
+		case elliptic.P256():
+			return []string{jwt.SigningMethodES256.Alg()}, nil
+		case elliptic.P384():
+			return []string{jwt.SigningMethodES384.Alg()}, nil
+		default:
+			return nil, fmt.Errorf("unsupported ecdsa curve %v", typedKey.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		return []string{jwt.SigningMethodEdDSA.Alg()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+/**
+ * KeyProvider supplies the keys that tokens are verified against.
+ */
+type KeyProvider interface {
+	// CurrentKeySet returns the keys that are currently trusted.
+	CurrentKeySet() *KeySet
+
+	// RefreshKeySet is called when a token names a key id that is not in the current set. Providers that
+	// load keys from a remote source may use this to fetch keys early. Returns the (possibly updated) keys.
+	RefreshKeySet(keyId string) *KeySet
+}
+
+/**
+ * RefreshableKeyProvider is a KeyProvider whose keys can be reloaded on demand, e.g. on SIGHUP.
+ */
+type RefreshableKeyProvider interface {
+	KeyProvider
+
+	// Refresh reloads the keys from their source. If the new keys can't be loaded, the old ones are kept.
+	Refresh() error
+}
+
+/**
+ * KeySet is an immutable set of public keys that tokens may be signed with.
+ */
+type KeySet struct {
+	keys []PublicKey
+}
+
+/**
+ * NewKeySet creates a new key set from the given keys. At least one key is required,
+ * and no two keys may share the same (non-empty) id.
+ */
+func NewKeySet(keys ...PublicKey) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one public key is required")
+	}
+
+	seenIds := make(map[string]bool)
+	for _, key := range keys {
+		if key.Key == nil || len(key.Algorithms) == 0 {
+			return nil, fmt.Errorf("public key %q is empty", key.Id)
+		}
+
+		if key.Id == "" {
+			continue
+		}
+
+		if seenIds[key.Id] {
+			return nil, fmt.Errorf("duplicate public key id %q", key.Id)
+		}
+		seenIds[key.Id] = true
+	}
+
+	return &KeySet{keys: keys}, nil
+}
+
+/**
+ * ParsePublicKey parses a PEM encoded public key, giving it the provided id. The type of key is detected
+ * from the PEM, which may contain a PKIX public key, a PKCS1 RSA public key or a certificate.
+ */
+func ParsePublicKey(id string, pemBytes []byte) (PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return PublicKey{}, fmt.Errorf("failed to parse public key %q: invalid pem", id)
+	}
+
+	var key crypto.PublicKey
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var certificate *x509.Certificate
+		certificate, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = certificate.PublicKey
+		}
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("failed to parse public key %q: %w", id, err)
+	}
+
+	return NewPublicKey(id, key)
+}
+
+/**
+ * LoadKeySet loads a key set from the given paths. Each path may either be a PEM file, or a directory
+ * in which case every .pem and .pub file in the directory is loaded. The id of each key is the name of
+ * the file it was loaded from, without the extension.
+ */
+func LoadKeySet(paths ...string) (*KeySet, error) {
+	files, err := readKeyFiles(paths...)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKeyFiles(files)
+}
+
+type keyFile struct {
+	path     string
+	contents []byte
+}
+
+/**
+ * readKeyFiles reads the contents of every key file at the given paths.
+ */
+func readKeyFiles(paths ...string) ([]keyFile, error) {
+	files := make([]keyFile, 0, len(paths))
+	for _, path := range paths {
+		filePaths, err := keyFilesAtPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, filePath := range filePaths {
+			contents, err := os.ReadFile(filePath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read public key file %v: %w", filePath, err)
+			}
+
+			files = append(files, keyFile{path: filePath, contents: contents})
+		}
+	}
+
+	return files, nil
+}
+
+func parseKeyFiles(files []keyFile) (*KeySet, error) {
+	keys := make([]PublicKey, 0, len(files))
+	for _, file := range files {
+		key, err := ParsePublicKey(keyIdFromPath(file.path), file.contents)
+		if err != nil {
+			return nil, err
+		}
+		key.IdFromFileName = true
+
+		keys = append(keys, key)
+	}
+
+	return NewKeySet(keys...)
+}
+
+/**
+ * keyFilesAtPath returns the key files at the given path, expanding directories.
+ */
+func keyFilesAtPath(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key path %v: %w", path, err)
+	}
+
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key directory %v: %w", path, err)
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		extension := filepath.Ext(entry.Name())
+		if entry.IsDir() || (extension != ".pem" && extension != ".pub") {
+			continue
+		}
+
+		files = append(files, filepath.Join(path, entry.Name()))
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no public key files found in directory %v", path)
+	}
+
+	return files, nil
+}
+
+func keyIdFromPath(path string) string {
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+/**
+ * CurrentKeySet implements KeyProvider for a fixed set of keys.
+ */
+func (keySet *KeySet) CurrentKeySet() *KeySet {
+	return keySet
+}
+
+/**
+ * RefreshKeySet implements KeyProvider for a fixed set of keys, which never changes.
+ */
+func (keySet *KeySet) RefreshKeySet(keyId string) *KeySet {
+	return keySet
+}
+
+/**
+ * Keys returns all keys in the set.
+ */
+func (keySet *KeySet) Keys() []PublicKey {
+	return keySet.keys
+}
+
+/**
+ * KeyById returns the key with the given id, if it is in the set.
+ */
+func (keySet *KeySet) KeyById(id string) (PublicKey, bool) {
+	for _, key := range keySet.keys {
+		if key.Id != "" && key.Id == id {
+			return key, true
+		}
+	}
+
+	return PublicKey{}, false
+}
+
+/**
+ * candidatesForKeyId returns the keys that a token with the given kid should be verified against.
+ * If the kid matches a key, only that key is used. Otherwise, the token is tried against every key
+ * that could have signed it: all keys if the token has no kid, or if it does, the keys that are unnamed
+ * or only named after their file.
+ */
+func (keySet *KeySet) candidatesForKeyId(id string) []PublicKey {
+	if id == "" {
+		return keySet.keys
+	}
+
+	if key, ok := keySet.KeyById(id); ok {
+		return []PublicKey{key}
+	}
+
+	candidates := make([]PublicKey, 0)
+	for _, key := range keySet.keys {
+		if key.Id == "" || key.IdFromFileName {
+			candidates = append(candidates, key)
+		}
+	}
+
+	return candidates
+}
@@ -0,0 +1,264 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+/**
+ * TlsConfig configures TLS on the gRPC listener.
+ */
+type TlsConfig struct {
+	// The server certificate and private key, reloaded when they change on disk
+	CertFile string
+	KeyFile  string
+
+	// If set, client certificates signed by a CA in this bundle are verified (mutual TLS)
+	ClientCaFile string
+
+	// Whether clients must present a certificate, rather than it being optional
+	RequireClientCert bool
+}
+
+/**
+ * NewTransportCredentials creates gRPC transport credentials from the TLS config.
+ */
+func NewTransportCredentials(config TlsConfig) (credentials.TransportCredentials, error) {
+	tlsConfig, err := NewTlsConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+/**
+ * NewTlsConfig creates the TLS config for the gRPC listener.
+ */
+func NewTlsConfig(config TlsConfig) (*tls.Config, error) {
+	reloader, err := newCertificateReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.ClientCaFile == "" {
+		if config.RequireClientCert {
+			return nil, fmt.Errorf("a client ca file is required to require client certificates")
+		}
+
+		return tlsConfig, nil
+	}
+
+	caBundle, err := os.ReadFile(config.ClientCaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client ca file %v: %w", config.ClientCaFile, err)
+	}
+
+	clientCas := x509.NewCertPool()
+	if !clientCas.AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("no certificates found in client ca file %v", config.ClientCaFile)
+	}
+
+	tlsConfig.ClientCAs = clientCas
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if config.RequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+/**
+ * certificateReloader serves the server certificate, reloading it from disk when the files change, so that
+ * certificates can be renewed without a restart. If the new files are invalid, the old certificate is kept.
+ */
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both a certificate and key file are required for tls")
+	}
+
+	reloader := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+func (reloader *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := reloader.reloadIfChanged(); err != nil {
+		log.Errorf("Failed to reload tls certificate, keeping existing certificate: %v", err)
+	}
+
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	return reloader.certificate, nil
+}
+
+func (reloader *certificateReloader) reloadIfChanged() error {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	modTime, err := latestModTime(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if reloader.certificate != nil && modTime.Equal(reloader.modTime) {
+		return nil
+	}
+
+	// Remember the time even on failure, so that a bad pair of files is only reported once
+	reloader.modTime = modTime
+
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+
+	reloader.certificate = &certificate
+	log.Infof("Loaded tls certificate from %v", reloader.certFile)
+	return nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read %v: %w", path, err)
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+/**
+ * ClientCertificateIdentity maps the subject of a client certificate to an identity.
+ */
+type ClientCertificateIdentity struct {
+	Subject string   `json:"subject"`
+	Name    string   `json:"name"`
+	Scopes  []string `json:"scopes"`
+}
+
+/**
+ * ClientCertificateAuthenticator authenticates requests by the verified client certificate presented during
+ * the mutual TLS handshake. The certificate subject is matched against the configured identities, either by
+ * its full distinguished name (e.g. "CN=ecfmp-api,O=ECFMP") or just its common name.
+ */
+type ClientCertificateAuthenticator struct {
+	identities map[string]ClientCertificateIdentity
+}
+
+/**
+ * NewClientCertificateAuthenticator creates an Authenticator for the given client certificate identities.
+ */
+func NewClientCertificateAuthenticator(identities []ClientCertificateIdentity) *ClientCertificateAuthenticator {
+	identitiesBySubject := make(map[string]ClientCertificateIdentity, len(identities))
+	for _, identity := range identities {
+		identitiesBySubject[identity.Subject] = identity
+	}
+
+	return &ClientCertificateAuthenticator{identities: identitiesBySubject}
+}
+
+/**
+ * LoadClientCertificateIdentities loads the client certificate identities from a JSON file.
+ */
+func LoadClientCertificateIdentities(path string) ([]ClientCertificateIdentity, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificate identities %v: %w", path, err)
+	}
+
+	var identities []ClientCertificateIdentity
+	if err := json.Unmarshal(contents, &identities); err != nil {
+		return nil, fmt.Errorf("failed to parse client certificate identities %v: %w", path, err)
+	}
+
+	for i, identity := range identities {
+		if identity.Subject == "" {
+			return nil, fmt.Errorf("client certificate identity %v in %v has no subject", i, path)
+		}
+	}
+
+	return identities, nil
+}
+
+/**
+ * Authenticate identifies the caller by their client certificate. Requests without a verified certificate,
+ * or with a certificate that isn't mapped to an identity, are left for other authenticators.
+ */
+func (authenticator *ClientCertificateAuthenticator) Authenticate(ctx context.Context, credential string) (Identity, error) {
+	certificate := verifiedClientCertificate(ctx)
+	if certificate == nil {
+		return Identity{}, ErrCredentialNotSupported
+	}
+
+	mapped, ok := authenticator.identities[certificate.Subject.String()]
+	if !ok {
+		mapped, ok = authenticator.identities[certificate.Subject.CommonName]
+	}
+
+	if !ok {
+		return Identity{}, ErrCredentialNotSupported
+	}
+
+	name := mapped.Name
+	if name == "" {
+		name = certificate.Subject.CommonName
+	}
+
+	return Identity{
+		Subject: "cert:" + certificate.Subject.String(),
+		Name:    name,
+		Scopes:  mapped.Scopes,
+	}, nil
+}
+
+/**
+ * verifiedClientCertificate returns the client certificate of the request, if one was presented
+ * and verified against the client CA bundle.
+ */
+func verifiedClientCertificate(ctx context.Context) *x509.Certificate {
+	peer, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	tlsInfo, ok := peer.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return tlsInfo.State.VerifiedChains[0][0]
+}
@@ -0,0 +1,377 @@
+package grpc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"ecfmp/discord/internal/grpc"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certFile    string
+	keyFile     string
+}
+
+/**
+ * Generates a certificate signed by the parent, or self-signed if there is no parent, and writes it to disk.
+ */
+func generateCertificate(t *testing.T, dir string, name string, parent *testCertificate, isCa bool) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("failed to generate serial: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"ECFMP"}},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if isCa {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writePem(t, certFile, "CERTIFICATE", der)
+	writePem(t, keyFile, "EC PRIVATE KEY", keyDer)
+
+	return &testCertificate{certificate: certificate, key: key, certFile: certFile, keyFile: keyFile}
+}
+
+func writePem(t *testing.T, path string, blockType string, contents []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: contents}), 0600); err != nil {
+		t.Fatalf("failed to write %v: %v", path, err)
+	}
+}
+
+/**
+ * Starts a TLS listener with the given config that completes handshakes, returning its address.
+ */
+func startTlsListener(t *testing.T, config *tls.Config) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+/**
+ * Connects to the listener, returning the certificate the server presented.
+ */
+func dialTls(address string, ca *testCertificate, client *testCertificate) (*x509.Certificate, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+
+	config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if client != nil {
+		keyPair, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{keyPair}
+	}
+
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// With TLS 1.3 a rejected client certificate is only reported on the first read, the listener
+	// closes the connection once the handshake succeeds
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func Test_ItServesTheConfiguredCertificate(t *testing.T) {
+	SetUpTest()
+
+	dir := t.TempDir()
+	ca := generateCertificate(t, dir, "ca", nil, true)
+	server := generateCertificate(t, dir, "localhost", ca, false)
+
+	config, err := grpc.NewTlsConfig(grpc.TlsConfig{CertFile: server.certFile, KeyFile: server.keyFile})
+	assert.Nil(t, err)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+
+	presented, err := dialTls(startTlsListener(t, config), ca, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, server.certificate.SerialNumber, presented.SerialNumber)
+}
+
+func Test_ItReloadsTheCertificateWhenItChanges(t *testing.T) {
+	SetUpTest()
+
+	dir := t.TempDir()
+	ca := generateCertificate(t, dir, "ca", nil, true)
+	original := generateCertificate(t, dir, "localhost", ca, false)
+
+	config, err := grpc.NewTlsConfig(grpc.TlsConfig{CertFile: original.certFile, KeyFile: original.keyFile})
+	assert.Nil(t, err)
+	address := startTlsListener(t, config)
+
+	// Overwrite the files with a new certificate, making sure the modification time moves on
+	renewed := generateCertificate(t, dir, "localhost", ca, false)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(renewed.certFile, later, later)
+	os.Chtimes(renewed.keyFile, later, later)
+
+	presented, err := dialTls(address, ca, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, renewed.certificate.SerialNumber, presented.SerialNumber)
+}
+
+func Test_ItKeepsTheCertificateIfTheNewOneIsInvalid(t *testing.T) {
+	SetUpTest()
+
+	dir := t.TempDir()
+	ca := generateCertificate(t, dir, "ca", nil, true)
+	server := generateCertificate(t, dir, "localhost", ca, false)
+
+	config, err := grpc.NewTlsConfig(grpc.TlsConfig{CertFile: server.certFile, KeyFile: server.keyFile})
+	assert.Nil(t, err)
+	address := startTlsListener(t, config)
+
+	os.WriteFile(server.certFile, []byte("not a certificate"), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(server.certFile, later, later)
+
+	presented, err := dialTls(address, ca, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, server.certificate.SerialNumber, presented.SerialNumber)
+}
+
+func Test_ItFailsToCreateTlsConfigWithoutAKey(t *testing.T) {
+	SetUpTest()
+
+	dir := t.TempDir()
+	server := generateCertificate(t, dir, "localhost", nil, false)
+
+	_, err := grpc.NewTlsConfig(grpc.TlsConfig{CertFile: server.certFile})
+	assert.NotNil(t, err)
+}
+
+func Test_ItFailsToRequireClientCertificatesWithoutACa(t *testing.T) {
+	SetUpTest()
+
+	dir := t.TempDir()
+	server := generateCertificate(t, dir, "localhost", nil, false)
+
+	_, err := grpc.NewTlsConfig(grpc.TlsConfig{CertFile: server.certFile, KeyFile: server.keyFile, RequireClientCert: true})
+	assert.NotNil(t, err)
+}
+
+func Test_ItRequiresAClientCertificateSignedByTheCa(t *testing.T) {
+	SetUpTest()
+
+	dir := t.TempDir()
+	ca := generateCertificate(t, dir, "ca", nil, true)
+	otherCa := generateCertificate(t, dir, "other-ca", nil, true)
+	server := generateCertificate(t, dir, "localhost", ca, false)
+	client := generateCertificate(t, dir, "ecfmp-api", ca, false)
+	untrustedClient := generateCertificate(t, dir, "intruder", otherCa, false)
+
+	config, err := grpc.NewTlsConfig(grpc.TlsConfig{
+		CertFile:          server.certFile,
+		KeyFile:           server.keyFile,
+		ClientCaFile:      ca.certFile,
+		RequireClientCert: true,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+	address := startTlsListener(t, config)
+
+	_, err = dialTls(address, ca, client)
+	assert.Nil(t, err)
+
+	_, err = dialTls(address, ca, nil)
+	assert.NotNil(t, err)
+
+	_, err = dialTls(address, ca, untrustedClient)
+	assert.NotNil(t, err)
+}
+
+func Test_ItAllowsOptionalClientCertificates(t *testing.T) {
+	SetUpTest()
+
+	dir := t.TempDir()
+	ca := generateCertificate(t, dir, "ca", nil, true)
+	server := generateCertificate(t, dir, "localhost", ca, false)
+
+	config, err := grpc.NewTlsConfig(grpc.TlsConfig{CertFile: server.certFile, KeyFile: server.keyFile, ClientCaFile: ca.certFile})
+	assert.Nil(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, config.ClientAuth)
+
+	_, err = dialTls(startTlsListener(t, config), ca, nil)
+	assert.Nil(t, err)
+}
+
+func contextWithClientCertificate(certificate *x509.Certificate) context.Context {
+	state := tls.ConnectionState{}
+	if certificate != nil {
+		state.VerifiedChains = [][]*x509.Certificate{{certificate}}
+	}
+
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234},
+		AuthInfo: credentials.TLSInfo{State: state},
+	})
+}
+
+func Test_ItAuthenticatesClientCertificatesByCommonName(t *testing.T) {
+	SetUpTest()
+
+	client := generateCertificate(t, t.TempDir(), "ecfmp-api", nil, false)
+	authenticator := grpc.NewClientCertificateAuthenticator([]grpc.ClientCertificateIdentity{
+		{Subject: "ecfmp-api", Scopes: []string{"admin"}},
+	})
+
+	identity, err := authenticator.Authenticate(contextWithClientCertificate(client.certificate), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "cert:CN=ecfmp-api,O=ECFMP", identity.Subject)
+	assert.Equal(t, "ecfmp-api", identity.Name)
+	assert.Equal(t, []string{"admin"}, identity.Scopes)
+}
+
+func Test_ItAuthenticatesClientCertificatesByDistinguishedName(t *testing.T) {
+	SetUpTest()
+
+	client := generateCertificate(t, t.TempDir(), "ecfmp-api", nil, false)
+	authenticator := grpc.NewClientCertificateAuthenticator([]grpc.ClientCertificateIdentity{
+		{Subject: "CN=ecfmp-api,O=ECFMP", Name: "ECFMP API"},
+	})
+
+	identity, err := authenticator.Authenticate(contextWithClientCertificate(client.certificate), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ECFMP API", identity.Name)
+}
+
+func Test_ItDoesNotAuthenticateUnmappedClientCertificates(t *testing.T) {
+	SetUpTest()
+
+	client := generateCertificate(t, t.TempDir(), "someone-else", nil, false)
+	authenticator := grpc.NewClientCertificateAuthenticator([]grpc.ClientCertificateIdentity{{Subject: "ecfmp-api"}})
+
+	_, err := authenticator.Authenticate(contextWithClientCertificate(client.certificate), "")
+	assert.ErrorIs(t, err, grpc.ErrCredentialNotSupported)
+
+	_, err = authenticator.Authenticate(contextWithClientCertificate(nil), "")
+	assert.ErrorIs(t, err, grpc.ErrCredentialNotSupported)
+
+	_, err = authenticator.Authenticate(context.Background(), "")
+	assert.ErrorIs(t, err, grpc.ErrCredentialNotSupported)
+}
+
+func Test_ItAcceptsAClientCertificateWithoutAuthorizationMetadata(t *testing.T) {
+	SetUpTest()
+
+	client := generateCertificate(t, t.TempDir(), "ecfmp-api", nil, false)
+	jwtAuthenticator, err := GetAuthenticatorWithCorrectKey("test-aud")
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+
+	interceptor := grpc.NewCompositeAuthInterceptor(
+		jwtAuthenticator,
+		grpc.NewClientCertificateAuthenticator([]grpc.ClientCertificateIdentity{{Subject: "ecfmp-api"}}),
+	)
+
+	nextCalled := false
+	var identity grpc.Identity
+	_, err = interceptor.AuthInterceptor(contextWithClientCertificate(client.certificate), nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		nextCalled = true
+		identity, _ = grpc.IdentityFromContext(ctx)
+		return nil, nil
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, nextCalled)
+	assert.Equal(t, "ecfmp-api", identity.Name)
+}
+
+func Test_ItLoadsClientCertificateIdentitiesFromFile(t *testing.T) {
+	SetUpTest()
+
+	path := filepath.Join(t.TempDir(), "identities.json")
+	os.WriteFile(path, []byte(`[{"subject": "ecfmp-api", "name": "ECFMP API", "scopes": ["admin"]}]`), 0600)
+
+	identities, err := grpc.LoadClientCertificateIdentities(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []grpc.ClientCertificateIdentity{{Subject: "ecfmp-api", Name: "ECFMP API", Scopes: []string{"admin"}}}, identities)
+
+	os.WriteFile(path, []byte(`[{"name": "no subject"}]`), 0600)
+	_, err = grpc.LoadClientCertificateIdentities(path)
+	assert.NotNil(t, err)
+}
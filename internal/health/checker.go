@@ -0,0 +1,147 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	grpcHealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+/**
+ * Check checks whether a component is healthy, returning an error describing the problem if not.
+ */
+type Check func(ctx context.Context) error
+
+/**
+ * Checker periodically runs health checks for each component, reporting the result through the standard
+ * gRPC health service. Each component is reported as its own service (e.g. grpc_health_probe -service mongo),
+ * and the overall service ("") is only serving if every component is.
+ */
+type Checker struct {
+	server   *grpcHealth.Server
+	interval time.Duration
+	timeout  time.Duration
+
+	mutex    sync.Mutex
+	names    []string
+	checks   map[string]Check
+	statuses map[string]healthpb.HealthCheckResponse_ServingStatus
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+/**
+ * NewChecker creates a checker that reports to the given health server, running the checks every interval.
+ */
+func NewChecker(server *grpcHealth.Server, interval time.Duration) *Checker {
+	return &Checker{
+		server:   server,
+		interval: interval,
+		timeout:  5 * time.Second,
+		checks:   make(map[string]Check),
+		statuses: make(map[string]healthpb.HealthCheckResponse_ServingStatus),
+		stop:     make(chan struct{}),
+	}
+}
+
+/**
+ * AddCheck adds a component to be checked. It is not serving until it has been checked.
+ */
+func (checker *Checker) AddCheck(name string, check Check) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+
+	checker.names = append(checker.names, name)
+	checker.checks[name] = check
+	checker.server.SetServingStatus(name, healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+/**
+ * Start runs the checks straight away, and then every interval until the checker is stopped.
+ */
+func (checker *Checker) Start() {
+	go func() {
+		ticker := time.NewTicker(checker.interval)
+		defer ticker.Stop()
+
+		for {
+			checker.RunChecks(context.Background())
+
+			select {
+			case <-ticker.C:
+			case <-checker.stop:
+				return
+			}
+		}
+	}()
+}
+
+/**
+ * RunChecks checks every component once and updates their status.
+ */
+func (checker *Checker) RunChecks(ctx context.Context) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+
+	overall := healthpb.HealthCheckResponse_SERVING
+	for _, name := range checker.names {
+		status := checker.runCheck(ctx, name)
+		if status != healthpb.HealthCheckResponse_SERVING {
+			overall = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+
+		checker.server.SetServingStatus(name, status)
+	}
+
+	checker.server.SetServingStatus("", overall)
+}
+
+func (checker *Checker) runCheck(ctx context.Context, name string) healthpb.HealthCheckResponse_ServingStatus {
+	checkCtx, cancel := context.WithTimeout(ctx, checker.timeout)
+	defer cancel()
+
+	status := healthpb.HealthCheckResponse_SERVING
+	err := checker.checks[name](checkCtx)
+	if err != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	// Only log when the status changes, so that we don't log every interval
+	if previous, ok := checker.statuses[name]; !ok || previous != status {
+		if err != nil {
+			log.Warnf("Health: %v is not serving: %v", name, err)
+		} else {
+			log.Infof("Health: %v is serving", name)
+		}
+	}
+
+	checker.statuses[name] = status
+	return status
+}
+
+/**
+ * Stop stops running the checks and marks every service as not serving, e.g. when shutting down.
+ */
+func (checker *Checker) Stop() {
+	checker.stopOnce.Do(func() {
+		close(checker.stop)
+		checker.server.Shutdown()
+	})
+}
+
+/**
+ * Serving returns whether the component, or the whole service if the name is empty, was serving when it
+ * was last checked. Components that aren't known are not serving.
+ */
+func (checker *Checker) Serving(ctx context.Context, name string) bool {
+	response, err := checker.server.Check(ctx, &healthpb.HealthCheckRequest{Service: name})
+	if err != nil {
+		return false
+	}
+
+	return response.GetStatus() == healthpb.HealthCheckResponse_SERVING
+}
@@ -0,0 +1,108 @@
+package health_test
+
+import (
+	"context"
+	"ecfmp/discord/internal/health"
+	"errors"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	grpcHealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func checkStatus(t *testing.T, server *grpcHealth.Server, service string) healthpb.HealthCheckResponse_ServingStatus {
+	resp, err := server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		t.Fatalf("failed to check health of %v: %v", service, err)
+	}
+
+	return resp.Status
+}
+
+func Test_ItReportsEachComponentAndTheOverallStatus(t *testing.T) {
+	log.SetLevel(log.FatalLevel)
+
+	server := grpcHealth.NewServer()
+	checker := health.NewChecker(server, time.Minute)
+
+	var mongoErr error
+	checker.AddCheck("mongo", func(context.Context) error { return mongoErr })
+	checker.AddCheck("discord", func(context.Context) error { return nil })
+
+	// Components aren't serving until they've been checked
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, checkStatus(t, server, "mongo"))
+
+	checker.RunChecks(context.Background())
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, checkStatus(t, server, "mongo"))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, checkStatus(t, server, "discord"))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, checkStatus(t, server, ""))
+
+	mongoErr = errors.New("connection refused")
+	checker.RunChecks(context.Background())
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, checkStatus(t, server, "mongo"))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, checkStatus(t, server, "discord"))
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, checkStatus(t, server, ""))
+}
+
+func Test_ItRunsChecksPeriodically(t *testing.T) {
+	log.SetLevel(log.FatalLevel)
+
+	server := grpcHealth.NewServer()
+	checker := health.NewChecker(server, 10*time.Millisecond)
+
+	checked := make(chan struct{}, 10)
+	checker.AddCheck("scheduler", func(context.Context) error {
+		checked <- struct{}{}
+		return nil
+	})
+
+	checker.Start()
+	defer checker.Stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-checked:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for check %v", i)
+		}
+	}
+
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, checkStatus(t, server, "scheduler"))
+}
+
+func Test_ItStopsServingWhenStopped(t *testing.T) {
+	log.SetLevel(log.FatalLevel)
+
+	server := grpcHealth.NewServer()
+	checker := health.NewChecker(server, time.Minute)
+	checker.AddCheck("mongo", func(context.Context) error { return nil })
+	checker.RunChecks(context.Background())
+
+	checker.Stop()
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, checkStatus(t, server, "mongo"))
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, checkStatus(t, server, ""))
+}
+
+func Test_ItReportsWhetherAComponentIsServing(t *testing.T) {
+	log.SetLevel(log.FatalLevel)
+
+	server := grpcHealth.NewServer()
+	checker := health.NewChecker(server, time.Minute)
+
+	var mongoErr error
+	checker.AddCheck("mongo", func(context.Context) error { return mongoErr })
+	assert.False(t, checker.Serving(context.Background(), "mongo"))
+
+	checker.RunChecks(context.Background())
+	assert.True(t, checker.Serving(context.Background(), "mongo"))
+	assert.True(t, checker.Serving(context.Background(), ""))
+	assert.False(t, checker.Serving(context.Background(), "unknown"))
+
+	mongoErr = errors.New("connection refused")
+	checker.RunChecks(context.Background())
+	assert.False(t, checker.Serving(context.Background(), "mongo"))
+	assert.False(t, checker.Serving(context.Background(), ""))
+}
@@ -0,0 +1,28 @@
+package log
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type loggerContextKey struct{}
+
+/**
+ * ContextWithLogger returns a copy of the context carrying a logger, so that everything logged while
+ * handling a request carries the same fields.
+ */
+func ContextWithLogger(ctx context.Context, logger *log.Entry) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+/**
+ * LoggerFromContext returns the logger carried by the context, or the standard logger if there isn't one.
+ */
+func LoggerFromContext(ctx context.Context) *log.Entry {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*log.Entry); ok {
+		return logger
+	}
+
+	return log.NewEntry(log.StandardLogger())
+}
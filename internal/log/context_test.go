@@ -0,0 +1,24 @@
+package log_test
+
+import (
+	"context"
+	log "ecfmp/discord/internal/log"
+	"testing"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+func TestLoggerFromContext(t *testing.T) {
+	entry := logger.WithField("client_request_id", "abc")
+	actual := log.LoggerFromContext(log.ContextWithLogger(context.Background(), entry))
+	if actual != entry {
+		t.Errorf("LoggerFromContext: expected the logger in the context, actual %v", actual)
+	}
+}
+
+func TestLoggerFromContextWithoutLogger(t *testing.T) {
+	actual := log.LoggerFromContext(context.Background())
+	if actual.Logger != logger.StandardLogger() {
+		t.Errorf("LoggerFromContext: expected the standard logger, actual %v", actual.Logger)
+	}
+}
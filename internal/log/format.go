@@ -0,0 +1,77 @@
+package log
+
+import (
+	"ecfmp/discord/internal/config"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The name of the service, added to every log line so that logs can be told apart once aggregated
+const serviceName = "ecfmp-discord"
+
+/**
+ * NewFormatter creates the formatter for the given LOG_FORMAT, either "json" or "text" (the default).
+ * Every line has the service field added and any secrets redacted.
+ */
+func NewFormatter(format string) (log.Formatter, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "json":
+		return &formatter{inner: &log.JSONFormatter{
+			FieldMap: log.FieldMap{
+				log.FieldKeyMsg: "message",
+			},
+		}}, nil
+	case "", "text":
+		return &formatter{inner: &log.TextFormatter{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, must be json or text", format)
+	}
+}
+
+/**
+ * Configure sets the format and level of the standard logger, and how long runtime changes to the level last.
+ */
+func Configure(config config.Log) error {
+	formatter, err := NewFormatter(config.Format)
+	if err != nil {
+		return err
+	}
+
+	log.SetFormatter(formatter)
+	setConfiguredLevel(EnvToLogLevel(config.Level), config.LevelRevertAfter)
+	return nil
+}
+
+/**
+ * formatter drops anything too verbose for the subsystem it was logged from, then adds the service field
+ * and redacts secrets before handing off to the real formatter.
+ */
+type formatter struct {
+	inner log.Formatter
+}
+
+func (f *formatter) Format(entry *log.Entry) ([]byte, error) {
+	if !levelEnabled(entry) {
+		return nil, nil
+	}
+
+	// The entry is shared with any hooks, so change a copy
+	redactedEntry := *entry
+	redactedEntry.Message = Redact(entry.Message)
+	redactedEntry.Data = make(log.Fields, len(entry.Data)+1)
+	redactedEntry.Data["service"] = serviceName
+	for key, value := range entry.Data {
+		switch value := value.(type) {
+		case string:
+			redactedEntry.Data[key] = Redact(value)
+		case error:
+			redactedEntry.Data[key] = Redact(value.Error())
+		default:
+			redactedEntry.Data[key] = value
+		}
+	}
+
+	return f.inner.Format(&redactedEntry)
+}
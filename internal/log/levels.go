@@ -0,0 +1,245 @@
+package log
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The subsystems whose log level can be changed on their own
+const (
+	SubsystemGrpc      = "grpc"
+	SubsystemScheduler = "scheduler"
+	SubsystemDiscord   = "discord"
+	SubsystemDb        = "db"
+)
+
+var Subsystems = []string{SubsystemGrpc, SubsystemScheduler, SubsystemDiscord, SubsystemDb}
+
+/**
+ * Subsystem returns a logger for the subsystem, so that its level can be changed on its own.
+ */
+func Subsystem(subsystem string) *log.Entry {
+	return ForSubsystem(log.NewEntry(log.StandardLogger()), subsystem)
+}
+
+/**
+ * ForSubsystem moves a logger, e.g. one carrying the fields of a request, into the subsystem.
+ */
+func ForSubsystem(logger *log.Entry, subsystem string) *log.Entry {
+	return logger.WithField("subsystem", subsystem)
+}
+
+/**
+ * A level that has been changed at runtime, and the timer that will change it back.
+ */
+type levelOverride struct {
+	level log.Level
+	timer *time.Timer
+}
+
+/**
+ * levels tracks the configured log level, and any changes made to it at runtime either overall ("") or
+ * for a subsystem. The standard logger is set to the most verbose of these, and the formatter drops
+ * anything that is too verbose for the subsystem it was logged from.
+ */
+type levels struct {
+	mutex       sync.RWMutex
+	configured  log.Level
+	revertAfter time.Duration
+	overrides   map[string]*levelOverride
+}
+
+var runtimeLevels = &levels{
+	configured:  log.InfoLevel,
+	revertAfter: 15 * time.Minute,
+	overrides:   make(map[string]*levelOverride),
+}
+
+/**
+ * LevelChange describes a change to the log level, for reporting back to whoever made it.
+ */
+type LevelChange struct {
+	Subsystem string
+	Previous  log.Level
+	Current   log.Level
+	RevertAt  time.Time
+}
+
+/**
+ * SetLevel changes the log level overall, if the subsystem is empty, or for just the subsystem. The
+ * change is reverted after revertAfter, or the default set by Configure if it is zero.
+ */
+func SetLevel(subsystem string, level log.Level, revertAfter time.Duration) (LevelChange, error) {
+	if err := validateSubsystem(subsystem); err != nil {
+		return LevelChange{}, err
+	}
+
+	runtimeLevels.mutex.Lock()
+	defer runtimeLevels.mutex.Unlock()
+
+	if revertAfter <= 0 {
+		revertAfter = runtimeLevels.revertAfter
+	}
+
+	change := LevelChange{
+		Subsystem: subsystem,
+		Previous:  runtimeLevels.effective(subsystem),
+		Current:   level,
+		RevertAt:  time.Now().Add(revertAfter),
+	}
+
+	if existing, ok := runtimeLevels.overrides[subsystem]; ok {
+		existing.timer.Stop()
+	}
+
+	override := &levelOverride{level: level}
+	override.timer = time.AfterFunc(revertAfter, func() {
+		runtimeLevels.mutex.Lock()
+
+		// Only revert if the level hasn't been changed again since
+		reverted := runtimeLevels.overrides[subsystem] == override
+		if reverted {
+			delete(runtimeLevels.overrides, subsystem)
+			runtimeLevels.apply()
+		}
+		level := runtimeLevels.effective(subsystem)
+
+		// Logging needs the lock, to check the level
+		runtimeLevels.mutex.Unlock()
+		if reverted {
+			log.WithField("subsystem", subsystem).Infof("Log level reverted to %v", level)
+		}
+	})
+	runtimeLevels.overrides[subsystem] = override
+	runtimeLevels.apply()
+
+	return change, nil
+}
+
+/**
+ * StepLevel makes the overall log level one step more verbose (e.g. INFO to DEBUG) if steps is positive, or
+ * less verbose if it is negative, reverting after the default set by Configure.
+ */
+func StepLevel(steps int) (LevelChange, error) {
+	runtimeLevels.mutex.RLock()
+	level := int(runtimeLevels.effective("")) + steps
+	runtimeLevels.mutex.RUnlock()
+
+	if level < int(log.PanicLevel) {
+		level = int(log.PanicLevel)
+	}
+
+	if level > int(log.TraceLevel) {
+		level = int(log.TraceLevel)
+	}
+
+	return SetLevel("", log.Level(level), 0)
+}
+
+/**
+ * ResetLevel reverts any runtime change to the log level overall, if the subsystem is empty, or for the subsystem.
+ */
+func ResetLevel(subsystem string) error {
+	if err := validateSubsystem(subsystem); err != nil {
+		return err
+	}
+
+	runtimeLevels.mutex.Lock()
+	defer runtimeLevels.mutex.Unlock()
+
+	if existing, ok := runtimeLevels.overrides[subsystem]; ok {
+		existing.timer.Stop()
+		delete(runtimeLevels.overrides, subsystem)
+	}
+
+	runtimeLevels.apply()
+	return nil
+}
+
+/**
+ * Levels returns the level currently in effect overall ("") and for each subsystem.
+ */
+func Levels() map[string]log.Level {
+	runtimeLevels.mutex.RLock()
+	defer runtimeLevels.mutex.RUnlock()
+
+	current := map[string]log.Level{"": runtimeLevels.effective("")}
+	for _, subsystem := range Subsystems {
+		current[subsystem] = runtimeLevels.effective(subsystem)
+	}
+
+	return current
+}
+
+/**
+ * Sets the level from the config, and how long runtime changes last by default. Any runtime changes are kept.
+ */
+func setConfiguredLevel(level log.Level, revertAfter time.Duration) {
+	runtimeLevels.mutex.Lock()
+	defer runtimeLevels.mutex.Unlock()
+
+	runtimeLevels.configured = level
+	if revertAfter > 0 {
+		runtimeLevels.revertAfter = revertAfter
+	}
+
+	runtimeLevels.apply()
+}
+
+/**
+ * Returns whether an entry should be logged, given the subsystem it was logged from.
+ */
+func levelEnabled(entry *log.Entry) bool {
+	subsystem, _ := entry.Data["subsystem"].(string)
+
+	runtimeLevels.mutex.RLock()
+	defer runtimeLevels.mutex.RUnlock()
+	return entry.Level <= runtimeLevels.effective(subsystem)
+}
+
+/**
+ * The level in effect for the subsystem, falling back to the overall level. Must hold the mutex.
+ */
+func (levels *levels) effective(subsystem string) log.Level {
+	if override, ok := levels.overrides[subsystem]; ok && subsystem != "" {
+		return override.level
+	}
+
+	if override, ok := levels.overrides[""]; ok {
+		return override.level
+	}
+
+	return levels.configured
+}
+
+/**
+ * Sets the standard logger to the most verbose level in effect, so that nothing is dropped before the
+ * formatter sees it. Must hold the mutex.
+ */
+func (levels *levels) apply() {
+	mostVerbose := levels.effective("")
+	for _, override := range levels.overrides {
+		if override.level > mostVerbose {
+			mostVerbose = override.level
+		}
+	}
+
+	log.SetLevel(mostVerbose)
+}
+
+func validateSubsystem(subsystem string) error {
+	if subsystem == "" {
+		return nil
+	}
+
+	for _, known := range Subsystems {
+		if subsystem == known {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown subsystem %q", subsystem)
+}
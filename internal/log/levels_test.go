@@ -0,0 +1,107 @@
+package log_test
+
+import (
+	log "ecfmp/discord/internal/log"
+	"strings"
+	"testing"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+func resetLevels(t *testing.T) {
+	t.Cleanup(func() {
+		log.ResetLevel("")
+		for _, subsystem := range log.Subsystems {
+			log.ResetLevel(subsystem)
+		}
+	})
+}
+
+func TestSetLevelForSubsystem(t *testing.T) {
+	resetLevels(t)
+	testLogger, output := newTestLogger(t, "text")
+	testLogger.SetLevel(logger.TraceLevel)
+
+	change, err := log.SetLevel(log.SubsystemScheduler, logger.DebugLevel, time.Minute)
+	if err != nil {
+		t.Fatalf("SetLevel: unexpected error %v", err)
+	}
+
+	if change.Previous != logger.InfoLevel || change.Current != logger.DebugLevel {
+		t.Errorf("SetLevel: expected INFO to DEBUG, actual %v to %v", change.Previous, change.Current)
+	}
+
+	log.ForSubsystem(logger.NewEntry(testLogger), log.SubsystemScheduler).Debug("from the scheduler")
+	log.ForSubsystem(logger.NewEntry(testLogger), log.SubsystemDb).Debug("from the db")
+	testLogger.Debug("from elsewhere")
+
+	if !strings.Contains(output.String(), "from the scheduler") {
+		t.Errorf("expected the scheduler to log at debug, actual %s", output.String())
+	}
+
+	if strings.Contains(output.String(), "from the db") || strings.Contains(output.String(), "from elsewhere") {
+		t.Errorf("expected nothing else to log at debug, actual %s", output.String())
+	}
+
+	if logger.GetLevel() != logger.DebugLevel {
+		t.Errorf("expected the standard logger to be at the most verbose level, actual %v", logger.GetLevel())
+	}
+}
+
+func TestSetLevelReverts(t *testing.T) {
+	resetLevels(t)
+
+	if _, err := log.SetLevel("", logger.TraceLevel, 10*time.Millisecond); err != nil {
+		t.Fatalf("SetLevel: unexpected error %v", err)
+	}
+
+	if log.Levels()[log.SubsystemDb] != logger.TraceLevel {
+		t.Errorf("expected subsystems to follow the overall level, actual %v", log.Levels()[log.SubsystemDb])
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for log.Levels()[""] != logger.InfoLevel {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the level to revert to INFO, actual %v", log.Levels()[""])
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStepLevel(t *testing.T) {
+	resetLevels(t)
+
+	change, _ := log.StepLevel(1)
+	if change.Current != logger.DebugLevel {
+		t.Errorf("StepLevel(1): expected DEBUG, actual %v", change.Current)
+	}
+
+	change, _ = log.StepLevel(-2)
+	if change.Current != logger.WarnLevel {
+		t.Errorf("StepLevel(-2): expected WARN, actual %v", change.Current)
+	}
+
+	change, _ = log.StepLevel(10)
+	if change.Current != logger.TraceLevel {
+		t.Errorf("StepLevel(10): expected TRACE, actual %v", change.Current)
+	}
+}
+
+func TestResetLevel(t *testing.T) {
+	resetLevels(t)
+
+	log.SetLevel(log.SubsystemDiscord, logger.TraceLevel, time.Minute)
+	log.ResetLevel(log.SubsystemDiscord)
+
+	if log.Levels()[log.SubsystemDiscord] != logger.InfoLevel {
+		t.Errorf("ResetLevel: expected INFO, actual %v", log.Levels()[log.SubsystemDiscord])
+	}
+}
+
+func TestSetLevelForUnknownSubsystem(t *testing.T) {
+	if _, err := log.SetLevel("nope", logger.DebugLevel, time.Minute); err == nil {
+		t.Errorf("SetLevel(nope): expected an error")
+	}
+}
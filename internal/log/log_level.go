@@ -1,28 +1,50 @@
 package log
 
 import (
+	"fmt"
+	"strings"
+
 	log "github.com/sirupsen/logrus"
 )
 
 /**
- * Given a string representation of a log level, return the logrus log level
- * that corresponds to it.
+ * ParseLogLevel parses a log level, e.g. "debug" or "WARN", ignoring case.
  */
-func EnvToLogLevel(envLevel string) log.Level {
-	switch envLevel {
+func ParseLogLevel(level string) (log.Level, error) {
+	switch strings.ToUpper(strings.TrimSpace(level)) {
 	case "TRACE":
-		return log.TraceLevel
+		return log.TraceLevel, nil
 	case "DEBUG":
-		return log.DebugLevel
+		return log.DebugLevel, nil
 	case "INFO":
-		return log.InfoLevel
-	case "WARN":
-		return log.WarnLevel
+		return log.InfoLevel, nil
+	case "WARN", "WARNING":
+		return log.WarnLevel, nil
 	case "ERROR":
-		return log.ErrorLevel
+		return log.ErrorLevel, nil
 	case "FATAL":
-		return log.FatalLevel
+		return log.FatalLevel, nil
+	case "PANIC":
+		return log.PanicLevel, nil
 	default:
-		return log.FatalLevel
+		return log.InfoLevel, fmt.Errorf("unknown log level %q", level)
 	}
 }
+
+/**
+ * Given a string representation of a log level, return the logrus log level
+ * that corresponds to it. If the level isn't set it defaults to INFO, and if it
+ * isn't known a warning is logged so that a typo doesn't silently hide logs.
+ */
+func EnvToLogLevel(envLevel string) log.Level {
+	if envLevel == "" {
+		return log.InfoLevel
+	}
+
+	level, err := ParseLogLevel(envLevel)
+	if err != nil {
+		log.Warnf("%v, defaulting to INFO", err)
+	}
+
+	return level
+}
@@ -16,7 +16,11 @@ var logLevelTest = []struct {
 	{"WARN", logger.WarnLevel},
 	{"ERROR", logger.ErrorLevel},
 	{"FATAL", logger.FatalLevel},
-	{"UNKOWN", logger.FatalLevel},
+	{"PANIC", logger.PanicLevel},
+	{"debug", logger.DebugLevel},
+	{"Warning", logger.WarnLevel},
+	{"", logger.InfoLevel},
+	{"UNKOWN", logger.InfoLevel},
 }
 
 func TestEnvToLogLevel(t *testing.T) {
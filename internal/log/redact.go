@@ -0,0 +1,48 @@
+package log
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	secretsMutex sync.RWMutex
+	secrets      []string
+
+	// Credentials in authorization headers, however they've been formatted, e.g. "authorization: Bearer abc"
+	// or {"Authorization":"Bot abc"}
+	authorizationPattern = regexp.MustCompile(`(?i)(authorization["']?\s*[:=]\s*\[?["']?)(?:(?:bearer|bot|basic)\s+)?[^\s"',\]}]+`)
+
+	// Tokens passed the way discord and JWTs expect them, wherever they appear
+	tokenPattern = regexp.MustCompile(`(?i)\b(bearer|bot)\s+[A-Za-z0-9._\-]{20,}`)
+)
+
+/**
+ * RegisterSecret registers a value, such as the discord bot token, that must never appear in the logs.
+ */
+func RegisterSecret(secret string) {
+	if secret == "" {
+		return
+	}
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	secrets = append(secrets, secret)
+}
+
+/**
+ * Redact replaces any secrets in the value with a placeholder.
+ */
+func Redact(value string) string {
+	secretsMutex.RLock()
+	for _, secret := range secrets {
+		value = strings.ReplaceAll(value, secret, redacted)
+	}
+	secretsMutex.RUnlock()
+
+	value = authorizationPattern.ReplaceAllString(value, "${1}"+redacted)
+	return tokenPattern.ReplaceAllString(value, "${1} "+redacted)
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ecfmp_discord"
+
+/**
+ * Registry is where all of the service's metrics are registered, along with the Go runtime and process metrics.
+ */
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	GrpcRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "grpc",
+		Name:      "requests_total",
+		Help:      "gRPC requests handled, by method and status code.",
+	}, []string{"method", "code"})
+
+	GrpcRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "grpc",
+		Name:      "request_duration_seconds",
+		Help:      "How long gRPC requests took to handle, by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	SchedulerQueueDepth = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "scheduler",
+		Name:      "queue_depth",
+		Help:      "Messages scheduled for publishing that have not yet been processed.",
+	})
+
+	DiscordRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "discord",
+		Name:      "request_duration_seconds",
+		Help:      "How long calls to the Discord API took, by operation (publish or update) and outcome (success or error).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "outcome"})
+
+	DiscordRateLimits = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "discord",
+		Name:      "rate_limits_total",
+		Help:      "Times a call to the Discord API was rate limited.",
+	})
+
+	MongoOperationDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "mongo",
+		Name:      "operation_duration_seconds",
+		Help:      "How long Mongo commands took, by command name (e.g. find, insert) and outcome (success or error).",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"operation", "outcome"})
+)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+/**
+ * Outcome gives the outcome label for an operation that returned the given error.
+ */
+func Outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "success"
+}
+
+/**
+ * ObserveDiscordRequest records a call to the Discord API that started at the given time.
+ */
+func ObserveDiscordRequest(operation string, start time.Time, err error) {
+	DiscordRequestDuration.WithLabelValues(operation, Outcome(err)).Observe(time.Since(start).Seconds())
+}
+
+/**
+ * Handler serves the metrics in the Prometheus exposition format.
+ */
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
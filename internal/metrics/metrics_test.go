@@ -0,0 +1,38 @@
+package metrics_test
+
+import (
+	"ecfmp/discord/internal/metrics"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ItGivesTheOutcomeOfAnOperation(t *testing.T) {
+	assert.Equal(t, "success", metrics.Outcome(nil))
+	assert.Equal(t, "error", metrics.Outcome(errors.New("failed")))
+}
+
+func Test_ItObservesDiscordRequests(t *testing.T) {
+	before := testutil.CollectAndCount(metrics.DiscordRequestDuration)
+	metrics.ObserveDiscordRequest("publish", time.Now(), nil)
+	metrics.ObserveDiscordRequest("publish", time.Now(), errors.New("failed"))
+
+	assert.Equal(t, before+2, testutil.CollectAndCount(metrics.DiscordRequestDuration))
+}
+
+func Test_ItServesMetrics(t *testing.T) {
+	metrics.DiscordRateLimits.Inc()
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, string(body), "ecfmp_discord_discord_rate_limits_total")
+	assert.Contains(t, string(body), "go_goroutines")
+}
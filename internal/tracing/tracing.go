@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	serviceName = "ecfmp-discord"
+	tracerName  = "ecfmp/discord"
+)
+
+/**
+ * Setup configures tracing. Spans are exported over OTLP if an OTLP endpoint is configured using the
+ * standard OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT environment variables,
+ * otherwise they are not recorded. Incoming W3C trace context is always propagated.
+ *
+ * The returned function flushes any remaining spans and should be called on shutdown.
+ */
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		log.Info("No OTLP endpoint configured, tracing is disabled")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+
+	log.Info("Tracing enabled, exporting spans over OTLP")
+	return provider.Shutdown, nil
+}
+
+/**
+ * NewTracerProvider creates a tracer provider for the service, with the given options such as where
+ * to export spans to.
+ */
+func NewTracerProvider(options ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	serviceResource := resource.NewSchemaless(attribute.String("service.name", serviceName))
+	return sdktrace.NewTracerProvider(append([]sdktrace.TracerProviderOption{sdktrace.WithResource(serviceResource)}, options...)...)
+}
+
+/**
+ * Tracer returns the tracer used for the service's spans.
+ */
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+/**
+ * StartSpan starts a span as a child of any span in the context.
+ */
+func StartSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, options...)
+}
+
+/**
+ * EndSpan ends the span, marking it as failed if there was an error.
+ */
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+/**
+ * TraceId returns the id of the trace in the context, or an empty string if there isn't one.
+ */
+func TraceId(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+
+	return spanContext.TraceID().String()
+}
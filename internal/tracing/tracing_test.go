@@ -0,0 +1,60 @@
+package tracing_test
+
+import (
+	"context"
+	"ecfmp/discord/internal/tracing"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func setupTracing(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tracing.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	return exporter
+}
+
+func Test_ItRecordsSpans(t *testing.T) {
+	exporter := setupTracing(t)
+
+	ctx, parent := tracing.StartSpan(context.Background(), "parent")
+	_, child := tracing.StartSpan(ctx, "child")
+	tracing.EndSpan(child, nil)
+	tracing.EndSpan(parent, nil)
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, spans[1].SpanContext.SpanID(), spans[0].Parent.SpanID())
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+}
+
+func Test_ItMarksSpansWithErrorsAsFailed(t *testing.T) {
+	exporter := setupTracing(t)
+
+	_, span := tracing.StartSpan(context.Background(), "failing")
+	tracing.EndSpan(span, errors.New("it broke"))
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+	assert.Equal(t, "it broke", spans[0].Status.Description)
+}
+
+func Test_ItGetsTheTraceId(t *testing.T) {
+	setupTracing(t)
+
+	assert.Equal(t, "", tracing.TraceId(context.Background()))
+
+	ctx, span := tracing.StartSpan(context.Background(), "span")
+	defer span.End()
+	assert.Equal(t, span.SpanContext().TraceID().String(), tracing.TraceId(ctx))
+}